@@ -0,0 +1,113 @@
+package tnpptMiddleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrConflictingCredentials = errors.New("conflicting credentials")
+
+var schemeAuthenticators = map[string]func(tnppt *TNPPT) error{
+	SchemeHMAC:          (*TNPPT).authenticateHMAC,
+	SchemeAPIKey:        (*TNPPT).authenticateAPIKey,
+	SchemeBasic:         (*TNPPT).authenticateBasic,
+	SchemeJWT:           (*TNPPT).authenticateJWT,
+	SchemeToken:         (*TNPPT).authenticateToken,
+	SchemeIntrospection: (*TNPPT).authenticateIntrospection,
+	SchemeMTLS:          (*TNPPT).authenticateMTLS,
+	SchemeDigest:        (*TNPPT).authenticateDigest,
+	SchemeChallenge:     (*TNPPT).authenticateChallenge,
+	SchemeSCRAM:         (*TNPPT).authenticateSCRAM,
+}
+
+// ActivateAny accepts the credentials of any of schemes, the succeeding scheme
+// is set on UserInfo.Scheme. Only the credentials of the listed schemes are
+// looked at: a request presenting two kinds of them is rejected with a 400.
+// The bearer schemes (SchemeJWT, SchemeToken, SchemeIntrospection) share the
+// Authorization header and are tried in the given order.
+//
+//	engine.GET("/log", auth.ActivateAny(tnpptMiddleware.SchemeAPIKey, tnpptMiddleware.SchemeHMAC), ...)
+func (tnppt *TNPPT) ActivateAny(schemes ...string) gin.HandlerFunc {
+	return tnppt.newVerifier("ActivateAny", schemes, true).handlerFunc()
+}
+
+// verifyAny looks for the credentials of schemes and tries the schemes reading them.
+func (tnppt *TNPPT) verifyAny(header http.Header, schemes []string) error {
+	var presented []string
+	for _, scheme := range schemes {
+		credentials := credentialsKind(scheme)
+		if !containsString(presented, credentials) && tnppt.presents(credentials) {
+			presented = append(presented, credentials)
+		}
+	}
+	if len(presented) > 1 {
+		message := fmt.Errorf("%w: %s", ErrConflictingCredentials, strings.Join(presented, ", "))
+		return &AuthenticationError{StatusCode: http.StatusBadRequest, Err: message}
+	}
+	if len(presented) == 0 {
+		for _, scheme := range schemes {
+			tnppt.challenge(header, scheme, nil)
+		}
+		message := errors.New(ErrFailedPayload.Error() + " - [ANY] No payload detected")
+		return &AuthenticationError{StatusCode: http.StatusUnauthorized, Err: message}
+	}
+	var errAuthenticate error
+	for _, scheme := range schemes {
+		if credentialsKind(scheme) != presented[0] {
+			continue
+		}
+		tnppt.scheme = scheme
+		if errAuthenticate = schemeAuthenticators[scheme](tnppt); errAuthenticate == nil {
+			tnppt.authenticated(header, scheme)
+			return nil
+		}
+	}
+	return tnppt.authenticationError(header, errAuthenticate)
+}
+
+// credentialsKind groups the schemes reading the same credentials.
+func credentialsKind(scheme string) string {
+	switch scheme {
+	case SchemeJWT, SchemeToken, SchemeIntrospection:
+		return "bearer"
+	}
+	return scheme
+}
+
+func (tnppt *TNPPT) presents(credentials string) bool {
+	authorization := strings.ToLower(tnppt.Request.Header.Get("Authorization"))
+	switch credentials {
+	case SchemeHMAC:
+		// HMAC_LOGIN and HMAC_HASH are shared with SchemeChallenge
+		return tnppt.Request.Header.Get("HMAC_TIME") != "" ||
+			(tnppt.Request.Header.Get("HMAC_CHALLENGE") == "" && (tnppt.Request.Header.Get("HMAC_LOGIN") != "" || tnppt.Request.Header.Get("HMAC_HASH") != ""))
+	case SchemeChallenge:
+		return tnppt.Request.Header.Get("HMAC_CHALLENGE") != ""
+	case SchemeAPIKey:
+		return tnppt.Request.Header.Get("API_KEY") != ""
+	case SchemeBasic:
+		return strings.HasPrefix(authorization, "basic ")
+	case SchemeDigest:
+		return strings.HasPrefix(authorization, "digest ")
+	case SchemeSCRAM:
+		return strings.HasPrefix(authorization, "scram-sha-256 ")
+	case "bearer":
+		return strings.HasPrefix(authorization, "bearer ")
+	case SchemeMTLS:
+		return tnppt.MTLS.presented(tnppt.Request)
+	}
+	return false
+}
+
+func containsString(values []string, expected string) bool {
+	for _, value := range values {
+		if value == expected {
+			return true
+		}
+	}
+	return false
+}
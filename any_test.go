@@ -0,0 +1,140 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTNPPT_ActivateAny(t *testing.T) {
+	passwordHash, _ := PasswordPolicy{Algorithm: PasswordBcrypt, BcryptCost: 4}.Hash("basic-pass")
+	store := newTestMemoryStore(t, StoreRecords{
+		Users: []UserRecord{
+			{Login: "steven", Password: "pass"},
+			{Login: "legacy-tool", PasswordHash: passwordHash},
+		},
+		APIKeys: []APIKeyRecord{{Login: "partner", Key: "partner-key"}},
+	})
+	jwtKey := JWTKey{ID: "idp", Algorithm: JWTAlgHS256, Key: []byte("idp-secret")}
+	auth, err := New(&TNPPT{
+		Store:     store,
+		JWT:       JWTSettings{Keys: []JWTKey{jwtKey}},
+		Tokens:    TokenSettings{SigningKey: JWTKey{ID: "session", Algorithm: JWTAlgHS256, Key: []byte("session-secret")}},
+		Passwords: PasswordPolicy{Algorithm: PasswordBcrypt, BcryptCost: 4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idpToken, _ := SignJWT(map[string]interface{}{"sub": "idp-user", "exp": time.Now().Add(time.Minute).Unix()}, jwtKey)
+	session, err := auth.Tokens.issue(context.Background(), UserInfo{Login: "session-user"}, "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/log", auth.ActivateAny(SchemeAPIKey, SchemeHMAC, SchemeBasic, SchemeJWT, SchemeToken), func(c *gin.Context) {
+		c.String(200, principal(c).Scheme+":"+principal(c).Login)
+	})
+	router.POST("/partner", auth.ActivateAny(SchemeAPIKey), func(c *gin.Context) {
+		c.String(200, principal(c).Scheme+":"+principal(c).Login)
+	})
+
+	withAPIKey := func(req *http.Request) { req.Header.Set("API_KEY", "partner-key") }
+	withBearer := func(token string) func(req *http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+	tests := []struct {
+		name      string
+		path      string
+		hmacLogin string
+		headers   []func(req *http.Request)
+		wantCode  int
+		wantBody  string
+	}{
+		{name: "api-key", path: "/log", headers: []func(*http.Request){withAPIKey}, wantCode: 200, wantBody: "api_key:partner"},
+		{name: "hmac", path: "/log", hmacLogin: "steven", wantCode: 200, wantBody: "hmac:steven"},
+		{name: "basic", path: "/log", headers: []func(*http.Request){func(req *http.Request) { req.SetBasicAuth("legacy-tool", "basic-pass") }}, wantCode: 200, wantBody: "basic:legacy-tool"},
+		{name: "jwt", path: "/log", headers: []func(*http.Request){withBearer(idpToken)}, wantCode: 200, wantBody: "jwt:idp-user"},
+		{name: "session-token", path: "/log", headers: []func(*http.Request){withBearer(session.AccessToken)}, wantCode: 200, wantBody: "token:session-user"},
+		{name: "invalid-bearer", path: "/log", headers: []func(*http.Request){withBearer("not-a-token")}, wantCode: 401},
+		{name: "invalid-api-key", path: "/log", headers: []func(*http.Request){func(req *http.Request) { req.Header.Set("API_KEY", "wrong") }}, wantCode: 401},
+		{name: "api-key-and-hmac", path: "/log", hmacLogin: "steven", headers: []func(*http.Request){withAPIKey}, wantCode: 400},
+		{name: "api-key-and-bearer", path: "/log", headers: []func(*http.Request){withAPIKey, withBearer(idpToken)}, wantCode: 400},
+		{name: "no-credentials", path: "/log", wantCode: 401},
+		{name: "unlisted-credentials-ignored", path: "/partner", hmacLogin: "steven", headers: []func(*http.Request){withAPIKey}, wantCode: 200, wantBody: "api_key:partner"},
+		{name: "unlisted-credentials-only", path: "/partner", hmacLogin: "steven", wantCode: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", tt.path, nil)
+			if tt.hmacLogin != "" {
+				req = hmacLoginRequest(t, auth, tt.path, tt.hmacLogin, "pass")
+			}
+			for _, header := range tt.headers {
+				header(req)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("basic-challenge", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/log", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, `Basic realm="tnppt", charset="UTF-8"`, w.Header().Get("WWW-Authenticate"))
+	})
+}
+
+func TestTNPPT_ActivateAnyConfiguration(t *testing.T) {
+	auth := &TNPPT{}
+	assert.Panics(t, func() { auth.ActivateAny() })
+	assert.Panics(t, func() { auth.ActivateAny(SchemeHMAC, "kerberos") })
+	assert.NotPanics(t, func() { auth.ActivateAny(SchemeHMAC, SchemeMTLS) })
+}
+
+func TestTNPPT_SchemeOnPrincipal(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{APIKeys: []APIKeyRecord{{Login: "partner", Key: "partner-key"}}})
+	auth, err := New(&TNPPT{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.GET("/log", auth.ActivateApiKeyAuth(), func(c *gin.Context) {
+		c.String(200, principal(c).Scheme)
+	})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/log", nil)
+	req.Header.Set("API_KEY", "partner-key")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, SchemeAPIKey, w.Body.String())
+}
+
+func TestTNPPT_ActivateAnyChallenges(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "device-42", Password: "device-secret"}}})
+	auth, err := New(&TNPPT{Store: store, Digest: DigestSettings{Algorithms: []string{DigestSHA256}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.GET("/telemetry", auth.ActivateAny(SchemeHMAC, SchemeDigest, SchemeBasic))
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/telemetry", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+	challenges := w.Header().Values("WWW-Authenticate")
+	if assert.Len(t, challenges, 2) {
+		assert.Contains(t, challenges[0], "Digest realm=")
+		assert.Contains(t, challenges[1], "Basic realm=")
+	}
+}
@@ -0,0 +1,97 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	AuditAccessDenied             = "access_denied"
+	AuditAuthenticationSucceeded  = "authentication_succeeded"
+	AuditAuthenticationFailed     = "authentication_failed"
+	AuditAuthenticationChallenged = "authentication_challenged"
+)
+
+// AuditEntry is an access decision worth keeping, Required lists the roles
+// or permissions that were missing. Route is the gin route when known.
+// Sequence, PrevHash and Hash chain the entries of an AuditLog.
+type AuditEntry struct {
+	Sequence   uint64    `json:"seq"`
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Login      string    `json:"login"`
+	Tenant     string    `json:"tenant"`
+	Scheme     string    `json:"scheme"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Route      string    `json:"route"`
+	RemoteAddr string    `json:"remote_addr"`
+	ClientIP   string    `json:"client_ip"`
+	Required   []string  `json:"required"`
+	Reason     string    `json:"reason"`
+	PrevHash   string    `json:"prev_hash"`
+	Hash       string    `json:"hash"`
+}
+
+// Auditor receives the AuditEntry of the middleware, it is called on the
+// request path and should not block.
+type Auditor interface {
+	Audit(ctx context.Context, entry AuditEntry)
+}
+
+// AuditorFunc is an Auditor from a function.
+type AuditorFunc func(ctx context.Context, entry AuditEntry)
+
+func (auditor AuditorFunc) Audit(ctx context.Context, entry AuditEntry) {
+	auditor(ctx, entry)
+}
+
+// audit completes entry with the principal user and request, then hands it to
+// the Auditor, or to the warning log when there is none.
+func (tnppt *TNPPT) audit(request *http.Request, user UserInfo, entry AuditEntry) {
+	entry.Login = user.Login
+	entry.Tenant = user.Tenant
+	entry.Scheme = user.Scheme
+	tnppt.record(request, entry)
+}
+
+// auditAuthentication hands the outcome err of the authentication of the
+// current request to the Auditor, if any: the successes are not worth a warning.
+func (tnppt *TNPPT) auditAuthentication(err error) {
+	if tnppt.Auditor == nil {
+		return
+	}
+	entry := AuditEntry{Event: AuditAuthenticationSucceeded, Tenant: tnppt.tenant, Scheme: tnppt.scheme, Route: tnppt.route}
+	if err == nil {
+		entry.Login = tnppt.Principal.Login
+	} else if challenged(err) {
+		entry.Event, entry.Login = AuditAuthenticationChallenged, tnppt.attemptedLogin()
+	} else {
+		entry.Event, entry.Reason = AuditAuthenticationFailed, err.Error()
+		if credentialsFailure(err) {
+			entry.Login = tnppt.attemptedLogin()
+		}
+	}
+	tnppt.record(tnppt.Request, entry)
+}
+
+func (tnppt *TNPPT) record(request *http.Request, entry AuditEntry) {
+	entry.Time = time.Now().UTC()
+	entry.Method = request.Method
+	entry.Path = request.URL.Path
+	entry.RemoteAddr = request.RemoteAddr
+	entry.ClientIP = tnppt.clientIP(request)
+	if tnppt.Auditor != nil {
+		tnppt.Auditor.Audit(request.Context(), entry)
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		tnppt.logError(request, "audit entry encoding failed", err)
+		return
+	}
+	tnppt.Logger.get().LogAttrs(logContext(request), slog.LevelWarn, "audit", slog.String("entry", string(line)))
+}
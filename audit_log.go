@@ -0,0 +1,521 @@
+package tnpptMiddleware
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AuditSink keeps the chained AuditEntry of an AuditLog.
+type AuditSink interface {
+	// Write appends entries, in order.
+	Write(entries []AuditEntry) error
+	// Last returns the last entry written, for the chain to go on after a restart.
+	Last() (AuditEntry, bool, error)
+	Close() error
+}
+
+var (
+	ErrAuditChainBroken = errors.New("audit chain broken")
+	ErrAuditLogClosed   = errors.New("audit log closed")
+)
+
+// AuditLog is the Auditor writing to Sink without blocking the requests: the
+// entries are buffered (BufferSize, default 4096) and written by batches of
+// BatchSize (256) at least every FlushInterval (1s). Entries arriving on a
+// full buffer are dropped and counted by Dropped.
+// Every entry carries its sequence number, the hash of the previous entry and
+// its own hash, so that an edited, removed or reordered entry breaks the
+// chain checked by an AuditVerifier. Without Key the hash is a plain SHA-256
+// that anyone able to edit the file can compute again: only accidental
+// corruption is caught. With Key it is an HMAC-SHA256, give the Key to the
+// AuditVerifier and keep it away from the files. Write errors are given to
+// OnError, logged on Logger (slog.Default when nil) by default, the entries
+// are lost and the gap shows in the chain.
+type AuditLog struct {
+	Sink          AuditSink
+	Key           []byte
+	BufferSize    int
+	BatchSize     int
+	FlushInterval time.Duration
+	OnError       func(err error)
+	Logger        *slog.Logger
+
+	mu      sync.RWMutex
+	closed  bool
+	entries chan AuditEntry
+	done    chan struct{}
+	last    AuditEntry
+	dropped uint64
+}
+
+func NewAuditLog(auditLog *AuditLog) (*AuditLog, error) {
+	return auditLog.Init()
+}
+
+func (auditLog *AuditLog) Init() (*AuditLog, error) {
+	if auditLog.Sink == nil {
+		return nil, errors.New("TNPPT - AuditLog - You need to set the Sink")
+	}
+	if auditLog.BufferSize == 0 {
+		auditLog.BufferSize = 4096
+	}
+	if auditLog.BatchSize == 0 {
+		auditLog.BatchSize = 256
+	}
+	if auditLog.FlushInterval == 0 {
+		auditLog.FlushInterval = time.Second
+	}
+	if auditLog.OnError == nil {
+		logger := loggerOrDefault(auditLog.Logger)
+		auditLog.OnError = func(err error) {
+			logger.Error("audit log write failed", "error", err)
+		}
+	}
+	last, found, err := auditLog.Sink.Last()
+	if err != nil {
+		return nil, fmt.Errorf("TNPPT - AuditLog - Last entry: %w", err)
+	}
+	if found {
+		auditLog.last = last
+	}
+	auditLog.entries = make(chan AuditEntry, auditLog.BufferSize)
+	auditLog.done = make(chan struct{})
+	go auditLog.run()
+	return auditLog, nil
+}
+
+// Audit queues entry, it never blocks.
+func (auditLog *AuditLog) Audit(ctx context.Context, entry AuditEntry) {
+	auditLog.mu.RLock()
+	defer auditLog.mu.RUnlock()
+	if auditLog.closed {
+		atomic.AddUint64(&auditLog.dropped, 1)
+		return
+	}
+	select {
+	case auditLog.entries <- entry:
+	default:
+		atomic.AddUint64(&auditLog.dropped, 1)
+	}
+}
+
+// Dropped returns the entries lost to a full buffer or a closed AuditLog.
+func (auditLog *AuditLog) Dropped() uint64 {
+	return atomic.LoadUint64(&auditLog.dropped)
+}
+
+// Close writes the buffered entries and closes the Sink.
+func (auditLog *AuditLog) Close() error {
+	auditLog.mu.Lock()
+	if auditLog.closed {
+		auditLog.mu.Unlock()
+		return ErrAuditLogClosed
+	}
+	auditLog.closed = true
+	close(auditLog.entries)
+	auditLog.mu.Unlock()
+	<-auditLog.done
+	return auditLog.Sink.Close()
+}
+
+func (auditLog *AuditLog) run() {
+	defer close(auditLog.done)
+	ticker := time.NewTicker(auditLog.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]AuditEntry, 0, auditLog.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := auditLog.Sink.Write(batch); err != nil {
+			auditLog.OnError(err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case entry, open := <-auditLog.entries:
+			if !open {
+				flush()
+				return
+			}
+			batch = append(batch, auditLog.chain(entry))
+			if len(batch) >= auditLog.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// chain links entry to the previous one.
+func (auditLog *AuditLog) chain(entry AuditEntry) AuditEntry {
+	entry.Sequence = auditLog.last.Sequence + 1
+	entry.PrevHash = auditLog.last.Hash
+	entry.Hash = ""
+	entry.Hash = auditHash(auditLog.Key, entry)
+	auditLog.last = entry
+	return entry
+}
+
+// auditHash is the SHA-256 of the JSON of entry without its Hash, the
+// HMAC-SHA256 under key when there is one.
+func auditHash(key []byte, entry AuditEntry) string {
+	entry.Hash = ""
+	line, _ := json.Marshal(entry)
+	if len(key) > 0 {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(line)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditVerifier checks the chain of an AuditLog, Key being the Key of the
+// AuditLog. The chain starts at the first entry of the log, or after
+// FromSequence and FromHash, the last entry of archived files recorded out of
+// reach of the log writer, so that the removal of the oldest entries is caught.
+// HeadSequence and HeadHash, the last entry of a previous check recorded the
+// same way, must still be in the chain so that the removal of the newest
+// entries is caught.
+type AuditVerifier struct {
+	Key          []byte
+	FromSequence uint64
+	FromHash     string
+	HeadSequence uint64
+	HeadHash     string
+}
+
+// auditChain checks entries one after the other.
+type auditChain struct {
+	verifier  AuditVerifier
+	last      AuditEntry
+	started   bool
+	headFound bool
+}
+
+func newAuditChain(verifier AuditVerifier) *auditChain {
+	return &auditChain{verifier: verifier, last: AuditEntry{Sequence: verifier.FromSequence, Hash: verifier.FromHash}}
+}
+
+func (chain *auditChain) check(entry AuditEntry) error {
+	if !hmac.Equal([]byte(entry.Hash), []byte(auditHash(chain.verifier.Key, entry))) {
+		return fmt.Errorf("%w: entry %d was modified", ErrAuditChainBroken, entry.Sequence)
+	}
+	if entry.Sequence != chain.last.Sequence+1 || entry.PrevHash != chain.last.Hash {
+		if !chain.started {
+			return fmt.Errorf("%w: entry %d does not start the chain, the entries before it are missing", ErrAuditChainBroken, entry.Sequence)
+		}
+		return fmt.Errorf("%w: entry %d does not follow entry %d", ErrAuditChainBroken, entry.Sequence, chain.last.Sequence)
+	}
+	if chain.verifier.HeadHash != "" && entry.Sequence == chain.verifier.HeadSequence {
+		if entry.Hash != chain.verifier.HeadHash {
+			return fmt.Errorf("%w: entry %d is not the recorded head", ErrAuditChainBroken, entry.Sequence)
+		}
+		chain.headFound = true
+	}
+	chain.last, chain.started = entry, true
+	return nil
+}
+
+// end checks that the recorded head was met.
+func (chain *auditChain) end() error {
+	if chain.verifier.HeadHash != "" && !chain.headFound {
+		return fmt.Errorf("%w: the recorded head, entry %d, is missing", ErrAuditChainBroken, chain.verifier.HeadSequence)
+	}
+	return nil
+}
+
+// VerifyEntries checks the chain of entries.
+func (verifier AuditVerifier) VerifyEntries(entries []AuditEntry) error {
+	chain := newAuditChain(verifier)
+	for _, entry := range entries {
+		if err := chain.check(entry); err != nil {
+			return err
+		}
+	}
+	return chain.end()
+}
+
+// VerifyFiles checks the chain across the JSON Lines files of paths, in order
+// (see AuditFiles), and returns the last entry, to be recorded as the head of
+// the next check, and the number of entries checked.
+func (verifier AuditVerifier) VerifyFiles(paths ...string) (AuditEntry, int, error) {
+	chain := newAuditChain(verifier)
+	count := 0
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return chain.last, count, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line++
+			var entry AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				_ = file.Close()
+				return chain.last, count, fmt.Errorf("%w: %s:%d: %s", ErrAuditChainBroken, path, line, err.Error())
+			}
+			if err := chain.check(entry); err != nil {
+				_ = file.Close()
+				return chain.last, count, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			count++
+		}
+		_ = file.Close()
+		if err := scanner.Err(); err != nil {
+			return chain.last, count, err
+		}
+	}
+	return chain.last, count, chain.end()
+}
+
+// VerifyAuditEntries checks the chain of entries of an AuditLog without Key.
+func VerifyAuditEntries(entries []AuditEntry) error {
+	return AuditVerifier{}.VerifyEntries(entries)
+}
+
+// VerifyAuditFiles checks the chain across the files of paths of an AuditLog
+// without Key, and returns the number of entries checked.
+func VerifyAuditFiles(paths ...string) (int, error) {
+	_, count, err := AuditVerifier{}.VerifyFiles(paths...)
+	return count, err
+}
+
+// AuditFiles returns the files of the FileAuditSink of path, the rotated ones
+// from the oldest, then path.
+func AuditFiles(path string) ([]string, error) {
+	dirEntries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(path) + "."
+	var paths []string
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if dirEntry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := time.Parse(auditRotationLayout, strings.TrimPrefix(name, prefix)); err == nil {
+			paths = append(paths, filepath.Join(filepath.Dir(path), name))
+		}
+	}
+	sort.Strings(paths)
+	if _, err := os.Stat(path); err == nil {
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// FileAuditSink writes JSON Lines to Path. The file is renamed with the UTC
+// time as suffix (Path.20060102T150405.000000000Z) and a new one started once
+// it would exceed MaxSize bytes or is older than MaxAge, 0 disabling either.
+type FileAuditSink struct {
+	Path    string
+	MaxSize int64
+	MaxAge  time.Duration
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+const auditRotationLayout = "20060102T150405.000000000Z"
+
+func NewFileAuditSink(fileAuditSink *FileAuditSink) (*FileAuditSink, error) {
+	return fileAuditSink.Init()
+}
+
+func (sink *FileAuditSink) Init() (*FileAuditSink, error) {
+	if sink.Path == "" {
+		return nil, errors.New("TNPPT - FileAuditSink - You need to set the Path")
+	}
+	if sink.MaxSize < 0 || sink.MaxAge < 0 {
+		return nil, errors.New("TNPPT - FileAuditSink - MaxSize and MaxAge can not be negative")
+	}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (sink *FileAuditSink) open() error {
+	file, err := os.OpenFile(sink.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	sink.file, sink.size, sink.openedAt = file, info.Size(), info.ModTime()
+	if info.Size() == 0 {
+		sink.openedAt = time.Now()
+	}
+	return nil
+}
+
+func (sink *FileAuditSink) Write(entries []AuditEntry) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.file == nil {
+		return ErrAuditLogClosed
+	}
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+		if err := sink.rotate(int64(len(line))); err != nil {
+			return err
+		}
+		written, err := sink.file.Write(line)
+		sink.size += int64(written)
+		if err != nil {
+			return err
+		}
+	}
+	return sink.file.Sync()
+}
+
+// rotate starts a new file when the next length bytes do not fit in the current one.
+func (sink *FileAuditSink) rotate(length int64) error {
+	full := sink.MaxSize > 0 && sink.size > 0 && sink.size+length > sink.MaxSize
+	old := sink.MaxAge > 0 && sink.size > 0 && time.Since(sink.openedAt) >= sink.MaxAge
+	if !full && !old {
+		return nil
+	}
+	if err := sink.file.Close(); err != nil {
+		return err
+	}
+	sink.file = nil
+	if err := os.Rename(sink.Path, sink.Path+"."+time.Now().UTC().Format(auditRotationLayout)); err != nil {
+		return err
+	}
+	return sink.open()
+}
+
+// Last reads the last entry of the newest file.
+func (sink *FileAuditSink) Last() (AuditEntry, bool, error) {
+	paths, err := AuditFiles(sink.Path)
+	if err != nil {
+		return AuditEntry{}, false, err
+	}
+	for index := len(paths) - 1; index >= 0; index-- {
+		line, err := lastLine(paths[index])
+		if err != nil {
+			return AuditEntry{}, false, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return AuditEntry{}, false, fmt.Errorf("%s: %w", paths[index], err)
+		}
+		return entry, true, nil
+	}
+	return AuditEntry{}, false, nil
+}
+
+// lastLine returns the last non-empty line of the file at path.
+func lastLine(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var tail []byte
+	for offset := info.Size(); offset > 0; {
+		chunk := int64(4096)
+		if offset < chunk {
+			chunk = offset
+		}
+		offset -= chunk
+		buffer := make([]byte, chunk)
+		if _, err := file.ReadAt(buffer, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		tail = append(buffer, tail...)
+		trimmed := bytes.TrimRight(tail, "\n")
+		if index := bytes.LastIndexByte(trimmed, '\n'); index >= 0 {
+			return trimmed[index+1:], nil
+		}
+	}
+	return bytes.TrimRight(tail, "\n"), nil
+}
+
+func (sink *FileAuditSink) Close() error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.file == nil {
+		return nil
+	}
+	err := sink.file.Close()
+	sink.file = nil
+	return err
+}
+
+// MemoryAuditSink keeps the entries in memory, for the tests and the short-lived processes.
+type MemoryAuditSink struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+func NewMemoryAuditSink() *MemoryAuditSink {
+	return &MemoryAuditSink{}
+}
+
+func (sink *MemoryAuditSink) Write(entries []AuditEntry) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.entries = append(sink.entries, entries...)
+	return nil
+}
+
+func (sink *MemoryAuditSink) Last() (AuditEntry, bool, error) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.entries) == 0 {
+		return AuditEntry{}, false, nil
+	}
+	return sink.entries[len(sink.entries)-1], true, nil
+}
+
+// Entries returns a copy of the entries written.
+func (sink *MemoryAuditSink) Entries() []AuditEntry {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return append([]AuditEntry(nil), sink.entries...)
+}
+
+func (sink *MemoryAuditSink) Close() error {
+	return nil
+}
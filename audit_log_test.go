@@ -0,0 +1,308 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	sink := NewMemoryAuditSink()
+	auditLog, err := NewAuditLog(&AuditLog{Sink: sink, BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		auditLog.Audit(context.Background(), AuditEntry{Event: AuditAccessDenied, Login: fmt.Sprintf("user-%d", i)})
+	}
+	assert.NoError(t, auditLog.Close())
+	assert.Equal(t, ErrAuditLogClosed, auditLog.Close())
+	auditLog.Audit(context.Background(), AuditEntry{Event: AuditAccessDenied})
+	assert.Equal(t, uint64(1), auditLog.Dropped())
+
+	entries := sink.Entries()
+	if !assert.Len(t, entries, 5) {
+		return
+	}
+	assert.Equal(t, uint64(1), entries[0].Sequence)
+	assert.Equal(t, "", entries[0].PrevHash)
+	assert.Equal(t, entries[0].Hash, entries[1].PrevHash)
+	assert.Equal(t, "user-4", entries[4].Login)
+	assert.NoError(t, VerifyAuditEntries(entries))
+
+	resumed, err := NewAuditLog(&AuditLog{Sink: sink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed.Audit(context.Background(), AuditEntry{Event: AuditAccessDenied})
+	assert.NoError(t, resumed.Close())
+	entries = sink.Entries()
+	assert.Equal(t, uint64(6), entries[5].Sequence)
+	assert.NoError(t, VerifyAuditEntries(entries))
+
+	tests := []struct {
+		name   string
+		tamper func(entries []AuditEntry) []AuditEntry
+	}{
+		{name: "edited", tamper: func(entries []AuditEntry) []AuditEntry {
+			entries[2].Login = "someone-else"
+			return entries
+		}},
+		{name: "edited-and-rehashed", tamper: func(entries []AuditEntry) []AuditEntry {
+			entries[2].Login = "someone-else"
+			entries[2].Hash = auditHash(nil, entries[2])
+			return entries
+		}},
+		{name: "removed", tamper: func(entries []AuditEntry) []AuditEntry {
+			return append(entries[:2], entries[3:]...)
+		}},
+		{name: "reordered", tamper: func(entries []AuditEntry) []AuditEntry {
+			entries[2], entries[3] = entries[3], entries[2]
+			return entries
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyAuditEntries(tt.tamper(sink.Entries()))
+			assert.True(t, errors.Is(err, ErrAuditChainBroken), err)
+		})
+	}
+}
+
+type blockingAuditSink struct {
+	*MemoryAuditSink
+	release chan struct{}
+}
+
+func (sink *blockingAuditSink) Write(entries []AuditEntry) error {
+	<-sink.release
+	return sink.MemoryAuditSink.Write(entries)
+}
+
+func TestAuditLog_NeverBlocks(t *testing.T) {
+	sink := &blockingAuditSink{MemoryAuditSink: NewMemoryAuditSink(), release: make(chan struct{})}
+	auditLog, err := NewAuditLog(&AuditLog{Sink: sink, BufferSize: 2, BatchSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			auditLog.Audit(context.Background(), AuditEntry{Event: AuditAccessDenied})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Audit blocked on a stuck sink")
+	}
+	close(sink.release)
+	assert.NoError(t, auditLog.Close())
+	assert.Equal(t, 10, len(sink.Entries())+int(auditLog.Dropped()))
+	assert.True(t, auditLog.Dropped() > 0)
+	assert.NoError(t, VerifyAuditEntries(sink.Entries()))
+}
+
+func TestFileAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	open := func() (*FileAuditSink, *AuditLog) {
+		sink, err := NewFileAuditSink(&FileAuditSink{Path: path, MaxSize: 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		auditLog, err := NewAuditLog(&AuditLog{Sink: sink})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sink, auditLog
+	}
+	_, auditLog := open()
+	for i := 0; i < 10; i++ {
+		auditLog.Audit(context.Background(), AuditEntry{Event: AuditAuthenticationFailed, Login: "steven", Reason: "incorrect Username or Password"})
+	}
+	assert.NoError(t, auditLog.Close())
+	_, auditLog = open()
+	auditLog.Audit(context.Background(), AuditEntry{Event: AuditAuthenticationSucceeded, Login: "steven"})
+	assert.NoError(t, auditLog.Close())
+
+	paths, err := AuditFiles(path)
+	assert.NoError(t, err)
+	assert.True(t, len(paths) > 2, "rotated on MaxSize")
+	assert.Equal(t, path, paths[len(paths)-1])
+	for _, rotated := range paths {
+		info, err := os.Stat(rotated)
+		assert.NoError(t, err)
+		assert.True(t, info.Size() <= 1024)
+	}
+	count, err := VerifyAuditFiles(paths...)
+	assert.NoError(t, err)
+	assert.Equal(t, 11, count)
+
+	t.Run("tampered", func(t *testing.T) {
+		content, _ := os.ReadFile(paths[0])
+		assert.NoError(t, os.WriteFile(paths[0], []byte(strings.Replace(string(content), "steven", "mallory", 1)), 0o600))
+		_, err := VerifyAuditFiles(paths...)
+		assert.True(t, errors.Is(err, ErrAuditChainBroken), err)
+		assert.Contains(t, err.Error(), paths[0]+":1")
+	})
+	t.Run("file-removed", func(t *testing.T) {
+		_, err := VerifyAuditFiles(paths[1:]...)
+		assert.True(t, errors.Is(err, ErrAuditChainBroken), "first file removed: %v", err)
+		_, err = VerifyAuditFiles(append([]string{paths[0]}, paths[2:]...)...)
+		assert.True(t, errors.Is(err, ErrAuditChainBroken), err)
+	})
+	t.Run("files-archived", func(t *testing.T) {
+		line, err := lastLine(paths[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var archived AuditEntry
+		if err := json.Unmarshal(line, &archived); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = AuditVerifier{FromSequence: archived.Sequence, FromHash: archived.Hash}.VerifyFiles(paths[2:]...)
+		assert.NoError(t, err)
+		_, _, err = AuditVerifier{FromSequence: archived.Sequence, FromHash: strings.Repeat("0", 64)}.VerifyFiles(paths[2:]...)
+		assert.True(t, errors.Is(err, ErrAuditChainBroken), err)
+	})
+}
+
+func TestAuditVerifier(t *testing.T) {
+	key := []byte("audit-key")
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := NewFileAuditSink(&FileAuditSink{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog, err := NewAuditLog(&AuditLog{Sink: sink, Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		auditLog.Audit(context.Background(), AuditEntry{Event: AuditAccessDenied, Login: fmt.Sprintf("user-%d", i)})
+	}
+	assert.NoError(t, auditLog.Close())
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(strings.TrimSuffix(string(content), "\n"), "\n")
+
+	head, count, err := AuditVerifier{Key: key}.VerifyFiles(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, count)
+	assert.Equal(t, uint64(5), head.Sequence)
+
+	var second AuditEntry
+	if err := json.Unmarshal([]byte(lines[1]), &second); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		verifier AuditVerifier
+		content  string
+		wantErr  bool
+	}{
+		{name: "keyed", verifier: AuditVerifier{Key: key, HeadSequence: 5, HeadHash: head.Hash}, content: string(content)},
+		{name: "without-key", verifier: AuditVerifier{}, content: string(content), wantErr: true},
+		{name: "other-key", verifier: AuditVerifier{Key: []byte("other-key")}, content: string(content), wantErr: true},
+		{name: "tail-truncated", verifier: AuditVerifier{Key: key}, content: strings.Join(lines[:3], "")},
+		{name: "tail-truncated-head", verifier: AuditVerifier{Key: key, HeadSequence: 5, HeadHash: head.Hash}, content: strings.Join(lines[:3], ""), wantErr: true},
+		{name: "oldest-removed", verifier: AuditVerifier{Key: key}, content: strings.Join(lines[2:], ""), wantErr: true},
+		{name: "oldest-archived", verifier: AuditVerifier{Key: key, FromSequence: 2, FromHash: second.Hash}, content: strings.Join(lines[2:], "")},
+		{name: "oldest-archived-and-removed", verifier: AuditVerifier{Key: key, FromSequence: 2, FromHash: second.Hash}, content: strings.Join(lines[3:], ""), wantErr: true},
+		{name: "head-replaced", verifier: AuditVerifier{Key: key, HeadSequence: 5, HeadHash: strings.Repeat("0", 64)}, content: string(content), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := filepath.Join(t.TempDir(), "audit.jsonl")
+			assert.NoError(t, os.WriteFile(tampered, []byte(tt.content), 0o600))
+			_, _, err := tt.verifier.VerifyFiles(tampered)
+			assert.Equal(t, tt.wantErr, err != nil, err)
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, ErrAuditChainBroken), err)
+			}
+		})
+	}
+
+	entries := []AuditEntry{{Sequence: 1, Login: "mallory"}}
+	entries[0].Hash = auditHash(nil, entries[0])
+	assert.NoError(t, VerifyAuditEntries(entries))
+	assert.True(t, errors.Is(AuditVerifier{Key: key}.VerifyEntries(entries), ErrAuditChainBroken), "rehashed without the key")
+}
+
+func TestFileAuditSink_MaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := NewFileAuditSink(&FileAuditSink{Path: path, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, sink.Write([]AuditEntry{{Sequence: 1}}))
+	sink.openedAt = time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, sink.Write([]AuditEntry{{Sequence: 2}}))
+	assert.NoError(t, sink.Close())
+	paths, _ := AuditFiles(path)
+	assert.Len(t, paths, 2)
+	last, found, err := sink.Last()
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, uint64(2), last.Sequence)
+
+	_, err = NewFileAuditSink(&FileAuditSink{})
+	assert.Error(t, err)
+}
+
+func TestTNPPT_AuditAuthentications(t *testing.T) {
+	sink := NewMemoryAuditSink()
+	auditLog, err := NewAuditLog(&AuditLog{Sink: sink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := New(&TNPPT{
+		Store:   newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "steven", Password: "pass"}}}),
+		Auditor: auditLog,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/logs/:id", auth.ActivateHMACAuth(), func(c *gin.Context) {})
+	for _, password := range []string{"pass", "wrong"} {
+		req := hmacLoginRequest(t, auth, "/logs/1", "steven", password)
+		req.RemoteAddr = "10.0.0.1:40000"
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	req, _ := http.NewRequest("POST", "/logs/2", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.NoError(t, auditLog.Close())
+
+	entries := sink.Entries()
+	if !assert.Len(t, entries, 3) {
+		return
+	}
+	assert.Equal(t, AuditAuthenticationSucceeded, entries[0].Event)
+	assert.Equal(t, "steven", entries[0].Login)
+	assert.Equal(t, "/logs/:id", entries[0].Route)
+	assert.Equal(t, "/logs/1", entries[0].Path)
+	assert.Equal(t, "10.0.0.1", entries[0].ClientIP)
+	assert.Equal(t, AuditAuthenticationFailed, entries[1].Event)
+	assert.Equal(t, "steven", entries[1].Login)
+	assert.Equal(t, ErrFailedAuthenticationHMAC.Error(), entries[1].Reason)
+	assert.Equal(t, AuditAuthenticationFailed, entries[2].Event)
+	assert.Equal(t, "", entries[2].Login, "the login of a previous request is not reused")
+	assert.NoError(t, VerifyAuditEntries(entries))
+}
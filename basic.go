@@ -0,0 +1,102 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const SchemeBasic = "basic"
+
+var ErrFailedAuthenticationBasic = errors.New("incorrect Username or Password")
+
+var (
+	dummyPasswordHashOnce sync.Once
+	dummyPasswordHash     string
+)
+
+// ActivateBasicAuth checks the Authorization: Basic header against the
+// UserInfo.PasswordHash found by IsCredentialsValid (or the Store). Hashes
+// weaker than the Passwords policy are replaced on success when the Store
+// implements PasswordHashUpdater.
+func (tnppt *TNPPT) ActivateBasicAuth() gin.HandlerFunc {
+	return tnppt.activate(SchemeBasic)
+}
+
+func (tnppt *TNPPT) authenticateBasic() error {
+	if err := tnppt.checkBasicPayload(); err != nil {
+		return errors.New(ErrFailedPayload.Error() + " - " + err.Error())
+	}
+	if err := tnppt.checkLoginLockout(); err != nil {
+		return err
+	}
+	if !tnppt.credentialsValid() {
+		tnppt.burnPasswordVerification()
+		return ErrFailedAuthenticationBasic
+	}
+	if !tnppt.comparePassword() {
+		return ErrFailedAuthenticationBasic
+	}
+	tnppt.rehashPassword(tnppt.Request.Context())
+	return nil
+}
+
+func (tnppt *TNPPT) checkBasicPayload() error {
+	login, password, found := tnppt.Request.BasicAuth()
+	if !found {
+		return fmt.Errorf("[BASIC] No payload detected")
+	}
+	if login == "" || password == "" {
+		return fmt.Errorf("[BASIC] Incorrect Payload")
+	}
+	tnppt.PayloadBasic = PayloadBasicFormat{Login: login, Password: password}
+	return nil
+}
+
+func (tnppt *TNPPT) comparePassword() bool {
+	if tnppt.Principal.PasswordHash == "" {
+		// a user without password hash answers as slowly as a wrong password
+		tnppt.burnPasswordVerification()
+		return false
+	}
+	valid, err := VerifyPassword(tnppt.PayloadBasic.Password, tnppt.Principal.PasswordHash)
+	if err != nil {
+		tnppt.logError(tnppt.Request, "password hash verification failed", err)
+		return false
+	}
+	return valid
+}
+
+// burnPasswordVerification spends the time of a hash verification so that
+// unknown logins can not be told apart from wrong passwords.
+func (tnppt *TNPPT) burnPasswordVerification() {
+	dummyPasswordHashOnce.Do(func() {
+		dummyPasswordHash, _ = tnppt.Passwords.Hash("tnppt-dummy-password")
+	})
+	if dummyPasswordHash != "" {
+		_, _ = VerifyPassword(tnppt.PayloadBasic.Password, dummyPasswordHash)
+	}
+}
+
+func (tnppt *TNPPT) rehashPassword(ctx context.Context) {
+	if !tnppt.Passwords.NeedsRehash(tnppt.Principal.PasswordHash) {
+		return
+	}
+	updater, canUpdate := tnppt.credentialStore().(PasswordHashUpdater)
+	if !canUpdate {
+		return
+	}
+	passwordHash, err := tnppt.Passwords.Hash(tnppt.PayloadBasic.Password)
+	if err != nil {
+		tnppt.logError(tnppt.Request, "password rehash failed", err)
+		return
+	}
+	if err := updater.UpdatePasswordHash(ctx, tnppt.Principal.Login, passwordHash); err != nil {
+		tnppt.logError(tnppt.Request, "password hash update failed", err)
+		return
+	}
+	tnppt.Principal.PasswordHash = passwordHash
+}
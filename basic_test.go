@@ -0,0 +1,94 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTNPPT_ActivateBasicAuth(t *testing.T) {
+	oldPolicy := PasswordPolicy{Algorithm: PasswordPBKDF2SHA256, PBKDF2Iterations: 1000}
+	currentPolicy := PasswordPolicy{Algorithm: PasswordArgon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1}
+	legacyHash, _ := oldPolicy.Hash("legacy-pass")
+	currentHash, _ := currentPolicy.Hash("pass")
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{
+		{Login: "steven", PasswordHash: currentHash, Scopes: []string{"logs:read"}},
+		{Login: "legacy", PasswordHash: legacyHash},
+		{Login: "hmac-only", Password: "secret"},
+	}})
+	auth, err := New(&TNPPT{Store: store, Passwords: currentPolicy, Realm: "logs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/log", auth.ActivateBasicAuth(), func(c *gin.Context) {
+		c.String(200, principal(c).Login)
+	})
+
+	tests := []struct {
+		name     string
+		login    string
+		password string
+		noHeader bool
+		want     int
+	}{
+		{name: "valid", login: "steven", password: "pass", want: 200},
+		{name: "wrong-password", login: "steven", password: "wrong", want: 401},
+		{name: "unknown-login", login: "nobody", password: "pass", want: 401},
+		{name: "hmac-only-user", login: "hmac-only", password: "secret", want: 401},
+		{name: "empty-password", login: "steven", password: "", want: 401},
+		{name: "missing-header", noHeader: true, want: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/log", nil)
+			if !tt.noHeader {
+				req.SetBasicAuth(tt.login, tt.password)
+			}
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.want, w.Code)
+			if tt.want == 401 {
+				assert.Equal(t, `Basic realm="logs", charset="UTF-8"`, w.Header().Get("WWW-Authenticate"))
+			} else {
+				assert.Equal(t, tt.login, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("rehash-on-login", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/log", nil)
+		req.SetBasicAuth("legacy", "legacy-pass")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+
+		user, _ := store.FindUserByLogin(context.Background(), "legacy")
+		assert.Equal(t, PasswordArgon2id, PasswordAlgorithm(user.PasswordHash))
+		assert.False(t, currentPolicy.NeedsRehash(user.PasswordHash))
+		valid, _ := VerifyPassword("legacy-pass", user.PasswordHash)
+		assert.True(t, valid)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+	})
+}
+
+func TestTNPPT_HMACRequiresSecret(t *testing.T) {
+	passwordHash, _ := PasswordPolicy{Algorithm: PasswordBcrypt, BcryptCost: 4}.Hash("pass")
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "basic-only", PasswordHash: passwordHash}}})
+	auth, err := New(&TNPPT{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := ginMockHandler(auth)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, hmacLoginRequest(t, auth, "/login", "basic-only", ""))
+	assert.Equal(t, 401, w.Code)
+}
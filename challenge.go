@@ -0,0 +1,214 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	crunchyTools "github.com/StevenLeclerc/crunchy-tools"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+const SchemeChallenge = "challenge"
+
+const memoryChallengeSweepFrequency = time.Minute
+
+// PayloadChallengeFormat is the HMAC payload where the server issued
+// challenge replaces HMAC_TIME: HMAC_HASH = sha256(login + password + challenge).
+type PayloadChallengeFormat struct {
+	Hash      string `header:"HMAC_HASH" binding:"required"`
+	Challenge string `header:"HMAC_CHALLENGE" binding:"required"`
+	Login     string `header:"HMAC_LOGIN" binding:"required"`
+}
+
+// ChallengeSettings configures ChallengeHandler and ActivateChallengeAuth.
+// Challenges are signed with Key (random unless set) and valid for TTL (30
+// seconds by default), Store makes them single use, in memory by default.
+// Instances behind a load balancer need the same Key and a shared Store.
+type ChallengeSettings struct {
+	Key   []byte
+	TTL   time.Duration
+	Store ChallengeStore
+}
+
+// ChallengeStore remembers the challenges already used until they expire.
+type ChallengeStore interface {
+	// Consume returns ErrChallengeUsed when challenge was already consumed.
+	Consume(ctx context.Context, challenge string, expiresAt time.Time) error
+}
+
+type ChallengeResponse struct {
+	Challenge string `json:"challenge"`
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+var (
+	ErrFailedAuthenticationChallenge = errors.New("incorrect Username or Password")
+	ErrChallengeInvalid              = errors.New("invalid challenge")
+	ErrChallengeExpired              = errors.New("challenge expired")
+	ErrChallengeUsed                 = errors.New("challenge already used")
+)
+
+// ChallengeHandler answers a new ChallengeResponse, the first step of the
+// login, it needs no authentication:
+//
+//	engine.POST("/challenge", auth.ChallengeHandler())
+//	engine.POST("/login", auth.ActivateChallengeAuth(), ...)
+func (tnppt *TNPPT) ChallengeHandler() gin.HandlerFunc {
+	tnppt.startSchemes("ChallengeHandler", SchemeChallenge)
+	return func(ginEngine *gin.Context) {
+		challenge, err := tnppt.Challenges.issue(time.Now())
+		if err != nil {
+			tnppt.sendError(ginEngine, http.StatusInternalServerError, err)
+			return
+		}
+		ginEngine.JSON(http.StatusOK, ChallengeResponse{
+			Challenge: challenge,
+			ExpiresIn: int64(tnppt.Challenges.TTL / time.Second),
+		})
+	}
+}
+
+// ActivateChallengeAuth is the HMAC mode without the client clock: the
+// signed value is a challenge from ChallengeHandler instead of HMAC_TIME.
+func (tnppt *TNPPT) ActivateChallengeAuth() gin.HandlerFunc {
+	return tnppt.activate(SchemeChallenge)
+}
+
+func (tnppt *TNPPT) authenticateChallenge() error {
+	if err := tnppt.checkChallengePayload(); err != nil {
+		return errors.New(ErrFailedPayload.Error() + " - " + err.Error())
+	}
+	now := time.Unix(0, tnppt.Security.TimeReceived*int64(time.Millisecond))
+	expiresAt, err := tnppt.Challenges.verify(tnppt.PayloadChallenge.Challenge, now)
+	if err != nil {
+		return errors.New(ErrFailedAuthenticationChallenge.Error() + " - " + err.Error())
+	}
+	if err := tnppt.checkLoginLockout(); err != nil {
+		return err
+	}
+	if !tnppt.credentialsValid() {
+		return ErrFailedAuthenticationChallenge
+	}
+	if !tnppt.compareChallengeHash() {
+		return ErrFailedAuthenticationChallenge
+	}
+	// consumed once verified only, so that nobody can burn the challenge of another client
+	errConsume := tnppt.Challenges.Store.Consume(tnppt.Request.Context(), tnppt.PayloadChallenge.Challenge, expiresAt)
+	if errConsume != nil {
+		if !errors.Is(errConsume, ErrChallengeUsed) {
+			tnppt.logError(tnppt.Request, "challenge store failed", errConsume)
+		}
+		return errors.New(ErrFailedAuthenticationChallenge.Error() + " - " + ErrChallengeUsed.Error())
+	}
+	return nil
+}
+
+func (tnppt *TNPPT) checkChallengePayload() error {
+	if tnppt.Request.Header.Get("HMAC_LOGIN") != "" &&
+		tnppt.Request.Header.Get("HMAC_HASH") != "" &&
+		tnppt.Request.Header.Get("HMAC_CHALLENGE") != "" {
+		errBind := crunchyTools.HasError(binding.Header.Bind(tnppt.Request, &tnppt.PayloadChallenge), "TNPPT - INIT - Parsing Json", true)
+		return errBind
+	}
+	return fmt.Errorf("[CHALLENGE] No payload detected")
+}
+
+func (tnppt *TNPPT) compareChallengeHash() bool {
+	if tnppt.Principal.Password == "" {
+		return false
+	}
+	hash := sha256.Sum256([]byte(tnppt.Principal.Login + tnppt.Principal.Password + tnppt.PayloadChallenge.Challenge))
+	generatedHash := fmt.Sprintf("%x", hash)
+	return subtle.ConstantTimeCompare([]byte(generatedHash), []byte(tnppt.PayloadChallenge.Hash)) == 1
+}
+
+func (settings *ChallengeSettings) init() error {
+	if settings.TTL == 0 {
+		settings.TTL = 30 * time.Second
+	}
+	return nil
+}
+
+// start draws the Key and sets the default Store, once a route uses the challenges.
+func (settings *ChallengeSettings) start() error {
+	if len(settings.Key) == 0 {
+		settings.Key = make([]byte, 32)
+		if _, err := rand.Read(settings.Key); err != nil {
+			return err
+		}
+	}
+	if settings.Store == nil {
+		settings.Store = NewMemoryChallengeStore()
+	}
+	return nil
+}
+
+// issue returns base64url(issued at, random, HMAC of both).
+func (settings ChallengeSettings) issue(now time.Time) (string, error) {
+	value := make([]byte, 24, 24+sha256.Size)
+	binary.BigEndian.PutUint64(value, uint64(now.Unix()))
+	if _, err := rand.Read(value[8:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(append(value, settings.sign(value)...)), nil
+}
+
+func (settings ChallengeSettings) verify(challenge string, now time.Time) (time.Time, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(challenge)
+	if err != nil || len(raw) != 24+sha256.Size || !hmac.Equal(raw[24:], settings.sign(raw[:24])) {
+		return time.Time{}, ErrChallengeInvalid
+	}
+	expiresAt := time.Unix(int64(binary.BigEndian.Uint64(raw[:8])), 0).Add(settings.TTL)
+	if !now.Before(expiresAt) {
+		return time.Time{}, ErrChallengeExpired
+	}
+	return expiresAt, nil
+}
+
+func (settings ChallengeSettings) sign(value []byte) []byte {
+	mac := hmac.New(sha256.New, settings.Key)
+	mac.Write(value)
+	return mac.Sum(nil)
+}
+
+// MemoryChallengeStore is a ChallengeStore for a single instance.
+type MemoryChallengeStore struct {
+	mu        sync.Mutex
+	used      map[string]time.Time
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryChallengeStore() *MemoryChallengeStore {
+	return &MemoryChallengeStore{used: map[string]time.Time{}, now: time.Now}
+}
+
+func (store *MemoryChallengeStore) Consume(ctx context.Context, challenge string, expiresAt time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := store.now()
+	if now.Sub(store.lastSweep) >= memoryChallengeSweepFrequency {
+		store.lastSweep = now
+		for used, usedExpiresAt := range store.used {
+			if !now.Before(usedExpiresAt) {
+				delete(store.used, used)
+			}
+		}
+	}
+	if _, used := store.used[challenge]; used {
+		return ErrChallengeUsed
+	}
+	store.used[challenge] = expiresAt
+	return nil
+}
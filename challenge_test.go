@@ -0,0 +1,129 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func challengeLoginRequest(login string, password string, challenge string) *http.Request {
+	hash := sha256.Sum256([]byte(login + password + challenge))
+	req, _ := http.NewRequest("POST", "/login", nil)
+	req.Header.Add("HMAC_HASH", fmt.Sprintf("%x", hash))
+	req.Header.Add("HMAC_LOGIN", login)
+	req.Header.Add("HMAC_CHALLENGE", challenge)
+	return req
+}
+
+func TestTNPPT_ActivateChallengeAuth(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "steven", Password: "pass"}}})
+	auth, err := New(&TNPPT{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/challenge", auth.ChallengeHandler())
+	router.POST("/login", auth.ActivateChallengeAuth(), func(c *gin.Context) {
+		c.String(200, principal(c).Scheme+":"+principal(c).Login)
+	})
+	newChallenge := func() string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/challenge", nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+		var response ChallengeResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, int64(30), response.ExpiresIn)
+		return response.Challenge
+	}
+	send := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("single-use", func(t *testing.T) {
+		challenge := newChallenge()
+		w := send(challengeLoginRequest("steven", "pass", challenge))
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "challenge:steven", w.Body.String())
+		assert.Equal(t, 401, send(challengeLoginRequest("steven", "pass", challenge)).Code)
+	})
+	t.Run("failed-attempt-keeps-challenge", func(t *testing.T) {
+		challenge := newChallenge()
+		assert.Equal(t, 401, send(challengeLoginRequest("steven", "wrong", challenge)).Code)
+		assert.Equal(t, 200, send(challengeLoginRequest("steven", "pass", challenge)).Code)
+	})
+
+	expired, _ := auth.Challenges.issue(time.Now().Add(-time.Minute))
+	foreign, _ := ChallengeSettings{Key: []byte("another-key"), TTL: time.Minute}.issue(time.Now())
+	tests := []struct {
+		name string
+		req  *http.Request
+	}{
+		{name: "unknown-login", req: challengeLoginRequest("nobody", "pass", newChallenge())},
+		{name: "expired", req: challengeLoginRequest("steven", "pass", expired)},
+		{name: "not-issued-by-us", req: challengeLoginRequest("steven", "pass", foreign)},
+		{name: "garbage", req: challengeLoginRequest("steven", "pass", "not-a-challenge")},
+		{name: "hmac-time-instead", req: hmacLoginRequest(t, auth, "/login", "steven", "pass")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, 401, send(tt.req).Code)
+		})
+	}
+}
+
+func TestTNPPT_ActivateAnyChallenge(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "steven", Password: "pass"}}})
+	auth, err := New(&TNPPT{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.POST("/login", auth.ActivateAny(SchemeHMAC, SchemeChallenge), func(c *gin.Context) {
+		c.String(200, principal(c).Scheme)
+	})
+	challenge, _ := auth.Challenges.issue(time.Now())
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, challengeLoginRequest("steven", "pass", challenge))
+	assert.Equal(t, SchemeChallenge, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, hmacLoginRequest(t, auth, "/login", "steven", "pass"))
+	assert.Equal(t, SchemeHMAC, w.Body.String())
+
+	both := hmacLoginRequest(t, auth, "/login", "steven", "pass")
+	both.Header.Set("HMAC_CHALLENGE", challenge)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, both)
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestMemoryChallengeStore_Consume(t *testing.T) {
+	store := NewMemoryChallengeStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	assert.NoError(t, store.Consume(ctx, "a", now.Add(time.Second)))
+	assert.True(t, errors.Is(store.Consume(ctx, "a", now.Add(time.Second)), ErrChallengeUsed))
+	assert.NoError(t, store.Consume(ctx, "b", now.Add(time.Second)))
+
+	now = now.Add(2 * time.Minute)
+	assert.NoError(t, store.Consume(ctx, "c", now.Add(time.Second)))
+	assert.Len(t, store.used, 1)
+}
@@ -0,0 +1,95 @@
+// Command tnppt-audit checks the hash chain of the audit log written by a
+// tnpptMiddleware.FileAuditSink, the rotated files included:
+//
+//	tnppt-audit verify [-key-file <path>] [-from <seq>:<hash>] [-head <seq>:<hash>] /var/log/api/audit.jsonl
+//
+// -key-file holds the AuditLog Key, as is. Without -from the chain must start
+// at its first entry, -from is the last entry of the files archived since,
+// recorded elsewhere. -head is the head printed by a previous check, recorded
+// elsewhere: the entries removed since are caught.
+// It exits with 1 when an entry was modified, removed or reordered.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	tnpptMiddleware "github.com/StevenLeclerc/gin-TNPPT"
+)
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "verify" {
+		usage()
+	}
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.Usage = usage
+	keyFile := flags.String("key-file", "", "file holding the AuditLog Key")
+	from := flags.String("from", "", "<seq>:<hash> of the last entry of the archived files")
+	head := flags.String("head", "", "<seq>:<hash> of the head recorded by a previous check")
+	_ = flags.Parse(os.Args[2:])
+	if flags.NArg() != 1 {
+		usage()
+	}
+	verifier, err := newVerifier(*keyFile, *from, *head)
+	if err != nil {
+		fail(err)
+	}
+	paths, err := tnpptMiddleware.AuditFiles(flags.Arg(0))
+	if err == nil && len(paths) == 0 {
+		err = fmt.Errorf("no audit log at %s", flags.Arg(0))
+	}
+	if err != nil {
+		fail(err)
+	}
+	last, count, err := verifier.VerifyFiles(paths...)
+	if err != nil {
+		fail(fmt.Errorf("%s (after %d valid entries)", err, count))
+	}
+	fmt.Printf("%d entries in %d files, chain intact, head %d:%s\n", count, len(paths), last.Sequence, last.Hash)
+}
+
+func newVerifier(keyFile string, from string, head string) (tnpptMiddleware.AuditVerifier, error) {
+	var verifier tnpptMiddleware.AuditVerifier
+	if keyFile != "" {
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return verifier, err
+		}
+		verifier.Key = key
+	}
+	var err error
+	if from != "" {
+		if verifier.FromSequence, verifier.FromHash, err = parseAnchor("from", from); err != nil {
+			return verifier, err
+		}
+	}
+	if head != "" {
+		if verifier.HeadSequence, verifier.HeadHash, err = parseAnchor("head", head); err != nil {
+			return verifier, err
+		}
+	}
+	return verifier, nil
+}
+
+// parseAnchor parses the <seq>:<hash> of an entry.
+func parseAnchor(name string, anchor string) (uint64, string, error) {
+	parts := strings.SplitN(anchor, ":", 2)
+	sequence, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 || parts[1] == "" {
+		return 0, "", fmt.Errorf("invalid %s %q, expected <seq>:<hash>", name, anchor)
+	}
+	return sequence, parts[1], nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: tnppt-audit verify [-key-file <path>] [-from <seq>:<hash>] [-head <seq>:<hash>] <audit log path>")
+	os.Exit(2)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,320 @@
+package tnpptMiddleware
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SchemeDigest = "digest"
+
+	DigestSHA256 = "SHA-256"
+	DigestMD5    = "MD5"
+)
+
+// DigestSettings configures ActivateDigestAuth. Algorithms are offered in
+// order (SHA-256 then MD5 by default). Nonces are signed with NonceKey, random
+// unless set, give the same NonceKey to instances sharing clients so that a
+// nonce issued by one is accepted by the others (nonce counts stay per instance).
+type DigestSettings struct {
+	Algorithms []string
+	NonceTTL   time.Duration
+	NonceKey   []byte
+
+	nonces *digestNonces
+}
+
+type PayloadDigestFormat struct {
+	Login     string
+	Realm     string
+	Nonce     string
+	URI       string
+	Algorithm string
+	Response  string
+	QOP       string
+	NC        string
+	CNonce    string
+}
+
+var (
+	ErrFailedAuthenticationDigest = errors.New("incorrect Username or Password")
+	ErrDigestStaleNonce           = errors.New("stale nonce")
+	ErrDigestReplayed             = errors.New("nonce count already used")
+)
+
+// digestNonces remembers the last nonce count of the nonces in use.
+type digestNonces struct {
+	mu        sync.Mutex
+	counts    map[string]digestNonceCount
+	lastSweep time.Time
+}
+
+type digestNonceCount struct {
+	count     uint64
+	expiresAt time.Time
+}
+
+// ActivateDigestAuth checks RFC 7616 Digest credentials (qop=auth) against
+// the UserInfo.Password found by IsCredentialsValid (or the Store), the shared
+// secret of the HMAC mode.
+func (tnppt *TNPPT) ActivateDigestAuth() gin.HandlerFunc {
+	return tnppt.activate(SchemeDigest)
+}
+
+func (tnppt *TNPPT) authenticateDigest() error {
+	if err := tnppt.checkDigestPayload(); err != nil {
+		return errors.New(ErrFailedPayload.Error() + " - " + err.Error())
+	}
+	now := time.Unix(0, tnppt.Security.TimeReceived*int64(time.Millisecond))
+	expiresAt, err := tnppt.Digest.checkNonce(tnppt.PayloadDigest.Nonce, now)
+	if err != nil {
+		return err
+	}
+	if err := tnppt.checkLoginLockout(); err != nil {
+		return err
+	}
+	if !tnppt.credentialsValid() {
+		return ErrFailedAuthenticationDigest
+	}
+	if !tnppt.compareDigest() {
+		return ErrFailedAuthenticationDigest
+	}
+	count, _ := strconv.ParseUint(tnppt.PayloadDigest.NC, 16, 64)
+	if !tnppt.Digest.nonces.use(tnppt.PayloadDigest.Nonce, count, expiresAt, now) {
+		return fmt.Errorf("%w: %v", ErrDigestStaleNonce, ErrDigestReplayed)
+	}
+	return nil
+}
+
+func (tnppt *TNPPT) checkDigestPayload() error {
+	authorization := tnppt.Request.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Digest ") {
+		return fmt.Errorf("[DIGEST] No payload detected")
+	}
+	parameters, err := parseAuthParameters("DIGEST", authorization[7:])
+	if err != nil {
+		return err
+	}
+	payload := PayloadDigestFormat{
+		Login:     parameters["username"],
+		Realm:     parameters["realm"],
+		Nonce:     parameters["nonce"],
+		URI:       parameters["uri"],
+		Algorithm: parameters["algorithm"],
+		Response:  strings.ToLower(parameters["response"]),
+		QOP:       parameters["qop"],
+		NC:        parameters["nc"],
+		CNonce:    parameters["cnonce"],
+	}
+	if payload.Algorithm == "" {
+		payload.Algorithm = DigestMD5
+	}
+	if payload.Login == "" || payload.Nonce == "" || payload.Response == "" || payload.CNonce == "" {
+		return fmt.Errorf("[DIGEST] Incorrect Payload")
+	}
+	if payload.QOP != "auth" {
+		return fmt.Errorf("[DIGEST] Only qop=auth is supported")
+	}
+	if _, errCount := strconv.ParseUint(payload.NC, 16, 64); errCount != nil || len(payload.NC) != 8 {
+		return fmt.Errorf("[DIGEST] Incorrect nonce count")
+	}
+	if payload.Realm != tnppt.Realm {
+		return fmt.Errorf("[DIGEST] Incorrect realm")
+	}
+	if !containsString(tnppt.Digest.Algorithms, payload.Algorithm) {
+		return fmt.Errorf("[DIGEST] Algorithm %q not allowed", payload.Algorithm)
+	}
+	// the response is bound to the URI, it must be the one requested
+	requestURI := tnppt.Request.RequestURI
+	if requestURI == "" {
+		requestURI = tnppt.Request.URL.RequestURI()
+	}
+	if payload.URI != requestURI {
+		return fmt.Errorf("[DIGEST] Incorrect uri")
+	}
+	tnppt.PayloadDigest = payload
+	return nil
+}
+
+func (tnppt *TNPPT) compareDigest() bool {
+	if tnppt.Principal.Password == "" {
+		return false
+	}
+	payload := tnppt.PayloadDigest
+	digest := digestHash(payload.Algorithm)
+	ha1 := digest(payload.Login + ":" + payload.Realm + ":" + tnppt.Principal.Password)
+	ha2 := digest(tnppt.Request.Method + ":" + payload.URI)
+	expected := digest(strings.Join([]string{ha1, payload.Nonce, payload.NC, payload.CNonce, payload.QOP, ha2}, ":"))
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(payload.Response)) == 1
+}
+
+// digestChallenges are the WWW-Authenticate values, one per algorithm.
+func (tnppt *TNPPT) digestChallenges(stale bool) []string {
+	nonce := tnppt.Digest.newNonce(time.Now())
+	challenges := make([]string, 0, len(tnppt.Digest.Algorithms))
+	for _, algorithm := range tnppt.Digest.Algorithms {
+		challenge := fmt.Sprintf("Digest realm=%q, qop=\"auth\", algorithm=%s, nonce=%q, charset=UTF-8", tnppt.Realm, algorithm, nonce)
+		if stale {
+			challenge += ", stale=true"
+		}
+		challenges = append(challenges, challenge)
+	}
+	return challenges
+}
+
+func (settings *DigestSettings) init() error {
+	if len(settings.Algorithms) == 0 {
+		settings.Algorithms = []string{DigestSHA256, DigestMD5}
+	}
+	for _, algorithm := range settings.Algorithms {
+		if algorithm != DigestSHA256 && algorithm != DigestMD5 {
+			return fmt.Errorf("TNPPT - Digest - Unknown algorithm %q", algorithm)
+		}
+	}
+	if settings.NonceTTL == 0 {
+		settings.NonceTTL = 5 * time.Minute
+	}
+	return nil
+}
+
+// start draws the NonceKey and keeps the nonce counts, once a route uses Digest.
+func (settings *DigestSettings) start() error {
+	if settings.nonces != nil {
+		return nil
+	}
+	if len(settings.NonceKey) == 0 {
+		settings.NonceKey = make([]byte, 32)
+		if _, err := rand.Read(settings.NonceKey); err != nil {
+			return err
+		}
+	}
+	settings.nonces = &digestNonces{counts: map[string]digestNonceCount{}}
+	return nil
+}
+
+// newNonce is hex(issued at, random) followed by its HMAC, so that no state
+// is kept for the challenges sent.
+func (settings DigestSettings) newNonce(now time.Time) string {
+	value := make([]byte, 16)
+	binary.BigEndian.PutUint64(value, uint64(now.Unix()))
+	_, _ = rand.Read(value[8:])
+	return hex.EncodeToString(value) + hex.EncodeToString(settings.signNonce(value))
+}
+
+func (settings DigestSettings) checkNonce(nonce string, now time.Time) (time.Time, error) {
+	raw, err := hex.DecodeString(nonce)
+	if err != nil || len(raw) != 16+sha256.Size || !hmac.Equal(raw[16:], settings.signNonce(raw[:16])) {
+		return time.Time{}, fmt.Errorf("%w: unknown nonce", ErrDigestStaleNonce)
+	}
+	expiresAt := time.Unix(int64(binary.BigEndian.Uint64(raw[:8])), 0).Add(settings.NonceTTL)
+	if !now.Before(expiresAt) {
+		return time.Time{}, ErrDigestStaleNonce
+	}
+	return expiresAt, nil
+}
+
+func (settings DigestSettings) signNonce(value []byte) []byte {
+	mac := hmac.New(sha256.New, settings.NonceKey)
+	mac.Write(value)
+	return mac.Sum(nil)
+}
+
+// use records count for nonce, it must be greater than the previous one.
+func (nonces *digestNonces) use(nonce string, count uint64, expiresAt time.Time, now time.Time) bool {
+	nonces.mu.Lock()
+	defer nonces.mu.Unlock()
+	if now.Sub(nonces.lastSweep) >= time.Minute {
+		nonces.lastSweep = now
+		for key, used := range nonces.counts {
+			if !now.Before(used.expiresAt) {
+				delete(nonces.counts, key)
+			}
+		}
+	}
+	if used, found := nonces.counts[nonce]; found && count <= used.count {
+		return false
+	}
+	nonces.counts[nonce] = digestNonceCount{count: count, expiresAt: expiresAt}
+	return true
+}
+
+func digestHash(algorithm string) func(value string) string {
+	var newHash func() hash.Hash = md5.New
+	if algorithm == DigestSHA256 {
+		newHash = sha256.New
+	}
+	return func(value string) string {
+		hasher := newHash()
+		hasher.Write([]byte(value))
+		return hex.EncodeToString(hasher.Sum(nil))
+	}
+}
+
+// parseAuthParameters reads the comma separated key=value or key="value" list
+// of an Authorization header, tag prefixes the errors. Unquoted values may end
+// with the padding of a base64 value.
+func parseAuthParameters(tag string, header string) (map[string]string, error) {
+	parameters := map[string]string{}
+	for rest := strings.TrimSpace(header); rest != ""; {
+		equal := strings.IndexByte(rest, '=')
+		if equal <= 0 {
+			return nil, fmt.Errorf("[%s] Incorrect Payload", tag)
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:equal]))
+		rest = strings.TrimLeft(rest[equal+1:], " \t")
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var builder strings.Builder
+			closed := false
+			index := 1
+			for ; index < len(rest); index++ {
+				if rest[index] == '\\' && index+1 < len(rest) {
+					index++
+				} else if rest[index] == '"' {
+					closed = true
+					break
+				}
+				builder.WriteByte(rest[index])
+			}
+			if !closed {
+				return nil, fmt.Errorf("[%s] Incorrect Payload", tag)
+			}
+			value, rest = builder.String(), rest[index+1:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = strings.TrimSpace(rest[:end]), rest[end:]
+			if value == "" || strings.ContainsAny(strings.TrimRight(value, "="), " \t=\"") {
+				return nil, fmt.Errorf("[%s] Incorrect Payload", tag)
+			}
+		}
+		if _, duplicated := parameters[key]; duplicated {
+			return nil, fmt.Errorf("[%s] Incorrect Payload", tag)
+		}
+		parameters[key] = value
+		rest = strings.TrimSpace(rest)
+		if rest != "" {
+			if rest[0] != ',' {
+				return nil, fmt.Errorf("[%s] Incorrect Payload", tag)
+			}
+			rest = strings.TrimSpace(rest[1:])
+		}
+	}
+	return parameters, nil
+}
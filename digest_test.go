@@ -0,0 +1,179 @@
+package tnpptMiddleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// RFC 7616 section 3.9.1
+func TestTNPPT_compareDigest(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		response  string
+	}{
+		{algorithm: DigestMD5, response: "8ca523f5e9506fed4657c9700eebdbec"},
+		{algorithm: DigestSHA256, response: "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/dir/index.html", nil)
+			tnppt := &TNPPT{requestState: requestState{
+				Request:   req,
+				Principal: UserInfo{Login: "Mufasa", Password: "Circle of Life"},
+				PayloadDigest: PayloadDigestFormat{
+					Login:     "Mufasa",
+					Realm:     "http-auth@example.org",
+					Nonce:     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+					URI:       "/dir/index.html",
+					Algorithm: tt.algorithm,
+					Response:  tt.response,
+					QOP:       "auth",
+					NC:        "00000001",
+					CNonce:    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+				},
+			}}
+			assert.True(t, tnppt.compareDigest())
+			tnppt.Principal.Password = "Circle of Death"
+			assert.False(t, tnppt.compareDigest())
+		})
+	}
+}
+
+type digestClient struct {
+	login     string
+	password  string
+	realm     string
+	algorithm string
+	nonce     string
+	count     int
+}
+
+func (client *digestClient) authorization(method string, uri string) string {
+	client.count++
+	nc := fmt.Sprintf("%08x", client.count)
+	digest := digestHash(client.algorithm)
+	ha1 := digest(client.login + ":" + client.realm + ":" + client.password)
+	ha2 := digest(method + ":" + uri)
+	response := digest(strings.Join([]string{ha1, client.nonce, nc, "0a4f113b", "auth", ha2}, ":"))
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s, qop=auth, nc=%s, cnonce="0a4f113b", response="%s"`,
+		client.login, client.realm, client.nonce, uri, client.algorithm, nc, response)
+}
+
+var digestNonceParameter = regexp.MustCompile(`nonce="([0-9a-f]+)"`)
+
+func TestTNPPT_ActivateDigestAuth(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "device-42", Password: "device-secret"}}})
+	auth, err := New(&TNPPT{Store: store, Realm: "fleet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/telemetry", auth.ActivateDigestAuth(), func(c *gin.Context) {
+		c.String(200, principal(c).Scheme+":"+principal(c).Login)
+	})
+	send := func(authorization string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/telemetry", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("")
+	assert.Equal(t, 401, w.Code)
+	challenges := w.Header().Values("WWW-Authenticate")
+	if assert.Len(t, challenges, 2) {
+		assert.Contains(t, challenges[0], `Digest realm="fleet", qop="auth", algorithm=SHA-256, nonce="`)
+		assert.Contains(t, challenges[1], "algorithm=MD5")
+	}
+	nonce := digestNonceParameter.FindStringSubmatch(challenges[0])[1]
+
+	t.Run("sha-256-and-replay", func(t *testing.T) {
+		client := &digestClient{login: "device-42", password: "device-secret", realm: "fleet", algorithm: DigestSHA256, nonce: nonce}
+		authorization := client.authorization("GET", "/telemetry")
+		w := send(authorization)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "digest:device-42", w.Body.String())
+
+		w = send(authorization)
+		assert.Equal(t, 401, w.Code)
+		assert.Contains(t, w.Header().Get("WWW-Authenticate"), "stale=true")
+
+		assert.Equal(t, 200, send(client.authorization("GET", "/telemetry")).Code)
+	})
+	t.Run("md5", func(t *testing.T) {
+		client := &digestClient{login: "device-42", password: "device-secret", realm: "fleet", algorithm: DigestMD5, nonce: auth.Digest.newNonce(time.Now())}
+		assert.Equal(t, 200, send(client.authorization("GET", "/telemetry")).Code)
+	})
+
+	tests := []struct {
+		name      string
+		client    digestClient
+		uri       string
+		wantStale bool
+	}{
+		{name: "wrong-password", client: digestClient{login: "device-42", password: "wrong", realm: "fleet", algorithm: DigestSHA256, nonce: nonce}},
+		{name: "unknown-login", client: digestClient{login: "device-7", password: "device-secret", realm: "fleet", algorithm: DigestSHA256, nonce: nonce}},
+		{name: "wrong-realm", client: digestClient{login: "device-42", password: "device-secret", realm: "other", algorithm: DigestSHA256, nonce: nonce}},
+		{name: "other-uri", client: digestClient{login: "device-42", password: "device-secret", realm: "fleet", algorithm: DigestSHA256, nonce: nonce}, uri: "/admin"},
+		{name: "forged-nonce", client: digestClient{login: "device-42", password: "device-secret", realm: "fleet", algorithm: DigestSHA256, nonce: strings.Repeat("ab", 48)}, wantStale: true},
+		{name: "expired-nonce", client: digestClient{login: "device-42", password: "device-secret", realm: "fleet", algorithm: DigestSHA256, nonce: auth.Digest.newNonce(time.Now().Add(-time.Hour))}, wantStale: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uri := tt.uri
+			if uri == "" {
+				uri = "/telemetry"
+			}
+			w := send(tt.client.authorization("GET", uri))
+			assert.Equal(t, 401, w.Code)
+			assert.Equal(t, tt.wantStale, strings.Contains(w.Header().Get("WWW-Authenticate"), "stale=true"))
+		})
+	}
+}
+
+func TestDigestSettings_Algorithms(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "device-42", Password: "device-secret"}}})
+	auth, err := New(&TNPPT{Store: store, Digest: DigestSettings{Algorithms: []string{DigestSHA256}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.GET("/telemetry", auth.ActivateDigestAuth())
+	client := &digestClient{login: "device-42", password: "device-secret", realm: "tnppt", algorithm: DigestMD5, nonce: auth.Digest.newNonce(time.Now())}
+	req, _ := http.NewRequest("GET", "/telemetry", nil)
+	req.Header.Set("Authorization", client.authorization("GET", "/telemetry"))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+	assert.Len(t, w.Header().Values("WWW-Authenticate"), 1)
+
+	_, err = New(&TNPPT{Store: store, Digest: DigestSettings{Algorithms: []string{"SHA-512-256"}}})
+	assert.Error(t, err)
+}
+
+func TestParseAuthParameters(t *testing.T) {
+	parameters, err := parseAuthParameters("DIGEST", `username="Mufasa", realm="a \"quoted\", realm",qop=auth, nc=00000001`)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"username": "Mufasa", "realm": `a "quoted", realm`, "qop": "auth", "nc": "00000001"}, parameters)
+
+	parameters, err = parseAuthParameters("SCRAM", `sid=AAAABBBB, data=biwsbj11c2VyLHI9ck9wck5HZndFYmVSV2diTkVrcU8=`)
+	assert.NoError(t, err)
+	assert.Equal(t, "biwsbj11c2VyLHI9ck9wck5HZndFYmVSV2diTkVrcU8=", parameters["data"])
+
+	for _, header := range []string{`username="unterminated`, `username`, `a=1 b=2`, `a=1, a=2`, `a=b=c`} {
+		_, err := parseAuthParameters("DIGEST", header)
+		assert.Error(t, err, header)
+	}
+}
@@ -0,0 +1,701 @@
+package tnpptMiddleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Expression is a compiled authorization rule, such as
+//
+//	principal.tenant == param.tenantId && 'admin' in principal.roles
+//
+// It has string ('...' or "..."), number, boolean and string list ([...])
+// literals, the comparisons == != < <= > >= and in, ! && || and parentheses,
+// and reads:
+//   - principal.login, id, scheme, scopes, roles, tenant, claims.<name>, any other
+//     principal.<name> being the claim of that name
+//   - param.<name>, query.<name>, header.<name>
+//   - method (GET, POST... are literals), path
+//   - time.hour, time.minute, time.weekday (Monday...), time.unix, in UTC
+//
+// Values that are not there, empty principal strings included, are null. A
+// comparison with a null value is false, != included, only the null literal
+// tests it: param.x == null. There is no call nor loop, evaluating is linear
+// in the size of the expression.
+type Expression struct {
+	source string
+	root   expressionNode
+}
+
+// ExpressionEnv is what an Expression reads.
+type ExpressionEnv struct {
+	Principal UserInfo
+	Params    map[string]string
+	Query     url.Values
+	Header    http.Header
+	Method    string
+	Path      string
+	Time      time.Time
+}
+
+var ErrInvalidExpression = errors.New("[EXPRESSION] invalid expression")
+
+const (
+	maxExpressionLength = 4096
+	maxExpressionDepth  = 32
+)
+
+var expressionMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+// CompileExpression parses source, the errors wrap ErrInvalidExpression.
+func CompileExpression(source string) (*Expression, error) {
+	if len(source) > maxExpressionLength {
+		return nil, fmt.Errorf("%w: longer than %d bytes", ErrInvalidExpression, maxExpressionLength)
+	}
+	tokens, err := tokenizeExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	parser := &expressionParser{source: source, tokens: tokens}
+	root, err := parser.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if parser.position < len(tokens) {
+		return nil, parser.errorAt(tokens[parser.position], "unexpected %q", tokens[parser.position].text)
+	}
+	return &Expression{source: source, root: root}, nil
+}
+
+func (expression *Expression) String() string {
+	return expression.source
+}
+
+// Evaluate returns whether env satisfies the expression, and when not, the
+// sub-expression that made it fail: the first false operand of an &&, the
+// whole || when none of its operands holds, or the one failing to evaluate.
+func (expression *Expression) Evaluate(env ExpressionEnv) (bool, string, error) {
+	return expression.condition(expression.root, &env)
+}
+
+// RequirePolicy lets the principal authenticated by the previous middleware go
+// on when the request satisfies the expression, compiled once here:
+//
+//	tenant := engine.Group("/tenants/:tenantId", auth.ActivateJWTAuth(),
+//		auth.RequirePolicy("principal.tenant == param.tenantId"))
+//
+// Denials are answered 403 and audited with the failing sub-expression.
+func (tnppt *TNPPT) RequirePolicy(source string) gin.HandlerFunc {
+	expression, err := CompileExpression(source)
+	if err != nil {
+		panic("TNPPT - RequirePolicy - " + err.Error())
+	}
+	return func(ginEngine *gin.Context) {
+		user, found := UserInfoFromGin(ginEngine)
+		if !found || user.Login == "" {
+			tnppt.audit(ginEngine.Request, user, AuditEntry{Event: AuditAccessDenied, Route: ginEngine.FullPath(), Reason: "no principal"})
+			tnppt.sendError(ginEngine, http.StatusUnauthorized, ErrAuthenticationRequired)
+			return
+		}
+		params := make(map[string]string, len(ginEngine.Params))
+		for _, param := range ginEngine.Params {
+			params[param.Key] = param.Value
+		}
+		allowed, culprit, errEvaluate := expression.Evaluate(ExpressionEnv{
+			Principal: user,
+			Params:    params,
+			Query:     ginEngine.Request.URL.Query(),
+			Header:    ginEngine.Request.Header,
+			Method:    ginEngine.Request.Method,
+			Path:      ginEngine.Request.URL.Path,
+			Time:      time.Now(),
+		})
+		if !allowed {
+			reason := "expression is false"
+			if errEvaluate != nil {
+				reason = errEvaluate.Error()
+			}
+			tnppt.audit(ginEngine.Request, user, AuditEntry{Event: AuditAccessDenied, Route: ginEngine.FullPath(), Required: []string{culprit}, Reason: reason})
+			tnppt.sendError(ginEngine, http.StatusForbidden, ErrAccessDenied)
+			return
+		}
+		ginEngine.Next()
+	}
+}
+
+type expressionToken struct {
+	kind     string
+	text     string
+	value    interface{}
+	position int
+	end      int
+}
+
+const (
+	tokenOperator   = "operator"
+	tokenLiteral    = "literal"
+	tokenIdentifier = "identifier"
+)
+
+func tokenizeExpression(source string) ([]expressionToken, error) {
+	var tokens []expressionToken
+	for position := 0; position < len(source); {
+		char := source[position]
+		switch {
+		case char == ' ' || char == '\t' || char == '\n' || char == '\r':
+			position++
+		case char == '\'' || char == '"':
+			var text strings.Builder
+			end := position + 1
+			for ; end < len(source) && source[end] != char; end++ {
+				if source[end] == '\\' && end+1 < len(source) {
+					end++
+				}
+				text.WriteByte(source[end])
+			}
+			if end >= len(source) {
+				return nil, fmt.Errorf("%w: unterminated string at %d", ErrInvalidExpression, position)
+			}
+			tokens = append(tokens, expressionToken{kind: tokenLiteral, text: source[position : end+1], value: text.String(), position: position, end: end + 1})
+			position = end + 1
+		case isExpressionDigit(char) || (char == '-' && position+1 < len(source) && isExpressionDigit(source[position+1])):
+			end := position + 1
+			for end < len(source) && (isExpressionDigit(source[end]) || source[end] == '.') {
+				end++
+			}
+			number, err := strconv.ParseFloat(source[position:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid number %q", ErrInvalidExpression, source[position:end])
+			}
+			tokens = append(tokens, expressionToken{kind: tokenLiteral, text: source[position:end], value: number, position: position, end: end})
+			position = end
+		case isExpressionLetter(char):
+			end := position + 1
+			for end < len(source) && (isExpressionLetter(source[end]) || isExpressionDigit(source[end]) || source[end] == '.' || source[end] == '-') {
+				end++
+			}
+			text := source[position:end]
+			token := expressionToken{kind: tokenIdentifier, text: text, position: position, end: end}
+			switch {
+			case text == "true" || text == "false":
+				token.kind, token.value = tokenLiteral, text == "true"
+			case text == "null":
+				token.kind = tokenLiteral
+			case text == "in":
+				token.kind = tokenOperator
+			case expressionMethods[text]:
+				token.kind, token.value = tokenLiteral, text
+			}
+			tokens = append(tokens, token)
+			position = end
+		default:
+			operator := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ","} {
+				if strings.HasPrefix(source[position:], candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("%w: unexpected %q at %d", ErrInvalidExpression, char, position)
+			}
+			tokens = append(tokens, expressionToken{kind: tokenOperator, text: operator, position: position, end: position + len(operator)})
+			position += len(operator)
+		}
+	}
+	return tokens, nil
+}
+
+func isExpressionDigit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
+
+func isExpressionLetter(char byte) bool {
+	return (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || char == '_'
+}
+
+type expressionParser struct {
+	source   string
+	tokens   []expressionToken
+	position int
+}
+
+func (parser *expressionParser) errorAt(token expressionToken, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s at %d", ErrInvalidExpression, fmt.Sprintf(format, args...), token.position)
+}
+
+func (parser *expressionParser) peek(operators ...string) bool {
+	if parser.position >= len(parser.tokens) {
+		return false
+	}
+	token := parser.tokens[parser.position]
+	return token.kind == tokenOperator && containsString(operators, token.text)
+}
+
+func (parser *expressionParser) next() (expressionToken, error) {
+	if parser.position >= len(parser.tokens) {
+		return expressionToken{}, fmt.Errorf("%w: unexpected end", ErrInvalidExpression)
+	}
+	token := parser.tokens[parser.position]
+	parser.position++
+	return token, nil
+}
+
+func (parser *expressionParser) parseOr(depth int) (expressionNode, error) {
+	return parser.parseLogic(depth, "||", parser.parseAnd)
+}
+
+func (parser *expressionParser) parseAnd(depth int) (expressionNode, error) {
+	return parser.parseLogic(depth, "&&", parser.parseNot)
+}
+
+func (parser *expressionParser) parseLogic(depth int, operator string, operand func(depth int) (expressionNode, error)) (expressionNode, error) {
+	if depth > maxExpressionDepth {
+		return nil, fmt.Errorf("%w: nested deeper than %d", ErrInvalidExpression, maxExpressionDepth)
+	}
+	left, err := operand(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+	for parser.peek(operator) {
+		parser.position++
+		right, err := operand(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &logicNode{operator: operator, left: left, right: right, span: span{left.start(), right.end()}}
+	}
+	return left, nil
+}
+
+func (parser *expressionParser) parseNot(depth int) (expressionNode, error) {
+	if depth > maxExpressionDepth {
+		return nil, fmt.Errorf("%w: nested deeper than %d", ErrInvalidExpression, maxExpressionDepth)
+	}
+	if parser.peek("!") {
+		token, _ := parser.next()
+		operand, err := parser.parseNot(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand, span: span{token.position, operand.end()}}, nil
+	}
+	left, err := parser.parseOperand(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+	if !parser.peek("==", "!=", "<", "<=", ">", ">=", "in") {
+		return left, nil
+	}
+	operator, _ := parser.next()
+	right, err := parser.parseOperand(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+	return &compareNode{operator: operator.text, left: left, right: right, span: span{left.start(), right.end()}}, nil
+}
+
+func (parser *expressionParser) parseOperand(depth int) (expressionNode, error) {
+	token, err := parser.next()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case token.kind == tokenLiteral:
+		return &literalNode{value: token.value, span: span{token.position, token.end}}, nil
+	case token.kind == tokenIdentifier:
+		return newLookupNode(token)
+	case token.text == "(":
+		inner, err := parser.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		closing, err := parser.next()
+		if err != nil || closing.text != ")" {
+			return nil, parser.errorAt(token, "unclosed (")
+		}
+		return &groupNode{inner: inner, span: span{token.position, closing.end}}, nil
+	case token.text == "[":
+		var items []string
+		for !parser.peek("]") {
+			if len(items) > 0 {
+				if comma, err := parser.next(); err != nil || comma.text != "," {
+					return nil, parser.errorAt(token, "expected , in list")
+				}
+			}
+			item, err := parser.next()
+			if err != nil {
+				return nil, err
+			}
+			value, isString := item.value.(string)
+			if item.kind != tokenLiteral || !isString {
+				return nil, parser.errorAt(item, "lists only hold strings")
+			}
+			items = append(items, value)
+		}
+		closing, _ := parser.next()
+		return &literalNode{value: items, span: span{token.position, closing.end}}, nil
+	}
+	return nil, parser.errorAt(token, "unexpected %q", token.text)
+}
+
+// span locates a node in the source, for the failing sub-expression.
+type span struct {
+	from int
+	to   int
+}
+
+func (nodeSpan span) start() int { return nodeSpan.from }
+func (nodeSpan span) end() int   { return nodeSpan.to }
+
+type expressionNode interface {
+	eval(env *ExpressionEnv) (interface{}, error)
+	start() int
+	end() int
+}
+
+type literalNode struct {
+	span
+	value interface{}
+}
+
+type lookupNode struct {
+	span
+	root string
+	keys []string
+}
+
+type groupNode struct {
+	span
+	inner expressionNode
+}
+
+type notNode struct {
+	span
+	operand expressionNode
+}
+
+type logicNode struct {
+	span
+	operator string
+	left     expressionNode
+	right    expressionNode
+}
+
+type compareNode struct {
+	span
+	operator string
+	left     expressionNode
+	right    expressionNode
+}
+
+var expressionTimeFields = []string{"hour", "minute", "weekday", "unix"}
+
+func newLookupNode(token expressionToken) (expressionNode, error) {
+	parts := strings.Split(token.text, ".")
+	node := &lookupNode{root: parts[0], keys: parts[1:], span: span{token.position, token.end}}
+	for _, key := range node.keys {
+		if key == "" {
+			return nil, fmt.Errorf("%w: invalid name %q at %d", ErrInvalidExpression, token.text, token.position)
+		}
+	}
+	valid := false
+	switch node.root {
+	case "method", "path":
+		valid = len(node.keys) == 0
+	case "param", "query", "header":
+		valid = len(node.keys) == 1
+	case "principal":
+		valid = len(node.keys) == 1 && node.keys[0] != "claims" || len(node.keys) == 2 && node.keys[0] == "claims"
+	case "time":
+		valid = len(node.keys) == 1 && containsString(expressionTimeFields, node.keys[0])
+	}
+	if !valid {
+		return nil, fmt.Errorf("%w: unknown name %q at %d", ErrInvalidExpression, token.text, token.position)
+	}
+	return node, nil
+}
+
+func (node *literalNode) eval(env *ExpressionEnv) (interface{}, error) {
+	return node.value, nil
+}
+
+func (node *groupNode) eval(env *ExpressionEnv) (interface{}, error) {
+	return node.inner.eval(env)
+}
+
+func (node *lookupNode) eval(env *ExpressionEnv) (interface{}, error) {
+	switch node.root {
+	case "method":
+		return env.Method, nil
+	case "path":
+		return env.Path, nil
+	case "param":
+		if value, found := env.Params[node.keys[0]]; found {
+			return value, nil
+		}
+	case "query":
+		if values, found := env.Query[node.keys[0]]; found && len(values) > 0 {
+			return values[0], nil
+		}
+	case "header":
+		if values := env.Header.Values(node.keys[0]); len(values) > 0 {
+			return values[0], nil
+		}
+	case "time":
+		now := env.Time.UTC()
+		switch node.keys[0] {
+		case "hour":
+			return float64(now.Hour()), nil
+		case "minute":
+			return float64(now.Minute()), nil
+		case "weekday":
+			return now.Weekday().String(), nil
+		case "unix":
+			return float64(now.Unix()), nil
+		}
+	case "principal":
+		return principalValue(env.Principal, node.keys), nil
+	}
+	return nil, nil
+}
+
+func principalValue(principal UserInfo, keys []string) interface{} {
+	switch keys[0] {
+	case "login":
+		return expressionString(principal.Login)
+	case "scheme":
+		return expressionString(principal.Scheme)
+	case "scopes":
+		return principal.Scopes
+	case "roles":
+		return principal.Roles
+	case "tenant":
+		if principal.Tenant != "" {
+			return principal.Tenant
+		}
+	case "id":
+		if principal.ID == nil {
+			return nil
+		}
+		return fmt.Sprint(principal.ID)
+	case "claims":
+		return expressionValue(principal.Claims[keys[1]])
+	}
+	return expressionValue(principal.Claims[keys[0]])
+}
+
+// expressionString is null for an empty string, like any missing value.
+func expressionString(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// expressionValue converts a claim to the types of the expressions.
+func expressionValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case string, float64, bool, []string:
+		return typed
+	case int:
+		return float64(typed)
+	case int64:
+		return float64(typed)
+	case []interface{}:
+		values := make([]string, 0, len(typed))
+		for _, item := range typed {
+			if text, isString := item.(string); isString {
+				values = append(values, text)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func (node *notNode) eval(env *ExpressionEnv) (interface{}, error) {
+	value, err := node.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	condition, isBool := value.(bool)
+	if !isBool {
+		return nil, errors.New("! of a non boolean")
+	}
+	return !condition, nil
+}
+
+func (node *logicNode) eval(env *ExpressionEnv) (interface{}, error) {
+	for _, operand := range []expressionNode{node.left, node.right} {
+		value, err := operand.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		condition, isBool := value.(bool)
+		if !isBool {
+			return nil, errors.New(node.operator + " of a non boolean")
+		}
+		if condition == (node.operator == "||") {
+			return condition, nil
+		}
+	}
+	return node.operator == "&&", nil
+}
+
+func (node *compareNode) eval(env *ExpressionEnv) (interface{}, error) {
+	left, err := node.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := node.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if node.operator == "in" {
+		if right == nil || left == nil {
+			return false, nil
+		}
+		list, isList := right.([]string)
+		text, isString := left.(string)
+		if !isList || !isString {
+			return nil, errors.New("in needs a string and a list")
+		}
+		return containsString(list, text), nil
+	}
+	if left == nil || right == nil {
+		// a missing value equals nothing, only the null literal tests it
+		if (node.operator == "==" || node.operator == "!=") && (isNullLiteral(node.left) || isNullLiteral(node.right)) {
+			return (left == right) == (node.operator == "=="), nil
+		}
+		return false, nil
+	}
+	left, right = coerceNumbers(left, right)
+	switch node.operator {
+	case "==", "!=":
+		_, leftList := left.([]string)
+		_, rightList := right.([]string)
+		if leftList || rightList {
+			return nil, errors.New("lists can not be compared")
+		}
+		return (left == right) == (node.operator == "=="), nil
+	}
+	var order int
+	switch typedLeft := left.(type) {
+	case float64:
+		typedRight, isNumber := right.(float64)
+		if !isNumber {
+			return nil, errors.New(node.operator + " between a number and a non number")
+		}
+		order = compareOrdered(typedLeft < typedRight, typedLeft > typedRight)
+	case string:
+		typedRight, isString := right.(string)
+		if !isString {
+			return nil, errors.New(node.operator + " between a string and a non string")
+		}
+		order = strings.Compare(typedLeft, typedRight)
+	default:
+		return nil, errors.New(node.operator + " needs numbers or strings")
+	}
+	switch node.operator {
+	case "<":
+		return order < 0, nil
+	case "<=":
+		return order <= 0, nil
+	case ">":
+		return order > 0, nil
+	}
+	return order >= 0, nil
+}
+
+func isNullLiteral(node expressionNode) bool {
+	switch typed := node.(type) {
+	case *literalNode:
+		return typed.value == nil
+	case *groupNode:
+		return isNullLiteral(typed.inner)
+	}
+	return false
+}
+
+func compareOrdered(less bool, greater bool) int {
+	if less {
+		return -1
+	}
+	if greater {
+		return 1
+	}
+	return 0
+}
+
+// coerceNumbers parses the string compared to a number, params and headers being strings.
+func coerceNumbers(left interface{}, right interface{}) (interface{}, interface{}) {
+	_, leftNumber := left.(float64)
+	_, rightNumber := right.(float64)
+	if leftNumber && !rightNumber {
+		if text, isString := right.(string); isString {
+			if number, err := strconv.ParseFloat(text, 64); err == nil {
+				return left, number
+			}
+		}
+	}
+	if rightNumber && !leftNumber {
+		if text, isString := left.(string); isString {
+			if number, err := strconv.ParseFloat(text, 64); err == nil {
+				return number, right
+			}
+		}
+	}
+	return left, right
+}
+
+// condition evaluates node as a boolean, returning the failing sub-expression
+// when it does not hold.
+func (expression *Expression) condition(node expressionNode, env *ExpressionEnv) (bool, string, error) {
+	source := strings.TrimSpace(expression.source[node.start():node.end()])
+	switch typed := node.(type) {
+	case *groupNode:
+		return expression.condition(typed.inner, env)
+	case *logicNode:
+		left, culprit, err := expression.condition(typed.left, env)
+		if err != nil {
+			return false, culprit, err
+		}
+		if typed.operator == "&&" {
+			if !left {
+				return false, culprit, nil
+			}
+			return expression.condition(typed.right, env)
+		}
+		if left {
+			return true, "", nil
+		}
+		right, culprit, err := expression.condition(typed.right, env)
+		if err != nil || right {
+			return right, culprit, err
+		}
+		return false, source, nil
+	}
+	value, err := node.eval(env)
+	if err != nil {
+		return false, source, err
+	}
+	condition, isBool := value.(bool)
+	if !isBool {
+		return false, source, errors.New("not a boolean")
+	}
+	if !condition {
+		return false, source, nil
+	}
+	return true, "", nil
+}
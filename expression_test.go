@@ -0,0 +1,169 @@
+package tnpptMiddleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpression_Evaluate(t *testing.T) {
+	env := ExpressionEnv{
+		Principal: UserInfo{
+			ID:     7,
+			Login:  "steven",
+			Scheme: SchemeJWT,
+			Scopes: []string{"logs:read"},
+			Roles:  []string{"editor"},
+			Claims: map[string]interface{}{"tenant": "acme", "level": float64(3), "groups": []interface{}{"ops", "dev"}},
+		},
+		Params: map[string]string{"tenantId": "acme", "page": "12"},
+		Query:  url.Values{"format": {"json"}},
+		Header: http.Header{"X-Region": {"eu"}},
+		Method: "GET",
+		Path:   "/tenants/acme/logs",
+		Time:   time.Date(2026, 10, 19, 14, 30, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		expression  string
+		want        bool
+		wantCulprit string
+		wantErr     bool
+	}{
+		{expression: "principal.tenant == param.tenantId", want: true},
+		{expression: "principal.claims.tenant == 'acme'", want: true},
+		{expression: `method == GET || 'admin' in principal.roles`, want: true},
+		{expression: `method == POST || 'admin' in principal.roles`, wantCulprit: `method == POST || 'admin' in principal.roles`},
+		{expression: "principal.login == 'steven' && 'admin' in principal.roles", wantCulprit: "'admin' in principal.roles"},
+		{expression: "(principal.id == '7' && 'logs:read' in principal.scopes) && query.format != 'xml'", want: true},
+		{expression: "!('admin' in principal.roles)", want: true},
+		{expression: "header.X-Region in ['eu', 'us'] && param.page > 10 && principal.level >= 3", want: true},
+		{expression: "param.page < 10", wantCulprit: "param.page < 10"},
+		{expression: "'ops' in principal.groups && principal.scheme == 'jwt'", want: true},
+		{expression: "time.hour >= 9 && time.hour < 18 && time.weekday != 'Sunday'", want: true},
+		{expression: "param.missing == null && param.tenantId != null", want: true},
+		{expression: "query.missing != 'x'", wantCulprit: "query.missing != 'x'"},
+		{expression: "principal.missing == param.missing", wantCulprit: "principal.missing == param.missing"},
+		{expression: "principal.missing != param.tenantId", wantCulprit: "principal.missing != param.tenantId"},
+		{expression: "'admin' in principal.missing", wantCulprit: "'admin' in principal.missing"},
+		{expression: "path == '/tenants/acme/logs' && time.unix > 0 && time.minute == 30", want: true},
+		{expression: "principal.login < 3", wantCulprit: "principal.login < 3", wantErr: true},
+		{expression: "principal.roles == principal.scopes", wantCulprit: "principal.roles == principal.scopes", wantErr: true},
+		{expression: "principal.login", wantCulprit: "principal.login", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			expression, err := CompileExpression(tt.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			allowed, culprit, err := expression.Evaluate(env)
+			assert.Equal(t, tt.want, allowed)
+			assert.Equal(t, tt.wantCulprit, culprit)
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
+
+func TestExpression_EvaluateMissing(t *testing.T) {
+	env := ExpressionEnv{Principal: UserInfo{ID: 7}, Params: map[string]string{}}
+	tests := []struct {
+		expression string
+		want       bool
+	}{
+		{expression: "principal.login == principal.tenant"},
+		{expression: "principal.tenant == param.tenantId"},
+		{expression: "principal.login == param.tenantId"},
+		{expression: "principal.scheme != 'jwt'"},
+		{expression: "principal.claims.tenant <= param.tenantId"},
+		{expression: "principal.login == null && principal.tenant == (null)", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			expression, err := CompileExpression(tt.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			allowed, _, err := expression.Evaluate(env)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, allowed)
+		})
+	}
+}
+
+func TestCompileExpression_Invalid(t *testing.T) {
+	tests := []string{
+		"",
+		"principal.login ==",
+		"principal == 'steven'",
+		"principal.claims == 'x'",
+		"param.a.b == 'x'",
+		"secret == 'x'",
+		"time.year == 2026",
+		"'unterminated",
+		"(method == GET",
+		"method == GET)",
+		"['a', 1] == 'a'",
+		"principal.login = 'steven'",
+		"os.exit(1)",
+		strings.Repeat("(", 40) + "true" + strings.Repeat(")", 40),
+		strings.Repeat("a", maxExpressionLength+1),
+	}
+	for _, source := range tests {
+		t.Run(source, func(t *testing.T) {
+			_, err := CompileExpression(source)
+			assert.True(t, errors.Is(err, ErrInvalidExpression), "%v", err)
+		})
+	}
+}
+
+func TestTNPPT_RequirePolicy(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{
+		{Login: "alice", Password: "pass", Roles: []string{"admin"}},
+		{Login: "bob", Password: "pass"},
+	}})
+	auditor := &recordingAuditor{}
+	auth, err := New(&TNPPT{Store: store, Auditor: auditor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	tenants := router.Group("/tenants/:tenantId", auth.ActivateHMACAuth(),
+		auth.RequirePolicy("param.tenantId == principal.login || 'admin' in principal.roles"))
+	tenants.POST("/logs", func(c *gin.Context) { c.String(200, "ok") })
+	router.POST("/unauthenticated/:tenantId", auth.RequirePolicy("param.tenantId == principal.login"), func(c *gin.Context) {})
+
+	tests := []struct {
+		login    string
+		path     string
+		wantCode int
+	}{
+		{login: "bob", path: "/tenants/bob/logs", wantCode: 200},
+		{login: "alice", path: "/tenants/bob/logs", wantCode: 200},
+		{login: "bob", path: "/tenants/alice/logs", wantCode: 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.login+tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, hmacLoginRequest(t, auth, tt.path, tt.login, "pass"))
+			assert.Equal(t, tt.wantCode, w.Code)
+		})
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/unauthenticated/bob", nil))
+	assert.Equal(t, 401, w.Code, "the principal of a previous request is not reused")
+
+	if denials := auditor.denials(); assert.Len(t, denials, 2) {
+		assert.Equal(t, []string{"param.tenantId == principal.login || 'admin' in principal.roles"}, denials[0].Required)
+		assert.Equal(t, "bob", denials[0].Login)
+	}
+
+	assert.Panics(t, func() { auth.RequirePolicy("principal.login ==") })
+}
@@ -1,11 +1,14 @@
 module github.com/StevenLeclerc/gin-TNPPT
 
-go 1.18
+go 1.21
 
 require (
 	github.com/StevenLeclerc/crunchy-tools v0.0.5
 	github.com/gin-gonic/gin v1.6.3
+	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/stretchr/testify v1.4.0
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
+	gopkg.in/yaml.v2 v2.2.8
 )
 
 require (
@@ -27,5 +30,4 @@ require (
 	github.com/ugorji/go/codec v1.1.7 // indirect
 	golang.org/x/sys v0.0.0-20220624220833-87e55d714810 // indirect
 	google.golang.org/protobuf v1.28.0 // indirect
-	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
@@ -0,0 +1,227 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const SchemeIntrospection = "introspection"
+
+const introspectionCacheSweepFrequency = time.Minute
+
+// IntrospectionSettings configures ActivateIntrospectionAuth against an
+// RFC 7662 endpoint, authenticated with ClientID and ClientSecret.
+// Active responses are cached until their exp, at most MaxCacheTTL when set,
+// DisableCache queries the endpoint for every request.
+type IntrospectionSettings struct {
+	URL          string
+	ClientID     string
+	ClientSecret string
+	HTTPClient   *http.Client
+	MaxCacheTTL  time.Duration
+	DisableCache bool
+
+	cache *introspectionCache
+}
+
+var (
+	ErrFailedAuthenticationIntrospection = errors.New("incorrect Access Token")
+	ErrTokenInactive                     = errors.New("token inactive")
+	ErrIntrospectionUnavailable          = errors.New("introspection endpoint unavailable")
+)
+
+type introspectionEntry struct {
+	claims    map[string]interface{}
+	expiresAt time.Time
+}
+
+type introspectionCache struct {
+	mu        sync.Mutex
+	entries   map[string]introspectionEntry
+	lastSweep time.Time
+}
+
+func (tnppt *TNPPT) ActivateIntrospectionAuth() gin.HandlerFunc {
+	return tnppt.activate(SchemeIntrospection)
+}
+
+func (tnppt *TNPPT) authenticateIntrospection() error {
+	token, err := bearerToken(tnppt.Request.Header.Get("Authorization"))
+	if err != nil {
+		return errors.New(ErrFailedPayload.Error() + " - " + err.Error())
+	}
+	claims, err := tnppt.Introspection.Introspect(tnppt.Request.Context(), token, time.Unix(0, tnppt.Security.TimeReceived*int64(time.Millisecond)))
+	if err != nil {
+		if errors.Is(err, ErrIntrospectionUnavailable) {
+			tnppt.logError(tnppt.Request, "introspection endpoint failed", err)
+		}
+		return errors.New(ErrFailedAuthenticationIntrospection.Error() + " - " + err.Error())
+	}
+	tnppt.Principal = introspectionUserInfo(claims)
+	return nil
+}
+
+// Introspect returns the claims of an active token, from the cache when possible.
+func (settings *IntrospectionSettings) Introspect(ctx context.Context, token string, now time.Time) (map[string]interface{}, error) {
+	if settings.URL == "" {
+		return nil, fmt.Errorf("%w: no URL configured", ErrIntrospectionUnavailable)
+	}
+	// only the hash of the token is kept in memory
+	cacheKey := HashAPIKey(token)
+	if claims, cached := settings.cache.get(cacheKey, now); cached {
+		return claims, nil
+	}
+	claims, err := settings.query(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, ErrTokenInactive
+	}
+	expiration, hasExpiration, err := numericClaim(claims, "exp")
+	if err != nil {
+		return nil, err
+	}
+	if hasExpiration && now.Unix() >= expiration {
+		return nil, ErrJWTExpired
+	}
+	if notBefore, hasNotBefore, err := numericClaim(claims, "nbf"); err != nil {
+		return nil, err
+	} else if hasNotBefore && now.Unix() < notBefore {
+		return nil, ErrJWTNotYetValid
+	}
+	if !settings.DisableCache && (hasExpiration || settings.MaxCacheTTL > 0) {
+		expiresAt := time.Unix(expiration, 0)
+		if settings.MaxCacheTTL > 0 && (!hasExpiration || now.Add(settings.MaxCacheTTL).Before(expiresAt)) {
+			expiresAt = now.Add(settings.MaxCacheTTL)
+		}
+		settings.cache.put(cacheKey, introspectionEntry{claims: copyClaims(claims), expiresAt: expiresAt}, now)
+	}
+	return claims, nil
+}
+
+func (settings *IntrospectionSettings) query(ctx context.Context, token string) (map[string]interface{}, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, settings.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIntrospectionUnavailable, err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if settings.ClientID != "" {
+		request.SetBasicAuth(url.QueryEscape(settings.ClientID), url.QueryEscape(settings.ClientSecret))
+	}
+	response, err := settings.HTTPClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIntrospectionUnavailable, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, response.Body)
+		return nil, fmt.Errorf("%w: status %d", ErrIntrospectionUnavailable, response.StatusCode)
+	}
+	var claims map[string]interface{}
+	decoder := json.NewDecoder(io.LimitReader(response.Body, 1<<20))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("%w: invalid response: %v", ErrIntrospectionUnavailable, err)
+	}
+	return claims, nil
+}
+
+func (settings *IntrospectionSettings) init() error {
+	if settings.URL == "" {
+		return nil
+	}
+	endpoint, err := url.Parse(settings.URL)
+	if err != nil || (endpoint.Scheme != "https" && endpoint.Scheme != "http") || endpoint.Host == "" {
+		return errors.New("TNPPT - Introspection - You need to set an absolute http(s) URL")
+	}
+	if settings.HTTPClient == nil {
+		settings.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	settings.cache = &introspectionCache{entries: map[string]introspectionEntry{}}
+	return nil
+}
+
+// introspectionUserInfo prefers sub, then username, then client_id (client
+// credentials tokens) as the login.
+func introspectionUserInfo(claims map[string]interface{}) UserInfo {
+	user := UserInfo{Scopes: claimStrings(claims["scope"]), Claims: claims}
+	user.Tenant, _ = claims["tenant"].(string)
+	for _, claim := range []string{"sub", "username", "client_id"} {
+		if login, isString := claims[claim].(string); isString && login != "" {
+			user.Login = login
+			break
+		}
+	}
+	if subject, isString := claims["sub"].(string); isString && subject != "" {
+		user.ID = subject
+	}
+	return user
+}
+
+func (cache *introspectionCache) get(key string, now time.Time) (map[string]interface{}, bool) {
+	if cache == nil {
+		return nil, false
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, found := cache.entries[key]
+	if !found || !now.Before(entry.expiresAt) {
+		return nil, false
+	}
+	// every hit gets its own copy, a handler changing its claims cannot alter the cache
+	return copyClaims(entry.claims), true
+}
+
+// copyClaims deep copies the objects and arrays of decoded JSON claims.
+func copyClaims(claims map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(claims))
+	for name, value := range claims {
+		copied[name] = copyClaimValue(value)
+	}
+	return copied
+}
+
+func copyClaimValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		return copyClaims(typed)
+	case []interface{}:
+		copied := make([]interface{}, len(typed))
+		for index, element := range typed {
+			copied[index] = copyClaimValue(element)
+		}
+		return copied
+	default:
+		return value
+	}
+}
+
+func (cache *introspectionCache) put(key string, entry introspectionEntry, now time.Time) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if now.Sub(cache.lastSweep) >= introspectionCacheSweepFrequency {
+		cache.lastSweep = now
+		for cachedKey, cached := range cache.entries {
+			if !now.Before(cached.expiresAt) {
+				delete(cache.entries, cachedKey)
+			}
+		}
+	}
+	cache.entries[key] = entry
+}
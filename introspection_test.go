@@ -0,0 +1,191 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// newIntrospectionServer stands in for the authorization server, tokens maps
+// the known opaque tokens to their introspection response.
+func newIntrospectionServer(t *testing.T, tokens map[string]map[string]interface{}, calls *int64) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(calls, 1)
+		// RFC 6749 section 2.3.1: client credentials are form encoded before Basic
+		clientID, clientSecret, found := r.BasicAuth()
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+		if !found || clientID != "logs-api" || clientSecret != "s3cr%t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost || r.PostFormValue("token_type_hint") != "access_token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		response, known := tokens[r.PostFormValue("token")]
+		if !known {
+			response = map[string]interface{}{"active": false}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestTNPPT_ActivateIntrospectionAuth(t *testing.T) {
+	now := time.Now()
+	var calls int64
+	server := newIntrospectionServer(t, map[string]map[string]interface{}{
+		"user-token":    {"active": true, "sub": "steven", "scope": "logs:read logs:write", "client_id": "web", "exp": now.Add(time.Hour).Unix()},
+		"service-token": {"active": true, "client_id": "collector", "scope": "logs:write", "exp": now.Add(time.Hour).Unix()},
+		"expired-token": {"active": true, "sub": "steven", "exp": now.Add(-time.Minute).Unix()},
+		"future-token":  {"active": true, "sub": "steven", "nbf": now.Add(time.Hour).Unix(), "exp": now.Add(2 * time.Hour).Unix()},
+	}, &calls)
+	auth, err := New(&TNPPT{Introspection: IntrospectionSettings{
+		URL:          server.URL,
+		ClientID:     "logs-api",
+		ClientSecret: "s3cr%t",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/log", auth.ActivateIntrospectionAuth(), func(c *gin.Context) {
+		c.JSON(200, gin.H{"login": principal(c).Login, "id": principal(c).ID, "scopes": principal(c).Scopes})
+	})
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantCode      int
+		wantBody      string
+	}{
+		{name: "user-token", authorization: "Bearer user-token", wantCode: 200, wantBody: `{"id":"steven","login":"steven","scopes":["logs:read","logs:write"]}`},
+		{name: "client-credentials-token", authorization: "Bearer service-token", wantCode: 200, wantBody: `{"id":null,"login":"collector","scopes":["logs:write"]}`},
+		{name: "inactive-token", authorization: "Bearer unknown-token", wantCode: 401},
+		{name: "expired-token", authorization: "Bearer expired-token", wantCode: 401},
+		{name: "not-yet-valid-token", authorization: "Bearer future-token", wantCode: 401},
+		{name: "no-token", wantCode: 401},
+		{name: "basic-header", authorization: "Basic c3RldmVuOnBhc3M=", wantCode: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/log", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantBody != "" {
+				assert.JSONEq(t, tt.wantBody, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("cached-until-exp", func(t *testing.T) {
+		before := atomic.LoadInt64(&calls)
+		for i := 0; i < 3; i++ {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/log", nil)
+			req.Header.Set("Authorization", "Bearer user-token")
+			router.ServeHTTP(w, req)
+			assert.Equal(t, 200, w.Code)
+		}
+		assert.Equal(t, before, atomic.LoadInt64(&calls))
+
+		_, err := auth.Introspection.Introspect(context.Background(), "user-token", now.Add(2*time.Hour))
+		assert.True(t, errors.Is(err, ErrJWTExpired))
+		assert.Equal(t, before+1, atomic.LoadInt64(&calls))
+	})
+}
+
+func TestIntrospectionSettings_Introspect(t *testing.T) {
+	now := time.Now()
+	var calls int64
+	server := newIntrospectionServer(t, map[string]map[string]interface{}{
+		"no-exp-token": {"active": true, "sub": "steven"},
+		"long-token":   {"active": true, "sub": "steven", "exp": now.Add(time.Hour).Unix()},
+		"scoped-token": {"active": true, "sub": "steven", "exp": now.Add(time.Hour).Unix(), "groups": []string{"ops"}},
+	}, &calls)
+	ctx := context.Background()
+
+	t.Run("max-cache-ttl", func(t *testing.T) {
+		settings := IntrospectionSettings{URL: server.URL, ClientID: "logs-api", ClientSecret: "s3cr%t", MaxCacheTTL: time.Minute}
+		assert.NoError(t, settings.init())
+		before := atomic.LoadInt64(&calls)
+		for _, at := range []time.Time{now, now.Add(30 * time.Second), now.Add(2 * time.Minute)} {
+			_, err := settings.Introspect(ctx, "long-token", at)
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, before+2, atomic.LoadInt64(&calls))
+	})
+	t.Run("cached-claims-copied", func(t *testing.T) {
+		settings := IntrospectionSettings{URL: server.URL, ClientID: "logs-api", ClientSecret: "s3cr%t"}
+		assert.NoError(t, settings.init())
+		before := atomic.LoadInt64(&calls)
+		for i := 0; i < 3; i++ {
+			claims, err := settings.Introspect(ctx, "scoped-token", now)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, "steven", claims["sub"])
+			assert.Equal(t, []interface{}{"ops"}, claims["groups"])
+			claims["sub"] = "mallory"
+			claims["groups"].([]interface{})[0] = "admin"
+		}
+		assert.Equal(t, before+1, atomic.LoadInt64(&calls))
+	})
+	t.Run("no-exp-not-cached", func(t *testing.T) {
+		settings := IntrospectionSettings{URL: server.URL, ClientID: "logs-api", ClientSecret: "s3cr%t"}
+		assert.NoError(t, settings.init())
+		before := atomic.LoadInt64(&calls)
+		for i := 0; i < 2; i++ {
+			claims, err := settings.Introspect(ctx, "no-exp-token", now)
+			assert.NoError(t, err)
+			assert.Equal(t, "steven", claims["sub"])
+		}
+		assert.Equal(t, before+2, atomic.LoadInt64(&calls))
+	})
+	t.Run("disable-cache", func(t *testing.T) {
+		settings := IntrospectionSettings{URL: server.URL, ClientID: "logs-api", ClientSecret: "s3cr%t", DisableCache: true}
+		assert.NoError(t, settings.init())
+		before := atomic.LoadInt64(&calls)
+		for i := 0; i < 2; i++ {
+			_, err := settings.Introspect(ctx, "long-token", now)
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, before+2, atomic.LoadInt64(&calls))
+	})
+	t.Run("wrong-client-credentials", func(t *testing.T) {
+		settings := IntrospectionSettings{URL: server.URL, ClientID: "logs-api", ClientSecret: "wrong"}
+		assert.NoError(t, settings.init())
+		_, err := settings.Introspect(ctx, "long-token", now)
+		assert.True(t, errors.Is(err, ErrIntrospectionUnavailable))
+	})
+	t.Run("endpoint-down", func(t *testing.T) {
+		down := httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+		settings := IntrospectionSettings{URL: down.URL}
+		assert.NoError(t, settings.init())
+		_, err := settings.Introspect(ctx, "long-token", now)
+		assert.True(t, errors.Is(err, ErrIntrospectionUnavailable))
+	})
+	t.Run("invalid-url", func(t *testing.T) {
+		settings := IntrospectionSettings{URL: "/introspect"}
+		assert.Error(t, settings.init())
+	})
+}
@@ -0,0 +1,400 @@
+package tnpptMiddleware
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SchemeJWT = "jwt"
+
+	JWTAlgHS256 = "HS256"
+	JWTAlgRS256 = "RS256"
+	JWTAlgES256 = "ES256"
+	JWTAlgEdDSA = "EdDSA"
+)
+
+// JWTKey is an entry of the key set, Key is a []byte secret for HS256, or an
+// RSA, ECDSA P-256 or Ed25519 key (public to verify, private to sign and verify).
+type JWTKey struct {
+	ID        string
+	Algorithm string
+	Key       interface{}
+}
+
+// JWTSettings configures ActivateJWTAuth. Issuer and Audience are only checked
+// when set, ClockSkew is tolerated on exp, nbf and iat.
+type JWTSettings struct {
+	Keys        []JWTKey
+	Issuer      string
+	Audience    string
+	ClockSkew   time.Duration
+	LoginClaim  string
+	ScopesClaim string
+	RolesClaim  string
+	TenantClaim string
+}
+
+var (
+	ErrFailedAuthenticationJWT = errors.New("incorrect Token")
+	ErrJWTMalformed            = errors.New("malformed token")
+	ErrJWTSignature            = errors.New("invalid token signature")
+	ErrJWTUnknownKey           = errors.New("unknown token key")
+	ErrJWTExpired              = errors.New("token expired")
+	ErrJWTNotYetValid          = errors.New("token not yet valid")
+	ErrJWTClaims               = errors.New("invalid token claims")
+)
+
+func (tnppt *TNPPT) ActivateJWTAuth() gin.HandlerFunc {
+	return tnppt.activate(SchemeJWT)
+}
+
+func (tnppt *TNPPT) authenticateJWT() error {
+	token, err := bearerToken(tnppt.Request.Header.Get("Authorization"))
+	if err != nil {
+		return errors.New(ErrFailedPayload.Error() + " - " + err.Error())
+	}
+	claims, err := tnppt.JWT.Verify(token, time.Unix(0, tnppt.Security.TimeReceived*int64(time.Millisecond)))
+	if err != nil {
+		return errors.New(ErrFailedAuthenticationJWT.Error() + " - " + err.Error())
+	}
+	tnppt.Principal = tnppt.JWT.userInfo(claims)
+	return nil
+}
+
+func bearerToken(authorization string) (string, error) {
+	if authorization == "" {
+		return "", fmt.Errorf("[JWT] No payload detected")
+	}
+	parts := strings.SplitN(authorization, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || strings.TrimSpace(parts[1]) == "" {
+		return "", fmt.Errorf("[JWT] Incorrect Payload")
+	}
+	return strings.TrimSpace(parts[1]), nil
+}
+
+// Verify checks the signature and the registered claims of token at the given time.
+func (settings JWTSettings) Verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrJWTMalformed
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	key, err := settings.key(header.KeyID, header.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	signature, errDecode := base64.RawURLEncoding.DecodeString(parts[2])
+	if errDecode != nil {
+		return nil, ErrJWTMalformed
+	}
+	if err := verifyJWTSignature(key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := settings.validateClaims(claims, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (settings JWTSettings) key(keyID string, algorithm string) (JWTKey, error) {
+	for _, key := range settings.Keys {
+		if key.ID == keyID || (keyID == "" && len(settings.Keys) == 1) {
+			if key.Algorithm != algorithm {
+				return JWTKey{}, fmt.Errorf("%w: algorithm %q not allowed for this key", ErrJWTUnknownKey, algorithm)
+			}
+			return key, nil
+		}
+	}
+	return JWTKey{}, ErrJWTUnknownKey
+}
+
+func (settings JWTSettings) validateClaims(claims map[string]interface{}, now time.Time) error {
+	skew := int64(settings.ClockSkew / time.Second)
+	unixNow := now.Unix()
+	expiration, hasExpiration, err := numericClaim(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if !hasExpiration {
+		return fmt.Errorf("%w: exp is required", ErrJWTClaims)
+	}
+	if unixNow > expiration+skew {
+		return ErrJWTExpired
+	}
+	if notBefore, hasNotBefore, err := numericClaim(claims, "nbf"); err != nil {
+		return err
+	} else if hasNotBefore && unixNow < notBefore-skew {
+		return ErrJWTNotYetValid
+	}
+	if issuedAt, hasIssuedAt, err := numericClaim(claims, "iat"); err != nil {
+		return err
+	} else if hasIssuedAt && unixNow < issuedAt-skew {
+		return fmt.Errorf("%w: iat is in the future", ErrJWTClaims)
+	}
+	if settings.Issuer != "" && claims["iss"] != settings.Issuer {
+		return fmt.Errorf("%w: unexpected iss", ErrJWTClaims)
+	}
+	if settings.Audience != "" && !audienceContains(claims["aud"], settings.Audience) {
+		return fmt.Errorf("%w: unexpected aud", ErrJWTClaims)
+	}
+	return nil
+}
+
+func (settings JWTSettings) userInfo(claims map[string]interface{}) UserInfo {
+	loginClaim := settings.LoginClaim
+	if loginClaim == "" {
+		loginClaim = "sub"
+	}
+	scopesClaim := settings.ScopesClaim
+	if scopesClaim == "" {
+		scopesClaim = "scope"
+	}
+	rolesClaim := settings.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = "roles"
+	}
+	tenantClaim := settings.TenantClaim
+	if tenantClaim == "" {
+		tenantClaim = "tenant"
+	}
+	login, _ := claims[loginClaim].(string)
+	tenant, _ := claims[tenantClaim].(string)
+	user := UserInfo{
+		Login:  login,
+		Scopes: claimStrings(claims[scopesClaim]),
+		Roles:  claimStrings(claims[rolesClaim]),
+		Tenant: tenant,
+		Claims: claims,
+	}
+	if subject, isString := claims["sub"].(string); isString {
+		user.ID = subject
+	}
+	return user
+}
+
+// SignJWT issues a token for claims with a private key of the key set.
+func SignJWT(claims map[string]interface{}, key JWTKey) (string, error) {
+	header := map[string]string{"alg": key.Algorithm, "typ": "JWT"}
+	if key.ID != "" {
+		header["kid"] = key.ID
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	signature, err := signJWT(key, []byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func signJWT(key JWTKey, signingInput []byte) ([]byte, error) {
+	digest := sha256.Sum256(signingInput)
+	switch key.Algorithm {
+	case JWTAlgHS256:
+		secret, isSecret := key.Key.([]byte)
+		if !isSecret || len(secret) == 0 {
+			return nil, fmt.Errorf("TNPPT - JWT - %s needs a []byte key", key.Algorithm)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signingInput)
+		return mac.Sum(nil), nil
+	case JWTAlgRS256:
+		privateKey, isRSA := key.Key.(*rsa.PrivateKey)
+		if !isRSA {
+			return nil, fmt.Errorf("TNPPT - JWT - %s needs a *rsa.PrivateKey", key.Algorithm)
+		}
+		return rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	case JWTAlgES256:
+		privateKey, isECDSA := key.Key.(*ecdsa.PrivateKey)
+		if !isECDSA || privateKey.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("TNPPT - JWT - %s needs a P-256 *ecdsa.PrivateKey", key.Algorithm)
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, privateKey, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature, nil
+	case JWTAlgEdDSA:
+		privateKey, isEd25519 := key.Key.(ed25519.PrivateKey)
+		if !isEd25519 {
+			return nil, fmt.Errorf("TNPPT - JWT - %s needs an ed25519.PrivateKey", key.Algorithm)
+		}
+		return ed25519.Sign(privateKey, signingInput), nil
+	}
+	return nil, fmt.Errorf("TNPPT - JWT - unsupported algorithm %q", key.Algorithm)
+}
+
+func verifyJWTSignature(key JWTKey, signingInput []byte, signature []byte) error {
+	digest := sha256.Sum256(signingInput)
+	valid := false
+	switch key.Algorithm {
+	case JWTAlgHS256:
+		if secret, isSecret := key.Key.([]byte); isSecret && len(secret) > 0 {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(signingInput)
+			valid = hmac.Equal(mac.Sum(nil), signature)
+		}
+	case JWTAlgRS256:
+		var publicKey *rsa.PublicKey
+		switch rsaKey := key.Key.(type) {
+		case *rsa.PublicKey:
+			publicKey = rsaKey
+		case *rsa.PrivateKey:
+			publicKey = &rsaKey.PublicKey
+		}
+		valid = publicKey != nil && rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil
+	case JWTAlgES256:
+		var publicKey *ecdsa.PublicKey
+		switch ecdsaKey := key.Key.(type) {
+		case *ecdsa.PublicKey:
+			publicKey = ecdsaKey
+		case *ecdsa.PrivateKey:
+			publicKey = &ecdsaKey.PublicKey
+		}
+		if publicKey != nil && publicKey.Curve == elliptic.P256() && len(signature) == 64 {
+			r := new(big.Int).SetBytes(signature[:32])
+			s := new(big.Int).SetBytes(signature[32:])
+			valid = ecdsa.Verify(publicKey, digest[:], r, s)
+		}
+	case JWTAlgEdDSA:
+		var publicKey ed25519.PublicKey
+		switch edKey := key.Key.(type) {
+		case ed25519.PublicKey:
+			publicKey = edKey
+		case ed25519.PrivateKey:
+			publicKey = edKey.Public().(ed25519.PublicKey)
+		}
+		valid = len(publicKey) == ed25519.PublicKeySize && ed25519.Verify(publicKey, signingInput, signature)
+	}
+	if !valid {
+		return ErrJWTSignature
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, target interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return ErrJWTMalformed
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(target); err != nil {
+		return ErrJWTMalformed
+	}
+	return nil
+}
+
+func numericClaim(claims map[string]interface{}, name string) (int64, bool, error) {
+	value, exists := claims[name]
+	if !exists {
+		return 0, false, nil
+	}
+	number, isNumber := value.(json.Number)
+	if !isNumber {
+		return 0, false, fmt.Errorf("%w: %s must be a number", ErrJWTClaims, name)
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return 0, false, fmt.Errorf("%w: %s must be a number", ErrJWTClaims, name)
+	}
+	return int64(seconds), true, nil
+}
+
+func audienceContains(audience interface{}, expected string) bool {
+	if single, isString := audience.(string); isString {
+		return single == expected
+	}
+	for _, value := range claimStrings(audience) {
+		if value == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// claimStrings reads a space separated string or an array of strings.
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		var result []string
+		for _, item := range value {
+			if text, isString := item.(string); isString {
+				result = append(result, text)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+func (key JWTKey) validate() error {
+	var valid bool
+	switch key.Algorithm {
+	case JWTAlgHS256:
+		secret, isSecret := key.Key.([]byte)
+		valid = isSecret && len(secret) > 0
+	case JWTAlgRS256:
+		switch key.Key.(type) {
+		case *rsa.PublicKey, *rsa.PrivateKey:
+			valid = true
+		}
+	case JWTAlgES256:
+		switch ecdsaKey := key.Key.(type) {
+		case *ecdsa.PublicKey:
+			valid = ecdsaKey.Curve == elliptic.P256()
+		case *ecdsa.PrivateKey:
+			valid = ecdsaKey.Curve == elliptic.P256()
+		}
+	case JWTAlgEdDSA:
+		switch key.Key.(type) {
+		case ed25519.PublicKey, ed25519.PrivateKey:
+			valid = true
+		}
+	default:
+		return fmt.Errorf("TNPPT - JWT - unsupported algorithm %q for key %q", key.Algorithm, key.ID)
+	}
+	if !valid {
+		return fmt.Errorf("TNPPT - JWT - key %q does not match algorithm %s", key.ID, key.Algorithm)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package tnpptMiddleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func testJWTKeys(t *testing.T) []JWTKey {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []JWTKey{
+		{ID: "hs", Algorithm: JWTAlgHS256, Key: []byte("shared-secret")},
+		{ID: "rs", Algorithm: JWTAlgRS256, Key: rsaKey},
+		{ID: "es", Algorithm: JWTAlgES256, Key: ecdsaKey},
+		{ID: "ed", Algorithm: JWTAlgEdDSA, Key: edKey},
+	}
+}
+
+func TestJWTSettings_Verify(t *testing.T) {
+	keys := testJWTKeys(t)
+	settings := JWTSettings{
+		Keys:      keys,
+		Issuer:    "https://idp.example.com",
+		Audience:  "logs-api",
+		ClockSkew: 30 * time.Second,
+	}
+	now := time.Now()
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"sub":   "steven",
+			"iss":   "https://idp.example.com",
+			"aud":   []string{"other-api", "logs-api"},
+			"exp":   now.Add(time.Minute).Unix(),
+			"nbf":   now.Add(-time.Minute).Unix(),
+			"iat":   now.Unix(),
+			"scope": "logs:read logs:write",
+		}
+	}
+	for _, key := range keys {
+		t.Run(key.Algorithm, func(t *testing.T) {
+			token, err := SignJWT(validClaims(), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := settings.Verify(token, now)
+			assert.NoError(t, err)
+			user := settings.userInfo(claims)
+			assert.Equal(t, "steven", user.Login)
+			assert.Equal(t, "steven", user.ID)
+			assert.Equal(t, []string{"logs:read", "logs:write"}, user.Scopes)
+
+			parts := strings.Split(token, ".")
+			tampered, _ := SignJWT(map[string]interface{}{"sub": "admin", "exp": now.Add(time.Minute).Unix()}, key)
+			_, err = settings.Verify(parts[0]+"."+strings.Split(tampered, ".")[1]+"."+parts[2], now)
+			assert.True(t, errors.Is(err, ErrJWTSignature), err)
+		})
+	}
+
+	tests := []struct {
+		name    string
+		claims  func(claims map[string]interface{})
+		key     JWTKey
+		wantErr error
+	}{
+		{name: "expired", claims: func(c map[string]interface{}) { c["exp"] = now.Add(-time.Minute).Unix() }, wantErr: ErrJWTExpired},
+		{name: "expired-within-skew", claims: func(c map[string]interface{}) { c["exp"] = now.Add(-10 * time.Second).Unix() }},
+		{name: "missing-exp", claims: func(c map[string]interface{}) { delete(c, "exp") }, wantErr: ErrJWTClaims},
+		{name: "not-yet-valid", claims: func(c map[string]interface{}) { c["nbf"] = now.Add(time.Minute).Unix() }, wantErr: ErrJWTNotYetValid},
+		{name: "nbf-within-skew", claims: func(c map[string]interface{}) { c["nbf"] = now.Add(10 * time.Second).Unix() }},
+		{name: "iat-in-future", claims: func(c map[string]interface{}) { c["iat"] = now.Add(time.Minute).Unix() }, wantErr: ErrJWTClaims},
+		{name: "wrong-issuer", claims: func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, wantErr: ErrJWTClaims},
+		{name: "wrong-audience", claims: func(c map[string]interface{}) { c["aud"] = "other-api" }, wantErr: ErrJWTClaims},
+		{name: "single-audience", claims: func(c map[string]interface{}) { c["aud"] = "logs-api" }},
+		{name: "exp-not-a-number", claims: func(c map[string]interface{}) { c["exp"] = "tomorrow" }, wantErr: ErrJWTClaims},
+		{name: "unknown-kid", key: JWTKey{ID: "other", Algorithm: JWTAlgHS256, Key: []byte("shared-secret")}, wantErr: ErrJWTUnknownKey},
+		{name: "algorithm-confusion", key: JWTKey{ID: "rs", Algorithm: JWTAlgHS256, Key: []byte("shared-secret")}, wantErr: ErrJWTUnknownKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			if tt.claims != nil {
+				tt.claims(claims)
+			}
+			key := tt.key
+			if key.Algorithm == "" {
+				key = keys[0]
+			}
+			token, err := SignJWT(claims, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = settings.Verify(token, now)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, tt.wantErr), err)
+		})
+	}
+
+	for _, token := range []string{"", "a.b", "a.b.c", "!!.e30.sig"} {
+		_, err := settings.Verify(token, now)
+		assert.Error(t, err, token)
+	}
+}
+
+func TestTNPPT_ActivateJWTAuth(t *testing.T) {
+	key := testJWTKeys(t)[3]
+	auth, err := New(&TNPPT{JWT: JWTSettings{Keys: []JWTKey{key}, LoginClaim: "email", ScopesClaim: "scp"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	var user UserInfo
+	router.GET("/me", auth.ActivateJWTAuth(), func(c *gin.Context) {
+		user = principal(c)
+		c.String(200, user.Login)
+	})
+	token, err := SignJWT(map[string]interface{}{
+		"sub":   "42",
+		"email": "s.leclerc@example.com",
+		"scp":   []string{"logs:read"},
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{name: "valid", authorization: "Bearer " + token, want: 200},
+		{name: "missing", authorization: "", want: 401},
+		{name: "wrong-scheme", authorization: "Basic " + token, want: 401},
+		{name: "garbage", authorization: "Bearer garbage", want: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/me", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.want, w.Code)
+			if tt.want == 200 {
+				assert.Equal(t, "s.leclerc@example.com", w.Body.String())
+				assert.Equal(t, "42", user.ID)
+				assert.Equal(t, []string{"logs:read"}, user.Scopes)
+			}
+		})
+	}
+}
+
+func TestTNPPT_InitJWTKeys(t *testing.T) {
+	_, err := New(&TNPPT{JWT: JWTSettings{Keys: []JWTKey{{ID: "rs", Algorithm: JWTAlgRS256, Key: []byte("secret")}}}})
+	assert.Error(t, err)
+	_, err = New(&TNPPT{JWT: JWTSettings{Keys: []JWTKey{{ID: "none", Algorithm: "none"}}}})
+	assert.Error(t, err)
+}
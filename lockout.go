@@ -0,0 +1,351 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LockoutSettings slows down the guessing of credentials. Once a login (per
+// tenant) reaches LoginThreshold failures, or a client IP IPThreshold, it is
+// locked for BaseDelay, doubled on every further failure up to MaxDelay.
+// Failures are forgotten Window after the last one, and those of a login on
+// its next success. Locked requests are answered 429 with Retry-After.
+// A threshold of 0 disables its counter. ClientIP defaults to the address of
+// the connection, set it when behind a trusted proxy.
+// Instances behind a load balancer need a shared Store.
+type LockoutSettings struct {
+	LoginThreshold int
+	IPThreshold    int
+	BaseDelay      time.Duration
+	MaxDelay       time.Duration
+	Window         time.Duration
+	ClientIP       func(request *http.Request) string
+	Store          LockoutStore
+}
+
+// LockoutStore keeps the failure counters and the locks.
+type LockoutStore interface {
+	// Fail counts a failure of key at now and returns the failures counted,
+	// the count restarts once window elapsed since the last failure.
+	Fail(ctx context.Context, key string, now time.Time, window time.Duration) (int, error)
+	Lock(ctx context.Context, key string, until time.Time) error
+	// LockedUntil returns the end of the lock of key, zero when there is none.
+	LockedUntil(ctx context.Context, key string) (time.Time, error)
+	// Reset removes the failures and the lock of key.
+	Reset(ctx context.Context, key string) error
+}
+
+var ErrLockedOut = errors.New("too many failed attempts, try again later")
+
+// credentialsErrors are the rejections of guessable credentials.
+var credentialsErrors = []error{
+	ErrFailedAuthenticationHMAC,
+	ErrFailedAuthenticationAPIKEY,
+	ErrFailedAuthenticationBasic,
+	ErrFailedAuthenticationChallenge,
+	ErrFailedAuthenticationDigest,
+	ErrFailedAuthenticationSCRAM,
+}
+
+// credentialsFailure reports whether err rejects the credentials themselves,
+// rather than their format or freshness: the payload was read.
+func credentialsFailure(err error) bool {
+	for _, credentialsError := range credentialsErrors {
+		if errors.Is(err, credentialsError) {
+			return true
+		}
+	}
+	return false
+}
+
+func (settings LockoutSettings) enabled() bool {
+	return settings.LoginThreshold > 0 || settings.IPThreshold > 0
+}
+
+func (settings *LockoutSettings) init() error {
+	if settings.LoginThreshold < 0 || settings.IPThreshold < 0 {
+		return errors.New("TNPPT - Lockout - Thresholds can not be negative")
+	}
+	if !settings.enabled() {
+		return nil
+	}
+	if settings.BaseDelay == 0 {
+		settings.BaseDelay = time.Second
+	}
+	if settings.MaxDelay == 0 {
+		settings.MaxDelay = 15 * time.Minute
+	}
+	if settings.Window == 0 {
+		settings.Window = 15 * time.Minute
+	}
+	if settings.MaxDelay < settings.BaseDelay {
+		return errors.New("TNPPT - Lockout - MaxDelay is shorter than BaseDelay")
+	}
+	if settings.ClientIP == nil {
+		settings.ClientIP = remoteIP
+	}
+	if settings.Store == nil {
+		settings.Store = NewMemoryLockoutStore()
+	}
+	return nil
+}
+
+// delay is the lock of the failures-th failure.
+func (settings LockoutSettings) delay(failures int, threshold int) time.Duration {
+	exponent := failures - threshold
+	if exponent > 30 {
+		return settings.MaxDelay
+	}
+	delay := settings.BaseDelay * time.Duration(1<<uint(exponent))
+	if delay > settings.MaxDelay || delay <= 0 {
+		return settings.MaxDelay
+	}
+	return delay
+}
+
+func remoteIP(request *http.Request) string {
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		return host
+	}
+	return request.RemoteAddr
+}
+
+func lockoutIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+func lockoutLoginKey(tenant string, login string) string {
+	return "login:" + tenant + "/" + login
+}
+
+func lockoutTOTPKey(tenant string, login string) string {
+	return "totp:" + tenant + "/" + login
+}
+
+// checkClientLockout answers 429 to a locked client IP before any authentication.
+func (tnppt *TNPPT) checkClientLockout(header http.Header) error {
+	if tnppt.Lockout.IPThreshold == 0 {
+		return nil
+	}
+	return tnppt.checkLocked(tnppt.Request, header, lockoutIPKey(tnppt.Lockout.ClientIP(tnppt.Request)))
+}
+
+func (tnppt *TNPPT) checkLocked(request *http.Request, header http.Header, key string) error {
+	until, err := tnppt.Lockout.Store.LockedUntil(request.Context(), key)
+	if err != nil {
+		tnppt.logError(request, "lockout lookup failed", err)
+		return nil
+	}
+	if wait := time.Until(until); wait > 0 {
+		header.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return &AuthenticationError{StatusCode: http.StatusTooManyRequests, Err: ErrLockedOut}
+	}
+	return nil
+}
+
+// checkLoginLockout answers 429 to a locked login before its credentials are
+// looked up and compared: even the right ones, so that the lock tells nothing.
+func (tnppt *TNPPT) checkLoginLockout() error {
+	if tnppt.Lockout.LoginThreshold == 0 {
+		return nil
+	}
+	login := tnppt.attemptedLogin()
+	if login == "" {
+		return nil
+	}
+	return tnppt.checkLocked(tnppt.Request, tnppt.header, lockoutLoginKey(tnppt.tenant, login))
+}
+
+// lockout counts the outcome err of an authentication, the locked logins were
+// rejected by checkLoginLockout.
+func (tnppt *TNPPT) lockout(err error) error {
+	if !tnppt.Lockout.enabled() {
+		return err
+	}
+	if err != nil && !credentialsFailure(err) {
+		return err
+	}
+	ctx := tnppt.Request.Context()
+	loginKey := ""
+	if login := tnppt.attemptedLogin(); login != "" && tnppt.Lockout.LoginThreshold > 0 {
+		loginKey = lockoutLoginKey(tnppt.tenant, login)
+	}
+	if err == nil {
+		if loginKey != "" {
+			if errReset := tnppt.Lockout.Store.Reset(ctx, loginKey); errReset != nil {
+				tnppt.logError(tnppt.Request, "lockout reset failed", errReset)
+			}
+		}
+		return nil
+	}
+	now := time.Now()
+	if tnppt.Lockout.IPThreshold > 0 {
+		tnppt.countFailure(tnppt.Request, lockoutIPKey(tnppt.Lockout.ClientIP(tnppt.Request)), tnppt.Lockout.IPThreshold, now)
+	}
+	if loginKey != "" {
+		tnppt.countFailure(tnppt.Request, loginKey, tnppt.Lockout.LoginThreshold, now)
+	}
+	return err
+}
+
+func (tnppt *TNPPT) countFailure(request *http.Request, key string, threshold int, now time.Time) {
+	ctx := request.Context()
+	failures, err := tnppt.Lockout.Store.Fail(ctx, key, now, tnppt.Lockout.Window)
+	if err != nil {
+		tnppt.logError(request, "lockout count failed", err)
+		return
+	}
+	if failures < threshold {
+		return
+	}
+	until := now.Add(tnppt.Lockout.delay(failures, threshold))
+	if err := tnppt.Lockout.Store.Lock(ctx, key, until); err != nil {
+		tnppt.logError(request, "lockout lock failed", err)
+	}
+}
+
+// attemptedLogin is the login of the credentials just checked, API keys have none.
+func (tnppt *TNPPT) attemptedLogin() string {
+	switch tnppt.scheme {
+	case SchemeHMAC:
+		return tnppt.PayloadHMAC.Login
+	case SchemeBasic:
+		return tnppt.PayloadBasic.Login
+	case SchemeDigest:
+		return tnppt.PayloadDigest.Login
+	case SchemeChallenge:
+		return tnppt.PayloadChallenge.Login
+	case SchemeSCRAM:
+		return tnppt.PayloadSCRAM.Login
+	}
+	return ""
+}
+
+// Unlock removes the failures and the locks of the login of tenant ("" without
+// tenancy), its TOTP included, when login is set, and of the client ip when set.
+func (tnppt *TNPPT) Unlock(ctx context.Context, tenant string, login string, ip string) error {
+	if !tnppt.Lockout.enabled() {
+		return nil
+	}
+	if login != "" {
+		if err := tnppt.Lockout.Store.Reset(ctx, lockoutLoginKey(tenant, login)); err != nil {
+			return err
+		}
+		if err := tnppt.Lockout.Store.Reset(ctx, lockoutTOTPKey(tenant, login)); err != nil {
+			return err
+		}
+	}
+	if ip != "" {
+		return tnppt.Lockout.Store.Reset(ctx, lockoutIPKey(ip))
+	}
+	return nil
+}
+
+// UnlockRequest is the body of UnlockHandler.
+type UnlockRequest struct {
+	Tenant string `json:"tenant"`
+	Login  string `json:"login"`
+	IP     string `json:"ip"`
+}
+
+// UnlockHandler is the admin endpoint calling Unlock, to be mounted behind
+// the administrators authentication:
+//
+//	admin.POST("/unlock", auth.UnlockHandler())
+func (tnppt *TNPPT) UnlockHandler() gin.HandlerFunc {
+	return func(ginEngine *gin.Context) {
+		var request UnlockRequest
+		if err := json.NewDecoder(ginEngine.Request.Body).Decode(&request); err != nil || (request.Login == "" && request.IP == "") {
+			tnppt.sendError(ginEngine, http.StatusBadRequest, errors.New("[LOCKOUT] login or ip is required"))
+			return
+		}
+		if err := tnppt.Unlock(ginEngine.Request.Context(), request.Tenant, request.Login, request.IP); err != nil {
+			tnppt.logError(ginEngine.Request, "unlock failed", err)
+			tnppt.sendError(ginEngine, http.StatusInternalServerError, errors.New("[LOCKOUT] unlock failed"))
+			return
+		}
+		ginEngine.Status(http.StatusNoContent)
+	}
+}
+
+// MemoryLockoutStore is a LockoutStore for a single instance.
+type MemoryLockoutStore struct {
+	mu        sync.Mutex
+	entries   map[string]memoryLockout
+	lastSweep time.Time
+}
+
+type memoryLockout struct {
+	failures    int
+	lastFailure time.Time
+	expiresAt   time.Time
+	lockedUntil time.Time
+}
+
+func NewMemoryLockoutStore() *MemoryLockoutStore {
+	return &MemoryLockoutStore{entries: map[string]memoryLockout{}}
+}
+
+func (store *MemoryLockoutStore) Fail(ctx context.Context, key string, now time.Time, window time.Duration) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.sweep(now)
+	entry := store.entries[key]
+	if now.Sub(entry.lastFailure) >= window {
+		entry.failures = 0
+	}
+	entry.failures++
+	entry.lastFailure = now
+	if expiresAt := now.Add(window); expiresAt.After(entry.expiresAt) {
+		entry.expiresAt = expiresAt
+	}
+	store.entries[key] = entry
+	return entry.failures, nil
+}
+
+func (store *MemoryLockoutStore) Lock(ctx context.Context, key string, until time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	entry := store.entries[key]
+	entry.lockedUntil = until
+	if until.After(entry.expiresAt) {
+		entry.expiresAt = until
+	}
+	store.entries[key] = entry
+	return nil
+}
+
+func (store *MemoryLockoutStore) LockedUntil(ctx context.Context, key string) (time.Time, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.entries[key].lockedUntil, nil
+}
+
+func (store *MemoryLockoutStore) Reset(ctx context.Context, key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.entries, key)
+	return nil
+}
+
+// sweep drops the expired entries, at most once a minute.
+func (store *MemoryLockoutStore) sweep(now time.Time) {
+	if now.Sub(store.lastSweep) < time.Minute {
+		return
+	}
+	store.lastSweep = now
+	for key, entry := range store.entries {
+		if now.After(entry.expiresAt) {
+			delete(store.entries, key)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTNPPT_Lockout(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{
+		Users:   []UserRecord{{Login: "steven", Password: "pass"}, {Login: "alice", Password: "pass"}},
+		APIKeys: []APIKeyRecord{{Login: "collector", Key: "collector-key"}},
+	})
+	auth, err := New(&TNPPT{
+		Store:   store,
+		Lockout: LockoutSettings{LoginThreshold: 2, IPThreshold: 4, BaseDelay: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/log", auth.ActivateAny(SchemeHMAC, SchemeAPIKey), func(c *gin.Context) {
+		c.String(200, principal(c).Login)
+	})
+	router.POST("/unlock", auth.UnlockHandler())
+
+	fromIP := func(req *http.Request, ip string) *http.Request {
+		req.RemoteAddr = ip + ":40000"
+		return req
+	}
+	apiKeyRequest := func(key string, ip string) *http.Request {
+		req, _ := http.NewRequest("POST", "/log", nil)
+		req.Header.Set("API_KEY", key)
+		return fromIP(req, ip)
+	}
+	unlockRequest := func(body string) *http.Request {
+		req, _ := http.NewRequest("POST", "/unlock", strings.NewReader(body))
+		return req
+	}
+	tests := []struct {
+		name           string
+		req            *http.Request
+		wantCode       int
+		wantRetryAfter string
+	}{
+		{name: "first-failure", req: fromIP(hmacLoginRequest(t, auth, "/log", "steven", "wrong"), "10.0.0.1"), wantCode: 401},
+		{name: "success-resets", req: fromIP(hmacLoginRequest(t, auth, "/log", "steven", "pass"), "10.0.0.1"), wantCode: 200},
+		{name: "failure-after-reset", req: fromIP(hmacLoginRequest(t, auth, "/log", "steven", "wrong"), "10.0.0.2"), wantCode: 401},
+		{name: "threshold-locks", req: fromIP(hmacLoginRequest(t, auth, "/log", "steven", "wrong"), "10.0.0.3"), wantCode: 401},
+		{name: "locked-with-right-password", req: fromIP(hmacLoginRequest(t, auth, "/log", "steven", "pass"), "10.0.0.4"), wantCode: 429, wantRetryAfter: "60"},
+		{name: "other-login", req: fromIP(hmacLoginRequest(t, auth, "/log", "alice", "pass"), "10.0.0.4"), wantCode: 200},
+		{name: "unlock-without-target", req: unlockRequest(`{"tenant":"acme"}`), wantCode: 400},
+		{name: "unlock-login", req: unlockRequest(`{"login":"steven"}`), wantCode: 204},
+		{name: "unlocked", req: fromIP(hmacLoginRequest(t, auth, "/log", "steven", "pass"), "10.0.0.4"), wantCode: 200},
+		{name: "ip-failure-1", req: apiKeyRequest("wrong-1", "10.0.0.9"), wantCode: 401},
+		{name: "ip-failure-2", req: apiKeyRequest("wrong-2", "10.0.0.9"), wantCode: 401},
+		{name: "ip-failure-3", req: apiKeyRequest("wrong-3", "10.0.0.9"), wantCode: 401},
+		{name: "ip-threshold-locks", req: apiKeyRequest("wrong-4", "10.0.0.9"), wantCode: 401},
+		{name: "ip-locked", req: apiKeyRequest("collector-key", "10.0.0.9"), wantCode: 429, wantRetryAfter: "60"},
+		{name: "ip-locked-missing-payload", req: fromIP(httptest.NewRequest("POST", "/log", nil), "10.0.0.9"), wantCode: 429, wantRetryAfter: "60"},
+		{name: "other-ip", req: apiKeyRequest("collector-key", "10.0.0.10"), wantCode: 200},
+		{name: "unlock-ip", req: unlockRequest(`{"ip":"10.0.0.9"}`), wantCode: 204},
+		{name: "ip-unlocked", req: apiKeyRequest("collector-key", "10.0.0.9"), wantCode: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, tt.req)
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Equal(t, tt.wantRetryAfter, w.Header().Get("Retry-After"))
+			if tt.wantCode == 429 {
+				assert.Contains(t, w.Body.String(), ErrLockedOut.Error())
+			}
+		})
+	}
+}
+
+func TestTNPPT_LockoutPayloadErrorsNotCounted(t *testing.T) {
+	auth, err := New(&TNPPT{
+		Store:   newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "steven", Password: "pass"}}}),
+		Lockout: LockoutSettings{LoginThreshold: 1, IPThreshold: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("POST", "/log", nil)
+		req.RemoteAddr = "10.0.0.1:40000"
+		req.Header.Set("HMAC_LOGIN", "steven")
+		_, err := auth.Verifier(SchemeHMAC).Verify(req, http.Header{})
+		assert.True(t, err != nil && !strings.Contains(err.Error(), ErrLockedOut.Error()))
+	}
+	req := hmacLoginRequest(t, auth, "/log", "steven", "pass")
+	req.RemoteAddr = "10.0.0.1:40000"
+	_, err = auth.Verifier(SchemeHMAC).Verify(req, http.Header{})
+	assert.NoError(t, err)
+}
+
+func TestTNPPT_LockoutBeforeCredentialsLookup(t *testing.T) {
+	lookups := 0
+	auth, err := New(&TNPPT{
+		Store: newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "steven", Password: "pass"}}}),
+		IsCredentialsValid: func(tnppt *TNPPT) bool {
+			lookups++
+			return storeCredentialsValid(tnppt)
+		},
+		Lockout: LockoutSettings{LoginThreshold: 1, BaseDelay: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		password       string
+		wantStatus     int
+		wantLookups    int
+		wantRetryAfter string
+	}{
+		{name: "failure-locks", password: "wrong", wantStatus: 401, wantLookups: 1},
+		{name: "locked-right-password", password: "pass", wantStatus: 429, wantLookups: 1, wantRetryAfter: "60"},
+		{name: "locked-wrong-password", password: "wrong", wantStatus: 429, wantLookups: 1, wantRetryAfter: "60"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			_, err := auth.Verifier(SchemeHMAC).Verify(hmacLoginRequest(t, auth, "/log", "steven", tt.password), header)
+			assert.Equal(t, tt.wantStatus, asAuthenticationError(err).StatusCode)
+			assert.Equal(t, tt.wantLookups, lookups)
+			assert.Equal(t, tt.wantRetryAfter, header.Get("Retry-After"))
+		})
+	}
+}
+
+func TestLockoutSettings_Delay(t *testing.T) {
+	settings := LockoutSettings{LoginThreshold: 3}
+	assert.NoError(t, settings.init())
+	tests := []struct {
+		failures  int
+		wantDelay time.Duration
+	}{
+		{failures: 3, wantDelay: time.Second},
+		{failures: 4, wantDelay: 2 * time.Second},
+		{failures: 6, wantDelay: 8 * time.Second},
+		{failures: 12, wantDelay: 512 * time.Second},
+		{failures: 13, wantDelay: 15 * time.Minute},
+		{failures: 200, wantDelay: 15 * time.Minute},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.wantDelay, settings.delay(tt.failures, settings.LoginThreshold), tt.failures)
+	}
+}
+
+func TestLockoutSettings_Init(t *testing.T) {
+	disabled := LockoutSettings{}
+	assert.NoError(t, disabled.init())
+	assert.Nil(t, disabled.Store)
+	assert.Error(t, (&LockoutSettings{LoginThreshold: -1}).init())
+	assert.Error(t, (&LockoutSettings{IPThreshold: 1, BaseDelay: time.Hour, MaxDelay: time.Minute}).init())
+}
+
+func TestMemoryLockoutStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryLockoutStore()
+	now := time.Now()
+	window := time.Minute
+
+	failures, _ := store.Fail(ctx, "login:/steven", now, window)
+	assert.Equal(t, 1, failures)
+	failures, _ = store.Fail(ctx, "login:/steven", now.Add(30*time.Second), window)
+	assert.Equal(t, 2, failures)
+	failures, _ = store.Fail(ctx, "login:/steven", now.Add(2*time.Minute), window)
+	assert.Equal(t, 1, failures, "the window elapsed")
+
+	until := now.Add(time.Hour)
+	assert.NoError(t, store.Lock(ctx, "login:/steven", until))
+	lockedUntil, _ := store.LockedUntil(ctx, "login:/steven")
+	assert.Equal(t, until, lockedUntil)
+	lockedUntil, _ = store.LockedUntil(ctx, "login:/alice")
+	assert.True(t, lockedUntil.IsZero())
+
+	_, _ = store.Fail(ctx, "ip:10.0.0.1", now, window)
+	_, _ = store.Fail(ctx, "ip:10.0.0.2", now.Add(10*time.Minute), window)
+	assert.Len(t, store.entries, 2, "the expired ip entry is swept, the locked login kept")
+
+	assert.NoError(t, store.Reset(ctx, "login:/steven"))
+	lockedUntil, _ = store.LockedUntil(ctx, "login:/steven")
+	assert.True(t, lockedUntil.IsZero())
+}
@@ -0,0 +1,275 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// LoggerSettings sends the authentication events to Handler (the one of
+// slog.Default when nil) from Level (slog.LevelInfo): successes at Info,
+// failures at Warn, server errors at Error and the failure details at Debug.
+// The records carry the scheme, login, key_id, client_ip (see
+// LockoutSettings.ClientIP), request_id (RequestIDHeader, default
+// X-Request-ID), reason and latency.
+// Secrets never reach Handler: the attributes named after a secret (password,
+// hash, api_key, token...) are replaced by [REDACTED], as are the credentials
+// of the request, authorization headers and hex digests found in any text.
+type LoggerSettings struct {
+	Handler         slog.Handler
+	Level           slog.Leveler
+	RequestIDHeader string
+
+	logger *slog.Logger
+}
+
+const redacted = "[REDACTED]"
+
+var (
+	authorizationRegex = regexp.MustCompile(`(?i)\b(basic|bearer|digest|scram-sha-256)\s+[^\s"]+`)
+	hexDigestRegex     = regexp.MustCompile(`\b[0-9a-fA-F]{32,}\b`)
+	secretKeyParts     = []string{"password", "passwd", "secret", "hash", "apikey", "token", "authorization", "cookie", "signature", "otp"}
+)
+
+type logSecretsContextKey struct{}
+
+func (settings *LoggerSettings) init() {
+	if settings.Level == nil {
+		settings.Level = slog.LevelInfo
+	}
+	if settings.Handler == nil {
+		settings.Handler = slog.Default().Handler()
+	}
+	if settings.RequestIDHeader == "" {
+		settings.RequestIDHeader = "X-Request-ID"
+	}
+	settings.logger = slog.New(&redactingHandler{next: settings.Handler, level: settings.Level})
+}
+
+// get returns the logger, one with the defaults when Init was not called.
+func (settings *LoggerSettings) get() *slog.Logger {
+	if settings.logger == nil {
+		defaults := *settings
+		defaults.init()
+		return defaults.logger
+	}
+	return settings.logger
+}
+
+// logContext is the context of the log records of request, it lists the
+// credentials of the request to redact.
+func logContext(request *http.Request) context.Context {
+	if request == nil {
+		return context.Background()
+	}
+	secrets := []string{request.Header.Get("HMAC_HASH"), request.Header.Get("API_KEY")}
+	if authorization := request.Header.Get("Authorization"); authorization != "" {
+		secrets = append(secrets, authorization)
+		if _, credentials, found := strings.Cut(authorization, " "); found {
+			secrets = append(secrets, strings.TrimSpace(credentials))
+		}
+	}
+	if _, password, found := request.BasicAuth(); found {
+		secrets = append(secrets, password)
+	}
+	return context.WithValue(request.Context(), logSecretsContextKey{}, secrets)
+}
+
+// logDebug records a detail of the authentication of the current request.
+func (tnppt *TNPPT) logDebug(message string, args ...any) {
+	tnppt.Logger.get().DebugContext(logContext(tnppt.Request), message, args...)
+}
+
+// logError records the server side failure err met on request (nil outside of
+// a request).
+func (tnppt *TNPPT) logError(request *http.Request, message string, err error) {
+	attrs := append(tnppt.requestAttrs(request), slog.String("error", err.Error()))
+	tnppt.Logger.get().LogAttrs(logContext(request), slog.LevelError, message, attrs...)
+}
+
+// loggerOrDefault is logger, or the redacting logger of slog.Default when nil,
+// for the components living outside of a TNPPT.
+func loggerOrDefault(logger *slog.Logger) *slog.Logger {
+	if logger != nil {
+		return logger
+	}
+	return (&LoggerSettings{}).get()
+}
+
+// logAuthentication records the outcome err of the authentication of the current request.
+func (tnppt *TNPPT) logAuthentication(err error, latency time.Duration) {
+	level, message := slog.LevelInfo, "authentication succeeded"
+	if err != nil {
+		level, message = slog.LevelWarn, "authentication failed"
+		if challenged(err) {
+			level, message = slog.LevelDebug, "authentication challenged"
+		} else if asAuthenticationError(err).StatusCode >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+	}
+	ctx := logContext(tnppt.Request)
+	logger := tnppt.Logger.get()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	attrs := []slog.Attr{slog.String("scheme", tnppt.scheme)}
+	if err == nil || credentialsFailure(err) || challenged(err) {
+		login := tnppt.Principal.Login
+		if err != nil {
+			login = tnppt.attemptedLogin()
+		}
+		attrs = append(attrs, slog.String("login", login))
+		if keyID := tnppt.keyID(); keyID != "" {
+			attrs = append(attrs, slog.String("key_id", keyID))
+		}
+	}
+	if tnppt.tenant != "" {
+		attrs = append(attrs, slog.String("tenant", tnppt.tenant))
+	}
+	attrs = append(attrs, tnppt.requestAttrs(tnppt.Request)...)
+	if err != nil {
+		attrs = append(attrs, slog.String("reason", err.Error()))
+	}
+	attrs = append(attrs, slog.Duration("latency", latency))
+	logger.LogAttrs(ctx, level, message, attrs...)
+}
+
+// logRejection records the answer statusCode to request of sendError, the
+// server errors at Error and the others at Debug.
+func (tnppt *TNPPT) logRejection(request *http.Request, statusCode int, err error) {
+	level := slog.LevelDebug
+	if statusCode >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	attrs := append([]slog.Attr{slog.Int("status", statusCode)}, tnppt.requestAttrs(request)...)
+	attrs = append(attrs, slog.String("reason", err.Error()))
+	tnppt.Logger.get().LogAttrs(logContext(request), level, "request rejected", attrs...)
+}
+
+func (tnppt *TNPPT) requestAttrs(request *http.Request) []slog.Attr {
+	if request == nil {
+		return nil
+	}
+	attrs := []slog.Attr{slog.String("client_ip", tnppt.clientIP(request))}
+	if requestID := request.Header.Get(tnppt.Logger.RequestIDHeader); tnppt.Logger.RequestIDHeader != "" && requestID != "" {
+		attrs = append(attrs, slog.String("request_id", requestID))
+	}
+	return attrs
+}
+
+func (tnppt *TNPPT) clientIP(request *http.Request) string {
+	if tnppt.Lockout.ClientIP != nil {
+		return tnppt.Lockout.ClientIP(request)
+	}
+	return remoteIP(request)
+}
+
+// keyID identifies the key used without revealing it: the fingerprint of an
+// API key, the kid of a JWT.
+func (tnppt *TNPPT) keyID() string {
+	switch tnppt.scheme {
+	case SchemeAPIKey:
+		if tnppt.PayloadAPIKey.APIKey == "" {
+			return ""
+		}
+		sum := sha256.Sum256([]byte(tnppt.PayloadAPIKey.APIKey))
+		return "sha256:" + hex.EncodeToString(sum[:6])
+	case SchemeJWT, SchemeToken:
+		token := strings.TrimSpace(tnppt.Request.Header.Get("Authorization"))
+		if len(token) < 7 || !strings.EqualFold(token[:7], "bearer ") {
+			return ""
+		}
+		var header struct {
+			KeyID string `json:"kid"`
+		}
+		if err := decodeJWTPart(strings.SplitN(strings.TrimSpace(token[7:]), ".", 2)[0], &header); err != nil {
+			return ""
+		}
+		return header.KeyID
+	}
+	return ""
+}
+
+// redactingHandler removes the secrets of the records before next.
+type redactingHandler struct {
+	next  slog.Handler
+	level slog.Leveler
+}
+
+func (handler *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= handler.level.Level() && handler.next.Enabled(ctx, level)
+}
+
+func (handler *redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	secrets, _ := ctx.Value(logSecretsContextKey{}).([]string)
+	clean := slog.NewRecord(record.Time, record.Level, redactText(record.Message, secrets), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		clean.AddAttrs(redactAttr(attr, secrets))
+		return true
+	})
+	return handler.next.Handle(ctx, clean)
+}
+
+func (handler *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clean := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		clean = append(clean, redactAttr(attr, nil))
+	}
+	return &redactingHandler{next: handler.next.WithAttrs(clean), level: handler.level}
+}
+
+func (handler *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: handler.next.WithGroup(name), level: handler.level}
+}
+
+func redactAttr(attr slog.Attr, secrets []string) slog.Attr {
+	attr.Value = attr.Value.Resolve()
+	switch {
+	case attr.Value.Kind() == slog.KindGroup:
+		group := attr.Value.Group()
+		clean := make([]slog.Attr, 0, len(group))
+		for _, member := range group {
+			clean = append(clean, redactAttr(member, secrets))
+		}
+		return slog.Attr{Key: attr.Key, Value: slog.GroupValue(clean...)}
+	case secretKey(attr.Key):
+		return slog.String(attr.Key, redacted)
+	case attr.Value.Kind() == slog.KindString:
+		return slog.String(attr.Key, redactText(attr.Value.String(), secrets))
+	case attr.Value.Kind() == slog.KindAny:
+		if err, isError := attr.Value.Any().(error); isError {
+			return slog.String(attr.Key, redactText(err.Error(), secrets))
+		}
+	}
+	return attr
+}
+
+// secretKey reports whether key names a secret, key_id and the like do not.
+func secretKey(key string) bool {
+	normalized := strings.NewReplacer("_", "", "-", "", ".", "", " ", "").Replace(strings.ToLower(key))
+	if normalized == "key" || normalized == "code" {
+		return true
+	}
+	for _, part := range secretKeyParts {
+		if strings.Contains(normalized, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactText removes secrets, the credentials of authorization headers and the hex digests from text.
+func redactText(text string, secrets []string) string {
+	for _, secret := range secrets {
+		if len(secret) >= 4 {
+			text = strings.ReplaceAll(text, secret, redacted)
+		}
+	}
+	text = authorizationRegex.ReplaceAllString(text, "$1 "+redacted)
+	return hexDigestRegex.ReplaceAllString(text, redacted)
+}
@@ -0,0 +1,219 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SchemeMTLS = "mtls"
+
+	MTLSURISAN      = "uri_san"
+	MTLSSubjectCN   = "subject_cn"
+	MTLSFingerprint = "fingerprint"
+
+	mtlsURIPrefix         = "uri:"
+	mtlsCNPrefix          = "cn:"
+	mtlsFingerprintPrefix = "sha256:"
+)
+
+// MTLSSettings configures ActivateMTLSAuth. Identities are the certificate
+// attributes looked up, in order, as logins in the Store (default MTLSURISAN
+// then MTLSSubjectCN): "uri:<uri>", "cn:<common name>" and "sha256:<hex>" for a
+// fingerprint, so that they never match the login of a password user.
+// ProxyHeader holds the URL encoded PEM certificate forwarded by a TLS
+// terminating proxy, it is only read from TrustedProxies (IPs or CIDRs) and
+// verified against ProxyRoots.
+type MTLSSettings struct {
+	Identities     []string
+	URIPrefix      string
+	ProxyHeader    string
+	TrustedProxies []string
+	ProxyRoots     *x509.CertPool
+
+	trustedNetworks []*net.IPNet
+}
+
+type PayloadMTLSFormat struct {
+	Certificate *x509.Certificate
+	Identities  []string
+}
+
+var ErrFailedAuthenticationMTLS = errors.New("incorrect Client Certificate")
+
+// ActivateMTLSAuth authenticates the client certificate verified by the TLS
+// handshake (tls.Config.ClientAuth must verify it), or forwarded by a trusted proxy.
+func (tnppt *TNPPT) ActivateMTLSAuth() gin.HandlerFunc {
+	return tnppt.activate(SchemeMTLS)
+}
+
+func (tnppt *TNPPT) authenticateMTLS() error {
+	if err := tnppt.checkMTLSPayload(); err != nil {
+		return errors.New(ErrFailedPayload.Error() + " - " + err.Error())
+	}
+	if !tnppt.credentialsValid() {
+		return ErrFailedAuthenticationMTLS
+	}
+	return nil
+}
+
+// CertificateFingerprint is the identity used for MTLSFingerprint.
+func CertificateFingerprint(certificate *x509.Certificate) string {
+	hash := sha256.Sum256(certificate.Raw)
+	return mtlsFingerprintPrefix + hex.EncodeToString(hash[:])
+}
+
+// isCertificateIdentity reports whether login is a certificate identity, that
+// only ActivateMTLSAuth authenticates.
+func isCertificateIdentity(login string) bool {
+	return strings.HasPrefix(login, mtlsURIPrefix) || strings.HasPrefix(login, mtlsCNPrefix) || strings.HasPrefix(login, mtlsFingerprintPrefix)
+}
+
+func (tnppt *TNPPT) checkMTLSPayload() error {
+	certificate, err := tnppt.MTLS.clientCertificate(tnppt.Request)
+	if err != nil {
+		return err
+	}
+	identities := tnppt.MTLS.identities(certificate)
+	if len(identities) == 0 {
+		return fmt.Errorf("[MTLS] No identity in certificate")
+	}
+	tnppt.PayloadMTLS = PayloadMTLSFormat{Certificate: certificate, Identities: identities}
+	return nil
+}
+
+func (settings *MTLSSettings) init() error {
+	if len(settings.Identities) == 0 {
+		settings.Identities = []string{MTLSURISAN, MTLSSubjectCN}
+	}
+	for _, identity := range settings.Identities {
+		if identity != MTLSURISAN && identity != MTLSSubjectCN && identity != MTLSFingerprint {
+			return fmt.Errorf("TNPPT - MTLS - Unknown identity %q", identity)
+		}
+	}
+	if settings.ProxyHeader != "" && len(settings.TrustedProxies) == 0 {
+		return errors.New("TNPPT - MTLS - You need to set the TrustedProxies allowed to send the ProxyHeader")
+	}
+	if settings.ProxyHeader != "" && settings.ProxyRoots == nil {
+		return errors.New("TNPPT - MTLS - You need to set the ProxyRoots verifying the certificates of the ProxyHeader")
+	}
+	settings.trustedNetworks = nil
+	for _, proxy := range settings.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("TNPPT - MTLS - Invalid TrustedProxies entry: %w", err)
+		}
+		settings.trustedNetworks = append(settings.trustedNetworks, network)
+	}
+	return nil
+}
+
+// clientCertificate only trusts verified chains, so that a server accepting
+// any certificate (tls.RequireAnyClientCert) can not be fooled.
+func (settings MTLSSettings) clientCertificate(request *http.Request) (*x509.Certificate, error) {
+	if request.TLS != nil && len(request.TLS.VerifiedChains) > 0 && len(request.TLS.VerifiedChains[0]) > 0 {
+		return request.TLS.VerifiedChains[0][0], nil
+	}
+	if settings.ProxyHeader == "" || request.Header.Get(settings.ProxyHeader) == "" || !settings.fromTrustedProxy(request) {
+		return nil, fmt.Errorf("[MTLS] No payload detected")
+	}
+	escaped := request.Header.Get(settings.ProxyHeader)
+	unescaped, err := url.QueryUnescape(escaped)
+	if err != nil {
+		return nil, fmt.Errorf("[MTLS] Incorrect Payload")
+	}
+	block, _ := pem.Decode([]byte(unescaped))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("[MTLS] Incorrect Payload")
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("[MTLS] Incorrect Payload")
+	}
+	_, errVerify := certificate.Verify(x509.VerifyOptions{
+		Roots:     settings.ProxyRoots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if errVerify != nil {
+		return nil, fmt.Errorf("[MTLS] Untrusted certificate: %v", errVerify)
+	}
+	return certificate, nil
+}
+
+// presented tells whether a certificate was given, without checking it.
+func (settings MTLSSettings) presented(request *http.Request) bool {
+	if request.TLS != nil && len(request.TLS.PeerCertificates) > 0 {
+		return true
+	}
+	return settings.ProxyHeader != "" && request.Header.Get(settings.ProxyHeader) != "" && settings.fromTrustedProxy(request)
+}
+
+// fromTrustedProxy checks the TCP peer, never the X-Forwarded-For headers.
+func (settings MTLSSettings) fromTrustedProxy(request *http.Request) bool {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range settings.trustedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (settings MTLSSettings) identities(certificate *x509.Certificate) []string {
+	var identities []string
+	for _, identity := range settings.Identities {
+		switch identity {
+		case MTLSURISAN:
+			for _, uri := range certificate.URIs {
+				if strings.HasPrefix(uri.String(), settings.URIPrefix) {
+					identities = append(identities, mtlsURIPrefix+uri.String())
+				}
+			}
+		case MTLSSubjectCN:
+			if certificate.Subject.CommonName != "" {
+				identities = append(identities, mtlsCNPrefix+certificate.Subject.CommonName)
+			}
+		case MTLSFingerprint:
+			identities = append(identities, CertificateFingerprint(certificate))
+		}
+	}
+	return identities
+}
+
+// findCertificateUser returns the first identity known by the store, a revoked
+// identity stops the lookup.
+func findCertificateUser(ctx context.Context, store CredentialStore, identities []string) (UserInfo, error) {
+	for _, identity := range identities {
+		user, errFind := store.FindUserByLogin(ctx, identity)
+		if errors.Is(errFind, ErrCredentialsNotFound) {
+			continue
+		}
+		return user, errFind
+	}
+	return UserInfo{}, ErrCredentialsNotFound
+}
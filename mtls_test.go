@@ -0,0 +1,254 @@
+package tnpptMiddleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCertificateAuthority struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pool        *x509.CertPool
+}
+
+func newTestCertificateAuthority(t *testing.T) *testCertificateAuthority {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tnppt test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := x509.ParseCertificate(raw)
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return &testCertificateAuthority{certificate: certificate, key: key, pool: pool}
+}
+
+func (authority *testCertificateAuthority) issue(t *testing.T, commonName string, uris ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, uri := range uris {
+		parsed, _ := url.Parse(uri)
+		template.URIs = append(template.URIs, parsed)
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, authority.certificate, &key.PublicKey, authority.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(raw)
+	return tls.Certificate{Certificate: [][]byte{raw}, PrivateKey: key, Leaf: leaf}
+}
+
+func newMTLSServer(t *testing.T, auth *TNPPT, clientAuth tls.ClientAuthType, roots *x509.CertPool) *httptest.Server {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/log", auth.ActivateMTLSAuth(), func(c *gin.Context) {
+		c.String(200, principal(c).Login)
+	})
+	server := httptest.NewUnstartedServer(router)
+	server.TLS = &tls.Config{ClientAuth: clientAuth, ClientCAs: roots}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func mtlsGet(t *testing.T, server *httptest.Server, certificates ...tls.Certificate) (int, string) {
+	t.Helper()
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = certificates
+	response, err := (&http.Client{Transport: transport}).Get(server.URL + "/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body := make([]byte, 512)
+	read, _ := response.Body.Read(body)
+	return response.StatusCode, string(body[:read])
+}
+
+func TestTNPPT_ActivateMTLSAuth(t *testing.T) {
+	authority := newTestCertificateAuthority(t)
+	spiffeCertificate := authority.issue(t, "ignored-cn", "spiffe://cluster.local/ns/logs/sa/collector")
+	cnCertificate := authority.issue(t, "billing")
+	pinnedCertificate := authority.issue(t, "")
+	unknownCertificate := authority.issue(t, "nobody")
+	otherAuthority := newTestCertificateAuthority(t)
+	foreignCertificate := otherAuthority.issue(t, "billing")
+
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{
+		{Login: "uri:spiffe://cluster.local/ns/logs/sa/collector"},
+		{Login: "cn:billing"},
+		{Login: "nobody", Password: "pass"},
+		{Login: CertificateFingerprint(pinnedCertificate.Leaf)},
+	}})
+	auth, err := New(&TNPPT{Store: store, MTLS: MTLSSettings{
+		Identities: []string{MTLSURISAN, MTLSSubjectCN, MTLSFingerprint},
+		URIPrefix:  "spiffe://cluster.local/",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newMTLSServer(t, auth, tls.VerifyClientCertIfGiven, authority.pool)
+
+	tests := []struct {
+		name        string
+		certificate []tls.Certificate
+		wantCode    int
+		wantLogin   string
+	}{
+		{name: "spiffe-id", certificate: []tls.Certificate{spiffeCertificate}, wantCode: 200, wantLogin: "uri:spiffe://cluster.local/ns/logs/sa/collector"},
+		{name: "subject-cn", certificate: []tls.Certificate{cnCertificate}, wantCode: 200, wantLogin: "cn:billing"},
+		{name: "fingerprint", certificate: []tls.Certificate{pinnedCertificate}, wantCode: 200, wantLogin: CertificateFingerprint(pinnedCertificate.Leaf)},
+		{name: "password-user-cn", certificate: []tls.Certificate{unknownCertificate}, wantCode: 401},
+		{name: "no-certificate", wantCode: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := mtlsGet(t, server, tt.certificate...)
+			assert.Equal(t, tt.wantCode, code)
+			if tt.wantCode == 200 {
+				assert.Equal(t, tt.wantLogin, body)
+			}
+		})
+	}
+
+	t.Run("unverified-certificate", func(t *testing.T) {
+		unverifiedServer := newMTLSServer(t, auth, tls.RequireAnyClientCert, nil)
+		code, _ := mtlsGet(t, unverifiedServer, foreignCertificate)
+		assert.Equal(t, 401, code)
+	})
+}
+
+func TestTNPPT_ActivateMTLSAuthProxyHeader(t *testing.T) {
+	authority := newTestCertificateAuthority(t)
+	certificate := authority.issue(t, "billing")
+	forged := newTestCertificateAuthority(t).issue(t, "billing")
+	encode := func(certificate tls.Certificate) string {
+		return url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]})))
+	}
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "cn:billing"}}})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		roots      *x509.CertPool
+		want       int
+	}{
+		{name: "trusted-proxy", remoteAddr: "10.0.0.7:4242", header: encode(certificate), roots: authority.pool, want: 200},
+		{name: "forged-certificate", remoteAddr: "10.0.0.7:4242", header: encode(forged), roots: authority.pool, want: 401},
+		{name: "untrusted-peer", remoteAddr: "192.168.1.3:4242", header: encode(certificate), roots: authority.pool, want: 401},
+		{name: "garbage", remoteAddr: "10.0.0.7:4242", header: "not-a-certificate", roots: authority.pool, want: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := New(&TNPPT{Store: store, MTLS: MTLSSettings{
+				ProxyHeader:    "X-Client-Cert",
+				TrustedProxies: []string{"10.0.0.0/8"},
+				ProxyRoots:     tt.roots,
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			router := gin.New()
+			router.GET("/log", auth.ActivateMTLSAuth(), func(c *gin.Context) {
+				c.String(200, principal(c).Login)
+			})
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/log", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Client-Cert", tt.header)
+			req.Header.Set("X-Forwarded-For", "10.0.0.7")
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.want, w.Code)
+		})
+	}
+}
+
+func TestTNPPT_PasswordSchemesRejectCertificateIdentities(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{
+		{Login: "cn:billing", Password: "pass"},
+		{Login: "billing", Password: "pass"},
+	}})
+	auth, err := New(&TNPPT{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.POST("/hmac", auth.ActivateHMACAuth(), func(c *gin.Context) {})
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{name: "hmac-password-user", req: hmacLoginRequest(t, auth, "/hmac", "billing", "pass"), want: 200},
+		{name: "hmac-certificate-identity", req: hmacLoginRequest(t, auth, "/hmac", "cn:billing", "pass"), want: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, tt.req)
+			assert.Equal(t, tt.want, w.Code)
+		})
+	}
+}
+
+func TestMTLSSettings_Init(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings MTLSSettings
+		wantErr  bool
+	}{
+		{name: "defaults", settings: MTLSSettings{}},
+		{name: "unknown-identity", settings: MTLSSettings{Identities: []string{"email"}}, wantErr: true},
+		{name: "header-without-proxies", settings: MTLSSettings{ProxyHeader: "X-Client-Cert"}, wantErr: true},
+		{name: "header-without-roots", settings: MTLSSettings{ProxyHeader: "X-Client-Cert", TrustedProxies: []string{"10.0.0.7"}}, wantErr: true},
+		{name: "invalid-proxy", settings: MTLSSettings{ProxyHeader: "X-Client-Cert", TrustedProxies: []string{"proxy.local"}, ProxyRoots: x509.NewCertPool()}, wantErr: true},
+		{name: "single-ips", settings: MTLSSettings{ProxyHeader: "X-Client-Cert", TrustedProxies: []string{"10.0.0.7", "::1"}, ProxyRoots: x509.NewCertPool()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.settings.init()
+			assert.Equal(t, tt.wantErr, err != nil, err)
+		})
+	}
+}
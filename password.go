@@ -0,0 +1,224 @@
+package tnpptMiddleware
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	PasswordArgon2id     = "argon2id"
+	PasswordBcrypt       = "bcrypt"
+	PasswordPBKDF2SHA256 = "pbkdf2-sha256"
+	PasswordSCRAMSHA256  = "scram-sha-256"
+)
+
+// DefaultPBKDF2Iterations is the PBKDF2Iterations of a PasswordPolicy, and the
+// iterations of NewSCRAMVerifier, by default.
+const DefaultPBKDF2Iterations = 600000
+
+// PasswordPolicy hashes new passwords with Algorithm, and tells which stored
+// hashes are weaker than the current parameters and should be rehashed.
+type PasswordPolicy struct {
+	Algorithm        string
+	BcryptCost       int
+	Argon2Time       uint32
+	Argon2Memory     uint32
+	Argon2Threads    uint8
+	PBKDF2Iterations int
+}
+
+var ErrUnknownPasswordHash = errors.New("unknown password hash format")
+
+type argon2Params struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	hash    []byte
+}
+
+type pbkdf2Params struct {
+	iterations int
+	salt       []byte
+	hash       []byte
+}
+
+func (policy PasswordPolicy) withDefaults() PasswordPolicy {
+	if policy.Algorithm == "" {
+		policy.Algorithm = PasswordArgon2id
+	}
+	if policy.BcryptCost == 0 {
+		policy.BcryptCost = 12
+	}
+	if policy.Argon2Time == 0 {
+		policy.Argon2Time = 1
+	}
+	if policy.Argon2Memory == 0 {
+		policy.Argon2Memory = 64 * 1024
+	}
+	if policy.Argon2Threads == 0 {
+		policy.Argon2Threads = 4
+	}
+	if policy.PBKDF2Iterations == 0 {
+		policy.PBKDF2Iterations = DefaultPBKDF2Iterations
+	}
+	return policy
+}
+
+// Hash encodes password with the policy Algorithm, in the bcrypt modular crypt
+// format or the PHC string format for argon2id and pbkdf2-sha256.
+func (policy PasswordPolicy) Hash(password string) (string, error) {
+	policy = policy.withDefaults()
+	switch policy.Algorithm {
+	case PasswordBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), policy.BcryptCost)
+		return string(hash), err
+	case PasswordArgon2id:
+		salt, err := randomSalt()
+		if err != nil {
+			return "", err
+		}
+		hash := argon2.IDKey([]byte(password), salt, policy.Argon2Time, policy.Argon2Memory, policy.Argon2Threads, 32)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, policy.Argon2Memory, policy.Argon2Time, policy.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+	case PasswordPBKDF2SHA256:
+		salt, err := randomSalt()
+		if err != nil {
+			return "", err
+		}
+		hash := pbkdf2.Key([]byte(password), salt, policy.PBKDF2Iterations, 32, sha256.New)
+		return fmt.Sprintf("$pbkdf2-sha256$i=%d$%s$%s", policy.PBKDF2Iterations,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+	case PasswordSCRAMSHA256:
+		return NewSCRAMVerifier(password, policy.PBKDF2Iterations)
+	}
+	return "", fmt.Errorf("TNPPT - Passwords - unsupported algorithm %q", policy.Algorithm)
+}
+
+// NeedsRehash reports whether encoded uses another algorithm or weaker
+// parameters than the policy. SCRAM-SHA-256 verifiers are only rehashed by a
+// SCRAM-SHA-256 policy, replacing them would lock the SCRAM clients out.
+func (policy PasswordPolicy) NeedsRehash(encoded string) bool {
+	policy = policy.withDefaults()
+	if PasswordAlgorithm(encoded) == PasswordSCRAMSHA256 && policy.Algorithm != PasswordSCRAMSHA256 {
+		return false
+	}
+	if PasswordAlgorithm(encoded) != policy.Algorithm {
+		return true
+	}
+	switch policy.Algorithm {
+	case PasswordBcrypt:
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return err != nil || cost < policy.BcryptCost
+	case PasswordArgon2id:
+		params, err := parseArgon2id(encoded)
+		return err != nil || params.time < policy.Argon2Time || params.memory < policy.Argon2Memory || params.threads < policy.Argon2Threads
+	case PasswordPBKDF2SHA256:
+		params, err := parsePBKDF2(encoded)
+		return err != nil || params.iterations < policy.PBKDF2Iterations
+	case PasswordSCRAMSHA256:
+		verifier, err := parseSCRAMVerifier(encoded)
+		return err != nil || verifier.iterations < policy.PBKDF2Iterations
+	}
+	return true
+}
+
+// PasswordAlgorithm detects the algorithm of encoded from its prefix.
+func PasswordAlgorithm(encoded string) string {
+	switch {
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		return PasswordBcrypt
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return PasswordArgon2id
+	case strings.HasPrefix(encoded, "$pbkdf2-sha256$"):
+		return PasswordPBKDF2SHA256
+	case strings.HasPrefix(encoded, scramMechanism+"$"):
+		return PasswordSCRAMSHA256
+	}
+	return ""
+}
+
+// VerifyPassword checks password against a hash produced by any supported algorithm.
+func VerifyPassword(password string, encoded string) (bool, error) {
+	switch PasswordAlgorithm(encoded) {
+	case PasswordBcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case PasswordArgon2id:
+		params, err := parseArgon2id(encoded)
+		if err != nil {
+			return false, err
+		}
+		hash := argon2.IDKey([]byte(password), params.salt, params.time, params.memory, params.threads, uint32(len(params.hash)))
+		return subtle.ConstantTimeCompare(hash, params.hash) == 1, nil
+	case PasswordPBKDF2SHA256:
+		params, err := parsePBKDF2(encoded)
+		if err != nil {
+			return false, err
+		}
+		hash := pbkdf2.Key([]byte(password), params.salt, params.iterations, len(params.hash), sha256.New)
+		return subtle.ConstantTimeCompare(hash, params.hash) == 1, nil
+	case PasswordSCRAMSHA256:
+		verifier, err := parseSCRAMVerifier(encoded)
+		if err != nil {
+			return false, err
+		}
+		derived := deriveSCRAMVerifier(password, verifier.salt, verifier.iterations)
+		return subtle.ConstantTimeCompare(derived.storedKey, verifier.storedKey) == 1, nil
+	}
+	return false, ErrUnknownPasswordHash
+}
+
+func parseArgon2id(encoded string) (argon2Params, error) {
+	var params argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return params, fmt.Errorf("%w: argon2id", ErrUnknownPasswordHash)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, fmt.Errorf("%w: argon2id parameters", ErrUnknownPasswordHash)
+	}
+	var errSalt, errHash error
+	params.salt, errSalt = base64.RawStdEncoding.DecodeString(parts[4])
+	params.hash, errHash = base64.RawStdEncoding.DecodeString(parts[5])
+	if errSalt != nil || errHash != nil || len(params.hash) == 0 || params.time == 0 || params.threads == 0 {
+		return params, fmt.Errorf("%w: argon2id", ErrUnknownPasswordHash)
+	}
+	return params, nil
+}
+
+func parsePBKDF2(encoded string) (pbkdf2Params, error) {
+	var params pbkdf2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || !strings.HasPrefix(parts[2], "i=") {
+		return params, fmt.Errorf("%w: pbkdf2-sha256", ErrUnknownPasswordHash)
+	}
+	iterations, errIterations := strconv.Atoi(strings.TrimPrefix(parts[2], "i="))
+	var errSalt, errHash error
+	params.iterations = iterations
+	params.salt, errSalt = base64.RawStdEncoding.DecodeString(parts[3])
+	params.hash, errHash = base64.RawStdEncoding.DecodeString(parts[4])
+	if errIterations != nil || errSalt != nil || errHash != nil || iterations <= 0 || len(params.hash) == 0 {
+		return params, fmt.Errorf("%w: pbkdf2-sha256", ErrUnknownPasswordHash)
+	}
+	return params, nil
+}
+
+func randomSalt() ([]byte, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	return salt, err
+}
@@ -0,0 +1,109 @@
+package tnpptMiddleware
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testPasswordPolicies = []PasswordPolicy{
+	{Algorithm: PasswordBcrypt, BcryptCost: 4},
+	{Algorithm: PasswordArgon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1},
+	{Algorithm: PasswordPBKDF2SHA256, PBKDF2Iterations: 1000},
+	{Algorithm: PasswordSCRAMSHA256, PBKDF2Iterations: 4096},
+}
+
+func TestPasswordPolicy_HashAndVerify(t *testing.T) {
+	for _, policy := range testPasswordPolicies {
+		t.Run(policy.Algorithm, func(t *testing.T) {
+			encoded, err := policy.Hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, policy.Algorithm, PasswordAlgorithm(encoded))
+
+			valid, err := VerifyPassword("correct horse", encoded)
+			assert.NoError(t, err)
+			assert.True(t, valid)
+
+			valid, err = VerifyPassword("battery staple", encoded)
+			assert.NoError(t, err)
+			assert.False(t, valid)
+
+			other, _ := policy.Hash("correct horse")
+			assert.NotEqual(t, encoded, other)
+			assert.False(t, policy.NeedsRehash(encoded))
+		})
+	}
+}
+
+func TestVerifyPassword_KnownHashes(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		encoded  string
+		want     bool
+	}{
+		{name: "bcrypt-2a", password: "U*U", encoded: "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", want: true},
+		{name: "bcrypt-2a-wrong", password: "U*V", encoded: "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", want: false},
+		{name: "argon2id", password: "password", encoded: "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc", want: true},
+		{name: "pbkdf2-sha256", password: "password", encoded: "$pbkdf2-sha256$i=1$c2FsdA$Eg+2z/z4syxD5yJSVsT4N6hlSMkszDVICAWYfLcL4Xs", want: true},
+		{name: "scram-sha-256", password: "pencil", encoded: testSCRAMVerifier, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			valid, err := VerifyPassword(tt.password, tt.encoded)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, valid)
+		})
+	}
+}
+
+func TestVerifyPassword_Malformed(t *testing.T) {
+	for _, encoded := range []string{
+		"",
+		"plain-text",
+		"$md5$abc",
+		"$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ",
+		"$argon2id$v=16$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=0,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$pbkdf2-sha256$i=0$c2FsdA$EgD6V+tHfXQ0sFgIUqcQUaAVUYcRGDLqfp8jZ5kcOUs",
+		"$pbkdf2-sha256$1000$c2FsdA$EgD6V+tHfXQ0sFgIUqcQUaAVUYcRGDLqfp8jZ5kcOUs",
+		"$pbkdf2-sha256$i=1$!!$EgD6V+tHfXQ0sFgIUqcQUaAVUYcRGDLqfp8jZ5kcOUs",
+		"SCRAM-SHA-256$4096:W22ZaJ0SNY7soEsUEjb6gQ==$WG5d8oPm3OtcPnkdi4Uo7BkeZkBFzpcXkuLmtbsT4qY=",
+		"SCRAM-SHA-256$0:W22ZaJ0SNY7soEsUEjb6gQ==$WG5d8oPm3OtcPnkdi4Uo7BkeZkBFzpcXkuLmtbsT4qY=:wfPLwcE6nTWhTAmQ7tl2KeoiWGPlZqQxSrmfPwDl2dU=",
+	} {
+		valid, err := VerifyPassword("password", encoded)
+		assert.False(t, valid, encoded)
+		assert.True(t, errors.Is(err, ErrUnknownPasswordHash), encoded)
+	}
+}
+
+func TestPasswordPolicy_NeedsRehash(t *testing.T) {
+	weakBcrypt, _ := PasswordPolicy{Algorithm: PasswordBcrypt, BcryptCost: 4}.Hash("pass")
+	weakPBKDF2, _ := PasswordPolicy{Algorithm: PasswordPBKDF2SHA256, PBKDF2Iterations: 10}.Hash("pass")
+	weakArgon2, _ := PasswordPolicy{Algorithm: PasswordArgon2id, Argon2Time: 1, Argon2Memory: 512, Argon2Threads: 1}.Hash("pass")
+	tests := []struct {
+		name    string
+		policy  PasswordPolicy
+		encoded string
+		want    bool
+	}{
+		{name: "bcrypt-cost-upgrade", policy: PasswordPolicy{Algorithm: PasswordBcrypt, BcryptCost: 5}, encoded: weakBcrypt, want: true},
+		{name: "bcrypt-same-cost", policy: PasswordPolicy{Algorithm: PasswordBcrypt, BcryptCost: 4}, encoded: weakBcrypt, want: false},
+		{name: "pbkdf2-iterations-upgrade", policy: PasswordPolicy{Algorithm: PasswordPBKDF2SHA256, PBKDF2Iterations: 20}, encoded: weakPBKDF2, want: true},
+		{name: "argon2-memory-upgrade", policy: PasswordPolicy{Algorithm: PasswordArgon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1}, encoded: weakArgon2, want: true},
+		{name: "algorithm-change", policy: PasswordPolicy{Algorithm: PasswordArgon2id}, encoded: weakBcrypt, want: true},
+		{name: "default-policy", policy: PasswordPolicy{}, encoded: weakPBKDF2, want: true},
+		{name: "unknown", policy: PasswordPolicy{}, encoded: "plain", want: true},
+		{name: "scram-kept", policy: PasswordPolicy{Algorithm: PasswordArgon2id}, encoded: testSCRAMVerifier, want: false},
+		{name: "scram-iterations-upgrade", policy: PasswordPolicy{Algorithm: PasswordSCRAMSHA256, PBKDF2Iterations: 8192}, encoded: testSCRAMVerifier, want: true},
+		{name: "to-scram", policy: PasswordPolicy{Algorithm: PasswordSCRAMSHA256}, encoded: weakPBKDF2, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.policy.NeedsRehash(tt.encoded))
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package tnpptMiddleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RoutePolicy is what a route requires. Path is a gin route pattern, "*"
+// matches any one segment and a last "**" any number of them, Methods is
+// every method when empty.
+// A principal must authenticate with one of Schemes, hold all of Scopes, one
+// of Roles and all of Permissions. Public routes require nothing.
+type RoutePolicy struct {
+	Methods     []string `yaml:"methods" json:"methods"`
+	Path        string   `yaml:"path" json:"path"`
+	Public      bool     `yaml:"public" json:"public"`
+	Schemes     []string `yaml:"schemes" json:"schemes"`
+	Scopes      []string `yaml:"scopes" json:"scopes"`
+	Roles       []string `yaml:"roles" json:"roles"`
+	Permissions []string `yaml:"permissions" json:"permissions"`
+}
+
+// PolicyConfig is the content of a policy file, the first matching route applies:
+//
+//	routes:
+//	  - path: /health
+//	    public: true
+//	  - methods: [POST]
+//	    path: /log
+//	    schemes: [api_key, hmac]
+//	    scopes: [logs:write]
+//	  - path: /admin/**
+//	    schemes: [jwt]
+//	    roles: [admin]
+type PolicyConfig struct {
+	Routes []RoutePolicy `yaml:"routes" json:"routes"`
+}
+
+// Policy maps the gin routes to their RoutePolicy.
+type Policy struct {
+	routes []RoutePolicy
+}
+
+var ErrRouteWithoutPolicy = errors.New("[POLICY] routes without policy")
+
+func NewPolicy(config PolicyConfig) (*Policy, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &Policy{routes: config.Routes}, nil
+}
+
+// LoadPolicyFile reads a PolicyConfig from a YAML or JSON file.
+func LoadPolicyFile(path string) (*Policy, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("[POLICY] %w", err)
+	}
+	var config PolicyConfig
+	if err := decodeConfigFile(path, content, &config, "POLICY"); err != nil {
+		return nil, err
+	}
+	return NewPolicy(config)
+}
+
+// Validate checks the paths, the methods and the schemes, and that public
+// routes require nothing while the others name at least one scheme.
+func (config PolicyConfig) Validate() error {
+	for index, route := range config.Routes {
+		if !strings.HasPrefix(route.Path, "/") {
+			return fmt.Errorf("[POLICY] routes[%d]: path must start with /", index)
+		}
+		segments := strings.Split(route.Path, "/")
+		for position, segment := range segments {
+			if segment == "**" && position != len(segments)-1 {
+				return fmt.Errorf("[POLICY] routes[%d]: ** must be the last segment", index)
+			}
+		}
+		for _, method := range route.Methods {
+			if method == "" || strings.ToUpper(method) != method {
+				return fmt.Errorf("[POLICY] routes[%d]: invalid method %q", index, method)
+			}
+		}
+		if route.Public {
+			if len(route.Schemes)+len(route.Scopes)+len(route.Roles)+len(route.Permissions) > 0 {
+				return fmt.Errorf("[POLICY] routes[%d]: a public route requires nothing", index)
+			}
+			continue
+		}
+		if len(route.Schemes) == 0 {
+			return fmt.Errorf("[POLICY] routes[%d]: schemes are required unless public", index)
+		}
+		for _, scheme := range route.Schemes {
+			if _, known := schemeAuthenticators[scheme]; !known {
+				return fmt.Errorf("[POLICY] routes[%d]: unknown scheme %q", index, scheme)
+			}
+		}
+		for _, values := range [][]string{route.Scopes, route.Roles, route.Permissions} {
+			for _, value := range values {
+				if value == "" {
+					return fmt.Errorf("[POLICY] routes[%d]: empty scope, role or permission", index)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Match returns the first RoutePolicy matching method and the gin route pattern path.
+func (policy *Policy) Match(method string, path string) (RoutePolicy, bool) {
+	for _, route := range policy.routes {
+		if route.matches(method, path) {
+			return route, true
+		}
+	}
+	return RoutePolicy{}, false
+}
+
+// CheckRoutes fails with ErrRouteWithoutPolicy, listing them, when some of
+// routes have no policy. Run it on engine.Routes() once every route is
+// registered, from RequireRoutes in a test or a -check-policy flag of the service.
+func (policy *Policy) CheckRoutes(routes gin.RoutesInfo) error {
+	var uncovered []string
+	for _, route := range routes {
+		if _, found := policy.Match(route.Method, route.Path); !found {
+			uncovered = append(uncovered, route.Method+" "+route.Path)
+		}
+	}
+	if len(uncovered) > 0 {
+		return fmt.Errorf("%w: %s", ErrRouteWithoutPolicy, strings.Join(uncovered, ", "))
+	}
+	return nil
+}
+
+// PolicyTestingT is the part of *testing.T used by RequireRoutes.
+type PolicyTestingT interface {
+	Helper()
+	Fatalf(format string, args ...interface{})
+}
+
+// RequireRoutes fails the test when some routes of engine have no policy,
+// call it once the service registered every route:
+//
+//	func TestPolicyCoversRoutes(t *testing.T) {
+//		policy.RequireRoutes(t, newRouter(policy))
+//	}
+func (policy *Policy) RequireRoutes(t PolicyTestingT, engine *gin.Engine) {
+	t.Helper()
+	if err := policy.CheckRoutes(engine.Routes()); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func (route RoutePolicy) matches(method string, path string) bool {
+	if len(route.Methods) > 0 && !containsString(route.Methods, method) {
+		return false
+	}
+	patterns := strings.Split(route.Path, "/")
+	segments := strings.Split(path, "/")
+	for index, pattern := range patterns {
+		if pattern == "**" {
+			return true
+		}
+		if index >= len(segments) || (pattern != "*" && pattern != segments[index]) {
+			return false
+		}
+	}
+	return len(patterns) == len(segments)
+}
+
+// Enforce is the engine level middleware applying policy to every route,
+// routes without policy are denied:
+//
+//	engine.Use(auth.Enforce(policy))
+func (tnppt *TNPPT) Enforce(policy *Policy) gin.HandlerFunc {
+	if policy == nil {
+		panic("TNPPT - Enforce - You need to set the policy")
+	}
+	verifiers := make([]*Verifier, len(policy.routes))
+	for index, route := range policy.routes {
+		if len(route.Permissions) > 0 && tnppt.RBAC == nil {
+			panic("TNPPT - Enforce - You need to set the RBAC")
+		}
+		if !route.Public {
+			verifiers[index] = tnppt.newVerifier("Enforce", route.Schemes, len(route.Schemes) > 1)
+		}
+	}
+	return func(ginEngine *gin.Context) {
+		path := ginEngine.FullPath()
+		if path == "" {
+			ginEngine.Next()
+			return
+		}
+		index := -1
+		for candidate, route := range policy.routes {
+			if route.matches(ginEngine.Request.Method, path) {
+				index = candidate
+				break
+			}
+		}
+		if index < 0 {
+			tnppt.audit(ginEngine.Request, UserInfo{}, AuditEntry{Event: AuditAccessDenied, Route: path, Reason: "no route policy"})
+			tnppt.sendError(ginEngine, http.StatusForbidden, ErrAccessDenied)
+			return
+		}
+		route := policy.routes[index]
+		if route.Public {
+			ginEngine.Next()
+			return
+		}
+		user, err := verifiers[index].verifyCopy(ginEngine.Request, ginEngine.Writer.Header(), ginEngine, path)
+		if err != nil {
+			tnppt.sendError(ginEngine, asAuthenticationError(err).StatusCode, err)
+			return
+		}
+		setPrincipal(ginEngine, user)
+		if len(route.Scopes) > 0 && tnppt.denied(ginEngine, user, missingScopes(route.Scopes), "missing scope") {
+			return
+		}
+		if len(route.Roles) > 0 && tnppt.denied(ginEngine, user, tnppt.missingRoles(route.Roles), "missing role") {
+			return
+		}
+		if len(route.Permissions) > 0 && tnppt.denied(ginEngine, user, tnppt.missingPermissions(route.Permissions), "missing permission") {
+			return
+		}
+		ginEngine.Next()
+	}
+}
+
+// missingScopes returns the scopes the principal was not granted.
+func missingScopes(scopes []string) func(user UserInfo) []string {
+	return func(user UserInfo) []string {
+		var missing []string
+		for _, scope := range scopes {
+			if !containsString(user.Scopes, scope) {
+				missing = append(missing, scope)
+			}
+		}
+		return missing
+	}
+}
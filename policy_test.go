@@ -0,0 +1,247 @@
+package tnpptMiddleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicyYAML = `
+routes:
+  - path: /health
+    public: true
+  - methods: [POST]
+    path: /log
+    schemes: [api_key, hmac]
+    scopes: [logs:write]
+  - methods: [GET]
+    path: /log/:id
+    schemes: [api_key]
+  - path: /admin/**
+    schemes: [hmac]
+    roles: [admin]
+  - methods: [DELETE]
+    path: /logs/*
+    schemes: [hmac]
+    permissions: [logs:delete]
+`
+
+func TestRoutePolicy_Matches(t *testing.T) {
+	tests := []struct {
+		policy RoutePolicy
+		method string
+		path   string
+		want   bool
+	}{
+		{policy: RoutePolicy{Path: "/log"}, method: "GET", path: "/log", want: true},
+		{policy: RoutePolicy{Path: "/log"}, method: "GET", path: "/log/:id", want: false},
+		{policy: RoutePolicy{Path: "/log", Methods: []string{"POST"}}, method: "GET", path: "/log", want: false},
+		{policy: RoutePolicy{Path: "/log/:id"}, method: "GET", path: "/log/:id", want: true},
+		{policy: RoutePolicy{Path: "/log/*"}, method: "GET", path: "/log/:id", want: true},
+		{policy: RoutePolicy{Path: "/log/*"}, method: "GET", path: "/log", want: false},
+		{policy: RoutePolicy{Path: "/admin/**"}, method: "PUT", path: "/admin/users/:id", want: true},
+		{policy: RoutePolicy{Path: "/admin/**"}, method: "PUT", path: "/admin", want: true},
+		{policy: RoutePolicy{Path: "/admin/**"}, method: "PUT", path: "/administration", want: false},
+		{policy: RoutePolicy{Path: "/**"}, method: "GET", path: "/anything", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.Path+" "+tt.method+" "+tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.policy.matches(tt.method, tt.path))
+		})
+	}
+}
+
+func TestPolicyConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name  string
+		route RoutePolicy
+	}{
+		{name: "relative-path", route: RoutePolicy{Path: "log", Public: true}},
+		{name: "inner-double-star", route: RoutePolicy{Path: "/**/log", Public: true}},
+		{name: "lowercase-method", route: RoutePolicy{Path: "/log", Methods: []string{"post"}, Public: true}},
+		{name: "public-with-requirements", route: RoutePolicy{Path: "/log", Public: true, Scopes: []string{"logs:read"}}},
+		{name: "no-scheme", route: RoutePolicy{Path: "/log"}},
+		{name: "unknown-scheme", route: RoutePolicy{Path: "/log", Schemes: []string{"kerberos"}}},
+		{name: "empty-role", route: RoutePolicy{Path: "/log", Schemes: []string{SchemeHMAC}, Roles: []string{""}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPolicy(PolicyConfig{Routes: []RoutePolicy{tt.route}})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestPolicy_CheckRoutes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(testPolicyYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := LoadPolicyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := func(c *gin.Context) {}
+	router := gin.New()
+	router.GET("/health", handler)
+	router.POST("/log", handler)
+	router.GET("/log/:id", handler)
+	router.PUT("/admin/users/:id", handler)
+	assert.NoError(t, policy.CheckRoutes(router.Routes()))
+
+	router.GET("/log", handler)
+	router.DELETE("/export", handler)
+	err = policy.CheckRoutes(router.Routes())
+	assert.True(t, errors.Is(err, ErrRouteWithoutPolicy))
+	assert.Contains(t, err.Error(), "GET /log")
+	assert.Contains(t, err.Error(), "DELETE /export")
+
+	_, err = LoadPolicyFile(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+type fatalRecorder struct {
+	messages []string
+}
+
+func (recorder *fatalRecorder) Helper() {}
+
+func (recorder *fatalRecorder) Fatalf(format string, args ...interface{}) {
+	recorder.messages = append(recorder.messages, fmt.Sprintf(format, args...))
+}
+
+func TestPolicy_RequireRoutes(t *testing.T) {
+	config := PolicyConfig{}
+	if err := decodeConfigYAML([]byte(testPolicyYAML), &config, "POLICY"); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := NewPolicy(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := func(c *gin.Context) {}
+	router := gin.New()
+	router.GET("/health", handler)
+	router.POST("/log", handler)
+
+	recorder := &fatalRecorder{}
+	policy.RequireRoutes(recorder, router)
+	assert.Empty(t, recorder.messages)
+
+	router.DELETE("/export", handler)
+	policy.RequireRoutes(recorder, router)
+	if assert.Len(t, recorder.messages, 1) {
+		assert.Contains(t, recorder.messages[0], "DELETE /export")
+	}
+}
+
+func TestTNPPT_Enforce(t *testing.T) {
+	config := PolicyConfig{}
+	if err := decodeConfigYAML([]byte(testPolicyYAML), &config, "POLICY"); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := NewPolicy(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rbac, err := NewRBAC(testRBACConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestMemoryStore(t, StoreRecords{
+		Users: []UserRecord{
+			{Login: "alice", Password: "pass", Roles: []string{"admin"}, Scopes: []string{"logs:write"}},
+			{Login: "bob", Password: "pass", Roles: []string{"editor"}},
+		},
+		APIKeys: []APIKeyRecord{{Login: "collector", Key: "collector-key", Scopes: []string{"logs:write"}}},
+	})
+	auditor := &recordingAuditor{}
+	auth, err := New(&TNPPT{Store: store, RBAC: rbac, Auditor: auditor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(auth.Enforce(policy))
+	ok := func(c *gin.Context) { c.String(200, "ok") }
+	whoami := func(c *gin.Context) {
+		user, found := UserInfoFromGin(c)
+		c.String(200, fmt.Sprintf("%t:%s", found, user.Login))
+	}
+	router.GET("/health", whoami)
+	router.POST("/log", whoami)
+	router.GET("/log/:id", ok)
+	router.POST("/admin/users", ok)
+	router.DELETE("/logs/:id", ok)
+	router.GET("/export", ok)
+
+	apiKeyRequest := func(method string, path string) *http.Request {
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("API_KEY", "collector-key")
+		return req
+	}
+	hmacRequest := func(method string, path string, login string) *http.Request {
+		req := hmacLoginRequest(t, auth, path, login, "pass")
+		req.Method = method
+		return req
+	}
+	anonymous := func(method string, path string) *http.Request {
+		req, _ := http.NewRequest(method, path, nil)
+		return req
+	}
+	tests := []struct {
+		name     string
+		req      *http.Request
+		wantCode int
+		wantBody string
+	}{
+		{name: "public", req: anonymous("GET", "/health"), wantCode: 200, wantBody: "false:"},
+		{name: "not-found", req: anonymous("GET", "/nowhere"), wantCode: 404},
+		{name: "no-policy", req: apiKeyRequest("GET", "/export"), wantCode: 403},
+		{name: "no-credentials", req: anonymous("POST", "/log"), wantCode: 401},
+		{name: "api-key-with-scope", req: apiKeyRequest("POST", "/log"), wantCode: 200, wantBody: "true:collector"},
+		{name: "hmac-with-scope", req: hmacRequest("POST", "/log", "alice"), wantCode: 200, wantBody: "true:alice"},
+		{name: "public-after-authentication", req: anonymous("GET", "/health"), wantCode: 200, wantBody: "false:"},
+		{name: "hmac-without-scope", req: hmacRequest("POST", "/log", "bob"), wantCode: 403},
+		{name: "scheme-not-allowed", req: hmacRequest("GET", "/log/1", "alice"), wantCode: 401},
+		{name: "param-route", req: apiKeyRequest("GET", "/log/1"), wantCode: 200},
+		{name: "role", req: hmacRequest("POST", "/admin/users", "alice"), wantCode: 200},
+		{name: "missing-role", req: hmacRequest("POST", "/admin/users", "bob"), wantCode: 403},
+		{name: "missing-permission", req: hmacRequest("DELETE", "/logs/1", "bob"), wantCode: 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, tt.req)
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, w.Body.String())
+			}
+		})
+	}
+
+	if denials := auditor.denials(); assert.Len(t, denials, 4) {
+		assert.Equal(t, "no route policy", denials[0].Reason)
+		assert.Equal(t, []string{"logs:write"}, denials[1].Required)
+		assert.Equal(t, "missing scope", denials[1].Reason)
+		assert.Equal(t, []string{"admin"}, denials[2].Required)
+		assert.Equal(t, []string{"logs:delete"}, denials[3].Required)
+	}
+}
+
+func TestTNPPT_EnforceConfiguration(t *testing.T) {
+	auth := &TNPPT{}
+	assert.Panics(t, func() { auth.Enforce(nil) })
+	policy, err := NewPolicy(PolicyConfig{Routes: []RoutePolicy{{Path: "/log", Schemes: []string{SchemeHMAC}, Permissions: []string{"logs:read"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Panics(t, func() { auth.Enforce(policy) })
+}
@@ -0,0 +1,271 @@
+package tnpptMiddleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Role grants its Permissions and those of the roles it Inherits, a
+// principal having the role has the inherited roles too.
+type Role struct {
+	Name        string   `yaml:"name" json:"name"`
+	Permissions []string `yaml:"permissions" json:"permissions"`
+	Inherits    []string `yaml:"inherits" json:"inherits"`
+}
+
+// RBACConfig is the content of a role definitions file:
+//
+//	roles:
+//	  - name: viewer
+//	    permissions: [logs:read]
+//	  - name: admin
+//	    inherits: [viewer]
+//	    permissions: [logs:delete, users:manage]
+type RBACConfig struct {
+	Roles []Role `yaml:"roles" json:"roles"`
+}
+
+// RBAC resolves the UserInfo.Roles of a principal into the roles it has,
+// inherited ones included, and the permissions they grant. Roles unknown to
+// the definitions are kept as is and grant nothing.
+type RBAC struct {
+	roles map[string]resolvedRole
+}
+
+type resolvedRole struct {
+	roles       map[string]bool
+	permissions map[string]bool
+}
+
+var (
+	ErrAuthenticationRequired = errors.New("authentication required")
+	ErrAccessDenied           = errors.New("access denied")
+)
+
+func NewRBAC(config RBACConfig) (*RBAC, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	definitions := make(map[string]Role, len(config.Roles))
+	for _, role := range config.Roles {
+		definitions[role.Name] = role
+	}
+	rbac := &RBAC{roles: make(map[string]resolvedRole, len(config.Roles))}
+	for _, role := range config.Roles {
+		rbac.resolve(definitions, role.Name)
+	}
+	return rbac, nil
+}
+
+// LoadRBACFile reads an RBACConfig from a YAML or JSON file.
+func LoadRBACFile(path string) (*RBAC, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("[RBAC] %w", err)
+	}
+	var config RBACConfig
+	if err := decodeConfigFile(path, content, &config, "RBAC"); err != nil {
+		return nil, err
+	}
+	return NewRBAC(config)
+}
+
+// Validate checks the names, and that inherited roles are defined without cycles.
+func (config RBACConfig) Validate() error {
+	definitions := make(map[string]Role, len(config.Roles))
+	for index, role := range config.Roles {
+		if role.Name == "" {
+			return fmt.Errorf("[RBAC] roles[%d]: name is required", index)
+		}
+		if _, duplicated := definitions[role.Name]; duplicated {
+			return fmt.Errorf("[RBAC] roles[%d]: duplicated role %q", index, role.Name)
+		}
+		for _, permission := range role.Permissions {
+			if permission == "" {
+				return fmt.Errorf("[RBAC] roles[%d]: empty permission", index)
+			}
+		}
+		definitions[role.Name] = role
+	}
+	for index, role := range config.Roles {
+		for _, inherited := range role.Inherits {
+			if _, defined := definitions[inherited]; !defined {
+				return fmt.Errorf("[RBAC] roles[%d]: unknown inherited role %q", index, inherited)
+			}
+		}
+	}
+	visiting := map[string]bool{}
+	done := map[string]bool{}
+	var visit func(name string) error
+	visit = func(name string) error {
+		if done[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("[RBAC] role %q inherits from itself", name)
+		}
+		visiting[name] = true
+		for _, inherited := range definitions[name].Inherits {
+			if err := visit(inherited); err != nil {
+				return err
+			}
+		}
+		done[name] = true
+		return nil
+	}
+	for _, role := range config.Roles {
+		if err := visit(role.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve flattens the inheritance of name, definitions have no cycle.
+func (rbac *RBAC) resolve(definitions map[string]Role, name string) resolvedRole {
+	if resolved, found := rbac.roles[name]; found {
+		return resolved
+	}
+	resolved := resolvedRole{roles: map[string]bool{name: true}, permissions: map[string]bool{}}
+	for _, permission := range definitions[name].Permissions {
+		resolved.permissions[permission] = true
+	}
+	for _, inherited := range definitions[name].Inherits {
+		parent := rbac.resolve(definitions, inherited)
+		for role := range parent.roles {
+			resolved.roles[role] = true
+		}
+		for permission := range parent.permissions {
+			resolved.permissions[permission] = true
+		}
+	}
+	rbac.roles[name] = resolved
+	return resolved
+}
+
+// HasRole reports whether user has role, directly or by inheritance.
+func (rbac *RBAC) HasRole(user UserInfo, role string) bool {
+	for _, userRole := range user.Roles {
+		if userRole == role {
+			return true
+		}
+		if rbac != nil && rbac.roles[userRole].roles[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission reports whether one of the roles of user grants permission.
+func (rbac *RBAC) HasPermission(user UserInfo, permission string) bool {
+	if rbac == nil {
+		return false
+	}
+	for _, userRole := range user.Roles {
+		if rbac.roles[userRole].permissions[permission] {
+			return true
+		}
+	}
+	return false
+}
+
+// Permissions returns the sorted permissions granted to user.
+func (rbac *RBAC) Permissions(user UserInfo) []string {
+	if rbac == nil {
+		return nil
+	}
+	granted := map[string]bool{}
+	for _, userRole := range user.Roles {
+		for permission := range rbac.roles[userRole].permissions {
+			granted[permission] = true
+		}
+	}
+	permissions := make([]string, 0, len(granted))
+	for permission := range granted {
+		permissions = append(permissions, permission)
+	}
+	sort.Strings(permissions)
+	return permissions
+}
+
+// RequireRole lets the principal authenticated by the previous middleware go
+// on when it has one of roles, inherited ones included when the RBAC is set.
+// It is meant for route groups:
+//
+//	admin := engine.Group("/admin", auth.ActivateHMACAuth(), auth.RequireRole("admin"))
+func (tnppt *TNPPT) RequireRole(roles ...string) gin.HandlerFunc {
+	if len(roles) == 0 {
+		panic("TNPPT - RequireRole - You need to set at least one role")
+	}
+	return tnppt.requireAccess(tnppt.missingRoles(roles), "missing role")
+}
+
+// RequirePermission lets the principal authenticated by the previous
+// middleware go on when its roles grant all of permissions.
+func (tnppt *TNPPT) RequirePermission(permissions ...string) gin.HandlerFunc {
+	if len(permissions) == 0 {
+		panic("TNPPT - RequirePermission - You need to set at least one permission")
+	}
+	if tnppt.RBAC == nil {
+		panic("TNPPT - RequirePermission - You need to set the RBAC")
+	}
+	return tnppt.requireAccess(tnppt.missingPermissions(permissions), "missing permission")
+}
+
+// missingRoles returns roles unless the principal has one of them.
+func (tnppt *TNPPT) missingRoles(roles []string) func(user UserInfo) []string {
+	return func(user UserInfo) []string {
+		for _, role := range roles {
+			if tnppt.RBAC.HasRole(user, role) {
+				return nil
+			}
+		}
+		return roles
+	}
+}
+
+// missingPermissions returns the permissions the roles of the principal do not grant.
+func (tnppt *TNPPT) missingPermissions(permissions []string) func(user UserInfo) []string {
+	return func(user UserInfo) []string {
+		var missing []string
+		for _, permission := range permissions {
+			if !tnppt.RBAC.HasPermission(user, permission) {
+				missing = append(missing, permission)
+			}
+		}
+		return missing
+	}
+}
+
+// requireAccess answers 403, and audits it, when missing returns what the
+// principal of the request lacks.
+func (tnppt *TNPPT) requireAccess(missing func(user UserInfo) []string, reason string) gin.HandlerFunc {
+	return func(ginEngine *gin.Context) {
+		user, found := UserInfoFromGin(ginEngine)
+		if !found || user.Login == "" {
+			tnppt.audit(ginEngine.Request, user, AuditEntry{Event: AuditAccessDenied, Route: ginEngine.FullPath(), Reason: "no principal"})
+			tnppt.sendError(ginEngine, http.StatusUnauthorized, ErrAuthenticationRequired)
+			return
+		}
+		if tnppt.denied(ginEngine, user, missing, reason) {
+			return
+		}
+		ginEngine.Next()
+	}
+}
+
+// denied answers 403, and audits it, when missing returns what user lacks.
+func (tnppt *TNPPT) denied(ginEngine *gin.Context, user UserInfo, missing func(user UserInfo) []string, reason string) bool {
+	lacking := missing(user)
+	if len(lacking) == 0 {
+		return false
+	}
+	tnppt.audit(ginEngine.Request, user, AuditEntry{Event: AuditAccessDenied, Route: ginEngine.FullPath(), Required: lacking, Reason: reason})
+	tnppt.sendError(ginEngine, http.StatusForbidden, ErrAccessDenied)
+	return true
+}
@@ -0,0 +1,253 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+var testRBACConfig = RBACConfig{Roles: []Role{
+	{Name: "viewer", Permissions: []string{"logs:read"}},
+	{Name: "editor", Inherits: []string{"viewer"}, Permissions: []string{"logs:write"}},
+	{Name: "auditor", Permissions: []string{"audit:read"}},
+	{Name: "admin", Inherits: []string{"editor", "auditor"}, Permissions: []string{"users:manage"}},
+}}
+
+func TestNewRBAC(t *testing.T) {
+	rbac, err := NewRBAC(testRBACConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := UserInfo{Roles: []string{"admin"}}
+	editor := UserInfo{Roles: []string{"editor", "undefined"}}
+
+	assert.True(t, rbac.HasRole(admin, "viewer"))
+	assert.True(t, rbac.HasRole(admin, "auditor"))
+	assert.False(t, rbac.HasRole(editor, "admin"))
+	assert.True(t, rbac.HasRole(editor, "undefined"))
+	assert.False(t, rbac.HasRole(UserInfo{}, "viewer"))
+
+	assert.True(t, rbac.HasPermission(admin, "logs:read"))
+	assert.True(t, rbac.HasPermission(editor, "logs:write"))
+	assert.False(t, rbac.HasPermission(editor, "users:manage"))
+	assert.Equal(t, []string{"audit:read", "logs:read", "logs:write", "users:manage"}, rbac.Permissions(admin))
+	assert.Equal(t, []string{"logs:read", "logs:write"}, rbac.Permissions(editor))
+
+	var noRBAC *RBAC
+	assert.True(t, noRBAC.HasRole(admin, "admin"))
+	assert.False(t, noRBAC.HasRole(admin, "viewer"))
+	assert.False(t, noRBAC.HasPermission(admin, "logs:read"))
+}
+
+func TestRBACConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name  string
+		roles []Role
+	}{
+		{name: "no-name", roles: []Role{{Permissions: []string{"logs:read"}}}},
+		{name: "duplicated", roles: []Role{{Name: "viewer"}, {Name: "viewer"}}},
+		{name: "empty-permission", roles: []Role{{Name: "viewer", Permissions: []string{""}}}},
+		{name: "unknown-inherited", roles: []Role{{Name: "admin", Inherits: []string{"root"}}}},
+		{name: "self-inheritance", roles: []Role{{Name: "admin", Inherits: []string{"admin"}}}},
+		{name: "cycle", roles: []Role{
+			{Name: "a", Inherits: []string{"b"}},
+			{Name: "b", Inherits: []string{"c"}},
+			{Name: "c", Inherits: []string{"a"}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRBAC(RBACConfig{Roles: tt.roles})
+			assert.Error(t, err)
+		})
+	}
+	assert.NoError(t, testRBACConfig.Validate())
+}
+
+func TestLoadRBACFile(t *testing.T) {
+	tests := []struct {
+		file    string
+		content string
+		wantErr bool
+	}{
+		{file: "roles.yaml", content: "roles:\n  - name: viewer\n    permissions: [logs:read]\n  - name: admin\n    inherits: [viewer]\n"},
+		{file: "roles.json", content: `{"roles": [{"name": "viewer", "permissions": ["logs:read"]}, {"name": "admin", "inherits": ["viewer"]}]}`},
+		{file: "typo.yaml", content: "roles:\n  - name: admin\n    inherit: [viewer]\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			rbac, err := LoadRBACFile(path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, rbac.HasPermission(UserInfo{Roles: []string{"admin"}}, "logs:read"))
+		})
+	}
+	_, err := LoadRBACFile(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+type recordingAuditor struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+func (auditor *recordingAuditor) Audit(ctx context.Context, entry AuditEntry) {
+	auditor.mu.Lock()
+	defer auditor.mu.Unlock()
+	auditor.entries = append(auditor.entries, entry)
+}
+
+// denials returns the entries of the access decisions, without the authentications.
+func (auditor *recordingAuditor) denials() []AuditEntry {
+	auditor.mu.Lock()
+	defer auditor.mu.Unlock()
+	var denials []AuditEntry
+	for _, entry := range auditor.entries {
+		if entry.Event == AuditAccessDenied {
+			denials = append(denials, entry)
+		}
+	}
+	return denials
+}
+
+func TestTNPPT_RequireRole(t *testing.T) {
+	rbac, err := NewRBAC(testRBACConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{
+		{Login: "alice", Password: "pass", Roles: []string{"admin"}},
+		{Login: "bob", Password: "pass", Roles: []string{"editor"}},
+		{Login: "carol", Password: "pass"},
+	}})
+	auditor := &recordingAuditor{}
+	auth, err := New(&TNPPT{Store: store, RBAC: rbac, Auditor: auditor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	ok := func(c *gin.Context) { c.String(200, "ok") }
+	admin := router.Group("/admin", auth.ActivateHMACAuth(), auth.RequireRole("admin"))
+	admin.POST("/users", ok)
+	logs := router.Group("/logs", auth.ActivateHMACAuth())
+	logs.POST("/read", auth.RequireRole("viewer"), ok)
+	logs.POST("/write", auth.RequirePermission("logs:read", "logs:write"), ok)
+	logs.POST("/purge", auth.RequirePermission("logs:write", "users:manage"), ok)
+
+	tests := []struct {
+		login    string
+		path     string
+		wantCode int
+	}{
+		{login: "alice", path: "/admin/users", wantCode: 200},
+		{login: "bob", path: "/admin/users", wantCode: 403},
+		{login: "carol", path: "/admin/users", wantCode: 403},
+		{login: "alice", path: "/logs/read", wantCode: 200},
+		{login: "bob", path: "/logs/read", wantCode: 200},
+		{login: "carol", path: "/logs/read", wantCode: 403},
+		{login: "bob", path: "/logs/write", wantCode: 200},
+		{login: "bob", path: "/logs/purge", wantCode: 403},
+		{login: "alice", path: "/logs/purge", wantCode: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.login+tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, hmacLoginRequest(t, auth, tt.path, tt.login, "pass"))
+			assert.Equal(t, tt.wantCode, w.Code)
+		})
+	}
+
+	assert.Len(t, auditor.entries, len(tests)+4, "the authentications are audited too")
+	denials := auditor.denials()
+	if assert.Len(t, denials, 4) {
+		entry := denials[0]
+		assert.Equal(t, AuditAccessDenied, entry.Event)
+		assert.Equal(t, "bob", entry.Login)
+		assert.Equal(t, SchemeHMAC, entry.Scheme)
+		assert.Equal(t, "POST", entry.Method)
+		assert.Equal(t, "/admin/users", entry.Path)
+		assert.Equal(t, "/admin/users", entry.Route)
+		assert.Equal(t, []string{"admin"}, entry.Required)
+		assert.False(t, entry.Time.IsZero())
+		assert.Equal(t, []string{"users:manage"}, denials[3].Required)
+	}
+}
+
+func TestTNPPT_RequireRoleWithoutPrincipal(t *testing.T) {
+	auditor := &recordingAuditor{}
+	// the principal of the TNPPT is not the one of the request
+	auth := &TNPPT{Auditor: auditor, requestState: requestState{Principal: UserInfo{Login: "alice", Roles: []string{"admin"}}}}
+	router := gin.New()
+	router.GET("/admin", auth.RequireRole("admin"))
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+	assert.Len(t, auditor.entries, 1)
+}
+
+func TestTNPPT_RequireRoleConcurrent(t *testing.T) {
+	rbac, err := NewRBAC(testRBACConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{
+		{Login: "alice", Password: "pass", Roles: []string{"admin"}},
+		{Login: "mallory", Password: "pass"},
+	}})
+	auth, err := New(&TNPPT{Store: store, RBAC: rbac})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	// the slow middleware lets the other requests authenticate in between
+	slow := func(c *gin.Context) { time.Sleep(time.Millisecond) }
+	router.POST("/admin/users", auth.ActivateHMACAuth(), slow, auth.RequireRole("admin"), func(c *gin.Context) {
+		c.String(200, principal(c).Login)
+	})
+
+	var wg sync.WaitGroup
+	for pair := 0; pair < 20; pair++ {
+		for _, login := range []string{"alice", "mallory"} {
+			wg.Add(1)
+			go func(login string) {
+				defer wg.Done()
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, hmacLoginRequest(t, auth, "/admin/users", login, "pass"))
+				if login == "mallory" {
+					assert.Equal(t, 403, w.Code)
+					return
+				}
+				assert.Equal(t, 200, w.Code)
+				assert.Equal(t, "alice", w.Body.String())
+			}(login)
+		}
+	}
+	wg.Wait()
+}
+
+func TestTNPPT_RequireConfiguration(t *testing.T) {
+	auth := &TNPPT{}
+	assert.Panics(t, func() { auth.RequireRole() })
+	assert.Panics(t, func() { auth.RequirePermission("logs:read") })
+	auth.RBAC = &RBAC{}
+	assert.Panics(t, func() { auth.RequirePermission() })
+	assert.NotPanics(t, func() { auth.RequireRole("admin") })
+}
@@ -0,0 +1,219 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RefreshTokenRecord tracks one refresh token, every token rotated from the
+// same login shares its FamilyID.
+type RefreshTokenRecord struct {
+	ID        string
+	FamilyID  string
+	Login     string
+	ExpiresAt time.Time
+}
+
+// RefreshTokenStore keeps the state of the issued refresh tokens.
+// Consume must atomically mark the token as used: it returns ErrRefreshTokenReused
+// when it already was, ErrCredentialsRevoked when its family was revoked and
+// ErrCredentialsNotFound when the token is unknown or expired.
+type RefreshTokenStore interface {
+	Save(ctx context.Context, record RefreshTokenRecord) error
+	Consume(ctx context.Context, tokenID string) (RefreshTokenRecord, error)
+	RevokeFamily(ctx context.Context, familyID string) error
+}
+
+const memoryRefreshTokenSweepFrequency = time.Minute
+
+var (
+	ErrRefreshTokenReused          = errors.New("refresh token reused")
+	ErrFailedAuthenticationRefresh = errors.New("incorrect Refresh Token")
+)
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" form:"refresh_token" binding:"required"`
+}
+
+// RefreshTokenHandler trades a refresh token, sent as JSON or form
+// refresh_token, for a new TokenResponse. The refresh token is single use:
+// presenting it again revokes every token of its family.
+//
+//	engine.POST("/token/refresh", auth.RefreshTokenHandler())
+func (tnppt *TNPPT) RefreshTokenHandler() gin.HandlerFunc {
+	return func(ginEngine *gin.Context) {
+		var request RefreshTokenRequest
+		if err := ginEngine.ShouldBind(&request); err != nil {
+			message := errors.New(ErrFailedPayload.Error() + " - " + err.Error())
+			tnppt.sendError(ginEngine, http.StatusBadRequest, message)
+			return
+		}
+		response, err := tnppt.refresh(ginEngine.Request.Context(), request.RefreshToken, time.Now())
+		if err != nil {
+			message := errors.New(ErrFailedAuthenticationRefresh.Error() + " - " + err.Error())
+			tnppt.sendError(ginEngine, http.StatusUnauthorized, message)
+			return
+		}
+		ginEngine.JSON(http.StatusOK, response)
+	}
+}
+
+func (tnppt *TNPPT) refresh(ctx context.Context, refreshToken string, now time.Time) (TokenResponse, error) {
+	settings := tnppt.Tokens
+	if settings.RefreshStore == nil {
+		return TokenResponse{}, errors.New("[REFRESH] Refresh tokens are disabled")
+	}
+	user, claims, err := settings.verifyClaims(refreshToken, tokenUseRefresh, now)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	tokenID, _ := claims["jti"].(string)
+	familyID, _ := claims["fam"].(string)
+	if tokenID == "" || familyID == "" {
+		return TokenResponse{}, fmt.Errorf("%w: jti and fam are required", ErrJWTClaims)
+	}
+	record, err := settings.RefreshStore.Consume(ctx, tokenID)
+	if errors.Is(err, ErrRefreshTokenReused) {
+		if errRevoke := settings.RefreshStore.RevokeFamily(ctx, familyID); errRevoke != nil {
+			tnppt.Logger.get().ErrorContext(ctx, "refresh token family revocation failed", "error", errRevoke)
+		}
+		return TokenResponse{}, err
+	}
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	if record.FamilyID != familyID || record.Login != user.Login {
+		return TokenResponse{}, fmt.Errorf("%w: token does not match its record", ErrJWTClaims)
+	}
+	if store := tnppt.tenantStore(user.Tenant); store != nil {
+		if user.Tenant != "" {
+			ctx = ContextWithTenant(ctx, user.Tenant)
+		}
+		storeUser, errFind := store.FindUserByLogin(ctx, user.Login)
+		if errFind != nil {
+			if errors.Is(errFind, ErrCredentialsNotFound) || errors.Is(errFind, ErrCredentialsRevoked) {
+				if errRevoke := settings.RefreshStore.RevokeFamily(ctx, familyID); errRevoke != nil {
+					tnppt.Logger.get().ErrorContext(ctx, "refresh token family revocation failed", "error", errRevoke)
+				}
+			}
+			return TokenResponse{}, errFind
+		}
+		storeUser.Password = ""
+		storeUser.Tenant = user.Tenant
+		user = storeUser
+	}
+	return settings.issue(ctx, user, familyID, now)
+}
+
+func (settings TokenSettings) issueRefreshToken(ctx context.Context, user UserInfo, familyID string, now time.Time) (string, error) {
+	tokenID, err := randomTokenID()
+	if err != nil {
+		return "", err
+	}
+	if familyID == "" {
+		if familyID, err = randomTokenID(); err != nil {
+			return "", err
+		}
+	}
+	record := RefreshTokenRecord{
+		ID:        tokenID,
+		FamilyID:  familyID,
+		Login:     user.Login,
+		ExpiresAt: now.Add(settings.RefreshTTL),
+	}
+	if err := settings.RefreshStore.Save(ctx, record); err != nil {
+		return "", err
+	}
+	return settings.signWithID(tokenID, user, tokenUseRefresh, settings.RefreshTTL, now, map[string]interface{}{"fam": familyID})
+}
+
+type memoryRefreshToken struct {
+	record RefreshTokenRecord
+	used   bool
+}
+
+// MemoryRefreshTokenStore is a RefreshTokenStore for a single instance,
+// expired tokens and families are swept from time to time.
+type MemoryRefreshTokenStore struct {
+	mu        sync.Mutex
+	tokens    map[string]*memoryRefreshToken
+	revoked   map[string]time.Time
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryRefreshTokenStore() *MemoryRefreshTokenStore {
+	return &MemoryRefreshTokenStore{
+		tokens:  map[string]*memoryRefreshToken{},
+		revoked: map[string]time.Time{},
+		now:     time.Now,
+	}
+}
+
+func (store *MemoryRefreshTokenStore) Save(ctx context.Context, record RefreshTokenRecord) error {
+	if record.ID == "" || record.FamilyID == "" {
+		return errors.New("TNPPT - Refresh - ID and FamilyID are required")
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.sweep()
+	if _, exists := store.tokens[record.ID]; exists {
+		return fmt.Errorf("TNPPT - Refresh - token %s already saved", record.ID)
+	}
+	store.tokens[record.ID] = &memoryRefreshToken{record: record}
+	return nil
+}
+
+func (store *MemoryRefreshTokenStore) Consume(ctx context.Context, tokenID string) (RefreshTokenRecord, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	token, found := store.tokens[tokenID]
+	if !found || !store.now().Before(token.record.ExpiresAt) {
+		return RefreshTokenRecord{}, ErrCredentialsNotFound
+	}
+	if _, revoked := store.revoked[token.record.FamilyID]; revoked {
+		return RefreshTokenRecord{}, ErrCredentialsRevoked
+	}
+	if token.used {
+		return token.record, ErrRefreshTokenReused
+	}
+	token.used = true
+	return token.record, nil
+}
+
+func (store *MemoryRefreshTokenStore) RevokeFamily(ctx context.Context, familyID string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	expiresAt := store.now()
+	for _, token := range store.tokens {
+		if token.record.FamilyID == familyID && token.record.ExpiresAt.After(expiresAt) {
+			expiresAt = token.record.ExpiresAt
+		}
+	}
+	store.revoked[familyID] = expiresAt
+	return nil
+}
+
+func (store *MemoryRefreshTokenStore) sweep() {
+	now := store.now()
+	if now.Sub(store.lastSweep) < memoryRefreshTokenSweepFrequency {
+		return
+	}
+	store.lastSweep = now
+	for tokenID, token := range store.tokens {
+		if !now.Before(token.record.ExpiresAt) {
+			delete(store.tokens, tokenID)
+		}
+	}
+	for familyID, expiresAt := range store.revoked {
+		if !now.Before(expiresAt) {
+			delete(store.revoked, familyID)
+		}
+	}
+}
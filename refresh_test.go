@@ -0,0 +1,157 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func refreshRequest(router *gin.Engine, refreshToken string) (int, TokenResponse) {
+	w := httptest.NewRecorder()
+	body, _ := json.Marshal(RefreshTokenRequest{RefreshToken: refreshToken})
+	req, _ := http.NewRequest("POST", "/token/refresh", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	var response TokenResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response
+}
+
+func TestTNPPT_RefreshTokenHandler(t *testing.T) {
+	auth := newTokenTestAuth(t, time.Hour)
+	router := tokenMockHandler(t, auth)
+	router.POST("/token/refresh", auth.RefreshTokenHandler())
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, hmacLoginRequest(t, auth, "/token", "steven", "pass"))
+	var login TokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &login); err != nil {
+		t.Fatal(err)
+	}
+
+	code, first := refreshRequest(router, login.RefreshToken)
+	assert.Equal(t, 200, code)
+	assert.NotEmpty(t, first.AccessToken)
+	assert.NotEqual(t, login.RefreshToken, first.RefreshToken)
+
+	assert.Equal(t, []string{"logs:read"}, mePrincipal(t, router, first.AccessToken).Scopes)
+
+	code, second := refreshRequest(router, first.RefreshToken)
+	assert.Equal(t, 200, code)
+
+	// replaying an already rotated token revokes the whole family
+	code, _ = refreshRequest(router, login.RefreshToken)
+	assert.Equal(t, 401, code)
+	code, _ = refreshRequest(router, second.RefreshToken)
+	assert.Equal(t, 401, code)
+
+	// a new login starts a new family
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, hmacLoginRequest(t, auth, "/token", "steven", "pass"))
+	if err := json.Unmarshal(w.Body.Bytes(), &login); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	form := url.Values{"refresh_token": {login.RefreshToken}}
+	req, _ := http.NewRequest("POST", "/token/refresh", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	code, _ = refreshRequest(router, login.AccessToken)
+	assert.Equal(t, 401, code)
+	code, _ = refreshRequest(router, "")
+	assert.Equal(t, 400, code)
+}
+
+func TestTNPPT_RefreshDeletedUser(t *testing.T) {
+	auth := newTokenTestAuth(t, time.Hour)
+	ctx := context.Background()
+	now := time.Now()
+	response, err := auth.Tokens.issue(ctx, UserInfo{Login: "ghost"}, "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = auth.refresh(ctx, response.RefreshToken, now)
+	assert.True(t, errors.Is(err, ErrCredentialsNotFound), err)
+
+	response, err = auth.Tokens.issue(ctx, UserInfo{Login: "steven"}, "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = auth.refresh(ctx, response.RefreshToken, now.Add(2*time.Hour))
+	assert.True(t, errors.Is(err, ErrJWTExpired), err)
+}
+
+func TestMemoryRefreshTokenStore(t *testing.T) {
+	store := NewMemoryRefreshTokenStore()
+	now := time.Now()
+	store.now = func() time.Time {
+		return now
+	}
+	ctx := context.Background()
+	for _, record := range []RefreshTokenRecord{
+		{ID: "a1", FamilyID: "a", Login: "steven", ExpiresAt: now.Add(time.Hour)},
+		{ID: "a2", FamilyID: "a", Login: "steven", ExpiresAt: now.Add(2 * time.Hour)},
+		{ID: "b1", FamilyID: "b", Login: "steven", ExpiresAt: now.Add(time.Hour)},
+	} {
+		assert.NoError(t, store.Save(ctx, record))
+	}
+	assert.Error(t, store.Save(ctx, RefreshTokenRecord{ID: "a1", FamilyID: "a"}))
+	assert.Error(t, store.Save(ctx, RefreshTokenRecord{ID: "c1"}))
+
+	record, err := store.Consume(ctx, "a1")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", record.FamilyID)
+	_, err = store.Consume(ctx, "a1")
+	assert.True(t, errors.Is(err, ErrRefreshTokenReused))
+	_, err = store.Consume(ctx, "unknown")
+	assert.True(t, errors.Is(err, ErrCredentialsNotFound))
+
+	assert.NoError(t, store.RevokeFamily(ctx, "a"))
+	_, err = store.Consume(ctx, "a2")
+	assert.True(t, errors.Is(err, ErrCredentialsRevoked))
+	_, err = store.Consume(ctx, "b1")
+	assert.NoError(t, err)
+
+	now = now.Add(90 * time.Minute)
+	_, err = store.Consume(ctx, "b1")
+	assert.True(t, errors.Is(err, ErrCredentialsNotFound))
+	store.sweep()
+	assert.Len(t, store.tokens, 1)
+	assert.Len(t, store.revoked, 1)
+	now = now.Add(time.Hour)
+	store.lastSweep = time.Time{}
+	store.sweep()
+	assert.Len(t, store.tokens, 0)
+	assert.Len(t, store.revoked, 0)
+}
+
+func TestMemoryRefreshTokenStore_ConcurrentConsume(t *testing.T) {
+	store := NewMemoryRefreshTokenStore()
+	ctx := context.Background()
+	assert.NoError(t, store.Save(ctx, RefreshTokenRecord{ID: "a1", FamilyID: "a", ExpiresAt: time.Now().Add(time.Hour)}))
+	results := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		go func() {
+			_, err := store.Consume(ctx, "a1")
+			results <- err
+		}()
+	}
+	succeeded := 0
+	for i := 0; i < 20; i++ {
+		if <-results == nil {
+			succeeded++
+		}
+	}
+	assert.Equal(t, 1, succeeded)
+}
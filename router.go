@@ -0,0 +1,218 @@
+package tnpptMiddleware
+
+import (
+	"log/slog"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RouteAuthenticated = "authenticated"
+	RouteAnonymous     = "anonymous"
+	RoutePublic        = "public"
+)
+
+// RouteAccess is a route registered through a Router, Access tells how it is
+// protected: RouteAuthenticated, RouteAnonymous or RoutePublic.
+type RouteAccess struct {
+	Method string
+	Path   string
+	Access string
+}
+
+// Router registers gin routes that require the authentication of its schemes
+// unless registered through Public() (no authentication) or AllowAnonymous()
+// (credentials checked when sent, the request goes on with an anonymous principal otherwise):
+//
+//	router := auth.Router(engine, tnpptMiddleware.SchemeHMAC, tnpptMiddleware.SchemeAPIKey)
+//	router.POST("/log", postLog)
+//	router.Public().GET("/health", health)
+//	admin := router.Group("/admin", auth.RequireRole("admin"))
+//
+// The middlewares given to Group and Use run after the authentication.
+type Router struct {
+	gin         gin.IRouter
+	basePath    string
+	access      string
+	middlewares []gin.HandlerFunc
+	shared      *routerShared
+}
+
+// routerShared is common to a Router, its groups and views.
+type routerShared struct {
+	authenticate   gin.HandlerFunc
+	allowAnonymous gin.HandlerFunc
+	logger         *slog.Logger
+	mu             sync.Mutex
+	routes         []RouteAccess
+}
+
+// Router wraps router, a *gin.Engine or a *gin.RouterGroup, several schemes
+// behave as ActivateAny.
+func (tnppt *TNPPT) Router(router gin.IRouter, schemes ...string) *Router {
+	verifier := tnppt.newVerifier("Router", schemes, len(schemes) > 1)
+	basePath := "/"
+	if group, isGroup := router.(interface{ BasePath() string }); isGroup {
+		basePath = group.BasePath()
+	}
+	return &Router{
+		gin:      router,
+		basePath: basePath,
+		access:   RouteAuthenticated,
+		shared: &routerShared{
+			authenticate:   verifier.handlerFunc(),
+			allowAnonymous: verifier.Optional().handlerFunc(),
+			logger:         tnppt.Logger.get(),
+		},
+	}
+}
+
+// Public returns the view of router registering routes without authentication.
+func (router *Router) Public() *Router {
+	return router.view(RoutePublic)
+}
+
+// AllowAnonymous returns the view of router registering routes reachable
+// without credentials, the credentials sent are still checked.
+func (router *Router) AllowAnonymous() *Router {
+	return router.view(RouteAnonymous)
+}
+
+func (router *Router) view(access string) *Router {
+	view := *router
+	view.access = access
+	return &view
+}
+
+// Group creates a group of routes with the protection of router.
+func (router *Router) Group(relativePath string, middlewares ...gin.HandlerFunc) *Router {
+	group := router.gin.Group(relativePath)
+	return &Router{
+		gin:         group,
+		basePath:    group.BasePath(),
+		access:      router.access,
+		middlewares: router.handlers(middlewares),
+		shared:      router.shared,
+	}
+}
+
+// Use adds middlewares to the routes registered afterwards through router.
+func (router *Router) Use(middlewares ...gin.HandlerFunc) *Router {
+	router.middlewares = router.handlers(middlewares)
+	return router
+}
+
+func (router *Router) Handle(method string, relativePath string, handlers ...gin.HandlerFunc) *Router {
+	chain := make([]gin.HandlerFunc, 0, len(handlers)+len(router.middlewares)+1)
+	switch router.access {
+	case RouteAuthenticated:
+		chain = append(chain, router.shared.authenticate)
+	case RouteAnonymous:
+		chain = append(chain, router.shared.allowAnonymous)
+	}
+	chain = append(chain, router.middlewares...)
+	chain = append(chain, handlers...)
+	router.gin.Handle(method, relativePath, chain...)
+	router.shared.mu.Lock()
+	defer router.shared.mu.Unlock()
+	router.shared.routes = append(router.shared.routes, RouteAccess{
+		Method: method,
+		Path:   joinRoutePaths(router.basePath, relativePath),
+		Access: router.access,
+	})
+	return router
+}
+
+func (router *Router) GET(relativePath string, handlers ...gin.HandlerFunc) *Router {
+	return router.Handle(http.MethodGet, relativePath, handlers...)
+}
+
+func (router *Router) POST(relativePath string, handlers ...gin.HandlerFunc) *Router {
+	return router.Handle(http.MethodPost, relativePath, handlers...)
+}
+
+func (router *Router) PUT(relativePath string, handlers ...gin.HandlerFunc) *Router {
+	return router.Handle(http.MethodPut, relativePath, handlers...)
+}
+
+func (router *Router) PATCH(relativePath string, handlers ...gin.HandlerFunc) *Router {
+	return router.Handle(http.MethodPatch, relativePath, handlers...)
+}
+
+func (router *Router) DELETE(relativePath string, handlers ...gin.HandlerFunc) *Router {
+	return router.Handle(http.MethodDelete, relativePath, handlers...)
+}
+
+func (router *Router) HEAD(relativePath string, handlers ...gin.HandlerFunc) *Router {
+	return router.Handle(http.MethodHead, relativePath, handlers...)
+}
+
+func (router *Router) OPTIONS(relativePath string, handlers ...gin.HandlerFunc) *Router {
+	return router.Handle(http.MethodOptions, relativePath, handlers...)
+}
+
+// Any registers the route for the methods gin.IRoutes.Any does.
+func (router *Router) Any(relativePath string, handlers ...gin.HandlerFunc) *Router {
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodHead, http.MethodOptions, http.MethodDelete, http.MethodConnect, http.MethodTrace} {
+		router.Handle(method, relativePath, handlers...)
+	}
+	return router
+}
+
+// Routes returns the routes registered through the Router and its groups,
+// sorted by path then method.
+func (router *Router) Routes() []RouteAccess {
+	router.shared.mu.Lock()
+	routes := append([]RouteAccess(nil), router.shared.routes...)
+	router.shared.mu.Unlock()
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	return routes
+}
+
+// PublicRoutes returns the routes reachable without credentials.
+func (router *Router) PublicRoutes() []RouteAccess {
+	var public []RouteAccess
+	for _, route := range router.Routes() {
+		if route.Access != RouteAuthenticated {
+			public = append(public, route)
+		}
+	}
+	return public
+}
+
+// ReportPublicRoutes logs at Warn, on the Logger of the TNPPT, the routes
+// reachable without credentials, to be called at startup once every route is registered.
+func (router *Router) ReportPublicRoutes() {
+	for _, route := range router.PublicRoutes() {
+		router.shared.logger.Warn("route reachable without credentials", "access", route.Access, "method", route.Method, "path", route.Path)
+	}
+}
+
+// handlers returns the middlewares of router followed by middlewares.
+func (router *Router) handlers(middlewares []gin.HandlerFunc) []gin.HandlerFunc {
+	combined := make([]gin.HandlerFunc, 0, len(router.middlewares)+len(middlewares))
+	combined = append(combined, router.middlewares...)
+	return append(combined, middlewares...)
+}
+
+// joinRoutePaths joins as gin does, keeping the trailing slash of relativePath.
+func joinRoutePaths(absolutePath string, relativePath string) string {
+	if relativePath == "" {
+		return absolutePath
+	}
+	joined := path.Join(absolutePath, relativePath)
+	if relativePath[len(relativePath)-1] == '/' && joined[len(joined)-1] != '/' {
+		return joined + "/"
+	}
+	return joined
+}
@@ -0,0 +1,109 @@
+package tnpptMiddleware
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTNPPT_Router(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{
+		Users:   []UserRecord{{Login: "alice", Password: "pass", Roles: []string{"admin"}}, {Login: "bob", Password: "pass"}},
+		APIKeys: []APIKeyRecord{{Login: "collector", Key: "collector-key"}},
+	})
+	output := &bytes.Buffer{}
+	auth, err := New(&TNPPT{Store: store, Logger: LoggerSettings{Handler: slog.NewJSONHandler(output, nil)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	whoami := func(c *gin.Context) { c.String(200, "user:"+principal(c).Login) }
+
+	router := auth.Router(engine, SchemeHMAC, SchemeAPIKey)
+	router.POST("/log", whoami)
+	router.Public().GET("/health", whoami)
+	router.AllowAnonymous().POST("/feed", whoami)
+	admin := router.Group("/admin", auth.RequireRole("admin"))
+	admin.POST("/users", whoami)
+	docs := router.Public().Group("/docs")
+	docs.GET("/", whoami)
+	v2 := auth.Router(engine.Group("/v2"), SchemeAPIKey)
+	v2.POST("/log", whoami)
+
+	apiKeyRequest := func(path string, key string) *http.Request {
+		req, _ := http.NewRequest("POST", path, nil)
+		req.Header.Set("API_KEY", key)
+		return req
+	}
+	anonymous := func(method string, path string) *http.Request {
+		req, _ := http.NewRequest(method, path, nil)
+		return req
+	}
+	tests := []struct {
+		name     string
+		req      *http.Request
+		wantCode int
+		wantBody string
+	}{
+		{name: "authenticated-hmac", req: hmacLoginRequest(t, auth, "/log", "bob", "pass"), wantCode: 200, wantBody: "user:bob"},
+		{name: "authenticated-api-key", req: apiKeyRequest("/log", "collector-key"), wantCode: 200, wantBody: "user:collector"},
+		{name: "authenticated-without-credentials", req: anonymous("POST", "/log"), wantCode: 401},
+		{name: "public", req: anonymous("GET", "/health"), wantCode: 200, wantBody: "user:"},
+		{name: "anonymous", req: anonymous("POST", "/feed"), wantCode: 200, wantBody: "user:"},
+		{name: "anonymous-signed", req: hmacLoginRequest(t, auth, "/feed", "bob", "pass"), wantCode: 200, wantBody: "user:bob"},
+		{name: "anonymous-invalid-credentials", req: apiKeyRequest("/feed", "wrong-key"), wantCode: 401},
+		{name: "group-after-authentication", req: hmacLoginRequest(t, auth, "/admin/users", "alice", "pass"), wantCode: 200, wantBody: "user:alice"},
+		{name: "group-denied", req: hmacLoginRequest(t, auth, "/admin/users", "bob", "pass"), wantCode: 403},
+		{name: "group-without-credentials", req: anonymous("POST", "/admin/users"), wantCode: 401},
+		{name: "public-group", req: anonymous("GET", "/docs/"), wantCode: 200},
+		{name: "public-after-authentication", req: anonymous("GET", "/health"), wantCode: 200, wantBody: "user:"},
+		{name: "sub-router", req: apiKeyRequest("/v2/log", "collector-key"), wantCode: 200, wantBody: "user:collector"},
+		{name: "sub-router-scheme", req: hmacLoginRequest(t, auth, "/v2/log", "bob", "pass"), wantCode: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			engine.ServeHTTP(w, tt.req)
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, w.Body.String())
+			}
+		})
+	}
+
+	assert.Equal(t, []RouteAccess{
+		{Method: "POST", Path: "/admin/users", Access: RouteAuthenticated},
+		{Method: "GET", Path: "/docs/", Access: RoutePublic},
+		{Method: "POST", Path: "/feed", Access: RouteAnonymous},
+		{Method: "GET", Path: "/health", Access: RoutePublic},
+		{Method: "POST", Path: "/log", Access: RouteAuthenticated},
+	}, router.Routes())
+	assert.Equal(t, []RouteAccess{
+		{Method: "GET", Path: "/docs/", Access: RoutePublic},
+		{Method: "POST", Path: "/feed", Access: RouteAnonymous},
+		{Method: "GET", Path: "/health", Access: RoutePublic},
+	}, router.PublicRoutes())
+	assert.Equal(t, []RouteAccess{{Method: "POST", Path: "/v2/log", Access: RouteAuthenticated}}, v2.Routes())
+
+	output.Reset()
+	router.ReportPublicRoutes()
+	var reported []RouteAccess
+	for _, record := range decodeLogLines(t, output) {
+		assert.Equal(t, "WARN", record["level"])
+		assert.Equal(t, "route reachable without credentials", record["msg"])
+		reported = append(reported, RouteAccess{Method: record["method"].(string), Path: record["path"].(string), Access: record["access"].(string)})
+	}
+	assert.Equal(t, router.PublicRoutes(), reported)
+}
+
+func TestTNPPT_RouterConfiguration(t *testing.T) {
+	auth := &TNPPT{}
+	assert.Panics(t, func() { auth.Router(gin.New()) })
+	assert.Panics(t, func() { auth.Router(gin.New(), "kerberos") })
+}
@@ -0,0 +1,535 @@
+package tnpptMiddleware
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	SchemeSCRAM = "scram-sha-256"
+
+	scramMechanism     = "SCRAM-SHA-256"
+	scramMinIterations = 4096
+)
+
+// SCRAMSettings configures ActivateSCRAMAuth. An exchange started by a request
+// must be finished within SessionTTL (30 seconds by default) by the same
+// instance. At most MaxSessions exchanges (10000 by default) are pending at
+// once, MaxClientSessions (10 by default) per client IP. Key derives the salts
+// answered for the logins without verifier, random unless set, give the same
+// Key to all instances so that these salts do not tell the unknown logins apart.
+// Iterations, answered for these logins too, is the count the verifiers are
+// created with (Passwords.PBKDF2Iterations, DefaultPBKDF2Iterations unless set).
+type SCRAMSettings struct {
+	SessionTTL        time.Duration
+	MaxSessions       int
+	MaxClientSessions int
+	Key               []byte
+	Iterations        int
+
+	sessions *scramSessions
+}
+
+type PayloadSCRAMFormat struct {
+	Login           string
+	SID             string
+	ServerSignature string
+}
+
+var (
+	ErrFailedAuthenticationSCRAM = errors.New("incorrect Username or Password")
+	ErrSCRAMContinue             = errors.New("SCRAM-SHA-256 exchange continues")
+	ErrSCRAMUnknownSession       = errors.New("unknown or expired SCRAM-SHA-256 session")
+	ErrSCRAMTooManySessions      = errors.New("too many pending SCRAM-SHA-256 exchanges")
+)
+
+// scramExchange is the 401 answering the client-first message, it carries
+// the server-first message to the WWW-Authenticate header.
+type scramExchange struct {
+	sid  string
+	data string
+}
+
+func (exchange scramExchange) Error() string {
+	return ErrSCRAMContinue.Error()
+}
+
+func (exchange scramExchange) Unwrap() error {
+	return ErrSCRAMContinue
+}
+
+// challenged reports whether err is the server-first message of an exchange
+// rather than a failure.
+func challenged(err error) bool {
+	return errors.Is(err, ErrSCRAMContinue)
+}
+
+// scramVerifier is what the server keeps, the password can not be derived
+// from it, nor can the client proof.
+type scramVerifier struct {
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+type scramSession struct {
+	login           string
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	tenant          string
+	client          string
+	expiresAt       time.Time
+}
+
+// scramSessions holds the exchanges waiting for their client-final message,
+// queue keeps their sids in creation order so that the expired ones are swept
+// from its head.
+type scramSessions struct {
+	mu                sync.Mutex
+	sessions          map[string]scramSession
+	clients           map[string]int
+	queue             []scramPending
+	maxSessions       int
+	maxClientSessions int
+}
+
+type scramPending struct {
+	sid       string
+	expiresAt time.Time
+}
+
+// NewSCRAMVerifier derives the SCRAM-SHA-256 verifier of password, in the RFC
+// 5803 format, to be stored as the user PasswordHash:
+//
+//	SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+//
+// iterations is DefaultPBKDF2Iterations when 0, PasswordPolicy.Hash gives the
+// same with the PBKDF2Iterations of the policy.
+func NewSCRAMVerifier(password string, iterations int) (string, error) {
+	if iterations == 0 {
+		iterations = DefaultPBKDF2Iterations
+	}
+	if iterations < scramMinIterations {
+		return "", fmt.Errorf("TNPPT - SCRAM - You need at least %d iterations", scramMinIterations)
+	}
+	salt, err := randomSalt()
+	if err != nil {
+		return "", err
+	}
+	return deriveSCRAMVerifier(password, salt, iterations).String(), nil
+}
+
+// ActivateSCRAMAuth runs the RFC 7804 SCRAM-SHA-256 exchange on the route it
+// protects, against the verifier stored as UserInfo.PasswordHash (see
+// NewSCRAMVerifier):
+//
+//	-> Authorization: SCRAM-SHA-256 data=base64(client-first)
+//	<- 401 WWW-Authenticate: SCRAM-SHA-256 sid=..., data=base64(server-first)
+//	-> Authorization: SCRAM-SHA-256 sid=..., data=base64(client-final)
+//	<- 200 Authentication-Info: sid=..., data=base64(server-final)
+//
+// Channel binding and authorization identities are not supported, logins and
+// passwords are used as given (no SASLprep).
+func (tnppt *TNPPT) ActivateSCRAMAuth() gin.HandlerFunc {
+	return tnppt.activate(SchemeSCRAM)
+}
+
+func (tnppt *TNPPT) authenticateSCRAM() error {
+	parameters, err := tnppt.checkSCRAMPayload()
+	if err != nil {
+		return errors.New(ErrFailedPayload.Error() + " - " + err.Error())
+	}
+	now := time.Unix(0, tnppt.Security.TimeReceived*int64(time.Millisecond))
+	if parameters["sid"] == "" {
+		return tnppt.startSCRAM(parameters["data"], now)
+	}
+	return tnppt.finishSCRAM(parameters["sid"], parameters["data"], now)
+}
+
+// checkSCRAMPayload returns the auth-params, data decoded.
+func (tnppt *TNPPT) checkSCRAMPayload() (map[string]string, error) {
+	authorization := tnppt.Request.Header.Get("Authorization")
+	if len(authorization) <= len(scramMechanism) || !strings.EqualFold(authorization[:len(scramMechanism)+1], scramMechanism+" ") {
+		return nil, fmt.Errorf("[SCRAM] No payload detected")
+	}
+	parameters, err := parseAuthParameters("SCRAM", authorization[len(scramMechanism)+1:])
+	if err != nil {
+		return nil, err
+	}
+	if realm, found := parameters["realm"]; found && realm != tnppt.Realm {
+		return nil, fmt.Errorf("[SCRAM] Incorrect realm")
+	}
+	data, errData := base64.StdEncoding.DecodeString(parameters["data"])
+	if errData != nil {
+		data, errData = base64.RawStdEncoding.DecodeString(parameters["data"])
+	}
+	if errData != nil || len(data) == 0 {
+		return nil, fmt.Errorf("[SCRAM] Incorrect data")
+	}
+	parameters["data"] = string(data)
+	return parameters, nil
+}
+
+// startSCRAM answers the client-first message with the salt of the login and
+// the nonce completed by the server.
+func (tnppt *TNPPT) startSCRAM(clientFirst string, now time.Time) error {
+	session, clientNonce, err := parseSCRAMClientFirst(clientFirst)
+	if err != nil {
+		return errors.New(ErrFailedPayload.Error() + " - " + err.Error())
+	}
+	tnppt.PayloadSCRAM = PayloadSCRAMFormat{Login: session.login}
+	salt, iterations := tnppt.scramSalt(session.login)
+	serverNonce := make([]byte, 18)
+	sid := make([]byte, 16)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return err
+	}
+	if _, err := rand.Read(sid); err != nil {
+		return err
+	}
+	session.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(serverNonce)
+	session.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", session.nonce, base64.StdEncoding.EncodeToString(salt), iterations)
+	session.tenant = tnppt.tenant
+	session.client = tnppt.clientIP(tnppt.Request)
+	session.expiresAt = now.Add(tnppt.SCRAM.SessionTTL)
+	exchange := scramExchange{sid: hex.EncodeToString(sid), data: base64.StdEncoding.EncodeToString([]byte(session.serverFirst))}
+	if err := tnppt.SCRAM.sessions.add(exchange.sid, session, now); err != nil {
+		return err
+	}
+	return exchange
+}
+
+// scramSalt returns the salt and iterations of the login verifier, or stable
+// made up ones when there is none.
+func (tnppt *TNPPT) scramSalt(login string) ([]byte, int) {
+	if tnppt.credentialsValid() {
+		if verifier, err := parseSCRAMVerifier(tnppt.Principal.PasswordHash); err == nil {
+			return verifier.salt, verifier.iterations
+		}
+	}
+	if tnppt.tenant != "" {
+		login = tnppt.tenant + "/" + login
+	}
+	iterations := tnppt.SCRAM.Iterations
+	if iterations == 0 {
+		iterations = tnppt.Passwords.withDefaults().PBKDF2Iterations
+	}
+	return scramHMAC(tnppt.SCRAM.Key, "salt:"+login)[:16], iterations
+}
+
+// finishSCRAM checks the client proof, a session is used once whatever the outcome.
+func (tnppt *TNPPT) finishSCRAM(sid string, clientFinal string, now time.Time) error {
+	session, found := tnppt.SCRAM.sessions.take(sid, now)
+	if !found || session.tenant != tnppt.tenant {
+		return errors.New(ErrFailedAuthenticationSCRAM.Error() + " - " + ErrSCRAMUnknownSession.Error())
+	}
+	withoutProof, proof, err := parseSCRAMClientFinal(clientFinal, session)
+	if err != nil {
+		return errors.New(ErrFailedPayload.Error() + " - " + err.Error())
+	}
+	tnppt.PayloadSCRAM = PayloadSCRAMFormat{Login: session.login, SID: sid}
+	if err := tnppt.checkLoginLockout(); err != nil {
+		return err
+	}
+	if !tnppt.credentialsValid() {
+		return ErrFailedAuthenticationSCRAM
+	}
+	verifier, err := parseSCRAMVerifier(tnppt.Principal.PasswordHash)
+	if err != nil {
+		return ErrFailedAuthenticationSCRAM
+	}
+	authMessage := session.clientFirstBare + "," + session.serverFirst + "," + withoutProof
+	serverSignature, valid := verifier.verifyProof(authMessage, proof)
+	if !valid {
+		return ErrFailedAuthenticationSCRAM
+	}
+	tnppt.PayloadSCRAM.ServerSignature = base64.StdEncoding.EncodeToString(serverSignature)
+	return nil
+}
+
+// scramChallenge is the WWW-Authenticate value, the server-first message
+// when errorFetch continues an exchange.
+func (tnppt *TNPPT) scramChallenge(errorFetch error) string {
+	var exchange scramExchange
+	if errors.As(errorFetch, &exchange) {
+		return fmt.Sprintf("%s sid=%s, data=%s", scramMechanism, exchange.sid, exchange.data)
+	}
+	return fmt.Sprintf("%s realm=%q", scramMechanism, tnppt.Realm)
+}
+
+// scramAuthenticationInfo carries the server-final message proving that the
+// server knows the verifier.
+func (tnppt *TNPPT) scramAuthenticationInfo() string {
+	serverFinal := base64.StdEncoding.EncodeToString([]byte("v=" + tnppt.PayloadSCRAM.ServerSignature))
+	return fmt.Sprintf("sid=%s, data=%s", tnppt.PayloadSCRAM.SID, serverFinal)
+}
+
+func (settings *SCRAMSettings) init() error {
+	if settings.SessionTTL == 0 {
+		settings.SessionTTL = 30 * time.Second
+	}
+	if settings.MaxSessions < 0 || settings.MaxClientSessions < 0 {
+		return errors.New("TNPPT - SCRAM - You need positive MaxSessions and MaxClientSessions")
+	}
+	if settings.Iterations != 0 && settings.Iterations < scramMinIterations {
+		return fmt.Errorf("TNPPT - SCRAM - You need at least %d Iterations", scramMinIterations)
+	}
+	if settings.MaxSessions == 0 {
+		settings.MaxSessions = 10000
+	}
+	if settings.MaxClientSessions == 0 {
+		settings.MaxClientSessions = 10
+	}
+	return nil
+}
+
+// start draws the Key and keeps the sessions, once a route uses SCRAM.
+func (settings *SCRAMSettings) start() error {
+	if settings.sessions != nil {
+		return nil
+	}
+	if len(settings.Key) == 0 {
+		settings.Key = make([]byte, 32)
+		if _, err := rand.Read(settings.Key); err != nil {
+			return err
+		}
+	}
+	settings.sessions = &scramSessions{
+		sessions:          map[string]scramSession{},
+		clients:           map[string]int{},
+		maxSessions:       settings.MaxSessions,
+		maxClientSessions: settings.MaxClientSessions,
+	}
+	return nil
+}
+
+// parseSCRAMClientFirst reads gs2-header client-first-message-bare, only the
+// "n" and "y" channel binding flags without authzid are accepted.
+func parseSCRAMClientFirst(message string) (scramSession, string, error) {
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 {
+		return scramSession{}, "", fmt.Errorf("[SCRAM] Incorrect client-first message")
+	}
+	if strings.HasPrefix(parts[0], "p=") {
+		return scramSession{}, "", fmt.Errorf("[SCRAM] Channel binding is not supported")
+	}
+	if parts[0] != "n" && parts[0] != "y" {
+		return scramSession{}, "", fmt.Errorf("[SCRAM] Incorrect client-first message")
+	}
+	if parts[1] != "" {
+		return scramSession{}, "", fmt.Errorf("[SCRAM] Authorization identity is not supported")
+	}
+	attributes := strings.Split(parts[2], ",")
+	if len(attributes) < 2 || !strings.HasPrefix(attributes[0], "n=") || !strings.HasPrefix(attributes[1], "r=") {
+		return scramSession{}, "", fmt.Errorf("[SCRAM] Incorrect client-first message")
+	}
+	for _, extension := range attributes[2:] {
+		if strings.HasPrefix(extension, "m=") {
+			return scramSession{}, "", fmt.Errorf("[SCRAM] Mandatory extensions are not supported")
+		}
+	}
+	login, err := decodeSCRAMName(attributes[0][2:])
+	if err != nil {
+		return scramSession{}, "", err
+	}
+	clientNonce := attributes[1][2:]
+	if !validSCRAMNonce(clientNonce) {
+		return scramSession{}, "", fmt.Errorf("[SCRAM] Incorrect nonce")
+	}
+	session := scramSession{
+		login:           login,
+		gs2Header:       parts[0] + "," + parts[1] + ",",
+		clientFirstBare: parts[2],
+	}
+	return session, clientNonce, nil
+}
+
+// parseSCRAMClientFinal returns the client-final message without its proof,
+// and the proof, once the channel binding and nonce checked against session.
+func parseSCRAMClientFinal(message string, session scramSession) (string, []byte, error) {
+	proofAt := strings.LastIndex(message, ",p=")
+	if proofAt < 0 {
+		return "", nil, fmt.Errorf("[SCRAM] Incorrect client-final message")
+	}
+	withoutProof := message[:proofAt]
+	attributes := strings.Split(withoutProof, ",")
+	if len(attributes) < 2 || !strings.HasPrefix(attributes[0], "c=") || !strings.HasPrefix(attributes[1], "r=") {
+		return "", nil, fmt.Errorf("[SCRAM] Incorrect client-final message")
+	}
+	if attributes[0][2:] != base64.StdEncoding.EncodeToString([]byte(session.gs2Header)) {
+		return "", nil, fmt.Errorf("[SCRAM] Incorrect channel binding")
+	}
+	if attributes[1][2:] != session.nonce {
+		return "", nil, fmt.Errorf("[SCRAM] Incorrect nonce")
+	}
+	proof, err := base64.StdEncoding.DecodeString(message[proofAt+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return "", nil, fmt.Errorf("[SCRAM] Incorrect proof")
+	}
+	return withoutProof, proof, nil
+}
+
+// decodeSCRAMName reverts the =2C and =3D escaping of "," and "=".
+func decodeSCRAMName(name string) (string, error) {
+	var builder strings.Builder
+	for index := 0; index < len(name); index++ {
+		if name[index] != '=' {
+			builder.WriteByte(name[index])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name[index:], "=2C"):
+			builder.WriteByte(',')
+		case strings.HasPrefix(name[index:], "=3D"):
+			builder.WriteByte('=')
+		default:
+			return "", fmt.Errorf("[SCRAM] Incorrect username")
+		}
+		index += 2
+	}
+	if builder.Len() == 0 {
+		return "", fmt.Errorf("[SCRAM] Incorrect username")
+	}
+	return builder.String(), nil
+}
+
+func validSCRAMNonce(nonce string) bool {
+	if nonce == "" {
+		return false
+	}
+	for index := 0; index < len(nonce); index++ {
+		if nonce[index] < 0x21 || nonce[index] > 0x7e || nonce[index] == ',' {
+			return false
+		}
+	}
+	return true
+}
+
+func deriveSCRAMVerifier(password string, salt []byte, iterations int) scramVerifier {
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	storedKey := sha256.Sum256(scramHMAC(saltedPassword, "Client Key"))
+	return scramVerifier{
+		iterations: iterations,
+		salt:       salt,
+		storedKey:  storedKey[:],
+		serverKey:  scramHMAC(saltedPassword, "Server Key"),
+	}
+}
+
+func parseSCRAMVerifier(encoded string) (scramVerifier, error) {
+	var verifier scramVerifier
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 3 || parts[0] != scramMechanism {
+		return verifier, fmt.Errorf("%w: scram-sha-256", ErrUnknownPasswordHash)
+	}
+	salt := strings.SplitN(parts[1], ":", 2)
+	keys := strings.SplitN(parts[2], ":", 2)
+	if len(salt) != 2 || len(keys) != 2 {
+		return verifier, fmt.Errorf("%w: scram-sha-256", ErrUnknownPasswordHash)
+	}
+	var errIterations, errSalt, errStoredKey, errServerKey error
+	verifier.iterations, errIterations = strconv.Atoi(salt[0])
+	verifier.salt, errSalt = base64.StdEncoding.DecodeString(salt[1])
+	verifier.storedKey, errStoredKey = base64.StdEncoding.DecodeString(keys[0])
+	verifier.serverKey, errServerKey = base64.StdEncoding.DecodeString(keys[1])
+	if errIterations != nil || errSalt != nil || errStoredKey != nil || errServerKey != nil ||
+		verifier.iterations <= 0 || len(verifier.salt) == 0 || len(verifier.storedKey) != sha256.Size || len(verifier.serverKey) != sha256.Size {
+		return verifier, fmt.Errorf("%w: scram-sha-256", ErrUnknownPasswordHash)
+	}
+	return verifier, nil
+}
+
+func (verifier scramVerifier) String() string {
+	return fmt.Sprintf("%s$%d:%s$%s:%s", scramMechanism, verifier.iterations, base64.StdEncoding.EncodeToString(verifier.salt),
+		base64.StdEncoding.EncodeToString(verifier.storedKey), base64.StdEncoding.EncodeToString(verifier.serverKey))
+}
+
+// verifyProof recovers the ClientKey from proof, checks it against StoredKey
+// and returns the ServerSignature of authMessage.
+func (verifier scramVerifier) verifyProof(authMessage string, proof []byte) ([]byte, bool) {
+	clientSignature := scramHMAC(verifier.storedKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for index := range proof {
+		clientKey[index] = proof[index] ^ clientSignature[index]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], verifier.storedKey) != 1 {
+		return nil, false
+	}
+	return scramHMAC(verifier.serverKey, authMessage), true
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// add keeps session under sid once the expired sessions swept, a full store
+// is answered 503 and a client at its limit 429.
+func (sessions *scramSessions) add(sid string, session scramSession, now time.Time) error {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	sessions.sweep(now)
+	if len(sessions.sessions) >= sessions.maxSessions {
+		return &AuthenticationError{StatusCode: http.StatusServiceUnavailable, Err: ErrSCRAMTooManySessions}
+	}
+	if sessions.clients[session.client] >= sessions.maxClientSessions {
+		return &AuthenticationError{StatusCode: http.StatusTooManyRequests, Err: ErrSCRAMTooManySessions}
+	}
+	sessions.sessions[sid] = session
+	sessions.clients[session.client]++
+	sessions.queue = append(sessions.queue, scramPending{sid: sid, expiresAt: session.expiresAt})
+	return nil
+}
+
+// take removes the session of sid, found only when it has not expired.
+func (sessions *scramSessions) take(sid string, now time.Time) (scramSession, bool) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	session, found := sessions.sessions[sid]
+	sessions.remove(sid)
+	if !found || !now.Before(session.expiresAt) {
+		return scramSession{}, false
+	}
+	return session, true
+}
+
+// sweep removes the sessions expired at now, the sids of the sessions already
+// taken leave the queue as well.
+func (sessions *scramSessions) sweep(now time.Time) {
+	expired := 0
+	for expired < len(sessions.queue) && !now.Before(sessions.queue[expired].expiresAt) {
+		sessions.remove(sessions.queue[expired].sid)
+		expired++
+	}
+	sessions.queue = sessions.queue[expired:]
+}
+
+func (sessions *scramSessions) remove(sid string) {
+	session, found := sessions.sessions[sid]
+	if !found {
+		return
+	}
+	delete(sessions.sessions, sid)
+	if sessions.clients[session.client]--; sessions.clients[session.client] <= 0 {
+		delete(sessions.clients, session.client)
+	}
+}
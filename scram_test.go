@@ -0,0 +1,371 @@
+package tnpptMiddleware
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// RFC 7677 section 3, password "pencil"
+const testSCRAMVerifier = "SCRAM-SHA-256$4096:W22ZaJ0SNY7soEsUEjb6gQ==$WG5d8oPm3OtcPnkdi4Uo7BkeZkBFzpcXkuLmtbsT4qY=:wfPLwcE6nTWhTAmQ7tl2KeoiWGPlZqQxSrmfPwDl2dU="
+
+func TestSCRAMVerifier_verifyProof(t *testing.T) {
+	verifier, err := parseSCRAMVerifier(testSCRAMVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authMessage := "n=user,r=rOprNGfwEbeRWgbNEkqO," +
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096," +
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	proof, _ := base64.StdEncoding.DecodeString("dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=")
+
+	serverSignature, valid := verifier.verifyProof(authMessage, proof)
+	assert.True(t, valid)
+	assert.Equal(t, "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", base64.StdEncoding.EncodeToString(serverSignature))
+
+	proof[0] ^= 1
+	_, valid = verifier.verifyProof(authMessage, proof)
+	assert.False(t, valid)
+}
+
+type scramClient struct {
+	login       string
+	password    string
+	nonce       string
+	gs2Header   string
+	authMessage string
+	serverKey   []byte
+}
+
+func (client *scramClient) first() string {
+	if client.gs2Header == "" {
+		client.gs2Header = "n,,"
+	}
+	login := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(client.login)
+	client.authMessage = "n=" + login + ",r=" + client.nonce
+	return "SCRAM-SHA-256 data=" + base64.StdEncoding.EncodeToString([]byte(client.gs2Header+client.authMessage))
+}
+
+func (client *scramClient) final(t *testing.T, challenge string) string {
+	parameters, err := parseAuthParameters("SCRAM", strings.TrimPrefix(challenge, "SCRAM-SHA-256 "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverFirst, _ := base64.StdEncoding.DecodeString(parameters["data"])
+	attributes := map[string]string{}
+	for _, attribute := range strings.Split(string(serverFirst), ",") {
+		attributes[attribute[:1]] = attribute[2:]
+	}
+	assert.True(t, strings.HasPrefix(attributes["r"], client.nonce))
+	salt, _ := base64.StdEncoding.DecodeString(attributes["s"])
+	iterations, _ := strconv.Atoi(attributes["i"])
+
+	saltedPassword := pbkdf2.Key([]byte(client.password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(client.gs2Header)) + ",r=" + attributes["r"]
+	client.authMessage += "," + string(serverFirst) + "," + withoutProof
+	client.serverKey = scramHMAC(saltedPassword, "Server Key")
+	clientSignature := scramHMAC(storedKey[:], client.authMessage)
+	for index := range clientKey {
+		clientKey[index] ^= clientSignature[index]
+	}
+	clientFinal := withoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientKey)
+	return "SCRAM-SHA-256 sid=" + parameters["sid"] + ", data=" + base64.StdEncoding.EncodeToString([]byte(clientFinal))
+}
+
+func (client *scramClient) serverFinal() string {
+	serverSignature := base64.StdEncoding.EncodeToString(scramHMAC(client.serverKey, client.authMessage))
+	return base64.StdEncoding.EncodeToString([]byte("v=" + serverSignature))
+}
+
+func TestTNPPT_ActivateSCRAMAuth(t *testing.T) {
+	verifier, err := NewSCRAMVerifier("pencil", 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{
+		{Login: "user", PasswordHash: verifier},
+		{Login: "team,lead", PasswordHash: testSCRAMVerifier},
+		{Login: "hmac-only", Password: "pencil"},
+	}})
+	auth, err := New(&TNPPT{Store: store, SCRAM: SCRAMSettings{Iterations: 4096}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/resource", auth.ActivateSCRAMAuth(), func(c *gin.Context) {
+		c.String(200, principal(c).Scheme+":"+principal(c).Login)
+	})
+	send := func(authorization string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/resource", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("")
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, `SCRAM-SHA-256 realm="tnppt"`, w.Header().Get("WWW-Authenticate"))
+
+	t.Run("exchange", func(t *testing.T) {
+		for _, login := range []string{"user", "team,lead"} {
+			client := &scramClient{login: login, password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+			w := send(client.first())
+			assert.Equal(t, 401, w.Code)
+			challenge := w.Header().Get("WWW-Authenticate")
+			assert.Contains(t, challenge, "sid=")
+
+			final := client.final(t, challenge)
+			w = send(final)
+			assert.Equal(t, 200, w.Code)
+			assert.Equal(t, "scram-sha-256:"+login, w.Body.String())
+			assert.Contains(t, w.Header().Get("Authentication-Info"), "data="+client.serverFinal())
+
+			w = send(final)
+			assert.Equal(t, 401, w.Code, "replayed client-final")
+			assert.Equal(t, `SCRAM-SHA-256 realm="tnppt"`, w.Header().Get("WWW-Authenticate"))
+		}
+	})
+	t.Run("made-up-salt-is-stable", func(t *testing.T) {
+		first := func(login string) string {
+			client := &scramClient{login: login, password: "pencil", nonce: "abc"}
+			challenge := send(client.first()).Header().Get("WWW-Authenticate")
+			parameters, _ := parseAuthParameters("SCRAM", strings.TrimPrefix(challenge, "SCRAM-SHA-256 "))
+			serverFirst, _ := base64.StdEncoding.DecodeString(parameters["data"])
+			return string(serverFirst[strings.Index(string(serverFirst), ",s="):])
+		}
+		assert.Equal(t, first("nobody"), first("nobody"))
+		assert.NotEqual(t, first("nobody"), first("somebody"))
+		assert.Equal(t, first("hmac-only"), first("hmac-only"))
+	})
+
+	tests := []struct {
+		name   string
+		client scramClient
+	}{
+		{name: "wrong-password", client: scramClient{login: "user", password: "crayon", nonce: "abc"}},
+		{name: "unknown-login", client: scramClient{login: "nobody", password: "pencil", nonce: "abc"}},
+		{name: "no-verifier", client: scramClient{login: "hmac-only", password: "pencil", nonce: "abc"}},
+		{name: "channel-binding", client: scramClient{login: "user", password: "pencil", nonce: "abc", gs2Header: "p=tls-unique,,"}},
+		{name: "authzid", client: scramClient{login: "user", password: "pencil", nonce: "abc", gs2Header: "n,a=admin,"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(tt.client.first())
+			assert.Equal(t, 401, w.Code)
+			challenge := w.Header().Get("WWW-Authenticate")
+			if !strings.Contains(challenge, "sid=") {
+				return
+			}
+			assert.Equal(t, 401, send(tt.client.final(t, challenge)).Code)
+		})
+	}
+	t.Run("unknown-session", func(t *testing.T) {
+		client := &scramClient{login: "user", password: "pencil", nonce: "abc"}
+		challenge := send(client.first()).Header().Get("WWW-Authenticate")
+		final := client.final(t, challenge)
+		assert.Equal(t, 401, send(strings.Replace(final, "sid=", "sid=0", 1)).Code)
+	})
+	t.Run("other-nonce", func(t *testing.T) {
+		client := &scramClient{login: "user", password: "pencil", nonce: "abc"}
+		challenge := send(client.first()).Header().Get("WWW-Authenticate")
+		other := &scramClient{login: "user", password: "pencil", nonce: "abc"}
+		otherChallenge := send(other.first()).Header().Get("WWW-Authenticate")
+		sid := otherChallenge[strings.Index(otherChallenge, "sid="):strings.Index(otherChallenge, ",")]
+		final := client.final(t, challenge)
+		final = "SCRAM-SHA-256 " + sid + final[strings.Index(final, ","):]
+		assert.Equal(t, 401, send(final).Code)
+	})
+}
+
+func TestTNPPT_ActivateSCRAMAuthUnknownLogin(t *testing.T) {
+	verifier, err := NewSCRAMVerifier("pencil", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "user", PasswordHash: verifier}}})
+	auth, err := New(&TNPPT{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.GET("/resource", auth.ActivateSCRAMAuth(), func(c *gin.Context) {})
+	// serverFirst returns the server-first message without the nonce
+	serverFirst := func(login string) string {
+		client := &scramClient{login: login, password: "pencil", nonce: "abc"}
+		req, _ := http.NewRequest("GET", "/resource", nil)
+		req.Header.Set("Authorization", client.first())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		parameters, _ := parseAuthParameters("SCRAM", strings.TrimPrefix(w.Header().Get("WWW-Authenticate"), "SCRAM-SHA-256 "))
+		message, _ := base64.StdEncoding.DecodeString(parameters["data"])
+		return string(message[strings.Index(string(message), ",s="):])
+	}
+	known, unknown := serverFirst("user"), serverFirst("nobody")
+	assert.True(t, strings.HasSuffix(known, ",i="+strconv.Itoa(DefaultPBKDF2Iterations)), known)
+	assert.True(t, strings.HasSuffix(unknown, ",i="+strconv.Itoa(DefaultPBKDF2Iterations)), unknown)
+	assert.Equal(t, len(known), len(unknown))
+}
+
+func TestTNPPT_ActivateAnySCRAM(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "user", PasswordHash: testSCRAMVerifier}}})
+	auth, err := New(&TNPPT{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.GET("/resource", auth.ActivateAny(SchemeBasic, SchemeSCRAM), func(c *gin.Context) {
+		c.String(200, principal(c).Scheme)
+	})
+	send := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	req, _ := http.NewRequest("GET", "/resource", nil)
+	w := send(req)
+	assert.Equal(t, []string{`Basic realm="tnppt", charset="UTF-8"`, `SCRAM-SHA-256 realm="tnppt"`}, w.Header().Values("WWW-Authenticate"))
+
+	client := &scramClient{login: "user", password: "pencil", nonce: "abc"}
+	req, _ = http.NewRequest("GET", "/resource", nil)
+	req.Header.Set("Authorization", client.first())
+	challenge := send(req).Header().Get("WWW-Authenticate")
+	req, _ = http.NewRequest("GET", "/resource", nil)
+	req.Header.Set("Authorization", client.final(t, challenge))
+	w = send(req)
+	assert.Equal(t, SchemeSCRAM, w.Body.String())
+	assert.NotEmpty(t, w.Header().Get("Authentication-Info"))
+
+	req, _ = http.NewRequest("GET", "/resource", nil)
+	req.SetBasicAuth("user", "pencil")
+	assert.Equal(t, SchemeBasic, send(req).Body.String())
+}
+
+func TestParseSCRAMClientFirst(t *testing.T) {
+	session, clientNonce, err := parseSCRAMClientFirst("y,,n=a=3Db=2Cc,r=abc,x=ext")
+	assert.NoError(t, err)
+	assert.Equal(t, "a=b,c", session.login)
+	assert.Equal(t, "y,,", session.gs2Header)
+	assert.Equal(t, "n=a=3Db=2Cc,r=abc,x=ext", session.clientFirstBare)
+	assert.Equal(t, "abc", clientNonce)
+
+	for _, message := range []string{
+		"",
+		"n,,",
+		"x,,n=user,r=abc",
+		"p=tls-unique,,n=user,r=abc",
+		"n,a=admin,n=user,r=abc",
+		"n,,r=abc,n=user",
+		"n,,n=,r=abc",
+		"n,,n=us=er,r=abc",
+		"n,,n=user,r=",
+		"n,,n=user,r=a b",
+		"n,,n=user,r=abc,m=mandatory",
+	} {
+		_, _, err := parseSCRAMClientFirst(message)
+		assert.Error(t, err, message)
+	}
+}
+
+func TestNewSCRAMVerifier(t *testing.T) {
+	_, err := NewSCRAMVerifier("pencil", 1000)
+	assert.Error(t, err)
+
+	verifier, err := NewSCRAMVerifier("pencil", 4096)
+	assert.NoError(t, err)
+	assert.Equal(t, PasswordSCRAMSHA256, PasswordAlgorithm(verifier))
+	assert.True(t, strings.HasPrefix(verifier, "SCRAM-SHA-256$4096:"))
+	assert.NotContains(t, verifier, "pencil")
+}
+
+func TestTNPPT_SCRAMChallengeNotFailure(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "user", PasswordHash: testSCRAMVerifier}}})
+	auditor := &recordingAuditor{}
+	auth, err := New(&TNPPT{Store: store, Auditor: auditor, Lockout: LockoutSettings{LoginThreshold: 1, IPThreshold: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(authorization string, header http.Header) error {
+		req, _ := http.NewRequest("GET", "/resource", nil)
+		req.RemoteAddr = "10.0.0.1:40000"
+		req.Header.Set("Authorization", authorization)
+		_, err := auth.Verifier(SchemeSCRAM).Verify(req, header)
+		return err
+	}
+
+	var client *scramClient
+	header := http.Header{}
+	for i := 0; i < 3; i++ {
+		client, header = &scramClient{login: "user", password: "pencil", nonce: "abc"}, http.Header{}
+		assert.True(t, challenged(send(client.first(), header)))
+	}
+	assert.NoError(t, send(client.final(t, header.Get("WWW-Authenticate")), http.Header{}), "the challenges are not counted by the lockout")
+
+	auditor.mu.Lock()
+	defer auditor.mu.Unlock()
+	events := []string{}
+	for _, entry := range auditor.entries {
+		events = append(events, entry.Event+":"+entry.Login)
+	}
+	assert.Equal(t, []string{
+		AuditAuthenticationChallenged + ":user",
+		AuditAuthenticationChallenged + ":user",
+		AuditAuthenticationChallenged + ":user",
+		AuditAuthenticationSucceeded + ":user",
+	}, events)
+}
+
+func TestSCRAMSessions_Limits(t *testing.T) {
+	settings := SCRAMSettings{MaxSessions: 3, MaxClientSessions: 2}
+	if err := settings.init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.start(); err != nil {
+		t.Fatal(err)
+	}
+	sessions := settings.sessions
+	now := time.Now()
+	add := func(sid string, client string, at time.Time) int {
+		err := sessions.add(sid, scramSession{client: client, expiresAt: at.Add(settings.SessionTTL)}, at)
+		if err == nil {
+			return 0
+		}
+		return asAuthenticationError(err).StatusCode
+	}
+
+	assert.Equal(t, 0, add("a1", "10.0.0.1", now))
+	assert.Equal(t, 0, add("a2", "10.0.0.1", now))
+	assert.Equal(t, http.StatusTooManyRequests, add("a3", "10.0.0.1", now))
+	assert.Equal(t, 0, add("b1", "10.0.0.2", now))
+	assert.Equal(t, http.StatusServiceUnavailable, add("c1", "10.0.0.3", now))
+
+	_, found := sessions.take("a1", now)
+	assert.True(t, found)
+	assert.Equal(t, 0, add("a3", "10.0.0.1", now))
+
+	later := now.Add(settings.SessionTTL)
+	assert.Equal(t, 0, add("c1", "10.0.0.3", later), "expired sessions swept")
+	assert.Equal(t, 1, len(sessions.sessions))
+	assert.Equal(t, map[string]int{"10.0.0.3": 1}, sessions.clients)
+	assert.Equal(t, 1, len(sessions.queue))
+	_, found = sessions.take("a2", later)
+	assert.False(t, found)
+
+	assert.Error(t, (&SCRAMSettings{MaxSessions: -1}).init())
+	assert.Error(t, (&SCRAMSettings{Iterations: 1000}).init())
+}
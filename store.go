@@ -0,0 +1,267 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// CredentialStore is the lookup used by the middleware when TNPPT.Store is set
+// instead of a hand written IsCredentialsValid.
+// Implementations return ErrCredentialsNotFound or ErrCredentialsRevoked for
+// unknown or disabled credentials, any other error is treated as a backend failure.
+type CredentialStore interface {
+	FindUserByLogin(ctx context.Context, login string) (UserInfo, error)
+	FindUserByAPIKey(ctx context.Context, apiKey string) (UserInfo, error)
+}
+
+const (
+	SchemeHMAC   = "hmac"
+	SchemeAPIKey = "api_key"
+)
+
+var (
+	ErrCredentialsNotFound = errors.New("credentials not found")
+	ErrCredentialsRevoked  = errors.New("credentials revoked")
+)
+
+// PasswordHashUpdater is implemented by the stores able to save the new hash
+// computed when a password is rehashed on login.
+type PasswordHashUpdater interface {
+	UpdatePasswordHash(ctx context.Context, login string, passwordHash string) error
+}
+
+// UserRecord holds the HMAC shared secret in Password and the hash used by
+// ActivateBasicAuth in PasswordHash (see PasswordPolicy), at least one is required.
+type UserRecord struct {
+	ID           string   `yaml:"id" json:"id"`
+	Login        string   `yaml:"login" json:"login"`
+	Password     string   `yaml:"password" json:"password"`
+	PasswordHash string   `yaml:"password_hash" json:"password_hash"`
+	Scopes       []string `yaml:"scopes" json:"scopes"`
+	Roles        []string `yaml:"roles" json:"roles"`
+}
+
+// APIKeyRecord holds either the raw Key or its KeySHA256 (see HashAPIKey),
+// so that the file on disk does not have to contain usable keys.
+type APIKeyRecord struct {
+	ID        string   `yaml:"id" json:"id"`
+	Login     string   `yaml:"login" json:"login"`
+	Key       string   `yaml:"key" json:"key"`
+	KeySHA256 string   `yaml:"key_sha256" json:"key_sha256"`
+	Scopes    []string `yaml:"scopes" json:"scopes"`
+	Roles     []string `yaml:"roles" json:"roles"`
+	Revoked   bool     `yaml:"revoked" json:"revoked"`
+}
+
+type StoreRecords struct {
+	Users   []UserRecord   `yaml:"users" json:"users"`
+	APIKeys []APIKeyRecord `yaml:"api_keys" json:"api_keys"`
+}
+
+// MemoryStore is a CredentialStore built from StoreRecords, only password
+// hashes can be updated afterwards.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	users   map[string]UserRecord
+	apiKeys map[string]APIKeyRecord
+}
+
+func HashAPIKey(apiKey string) string {
+	hash := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(hash[:])
+}
+
+func NewMemoryStore(records StoreRecords) (*MemoryStore, error) {
+	if err := records.Validate(); err != nil {
+		return nil, err
+	}
+	store := &MemoryStore{
+		users:   make(map[string]UserRecord, len(records.Users)),
+		apiKeys: make(map[string]APIKeyRecord, len(records.APIKeys)),
+	}
+	for _, user := range records.Users {
+		store.users[user.Login] = user
+	}
+	for _, apiKey := range records.APIKeys {
+		store.apiKeys[apiKey.hash()] = apiKey
+	}
+	return store, nil
+}
+
+func (store *MemoryStore) FindUserByLogin(ctx context.Context, login string) (UserInfo, error) {
+	store.mu.RLock()
+	user, found := store.users[login]
+	store.mu.RUnlock()
+	if !found {
+		return UserInfo{}, ErrCredentialsNotFound
+	}
+	return UserInfo{
+		ID:           recordID(user.ID),
+		Login:        user.Login,
+		Password:     user.Password,
+		PasswordHash: user.PasswordHash,
+		Scopes:       copyStrings(user.Scopes),
+		Roles:        copyStrings(user.Roles),
+	}, nil
+}
+
+func (store *MemoryStore) UpdatePasswordHash(ctx context.Context, login string, passwordHash string) error {
+	if PasswordAlgorithm(passwordHash) == "" {
+		return ErrUnknownPasswordHash
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	user, found := store.users[login]
+	if !found {
+		return ErrCredentialsNotFound
+	}
+	user.PasswordHash = passwordHash
+	store.users[login] = user
+	return nil
+}
+
+func (store *MemoryStore) FindUserByAPIKey(ctx context.Context, apiKey string) (UserInfo, error) {
+	keySHA256 := HashAPIKey(apiKey)
+	store.mu.RLock()
+	record, found := store.apiKeys[keySHA256]
+	store.mu.RUnlock()
+	if !found {
+		return UserInfo{}, ErrCredentialsNotFound
+	}
+	if record.Revoked {
+		return UserInfo{}, ErrCredentialsRevoked
+	}
+	return UserInfo{
+		ID:     recordID(record.ID),
+		Login:  record.Login,
+		Scopes: copyStrings(record.Scopes),
+		Roles:  copyStrings(record.Roles),
+	}, nil
+}
+
+func (records StoreRecords) Validate() error {
+	logins := make(map[string]bool, len(records.Users))
+	for index, user := range records.Users {
+		if user.Login == "" {
+			return fmt.Errorf("[STORE] users[%d]: login is required", index)
+		}
+		if user.Password == "" && user.PasswordHash == "" && !isCertificateIdentity(user.Login) {
+			return fmt.Errorf("[STORE] users[%d]: password or password_hash is required", index)
+		}
+		if user.PasswordHash != "" && PasswordAlgorithm(user.PasswordHash) == "" {
+			return fmt.Errorf("[STORE] users[%d]: %w", index, ErrUnknownPasswordHash)
+		}
+		if logins[user.Login] {
+			return fmt.Errorf("[STORE] users[%d]: duplicated login %q", index, user.Login)
+		}
+		if err := validateScopes(user.Scopes); err != nil {
+			return fmt.Errorf("[STORE] users[%d]: %w", index, err)
+		}
+		if err := validateRoles(user.Roles); err != nil {
+			return fmt.Errorf("[STORE] users[%d]: %w", index, err)
+		}
+		logins[user.Login] = true
+	}
+	hashes := make(map[string]bool, len(records.APIKeys))
+	for index, apiKey := range records.APIKeys {
+		if apiKey.Login == "" {
+			return fmt.Errorf("[STORE] api_keys[%d]: login is required", index)
+		}
+		if (apiKey.Key == "") == (apiKey.KeySHA256 == "") {
+			return fmt.Errorf("[STORE] api_keys[%d]: exactly one of key or key_sha256 is required", index)
+		}
+		if apiKey.KeySHA256 != "" {
+			if decoded, errDecode := hex.DecodeString(apiKey.KeySHA256); errDecode != nil || len(decoded) != sha256.Size {
+				return fmt.Errorf("[STORE] api_keys[%d]: key_sha256 must be a hex encoded sha256", index)
+			}
+		}
+		if hashes[apiKey.hash()] {
+			return fmt.Errorf("[STORE] api_keys[%d]: duplicated key", index)
+		}
+		if err := validateScopes(apiKey.Scopes); err != nil {
+			return fmt.Errorf("[STORE] api_keys[%d]: %w", index, err)
+		}
+		if err := validateRoles(apiKey.Roles); err != nil {
+			return fmt.Errorf("[STORE] api_keys[%d]: %w", index, err)
+		}
+		hashes[apiKey.hash()] = true
+	}
+	return nil
+}
+
+func (apiKey APIKeyRecord) hash() string {
+	if apiKey.KeySHA256 != "" {
+		decoded, _ := hex.DecodeString(apiKey.KeySHA256)
+		return hex.EncodeToString(decoded)
+	}
+	return HashAPIKey(apiKey.Key)
+}
+
+func validateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if scope == "" {
+			return errors.New("empty scope")
+		}
+	}
+	return nil
+}
+
+func validateRoles(roles []string) error {
+	for _, role := range roles {
+		if role == "" {
+			return errors.New("empty role")
+		}
+	}
+	return nil
+}
+
+func recordID(id string) interface{} {
+	if id == "" {
+		return nil
+	}
+	return id
+}
+
+func copyStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	return append([]string(nil), values...)
+}
+
+func storeCredentialsValid(tnppt *TNPPT) bool {
+	ctx := context.Background()
+	if tnppt.Request != nil {
+		ctx = tnppt.Request.Context()
+	}
+	var user UserInfo
+	var errFind error
+	switch tnppt.scheme {
+	case SchemeAPIKey:
+		user, errFind = tnppt.credentialStore().FindUserByAPIKey(ctx, tnppt.PayloadAPIKey.APIKey)
+	case SchemeBasic:
+		user, errFind = tnppt.credentialStore().FindUserByLogin(ctx, tnppt.PayloadBasic.Login)
+	case SchemeChallenge:
+		user, errFind = tnppt.credentialStore().FindUserByLogin(ctx, tnppt.PayloadChallenge.Login)
+	case SchemeDigest:
+		user, errFind = tnppt.credentialStore().FindUserByLogin(ctx, tnppt.PayloadDigest.Login)
+	case SchemeSCRAM:
+		user, errFind = tnppt.credentialStore().FindUserByLogin(ctx, tnppt.PayloadSCRAM.Login)
+	case SchemeMTLS:
+		user, errFind = findCertificateUser(ctx, tnppt.credentialStore(), tnppt.PayloadMTLS.Identities)
+	default:
+		user, errFind = tnppt.credentialStore().FindUserByLogin(ctx, tnppt.PayloadHMAC.Login)
+	}
+	if errFind != nil {
+		if !errors.Is(errFind, ErrCredentialsNotFound) && !errors.Is(errFind, ErrCredentialsRevoked) {
+			tnppt.logError(tnppt.Request, "credential store lookup failed", errFind)
+		}
+		return false
+	}
+	tnppt.Principal = user
+	return true
+}
@@ -0,0 +1,127 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+type ChainErrorPolicy int
+
+const (
+	// AbortOnError fails the lookup as soon as the store returns a backend error.
+	AbortOnError ChainErrorPolicy = iota
+	// SkipOnError moves on to the next store, the error is only returned if no store resolves the credentials
+	// nor reports them revoked.
+	SkipOnError
+)
+
+type ChainPrecedence int
+
+const (
+	// FirstFound stops at the first store knowing the credentials, even if it reports them revoked.
+	FirstFound ChainPrecedence = iota
+	// FirstValid keeps looking when a store reports the credentials revoked.
+	FirstValid
+)
+
+type ChainLink struct {
+	Name    string
+	Store   CredentialStore
+	OnError ChainErrorPolicy
+	// Accept restricts the store to some logins (or API keys), every lookup goes through when nil.
+	Accept func(identifier string) bool
+}
+
+// ChainStore queries its Links in order, the name of the resolving link is set on UserInfo.StoreName.
+// The errors of the skipped links are logged on Logger (slog.Default when nil).
+type ChainStore struct {
+	Links      []ChainLink
+	Precedence ChainPrecedence
+	Logger     *slog.Logger
+}
+
+func NewChainStore(chainStore *ChainStore) (*ChainStore, error) {
+	return chainStore.Init()
+}
+
+func (chainStore *ChainStore) Init() (*ChainStore, error) {
+	if len(chainStore.Links) == 0 {
+		return nil, errors.New("TNPPT - ChainStore - You need to set at least one Link")
+	}
+	names := make(map[string]bool, len(chainStore.Links))
+	for index, link := range chainStore.Links {
+		if link.Store == nil {
+			return nil, fmt.Errorf("TNPPT - ChainStore - Links[%d] has no Store", index)
+		}
+		if link.Name == "" {
+			return nil, fmt.Errorf("TNPPT - ChainStore - Links[%d] has no Name", index)
+		}
+		if names[link.Name] {
+			return nil, fmt.Errorf("TNPPT - ChainStore - Links[%d] duplicates the name %q", index, link.Name)
+		}
+		names[link.Name] = true
+	}
+	return chainStore, nil
+}
+
+func (chainStore *ChainStore) FindUserByLogin(ctx context.Context, login string) (UserInfo, error) {
+	return chainStore.find(ctx, login, func(store CredentialStore) (UserInfo, error) {
+		return store.FindUserByLogin(ctx, login)
+	})
+}
+
+func (chainStore *ChainStore) FindUserByAPIKey(ctx context.Context, apiKey string) (UserInfo, error) {
+	return chainStore.find(ctx, apiKey, func(store CredentialStore) (UserInfo, error) {
+		return store.FindUserByAPIKey(ctx, apiKey)
+	})
+}
+
+func (chainStore *ChainStore) find(ctx context.Context, identifier string, lookup func(store CredentialStore) (UserInfo, error)) (UserInfo, error) {
+	result := ErrCredentialsNotFound
+	var skipped error
+	for _, link := range chainStore.Links {
+		if link.Accept != nil && !link.Accept(identifier) {
+			continue
+		}
+		user, errFind := lookup(link.Store)
+		switch {
+		case errFind == nil:
+			user.StoreName = link.Name
+			return user, nil
+		case errors.Is(errFind, ErrCredentialsNotFound):
+			continue
+		case errors.Is(errFind, ErrCredentialsRevoked):
+			if chainStore.Precedence == FirstFound {
+				return UserInfo{}, errFind
+			}
+			result = errFind
+		case link.OnError == SkipOnError:
+			skipped = fmt.Errorf("[STORE] %s: %w", link.Name, errFind)
+			loggerOrDefault(chainStore.Logger).WarnContext(ctx, "credential store skipped", "store", link.Name, "error", errFind)
+		default:
+			return UserInfo{}, fmt.Errorf("[STORE] %s: %w", link.Name, errFind)
+		}
+	}
+	// a revoked answer is definitive, whatever the skipped stores might have said
+	if skipped != nil && !errors.Is(result, ErrCredentialsRevoked) {
+		return UserInfo{}, skipped
+	}
+	return UserInfo{}, result
+}
+
+// UpdatePasswordHash updates the first link knowing login and able to store password hashes.
+func (chainStore *ChainStore) UpdatePasswordHash(ctx context.Context, login string, passwordHash string) error {
+	for _, link := range chainStore.Links {
+		updater, canUpdate := link.Store.(PasswordHashUpdater)
+		if !canUpdate || (link.Accept != nil && !link.Accept(login)) {
+			continue
+		}
+		if _, errFind := link.Store.FindUserByLogin(ctx, login); errFind != nil {
+			continue
+		}
+		return updater.UpdatePasswordHash(ctx, login, passwordHash)
+	}
+	return ErrCredentialsNotFound
+}
@@ -0,0 +1,192 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingStore struct {
+	calls int
+}
+
+var errStoreDown = errors.New("store down")
+
+func (store *failingStore) FindUserByLogin(ctx context.Context, login string) (UserInfo, error) {
+	store.calls++
+	return UserInfo{}, errStoreDown
+}
+
+func (store *failingStore) FindUserByAPIKey(ctx context.Context, apiKey string) (UserInfo, error) {
+	store.calls++
+	return UserInfo{}, errStoreDown
+}
+
+func newTestMemoryStore(t *testing.T, records StoreRecords) *MemoryStore {
+	t.Helper()
+	store, err := NewMemoryStore(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestChainStore(t *testing.T) {
+	newStore := newTestMemoryStore(t, StoreRecords{
+		Users:   []UserRecord{{Login: "steven", Password: "new"}},
+		APIKeys: []APIKeyRecord{{Login: "collector", Key: "shared-key", Revoked: true}},
+	})
+	legacyStore := newTestMemoryStore(t, StoreRecords{
+		Users:   []UserRecord{{Login: "steven", Password: "old"}, {Login: "legacy", Password: "old"}},
+		APIKeys: []APIKeyRecord{{Login: "legacy-collector", Key: "shared-key"}},
+	})
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		chainStore *ChainStore
+		lookup     func(store CredentialStore) (UserInfo, error)
+		wantStore  string
+		wantLogin  string
+		wantErr    error
+	}{
+		{
+			name:       "new-store-first",
+			chainStore: &ChainStore{Links: []ChainLink{{Name: "new", Store: newStore}, {Name: "legacy", Store: legacyStore}}},
+			lookup: func(store CredentialStore) (UserInfo, error) {
+				return store.FindUserByLogin(ctx, "steven")
+			},
+			wantStore: "new",
+			wantLogin: "steven",
+		},
+		{
+			name:       "fallback-to-legacy",
+			chainStore: &ChainStore{Links: []ChainLink{{Name: "new", Store: newStore}, {Name: "legacy", Store: legacyStore}}},
+			lookup: func(store CredentialStore) (UserInfo, error) {
+				return store.FindUserByLogin(ctx, "legacy")
+			},
+			wantStore: "legacy",
+			wantLogin: "legacy",
+		},
+		{
+			name:       "not-found",
+			chainStore: &ChainStore{Links: []ChainLink{{Name: "new", Store: newStore}, {Name: "legacy", Store: legacyStore}}},
+			lookup: func(store CredentialStore) (UserInfo, error) {
+				return store.FindUserByLogin(ctx, "nobody")
+			},
+			wantErr: ErrCredentialsNotFound,
+		},
+		{
+			name:       "revoked-first-found",
+			chainStore: &ChainStore{Links: []ChainLink{{Name: "new", Store: newStore}, {Name: "legacy", Store: legacyStore}}},
+			lookup: func(store CredentialStore) (UserInfo, error) {
+				return store.FindUserByAPIKey(ctx, "shared-key")
+			},
+			wantErr: ErrCredentialsRevoked,
+		},
+		{
+			name: "revoked-first-valid",
+			chainStore: &ChainStore{
+				Links:      []ChainLink{{Name: "new", Store: newStore}, {Name: "legacy", Store: legacyStore}},
+				Precedence: FirstValid,
+			},
+			lookup: func(store CredentialStore) (UserInfo, error) {
+				return store.FindUserByAPIKey(ctx, "shared-key")
+			},
+			wantStore: "legacy",
+			wantLogin: "legacy-collector",
+		},
+		{
+			name: "accept-filter",
+			chainStore: &ChainStore{Links: []ChainLink{
+				{Name: "service-accounts", Store: legacyStore, Accept: func(login string) bool { return strings.HasPrefix(login, "svc-") }},
+				{Name: "humans", Store: newStore},
+			}},
+			lookup: func(store CredentialStore) (UserInfo, error) {
+				return store.FindUserByLogin(ctx, "steven")
+			},
+			wantStore: "humans",
+			wantLogin: "steven",
+		},
+		{
+			name:       "abort-on-error",
+			chainStore: &ChainStore{Links: []ChainLink{{Name: "db", Store: &failingStore{}}, {Name: "legacy", Store: legacyStore}}},
+			lookup: func(store CredentialStore) (UserInfo, error) {
+				return store.FindUserByLogin(ctx, "steven")
+			},
+			wantErr: errStoreDown,
+		},
+		{
+			name:       "skip-on-error",
+			chainStore: &ChainStore{Links: []ChainLink{{Name: "db", Store: &failingStore{}, OnError: SkipOnError}, {Name: "legacy", Store: legacyStore}}},
+			lookup: func(store CredentialStore) (UserInfo, error) {
+				return store.FindUserByLogin(ctx, "steven")
+			},
+			wantStore: "legacy",
+			wantLogin: "steven",
+		},
+		{
+			name:       "skip-on-error-not-found",
+			chainStore: &ChainStore{Links: []ChainLink{{Name: "db", Store: &failingStore{}, OnError: SkipOnError}, {Name: "legacy", Store: legacyStore}}},
+			lookup: func(store CredentialStore) (UserInfo, error) {
+				return store.FindUserByLogin(ctx, "nobody")
+			},
+			wantErr: errStoreDown,
+		},
+		{
+			name: "skip-on-error-revoked",
+			chainStore: &ChainStore{
+				Links:      []ChainLink{{Name: "db", Store: &failingStore{}, OnError: SkipOnError}, {Name: "new", Store: newStore}},
+				Precedence: FirstValid,
+			},
+			lookup: func(store CredentialStore) (UserInfo, error) {
+				return store.FindUserByAPIKey(ctx, "shared-key")
+			},
+			wantErr: ErrCredentialsRevoked,
+		},
+		{
+			name: "revoked-before-skipped-error",
+			chainStore: &ChainStore{
+				Links:      []ChainLink{{Name: "new", Store: newStore}, {Name: "db", Store: &failingStore{}, OnError: SkipOnError}},
+				Precedence: FirstValid,
+			},
+			lookup: func(store CredentialStore) (UserInfo, error) {
+				return store.FindUserByAPIKey(ctx, "shared-key")
+			},
+			wantErr: ErrCredentialsRevoked,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chainStore, err := NewChainStore(tt.chainStore)
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, err := tt.lookup(chainStore)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr), err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantStore, user.StoreName)
+			assert.Equal(t, tt.wantLogin, user.Login)
+		})
+	}
+}
+
+func TestChainStore_Init(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{})
+	invalid := []*ChainStore{
+		{},
+		{Links: []ChainLink{{Name: "a"}}},
+		{Links: []ChainLink{{Store: store}}},
+		{Links: []ChainLink{{Name: "a", Store: store}, {Name: "a", Store: store}}},
+	}
+	for _, chainStore := range invalid {
+		_, err := NewChainStore(chainStore)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,90 @@
+package tnpptMiddleware_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	tnpptMiddleware "github.com/StevenLeclerc/gin-TNPPT"
+	"github.com/StevenLeclerc/gin-TNPPT/storetest"
+)
+
+func TestMemoryStore_Conformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, records tnpptMiddleware.StoreRecords) tnpptMiddleware.CredentialStore {
+		store, err := tnpptMiddleware.NewMemoryStore(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func TestFileStore_Conformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, records tnpptMiddleware.StoreRecords) tnpptMiddleware.CredentialStore {
+		content, err := json.Marshal(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "credentials.json")
+		if err := os.WriteFile(path, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		store, err := tnpptMiddleware.NewFileStore(&tnpptMiddleware.FileStore{Path: path, DisableSIGHUP: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(store.Close)
+		return store
+	})
+}
+
+func TestChainStore_Conformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, records tnpptMiddleware.StoreRecords) tnpptMiddleware.CredentialStore {
+		empty, err := tnpptMiddleware.NewMemoryStore(tnpptMiddleware.StoreRecords{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := tnpptMiddleware.NewMemoryStore(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chainStore, err := tnpptMiddleware.NewChainStore(&tnpptMiddleware.ChainStore{Links: []tnpptMiddleware.ChainLink{
+			{Name: "empty", Store: empty},
+			{Name: "records", Store: store},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chainStore
+	})
+	storetest.RunBackendFailure(t, func(t *testing.T, records tnpptMiddleware.StoreRecords) tnpptMiddleware.CredentialStore {
+		store, err := tnpptMiddleware.NewMemoryStore(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chainStore, err := tnpptMiddleware.NewChainStore(&tnpptMiddleware.ChainStore{Links: []tnpptMiddleware.ChainLink{
+			{Name: "down", Store: downStore{}},
+			{Name: "records", Store: store},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chainStore
+	})
+}
+
+// downStore is a CredentialStore whose backend is unreachable.
+type downStore struct{}
+
+var errStoreDown = errors.New("connection refused")
+
+func (downStore) FindUserByLogin(ctx context.Context, login string) (tnpptMiddleware.UserInfo, error) {
+	return tnpptMiddleware.UserInfo{}, errStoreDown
+}
+
+func (downStore) FindUserByAPIKey(ctx context.Context, apiKey string) (tnpptMiddleware.UserInfo, error) {
+	return tnpptMiddleware.UserInfo{}, errStoreDown
+}
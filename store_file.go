@@ -0,0 +1,192 @@
+package tnpptMiddleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// FileStore serves the StoreRecords found in a YAML or JSON file.
+// The file is polled every ReloadInterval and re-read on SIGHUP; a new version
+// is only swapped in once it has been fully parsed and validated, otherwise the
+// previous one keeps being served and OnReload receives the error, also
+// logged on Logger (slog.Default when nil).
+type FileStore struct {
+	Path           string
+	ReloadInterval time.Duration
+	DisableSIGHUP  bool
+	OnReload       func(err error)
+	Logger         *slog.Logger
+
+	mu           sync.RWMutex
+	current      *MemoryStore
+	digest       [sha256.Size]byte
+	failedDigest [sha256.Size]byte
+	signals      chan os.Signal
+	stop         chan struct{}
+	stopOnce     sync.Once
+	watching     sync.WaitGroup
+}
+
+func NewFileStore(fileStore *FileStore) (*FileStore, error) {
+	return fileStore.Init()
+}
+
+func (fileStore *FileStore) Init() (*FileStore, error) {
+	if fileStore.Path == "" {
+		return nil, errors.New("TNPPT - FileStore - You need to set the Path")
+	}
+	if fileStore.ReloadInterval == 0 {
+		fileStore.ReloadInterval = 2 * time.Second
+	}
+	if err := fileStore.Reload(); err != nil {
+		return nil, err
+	}
+	fileStore.stop = make(chan struct{})
+	fileStore.signals = make(chan os.Signal, 1)
+	if !fileStore.DisableSIGHUP {
+		signal.Notify(fileStore.signals, syscall.SIGHUP)
+	}
+	fileStore.watching.Add(1)
+	go fileStore.watch()
+	return fileStore, nil
+}
+
+func (fileStore *FileStore) FindUserByLogin(ctx context.Context, login string) (UserInfo, error) {
+	return fileStore.snapshot().FindUserByLogin(ctx, login)
+}
+
+func (fileStore *FileStore) FindUserByAPIKey(ctx context.Context, apiKey string) (UserInfo, error) {
+	return fileStore.snapshot().FindUserByAPIKey(ctx, apiKey)
+}
+
+// Reload reads the file again and swaps it in if its content changed.
+func (fileStore *FileStore) Reload() error {
+	_, err := fileStore.reload()
+	return err
+}
+
+func (fileStore *FileStore) Close() {
+	fileStore.stopOnce.Do(func() {
+		if fileStore.stop != nil {
+			close(fileStore.stop)
+			fileStore.watching.Wait()
+		}
+	})
+}
+
+func (fileStore *FileStore) snapshot() *MemoryStore {
+	fileStore.mu.RLock()
+	defer fileStore.mu.RUnlock()
+	return fileStore.current
+}
+
+func (fileStore *FileStore) reload() (bool, error) {
+	content, errRead := os.ReadFile(fileStore.Path)
+	if errRead != nil {
+		return false, fmt.Errorf("[STORE] %w", errRead)
+	}
+	digest := sha256.Sum256(content)
+	fileStore.mu.RLock()
+	unchanged := fileStore.current != nil && digest == fileStore.digest
+	fileStore.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	records, errParse := parseStoreRecords(fileStore.Path, content)
+	if errParse != nil {
+		return true, errParse
+	}
+	store, errStore := NewMemoryStore(records)
+	if errStore != nil {
+		return true, errStore
+	}
+	fileStore.mu.Lock()
+	fileStore.current = store
+	fileStore.digest = digest
+	fileStore.mu.Unlock()
+	return true, nil
+}
+
+func (fileStore *FileStore) watch() {
+	defer fileStore.watching.Done()
+	ticker := time.NewTicker(fileStore.ReloadInterval)
+	defer ticker.Stop()
+	defer signal.Stop(fileStore.signals)
+	for {
+		select {
+		case <-fileStore.stop:
+			return
+		case <-ticker.C:
+			fileStore.reloadAndReport(false)
+		case <-fileStore.signals:
+			fileStore.reloadAndReport(true)
+		}
+	}
+}
+
+// reloadAndReport only reports a broken file once per content, unless forced by SIGHUP.
+func (fileStore *FileStore) reloadAndReport(forced bool) {
+	changed, err := fileStore.reload()
+	if err != nil {
+		content, _ := os.ReadFile(fileStore.Path)
+		failedDigest := sha256.Sum256(content)
+		if !forced && failedDigest == fileStore.failedDigest {
+			return
+		}
+		fileStore.failedDigest = failedDigest
+		loggerOrDefault(fileStore.Logger).Error("credentials file reload failed", "path", fileStore.Path, "error", err)
+	}
+	if (changed || err != nil || forced) && fileStore.OnReload != nil {
+		fileStore.OnReload(err)
+	}
+}
+
+func parseStoreRecords(path string, content []byte) (StoreRecords, error) {
+	var records StoreRecords
+	return records, decodeConfigFile(path, content, &records, "STORE")
+}
+
+// decodeConfigFile decodes content in out as JSON or YAML, depending on the
+// extension of path or else on the content. Unknown fields are rejected.
+func decodeConfigFile(path string, content []byte, out interface{}, tag string) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return decodeConfigJSON(content, out, tag)
+	case ".yaml", ".yml":
+		return decodeConfigYAML(content, out, tag)
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		return decodeConfigJSON(content, out, tag)
+	}
+	return decodeConfigYAML(content, out, tag)
+}
+
+func decodeConfigJSON(content []byte, out interface{}, tag string) error {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(out); err != nil {
+		return fmt.Errorf("[%s] invalid JSON: %w", tag, err)
+	}
+	return nil
+}
+
+func decodeConfigYAML(content []byte, out interface{}, tag string) error {
+	if err := yaml.UnmarshalStrict(content, out); err != nil {
+		return fmt.Errorf("[%s] invalid YAML: %w", tag, err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const storeFileYAML = `
+users:
+  - id: "1"
+    login: steven
+    password: pass
+    scopes: [logs:read]
+    roles: [viewer]
+api_keys:
+  - login: collector
+    key: secret-key
+    scopes: [logs:write]
+  - login: old-collector
+    key_sha256: %s
+    revoked: true
+`
+
+func writeStoreFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestFileStore(t *testing.T, name string, content string) *FileStore {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	writeStoreFile(t, path, content)
+	fileStore, err := NewFileStore(&FileStore{Path: path, ReloadInterval: 10 * time.Millisecond, DisableSIGHUP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fileStore.Close)
+	return fileStore
+}
+
+func TestFileStore_Lookups(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{name: "yaml", file: "credentials.yaml", content: fmt.Sprintf(storeFileYAML, HashAPIKey("old-key"))},
+		{name: "json", file: "credentials.json", content: `{
+			"users": [{"id": "1", "login": "steven", "password": "pass", "scopes": ["logs:read"], "roles": ["viewer"]}],
+			"api_keys": [
+				{"login": "collector", "key": "secret-key", "scopes": ["logs:write"]},
+				{"login": "old-collector", "key_sha256": "` + HashAPIKey("old-key") + `", "revoked": true}
+			]
+		}`},
+	}
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileStore := newTestFileStore(t, tt.file, tt.content)
+
+			user, err := fileStore.FindUserByLogin(ctx, "steven")
+			assert.NoError(t, err)
+			assert.Equal(t, UserInfo{ID: "1", Login: "steven", Password: "pass", Scopes: []string{"logs:read"}, Roles: []string{"viewer"}}, user)
+
+			_, err = fileStore.FindUserByLogin(ctx, "unknown")
+			assert.True(t, errors.Is(err, ErrCredentialsNotFound))
+
+			user, err = fileStore.FindUserByAPIKey(ctx, "secret-key")
+			assert.NoError(t, err)
+			assert.Equal(t, "collector", user.Login)
+			assert.Equal(t, []string{"logs:write"}, user.Scopes)
+
+			_, err = fileStore.FindUserByAPIKey(ctx, "old-key")
+			assert.True(t, errors.Is(err, ErrCredentialsRevoked))
+		})
+	}
+}
+
+func TestFileStore_InvalidAtStartup(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "syntax", content: "users: [\n"},
+		{name: "unknown-field", content: "users:\n  - login: steven\n    password: pass\n    pasword: typo\n"},
+		{name: "missing-password", content: "users:\n  - login: steven\n"},
+		{name: "duplicated-login", content: "users:\n  - login: steven\n    password: a\n  - login: steven\n    password: b\n"},
+		{name: "key-and-hash", content: "api_keys:\n  - login: a\n    key: k\n    key_sha256: " + HashAPIKey("k") + "\n"},
+		{name: "bad-hash", content: "api_keys:\n  - login: a\n    key_sha256: nothex\n"},
+		{name: "empty-role", content: "users:\n  - login: steven\n    password: pass\n    roles: [\"\"]\n"},
+		{name: "duplicated-key", content: "api_keys:\n  - login: a\n    key: k\n  - login: b\n    key_sha256: " + HashAPIKey("k") + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "credentials.yaml")
+			writeStoreFile(t, path, tt.content)
+			_, err := NewFileStore(&FileStore{Path: path, DisableSIGHUP: true})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestFileStore_HotReload(t *testing.T) {
+	reloads := make(chan error, 10)
+	path := filepath.Join(t.TempDir(), "credentials.yaml")
+	writeStoreFile(t, path, "users:\n  - login: steven\n    password: pass\n")
+	fileStore, err := NewFileStore(&FileStore{
+		Path:           path,
+		ReloadInterval: 10 * time.Millisecond,
+		DisableSIGHUP:  true,
+		OnReload: func(err error) {
+			reloads <- err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileStore.Close()
+	ctx := context.Background()
+
+	writeStoreFile(t, path, "users:\n  - login: steven\n    password: rotated\n")
+	assert.NoError(t, <-reloads)
+	user, _ := fileStore.FindUserByLogin(ctx, "steven")
+	assert.Equal(t, "rotated", user.Password)
+
+	writeStoreFile(t, path, "users:\n  - login: steven\n")
+	assert.Error(t, <-reloads)
+	user, errFind := fileStore.FindUserByLogin(ctx, "steven")
+	assert.NoError(t, errFind)
+	assert.Equal(t, "rotated", user.Password)
+}
+
+func TestTNPPT_Store(t *testing.T) {
+	fileStore := newTestFileStore(t, "credentials.yaml", fmt.Sprintf(storeFileYAML, HashAPIKey("old-key")))
+	auth, err := New(&TNPPT{Store: fileStore})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	var user UserInfo
+	router.POST("/login", auth.ActivateHMACAuth(), func(c *gin.Context) { user = principal(c) })
+	router.POST("/log", auth.ActivateApiKeyAuth())
+
+	timeNow := auth.GetTimeMilliseconds()
+	hash := sha256.Sum256([]byte("steven" + "pass" + strconv.FormatInt(timeNow, 10)))
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/login", nil)
+	req.Header.Add("HMAC_HASH", fmt.Sprintf("%x", hash))
+	req.Header.Add("HMAC_LOGIN", "steven")
+	req.Header.Add("HMAC_TIME", strconv.FormatInt(timeNow, 10))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, []string{"logs:read"}, user.Scopes)
+
+	tests := []struct {
+		apiKey string
+		want   int
+	}{
+		{apiKey: "secret-key", want: 200},
+		{apiKey: "old-key", want: 401},
+		{apiKey: "unknown", want: 401},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/log", nil)
+		req.Header.Add("API_KEY", tt.apiKey)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tt.want, w.Code, tt.apiKey)
+	}
+}
@@ -0,0 +1,44 @@
+//go:build !windows
+
+package tnpptMiddleware
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStore_SIGHUP(t *testing.T) {
+	reloads := make(chan error, 10)
+	path := filepath.Join(t.TempDir(), "credentials.yaml")
+	writeStoreFile(t, path, "users:\n  - login: steven\n    password: pass\n")
+	fileStore, err := NewFileStore(&FileStore{
+		Path:           path,
+		ReloadInterval: time.Hour,
+		OnReload: func(err error) {
+			reloads <- err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileStore.Close()
+
+	writeStoreFile(t, path, "users:\n  - login: steven\n    password: rotated\n")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case errReload := <-reloads:
+		assert.NoError(t, errReload)
+		user, _ := fileStore.FindUserByLogin(context.Background(), "steven")
+		assert.Equal(t, "rotated", user.Password)
+	case <-time.After(2 * time.Second):
+		t.Fatal("SIGHUP did not trigger a reload")
+	}
+}
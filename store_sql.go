@@ -0,0 +1,329 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SQLUserMapping maps the users table, PasswordHashColumn is optional and
+// only selected (and updated on rehash) when set, so is RolesColumn.
+type SQLUserMapping struct {
+	Table              string
+	IDColumn           string
+	LoginColumn        string
+	PasswordColumn     string
+	PasswordHashColumn string
+	ScopesColumn       string
+	RolesColumn        string
+}
+
+// SQLAPIKeyMapping maps the api keys table, KeyColumn holds HashAPIKey(key)
+// unless SQLStore.PlainAPIKeys is set.
+type SQLAPIKeyMapping struct {
+	Table         string
+	IDColumn      string
+	LoginColumn   string
+	KeyColumn     string
+	ScopesColumn  string
+	RevokedColumn string
+	RolesColumn   string
+}
+
+// SQLStore is a CredentialStore on top of database/sql.
+// Queries are built from the mappings, or taken as is from UserQuery and
+// APIKeyQuery which must select (id, login, password, scopes[, password_hash[, roles]])
+// and (id, login, scopes, revoked[, roles]) with a single placeholder, and from
+// UpdatePasswordHashQuery taking the new hash then the login.
+// Scopes and roles are stored in a single column, separated by ScopeSeparator.
+type SQLStore struct {
+	DB                      *sql.DB
+	Users                   SQLUserMapping
+	APIKeys                 SQLAPIKeyMapping
+	UserQuery               string
+	APIKeyQuery             string
+	UpdatePasswordHashQuery string
+	Placeholder             string
+	ScopeSeparator          string
+	PlainAPIKeys            bool
+	DisableUsers            bool
+	DisableAPIKeys          bool
+
+	userStmt       *sql.Stmt
+	apiKeyStmt     *sql.Stmt
+	updateHashStmt *sql.Stmt
+}
+
+var (
+	sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+	sqlSelect     = regexp.MustCompile(`(?i)^\s*(SELECT|WITH)\s`)
+)
+
+func NewSQLStore(sqlStore *SQLStore) (*SQLStore, error) {
+	return sqlStore.Init()
+}
+
+func (sqlStore *SQLStore) Init() (*SQLStore, error) {
+	if sqlStore.DB == nil {
+		return nil, errors.New("TNPPT - SQLStore - You need to set the DB")
+	}
+	if sqlStore.Placeholder == "" {
+		sqlStore.Placeholder = "?"
+	}
+	if sqlStore.ScopeSeparator == "" {
+		sqlStore.ScopeSeparator = " "
+	}
+	sqlStore.Users.setDefaults()
+	sqlStore.APIKeys.setDefaults()
+	if !sqlStore.DisableUsers {
+		query := sqlStore.UserQuery
+		if query == "" {
+			var errQuery error
+			if query, errQuery = sqlStore.Users.query(sqlStore.Placeholder); errQuery != nil {
+				return nil, errQuery
+			}
+		} else if !sqlSelect.MatchString(query) {
+			return nil, errors.New("[STORE] UserQuery is not a SELECT")
+		}
+		userStmt, errPrepare := sqlStore.DB.Prepare(query)
+		if errPrepare != nil {
+			return nil, fmt.Errorf("[STORE] preparing user query: %w", errPrepare)
+		}
+		sqlStore.userStmt = userStmt
+		query = sqlStore.UpdatePasswordHashQuery
+		if query == "" && sqlStore.Users.PasswordHashColumn != "" {
+			var errQuery error
+			if query, errQuery = sqlStore.Users.updateHashQuery(sqlStore.Placeholder); errQuery != nil {
+				sqlStore.Close()
+				return nil, errQuery
+			}
+		}
+		if query != "" {
+			updateHashStmt, errPrepare := sqlStore.DB.Prepare(query)
+			if errPrepare != nil {
+				sqlStore.Close()
+				return nil, fmt.Errorf("[STORE] preparing password hash update: %w", errPrepare)
+			}
+			sqlStore.updateHashStmt = updateHashStmt
+		}
+	}
+	if !sqlStore.DisableAPIKeys {
+		query := sqlStore.APIKeyQuery
+		if query == "" {
+			var errQuery error
+			if query, errQuery = sqlStore.APIKeys.query(sqlStore.Placeholder); errQuery != nil {
+				sqlStore.Close()
+				return nil, errQuery
+			}
+		} else if !sqlSelect.MatchString(query) {
+			sqlStore.Close()
+			return nil, errors.New("[STORE] APIKeyQuery is not a SELECT")
+		}
+		apiKeyStmt, errPrepare := sqlStore.DB.Prepare(query)
+		if errPrepare != nil {
+			sqlStore.Close()
+			return nil, fmt.Errorf("[STORE] preparing api key query: %w", errPrepare)
+		}
+		sqlStore.apiKeyStmt = apiKeyStmt
+	}
+	return sqlStore, nil
+}
+
+// Close releases the prepared statements, the DB itself is left open.
+func (sqlStore *SQLStore) Close() {
+	if sqlStore.userStmt != nil {
+		_ = sqlStore.userStmt.Close()
+		sqlStore.userStmt = nil
+	}
+	if sqlStore.apiKeyStmt != nil {
+		_ = sqlStore.apiKeyStmt.Close()
+		sqlStore.apiKeyStmt = nil
+	}
+	if sqlStore.updateHashStmt != nil {
+		_ = sqlStore.updateHashStmt.Close()
+		sqlStore.updateHashStmt = nil
+	}
+}
+
+func (sqlStore *SQLStore) FindUserByLogin(ctx context.Context, login string) (UserInfo, error) {
+	if sqlStore.userStmt == nil {
+		return UserInfo{}, ErrCredentialsNotFound
+	}
+	rows, errQuery := sqlStore.userStmt.QueryContext(ctx, login)
+	if errQuery != nil {
+		return UserInfo{}, fmt.Errorf("[STORE] user lookup: %w", errQuery)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if errRows := rows.Err(); errRows != nil {
+			return UserInfo{}, fmt.Errorf("[STORE] user lookup: %w", errRows)
+		}
+		return UserInfo{}, ErrCredentialsNotFound
+	}
+	columns, errColumns := rows.Columns()
+	if errColumns != nil {
+		return UserInfo{}, fmt.Errorf("[STORE] user lookup: %w", errColumns)
+	}
+	var id interface{}
+	var userLogin, password, scopes, passwordHash, roles sql.NullString
+	destinations := []interface{}{&id, &userLogin, &password, &scopes, &passwordHash, &roles}
+	if len(columns) < len(destinations) {
+		destinations = destinations[:len(columns)]
+	}
+	if errScan := rows.Scan(destinations...); errScan != nil {
+		return UserInfo{}, fmt.Errorf("[STORE] user lookup: %w", errScan)
+	}
+	return UserInfo{
+		ID:           sqlID(id),
+		Login:        userLogin.String,
+		Password:     password.String,
+		PasswordHash: passwordHash.String,
+		Scopes:       sqlStore.splitScopes(scopes.String),
+		Roles:        sqlStore.splitScopes(roles.String),
+	}, nil
+}
+
+func (sqlStore *SQLStore) UpdatePasswordHash(ctx context.Context, login string, passwordHash string) error {
+	if sqlStore.updateHashStmt == nil {
+		return errors.New("[STORE] no password hash column configured")
+	}
+	result, errExec := sqlStore.updateHashStmt.ExecContext(ctx, passwordHash, login)
+	if errExec != nil {
+		return fmt.Errorf("[STORE] password hash update: %w", errExec)
+	}
+	if updated, errAffected := result.RowsAffected(); errAffected == nil && updated == 0 {
+		return ErrCredentialsNotFound
+	}
+	return nil
+}
+
+func (sqlStore *SQLStore) FindUserByAPIKey(ctx context.Context, apiKey string) (UserInfo, error) {
+	if sqlStore.apiKeyStmt == nil {
+		return UserInfo{}, ErrCredentialsNotFound
+	}
+	lookup := HashAPIKey(apiKey)
+	if sqlStore.PlainAPIKeys {
+		lookup = apiKey
+	}
+	rows, errQuery := sqlStore.apiKeyStmt.QueryContext(ctx, lookup)
+	if errQuery != nil {
+		return UserInfo{}, fmt.Errorf("[STORE] api key lookup: %w", errQuery)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if errRows := rows.Err(); errRows != nil {
+			return UserInfo{}, fmt.Errorf("[STORE] api key lookup: %w", errRows)
+		}
+		return UserInfo{}, ErrCredentialsNotFound
+	}
+	columns, errColumns := rows.Columns()
+	if errColumns != nil {
+		return UserInfo{}, fmt.Errorf("[STORE] api key lookup: %w", errColumns)
+	}
+	var id interface{}
+	var login, scopes, roles sql.NullString
+	var revoked sql.NullBool
+	destinations := []interface{}{&id, &login, &scopes, &revoked, &roles}
+	if len(columns) < len(destinations) {
+		destinations = destinations[:len(columns)]
+	}
+	if errScan := rows.Scan(destinations...); errScan != nil {
+		return UserInfo{}, fmt.Errorf("[STORE] api key lookup: %w", errScan)
+	}
+	if revoked.Bool {
+		return UserInfo{}, ErrCredentialsRevoked
+	}
+	return UserInfo{
+		ID:     sqlID(id),
+		Login:  login.String,
+		Scopes: sqlStore.splitScopes(scopes.String),
+		Roles:  sqlStore.splitScopes(roles.String),
+	}, nil
+}
+
+func (sqlStore *SQLStore) splitScopes(scopes string) []string {
+	var result []string
+	for _, scope := range strings.Split(scopes, sqlStore.ScopeSeparator) {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			result = append(result, scope)
+		}
+	}
+	return result
+}
+
+func (mapping *SQLUserMapping) setDefaults() {
+	setDefault(&mapping.Table, "users")
+	setDefault(&mapping.IDColumn, "id")
+	setDefault(&mapping.LoginColumn, "login")
+	setDefault(&mapping.PasswordColumn, "password")
+	setDefault(&mapping.ScopesColumn, "scopes")
+}
+
+func (mapping SQLUserMapping) query(placeholder string) (string, error) {
+	columns := []string{mapping.IDColumn, mapping.LoginColumn, mapping.PasswordColumn, mapping.ScopesColumn}
+	if mapping.PasswordHashColumn != "" {
+		columns = append(columns, mapping.PasswordHashColumn)
+	} else if mapping.RolesColumn != "" {
+		columns = append(columns, "NULL")
+	}
+	if mapping.RolesColumn != "" {
+		columns = append(columns, mapping.RolesColumn)
+	}
+	return selectQuery(mapping.Table, mapping.LoginColumn, placeholder, columns...)
+}
+
+// updateHashQuery numbers the placeholders when they are, as for Postgres.
+func (mapping SQLUserMapping) updateHashQuery(placeholder string) (string, error) {
+	for _, identifier := range []string{mapping.Table, mapping.PasswordHashColumn, mapping.LoginColumn} {
+		if !sqlIdentifier.MatchString(identifier) {
+			return "", fmt.Errorf("[STORE] invalid SQL identifier %q", identifier)
+		}
+	}
+	secondPlaceholder := placeholder
+	if placeholder == "$1" {
+		secondPlaceholder = "$2"
+	}
+	return fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s = %s", mapping.Table, mapping.PasswordHashColumn, placeholder, mapping.LoginColumn, secondPlaceholder), nil
+}
+
+func (mapping *SQLAPIKeyMapping) setDefaults() {
+	setDefault(&mapping.Table, "api_keys")
+	setDefault(&mapping.IDColumn, "id")
+	setDefault(&mapping.LoginColumn, "login")
+	setDefault(&mapping.KeyColumn, "key_sha256")
+	setDefault(&mapping.ScopesColumn, "scopes")
+	setDefault(&mapping.RevokedColumn, "revoked")
+}
+
+func (mapping SQLAPIKeyMapping) query(placeholder string) (string, error) {
+	columns := []string{mapping.IDColumn, mapping.LoginColumn, mapping.ScopesColumn, mapping.RevokedColumn}
+	if mapping.RolesColumn != "" {
+		columns = append(columns, mapping.RolesColumn)
+	}
+	return selectQuery(mapping.Table, mapping.KeyColumn, placeholder, columns...)
+}
+
+func selectQuery(table string, whereColumn string, placeholder string, columns ...string) (string, error) {
+	for _, identifier := range append([]string{table, whereColumn}, columns...) {
+		if !sqlIdentifier.MatchString(identifier) {
+			return "", fmt.Errorf("[STORE] invalid SQL identifier %q", identifier)
+		}
+	}
+	return fmt.Sprintf("SELECT %s FROM %s WHERE %s = %s", strings.Join(columns, ", "), table, whereColumn, placeholder), nil
+}
+
+func setDefault(value *string, defaultValue string) {
+	if *value == "" {
+		*value = defaultValue
+	}
+}
+
+func sqlID(id interface{}) interface{} {
+	if raw, isBytes := id.([]byte); isBytes {
+		return string(raw)
+	}
+	return id
+}
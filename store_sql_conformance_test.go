@@ -0,0 +1,68 @@
+//go:build cgo
+
+package tnpptMiddleware_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tnpptMiddleware "github.com/StevenLeclerc/gin-TNPPT"
+	"github.com/StevenLeclerc/gin-TNPPT/storetest"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSQLStore_Conformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, records tnpptMiddleware.StoreRecords) tnpptMiddleware.CredentialStore {
+		store, _ := newConformanceSQLStore(t, records)
+		return store
+	})
+	storetest.RunBackendFailure(t, func(t *testing.T, records tnpptMiddleware.StoreRecords) tnpptMiddleware.CredentialStore {
+		store, db := newConformanceSQLStore(t, records)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+// newConformanceSQLStore returns a SQLStore on a SQLite database holding records.
+func newConformanceSQLStore(t *testing.T, records tnpptMiddleware.StoreRecords) (*tnpptMiddleware.SQLStore, *sql.DB) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "credentials.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	statements := []string{
+		"CREATE TABLE users (id TEXT PRIMARY KEY, login TEXT UNIQUE, password TEXT, scopes TEXT)",
+		"CREATE TABLE api_keys (id TEXT PRIMARY KEY, login TEXT, key_sha256 TEXT UNIQUE, scopes TEXT, revoked BOOLEAN)",
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, user := range records.Users {
+		if _, err := db.Exec("INSERT INTO users VALUES (?, ?, ?, ?)", user.ID, user.Login, user.Password, strings.Join(user.Scopes, " ")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, apiKey := range records.APIKeys {
+		keySHA256 := apiKey.KeySHA256
+		if keySHA256 == "" {
+			keySHA256 = tnpptMiddleware.HashAPIKey(apiKey.Key)
+		}
+		if _, err := db.Exec("INSERT INTO api_keys VALUES (?, ?, ?, ?, ?)", apiKey.ID, apiKey.Login, keySHA256, strings.Join(apiKey.Scopes, " "), apiKey.Revoked); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := tnpptMiddleware.NewSQLStore(&tnpptMiddleware.SQLStore{DB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Close)
+	return store, db
+}
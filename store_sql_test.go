@@ -0,0 +1,222 @@
+//go:build cgo
+
+package tnpptMiddleware
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingSQLite is the SQLite driver counting the statements prepared.
+type countingSQLite struct {
+	sqlite3.SQLiteDriver
+	prepared int64
+}
+
+type countingSQLiteConn struct {
+	*sqlite3.SQLiteConn
+	driver *countingSQLite
+}
+
+var countingSQLiteDriver = &countingSQLite{}
+
+func init() {
+	sql.Register("sqlite3-counting", countingSQLiteDriver)
+}
+
+func (sqliteDriver *countingSQLite) Open(name string) (driver.Conn, error) {
+	conn, err := sqliteDriver.SQLiteDriver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &countingSQLiteConn{SQLiteConn: conn.(*sqlite3.SQLiteConn), driver: sqliteDriver}, nil
+}
+
+func (conn *countingSQLiteConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	atomic.AddInt64(&conn.driver.prepared, 1)
+	return conn.SQLiteConn.PrepareContext(ctx, query)
+}
+
+// openSQLite opens a SQLite database in a temporary file and runs statements on it.
+func openSQLite(t *testing.T, statements ...string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3-counting", filepath.Join(t.TempDir(), "credentials.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestSQLStore_DefaultMapping(t *testing.T) {
+	db := openSQLite(t,
+		"CREATE TABLE users (id INTEGER PRIMARY KEY, login TEXT, password TEXT, scopes TEXT)",
+		"CREATE TABLE api_keys (id INTEGER PRIMARY KEY, login TEXT, key_sha256 TEXT, scopes TEXT, revoked BOOLEAN)",
+		"INSERT INTO users VALUES (1, 'steven', 'pass', 'logs:read logs:write')",
+		"INSERT INTO api_keys VALUES (7, 'collector', '"+HashAPIKey("secret-key")+"', 'logs:write', 0)",
+		"INSERT INTO api_keys VALUES (8, 'old-collector', '"+HashAPIKey("old-key")+"', NULL, 1)",
+	)
+	db.SetMaxOpenConns(1)
+	preparedBefore := atomic.LoadInt64(&countingSQLiteDriver.prepared)
+	sqlStore, err := NewSQLStore(&SQLStore{DB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlStore.Close()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		user, errFind := sqlStore.FindUserByLogin(ctx, "steven")
+		assert.NoError(t, errFind)
+		assert.Equal(t, UserInfo{ID: int64(1), Login: "steven", Password: "pass", Scopes: []string{"logs:read", "logs:write"}}, user)
+	}
+	assert.Equal(t, int64(2), atomic.LoadInt64(&countingSQLiteDriver.prepared)-preparedBefore)
+
+	_, err = sqlStore.FindUserByLogin(ctx, "unknown")
+	assert.True(t, errors.Is(err, ErrCredentialsNotFound))
+
+	user, err := sqlStore.FindUserByAPIKey(ctx, "secret-key")
+	assert.NoError(t, err)
+	assert.Equal(t, UserInfo{ID: int64(7), Login: "collector", Scopes: []string{"logs:write"}}, user)
+
+	_, err = sqlStore.FindUserByAPIKey(ctx, "old-key")
+	assert.True(t, errors.Is(err, ErrCredentialsRevoked))
+
+	_, err = sqlStore.FindUserByAPIKey(ctx, "unknown")
+	assert.True(t, errors.Is(err, ErrCredentialsNotFound))
+}
+
+func TestSQLStore_CustomMapping(t *testing.T) {
+	db := openSQLite(t,
+		"CREATE TABLE accounts (uuid TEXT, username TEXT, secret TEXT, perms TEXT, groups TEXT)",
+		"CREATE TABLE tokens (uuid TEXT, owner TEXT, token TEXT, perms TEXT, disabled BOOLEAN, groups TEXT)",
+		"INSERT INTO accounts VALUES ('a-1', 'steven', 'pass', 'a,b', 'admin, ops')",
+		"INSERT INTO tokens VALUES ('t-1', 'collector', 'secret-key', '', 0, 'collector')",
+	)
+	sqlStore, err := NewSQLStore(&SQLStore{
+		DB: db,
+		Users: SQLUserMapping{
+			Table:          "main.accounts",
+			IDColumn:       "uuid",
+			LoginColumn:    "username",
+			PasswordColumn: "secret",
+			ScopesColumn:   "perms",
+			RolesColumn:    "groups",
+		},
+		APIKeyQuery:    "SELECT uuid, owner, perms, disabled, groups FROM tokens WHERE token = $1",
+		Placeholder:    "$1",
+		ScopeSeparator: ",",
+		PlainAPIKeys:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlStore.Close()
+	ctx := context.Background()
+
+	user, err := sqlStore.FindUserByLogin(ctx, "steven")
+	assert.NoError(t, err)
+	assert.Equal(t, UserInfo{ID: "a-1", Login: "steven", Password: "pass", Scopes: []string{"a", "b"}, Roles: []string{"admin", "ops"}}, user)
+
+	user, err = sqlStore.FindUserByAPIKey(ctx, "secret-key")
+	assert.NoError(t, err)
+	assert.Equal(t, UserInfo{ID: "t-1", Login: "collector", Roles: []string{"collector"}}, user)
+}
+
+func TestSQLStore_Init(t *testing.T) {
+	db := openSQLite(t,
+		"CREATE TABLE users (id INTEGER PRIMARY KEY, login TEXT, password TEXT, scopes TEXT)",
+		"CREATE TABLE api_keys (id INTEGER PRIMARY KEY, login TEXT, key_sha256 TEXT, scopes TEXT, revoked BOOLEAN)",
+	)
+	tests := []struct {
+		name     string
+		sqlStore *SQLStore
+		wantErr  bool
+	}{
+		{name: "no-db", sqlStore: &SQLStore{}, wantErr: true},
+		{name: "injection", sqlStore: &SQLStore{DB: db, Users: SQLUserMapping{Table: "users; DROP TABLE users"}}, wantErr: true},
+		{name: "invalid-template", sqlStore: &SQLStore{DB: db, UserQuery: "DELETE FROM users"}, wantErr: true},
+		{name: "unknown-table", sqlStore: &SQLStore{DB: db, Users: SQLUserMapping{Table: "accounts"}}, wantErr: true},
+		{name: "schema-table", sqlStore: &SQLStore{DB: db, Users: SQLUserMapping{Table: "main.users"}, APIKeys: SQLAPIKeyMapping{Table: "main.api_keys"}}, wantErr: false},
+		{name: "api-keys-only", sqlStore: &SQLStore{DB: db, DisableUsers: true}, wantErr: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlStore, err := NewSQLStore(tt.sqlStore)
+			assert.Equal(t, tt.wantErr, err != nil, err)
+			if sqlStore != nil {
+				_, errFind := sqlStore.FindUserByLogin(context.Background(), "steven")
+				assert.True(t, errors.Is(errFind, ErrCredentialsNotFound))
+				sqlStore.Close()
+			}
+		})
+	}
+}
+
+func TestSQLStore_BackendError(t *testing.T) {
+	db := openSQLite(t,
+		"CREATE TABLE users (id INTEGER PRIMARY KEY, login TEXT, password TEXT, scopes TEXT)",
+		"INSERT INTO users VALUES (1, 'steven', 'pass', NULL)",
+	)
+	sqlStore, err := NewSQLStore(&SQLStore{DB: db, DisableAPIKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlStore.Close()
+	_ = db.Close()
+	_, err = sqlStore.FindUserByLogin(context.Background(), "steven")
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrCredentialsNotFound))
+}
+
+func TestSQLStore_PasswordHash(t *testing.T) {
+	db := openSQLite(t,
+		"CREATE TABLE users (id INTEGER PRIMARY KEY, login TEXT, password TEXT, scopes TEXT, password_hash TEXT)",
+		"INSERT INTO users VALUES (1, 'steven', NULL, NULL, '$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW')",
+	)
+	sqlStore, err := NewSQLStore(&SQLStore{
+		DB:             db,
+		Users:          SQLUserMapping{PasswordHashColumn: "password_hash"},
+		Placeholder:    "$1",
+		DisableAPIKeys: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlStore.Close()
+	ctx := context.Background()
+
+	user, err := sqlStore.FindUserByLogin(ctx, "steven")
+	assert.NoError(t, err)
+	assert.Equal(t, "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", user.PasswordHash)
+
+	assert.NoError(t, sqlStore.UpdatePasswordHash(ctx, "steven", "$argon2id$new"))
+	user, _ = sqlStore.FindUserByLogin(ctx, "steven")
+	assert.Equal(t, "$argon2id$new", user.PasswordHash)
+	assert.True(t, errors.Is(sqlStore.UpdatePasswordHash(ctx, "unknown", "$argon2id$new"), ErrCredentialsNotFound))
+
+	withoutColumn, err := NewSQLStore(&SQLStore{DB: db, DisableAPIKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer withoutColumn.Close()
+	user, err = withoutColumn.FindUserByLogin(ctx, "steven")
+	assert.NoError(t, err)
+	assert.Empty(t, user.PasswordHash)
+	assert.Error(t, withoutColumn.UpdatePasswordHash(ctx, "steven", "$argon2id$new"))
+}
@@ -0,0 +1,251 @@
+// Package storetest checks that a tnpptMiddleware.CredentialStore behaves the
+// way the middleware expects.
+//
+//	func TestMyStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T, records tnpptMiddleware.StoreRecords) tnpptMiddleware.CredentialStore {
+//			return newMyStoreFilledWith(t, records)
+//		})
+//		storetest.RunBackendFailure(t, func(t *testing.T, records tnpptMiddleware.StoreRecords) tnpptMiddleware.CredentialStore {
+//			store, db := newMyStoreFilledWith(t, records)
+//			db.Close()
+//			return store
+//		})
+//	}
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	tnpptMiddleware "github.com/StevenLeclerc/gin-TNPPT"
+)
+
+// Factory returns a store holding exactly the given records.
+type Factory func(t *testing.T, records tnpptMiddleware.StoreRecords) tnpptMiddleware.CredentialStore
+
+// Records are the fixtures handed to the Factory by Run.
+var Records = tnpptMiddleware.StoreRecords{
+	Users: []tnpptMiddleware.UserRecord{
+		{ID: "1", Login: "steven", Password: "pass", Scopes: []string{"logs:read", "logs:write"}},
+		{ID: "2", Login: "no-scope", Password: "other-pass"},
+	},
+	APIKeys: []tnpptMiddleware.APIKeyRecord{
+		{ID: "10", Login: "collector", Key: "plain-key", Scopes: []string{"logs:write"}},
+		{ID: "11", Login: "hashed-collector", KeySHA256: tnpptMiddleware.HashAPIKey("hashed-key")},
+		{ID: "12", Login: "old-collector", Key: "revoked-key", Revoked: true},
+	},
+}
+
+// Run exercises the store returned by factory with the standard battery of cases.
+func Run(t *testing.T, factory Factory) {
+	t.Helper()
+	cases := []struct {
+		name string
+		test func(t *testing.T, store tnpptMiddleware.CredentialStore)
+	}{
+		{name: "UserFound", test: testUserFound},
+		{name: "UserWithoutScopes", test: testUserWithoutScopes},
+		{name: "UserNotFound", test: testUserNotFound},
+		{name: "APIKeyFound", test: testAPIKeyFound},
+		{name: "APIKeyHashed", test: testAPIKeyHashed},
+		{name: "APIKeyNotFound", test: testAPIKeyNotFound},
+		{name: "APIKeyRevoked", test: testAPIKeyRevoked},
+		{name: "ResultsAreCopies", test: testResultsAreCopies},
+		{name: "ConcurrentAccess", test: testConcurrentAccess},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, factory(t, Records))
+		})
+	}
+	t.Run("EmptyStore", func(t *testing.T) {
+		store := factory(t, tnpptMiddleware.StoreRecords{})
+		expectError(t, "FindUserByLogin", tnpptMiddleware.ErrCredentialsNotFound, func() (tnpptMiddleware.UserInfo, error) {
+			return store.FindUserByLogin(context.Background(), "steven")
+		})
+		expectError(t, "FindUserByAPIKey", tnpptMiddleware.ErrCredentialsNotFound, func() (tnpptMiddleware.UserInfo, error) {
+			return store.FindUserByAPIKey(context.Background(), "plain-key")
+		})
+	})
+}
+
+// RunBackendFailure checks that the store returned by factory, whose backend
+// fails (a closed database, an unreachable server), reports the failure as an
+// error other than ErrCredentialsNotFound and ErrCredentialsRevoked: an outage
+// must not pass for unknown or revoked credentials.
+func RunBackendFailure(t *testing.T, factory Factory) {
+	t.Helper()
+	store := factory(t, Records)
+	lookups := []struct {
+		call   string
+		lookup func() (tnpptMiddleware.UserInfo, error)
+	}{
+		{call: "FindUserByLogin(steven)", lookup: func() (tnpptMiddleware.UserInfo, error) {
+			return store.FindUserByLogin(context.Background(), "steven")
+		}},
+		{call: "FindUserByLogin(unknown)", lookup: func() (tnpptMiddleware.UserInfo, error) {
+			return store.FindUserByLogin(context.Background(), "unknown")
+		}},
+		{call: "FindUserByAPIKey(plain-key)", lookup: func() (tnpptMiddleware.UserInfo, error) {
+			return store.FindUserByAPIKey(context.Background(), "plain-key")
+		}},
+		{call: "FindUserByAPIKey(revoked-key)", lookup: func() (tnpptMiddleware.UserInfo, error) {
+			return store.FindUserByAPIKey(context.Background(), "revoked-key")
+		}},
+		{call: "FindUserByAPIKey(unknown)", lookup: func() (tnpptMiddleware.UserInfo, error) {
+			return store.FindUserByAPIKey(context.Background(), "unknown")
+		}},
+	}
+	for _, lookup := range lookups {
+		lookup := lookup
+		t.Run("BackendFailure/"+lookup.call, func(t *testing.T) {
+			user, err := lookup.lookup()
+			switch {
+			case err == nil:
+				t.Errorf("%s returned %+v, want a backend error", lookup.call, user)
+			case errors.Is(err, tnpptMiddleware.ErrCredentialsNotFound), errors.Is(err, tnpptMiddleware.ErrCredentialsRevoked):
+				t.Errorf("%s error = %v, want a backend error", lookup.call, err)
+			case user.Login != "" || user.Password != "" || user.ID != nil:
+				t.Errorf("%s returned %+v alongside an error", lookup.call, user)
+			}
+		})
+	}
+}
+
+func testUserFound(t *testing.T, store tnpptMiddleware.CredentialStore) {
+	user, err := store.FindUserByLogin(context.Background(), "steven")
+	if err != nil {
+		t.Fatalf("FindUserByLogin(steven) error = %v", err)
+	}
+	expectUser(t, user, "1", "steven", "pass", []string{"logs:read", "logs:write"})
+}
+
+func testUserWithoutScopes(t *testing.T, store tnpptMiddleware.CredentialStore) {
+	user, err := store.FindUserByLogin(context.Background(), "no-scope")
+	if err != nil {
+		t.Fatalf("FindUserByLogin(no-scope) error = %v", err)
+	}
+	expectUser(t, user, "2", "no-scope", "other-pass", nil)
+}
+
+func testUserNotFound(t *testing.T, store tnpptMiddleware.CredentialStore) {
+	for _, login := range []string{"unknown", "", "steven ", "collector"} {
+		expectError(t, fmt.Sprintf("FindUserByLogin(%q)", login), tnpptMiddleware.ErrCredentialsNotFound, func() (tnpptMiddleware.UserInfo, error) {
+			return store.FindUserByLogin(context.Background(), login)
+		})
+	}
+}
+
+func testAPIKeyFound(t *testing.T, store tnpptMiddleware.CredentialStore) {
+	user, err := store.FindUserByAPIKey(context.Background(), "plain-key")
+	if err != nil {
+		t.Fatalf("FindUserByAPIKey(plain-key) error = %v", err)
+	}
+	expectUser(t, user, "10", "collector", "", []string{"logs:write"})
+}
+
+func testAPIKeyHashed(t *testing.T, store tnpptMiddleware.CredentialStore) {
+	user, err := store.FindUserByAPIKey(context.Background(), "hashed-key")
+	if err != nil {
+		t.Fatalf("FindUserByAPIKey(hashed-key) error = %v", err)
+	}
+	expectUser(t, user, "11", "hashed-collector", "", nil)
+	expectError(t, "FindUserByAPIKey(<sha256>)", tnpptMiddleware.ErrCredentialsNotFound, func() (tnpptMiddleware.UserInfo, error) {
+		return store.FindUserByAPIKey(context.Background(), tnpptMiddleware.HashAPIKey("hashed-key"))
+	})
+}
+
+func testAPIKeyNotFound(t *testing.T, store tnpptMiddleware.CredentialStore) {
+	for _, apiKey := range []string{"unknown", "", "plain-key ", "steven", "pass"} {
+		expectError(t, fmt.Sprintf("FindUserByAPIKey(%q)", apiKey), tnpptMiddleware.ErrCredentialsNotFound, func() (tnpptMiddleware.UserInfo, error) {
+			return store.FindUserByAPIKey(context.Background(), apiKey)
+		})
+	}
+}
+
+func testAPIKeyRevoked(t *testing.T, store tnpptMiddleware.CredentialStore) {
+	expectError(t, "FindUserByAPIKey(revoked-key)", tnpptMiddleware.ErrCredentialsRevoked, func() (tnpptMiddleware.UserInfo, error) {
+		return store.FindUserByAPIKey(context.Background(), "revoked-key")
+	})
+}
+
+func testResultsAreCopies(t *testing.T, store tnpptMiddleware.CredentialStore) {
+	user, err := store.FindUserByLogin(context.Background(), "steven")
+	if err != nil {
+		t.Fatalf("FindUserByLogin(steven) error = %v", err)
+	}
+	user.Scopes[0] = "admin"
+	user, err = store.FindUserByLogin(context.Background(), "steven")
+	if err != nil {
+		t.Fatalf("FindUserByLogin(steven) error = %v", err)
+	}
+	expectUser(t, user, "1", "steven", "pass", []string{"logs:read", "logs:write"})
+}
+
+func testConcurrentAccess(t *testing.T, store tnpptMiddleware.CredentialStore) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				if _, err := store.FindUserByLogin(context.Background(), "steven"); err != nil {
+					errs <- fmt.Errorf("FindUserByLogin(steven): %w", err)
+					return
+				}
+				if _, err := store.FindUserByAPIKey(context.Background(), "plain-key"); err != nil {
+					errs <- fmt.Errorf("FindUserByAPIKey(plain-key): %w", err)
+					return
+				}
+				if _, err := store.FindUserByAPIKey(context.Background(), "revoked-key"); !errors.Is(err, tnpptMiddleware.ErrCredentialsRevoked) {
+					errs <- fmt.Errorf("FindUserByAPIKey(revoked-key) = %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func expectUser(t *testing.T, user tnpptMiddleware.UserInfo, id string, login string, password string, scopes []string) {
+	t.Helper()
+	if got := fmt.Sprint(user.ID); got != id {
+		t.Errorf("ID = %q, want %q", got, id)
+	}
+	if user.Login != login {
+		t.Errorf("Login = %q, want %q", user.Login, login)
+	}
+	if user.Password != password {
+		t.Errorf("Password = %q, want %q", user.Password, password)
+	}
+	if len(user.Scopes) != len(scopes) {
+		t.Errorf("Scopes = %q, want %q", user.Scopes, scopes)
+		return
+	}
+	for index := range scopes {
+		if user.Scopes[index] != scopes[index] {
+			t.Errorf("Scopes = %q, want %q", user.Scopes, scopes)
+			return
+		}
+	}
+}
+
+func expectError(t *testing.T, call string, want error, lookup func() (tnpptMiddleware.UserInfo, error)) {
+	t.Helper()
+	user, err := lookup()
+	if !errors.Is(err, want) {
+		t.Errorf("%s error = %v, want %v", call, err, want)
+	}
+	if err != nil && (user.Login != "" || user.Password != "" || user.ID != nil) {
+		t.Errorf("%s returned %+v alongside an error", call, user)
+	}
+}
@@ -0,0 +1,344 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TenantFromHeader    = "header"
+	TenantFromSubdomain = "subdomain"
+	TenantFromPath      = "path"
+)
+
+// TenantSettings resolves the tenant of every request, from the Header
+// (default X-Tenant-ID), the subdomain of Domain or the PathSegment (0 for
+// the first one), and applies its TenantConfig. Tenants not listed use
+// Default, and are rejected when it is nil.
+// Tenancy is disabled while Source is empty.
+type TenantSettings struct {
+	Source      string
+	Header      string
+	Domain      string
+	PathSegment int
+	Tenants     map[string]TenantConfig
+	Default     *TenantConfig
+
+	limiters       map[string]*rateLimiter
+	defaultLimiter *rateLimiter
+}
+
+// TenantConfig is the configuration of a tenant. Its credentials are looked up
+// in Store, TNPPT.Store when nil (TenantFromContext gives the tenant to the
+// store). A Store shared by several tenants, TNPPT.Store or the Store of
+// Default, must be a TenantScopedStore unless the tenant only accepts bearer
+// tokens. TTL replaces Security.TTL when set, Schemes restricts the schemes
+// accepted and RateLimit the requests of the whole tenant.
+// Unlisted tenants share the rate limit of Default.
+type TenantConfig struct {
+	Store     CredentialStore
+	TTL       int64
+	Schemes   []string
+	RateLimit RateLimit
+}
+
+// TenantScopedStore is a CredentialStore shared by several tenants that only
+// returns the credentials of the tenant of the context (TenantFromContext).
+// The built-in stores are not, they ignore the tenant.
+type TenantScopedStore interface {
+	CredentialStore
+	TenantScoped()
+}
+
+// RateLimit lets RequestsPerSecond go through with bursts of Burst, it is
+// disabled when RequestsPerSecond is 0.
+type RateLimit struct {
+	RequestsPerSecond float64
+	Burst             int
+}
+
+var (
+	ErrUnknownTenant      = errors.New("unknown tenant")
+	ErrTenantMismatch     = errors.New("credentials of another tenant")
+	ErrSchemeNotAllowed   = errors.New("scheme not allowed for this tenant")
+	ErrTenantRateLimited  = errors.New("too many requests for this tenant")
+	tenantIdentifierRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,62}$`)
+)
+
+type tenantContextKey struct{}
+
+func (settings *TenantSettings) enabled() bool {
+	return settings.Source != ""
+}
+
+func (settings *TenantSettings) init() error {
+	switch settings.Source {
+	case "":
+		return nil
+	case TenantFromHeader:
+		if settings.Header == "" {
+			settings.Header = "X-Tenant-ID"
+		}
+	case TenantFromSubdomain:
+		if settings.Domain == "" {
+			return errors.New("TNPPT - Tenants - You need to set the Domain")
+		}
+		settings.Domain = strings.ToLower(strings.TrimPrefix(settings.Domain, "."))
+	case TenantFromPath:
+		if settings.PathSegment < 0 {
+			return errors.New("TNPPT - Tenants - PathSegment can not be negative")
+		}
+	default:
+		return fmt.Errorf("TNPPT - Tenants - Unknown Source %q", settings.Source)
+	}
+	settings.limiters = make(map[string]*rateLimiter, len(settings.Tenants))
+	for tenant, config := range settings.Tenants {
+		if !tenantIdentifierRegex.MatchString(tenant) {
+			return fmt.Errorf("TNPPT - Tenants - Invalid tenant %q", tenant)
+		}
+		if err := config.validate(); err != nil {
+			return fmt.Errorf("TNPPT - Tenants - %s: %w", tenant, err)
+		}
+		settings.limiters[tenant] = newRateLimiter(config.RateLimit)
+	}
+	if settings.Default != nil {
+		if err := settings.Default.validate(); err != nil {
+			return fmt.Errorf("TNPPT - Tenants - Default: %w", err)
+		}
+		settings.defaultLimiter = newRateLimiter(settings.Default.RateLimit)
+	}
+	return nil
+}
+
+// checkStores rejects the tenants left with a Store they share with the other
+// tenants, shared, which would authenticate the users of any tenant.
+func (settings *TenantSettings) checkStores(shared CredentialStore) error {
+	if !settings.enabled() {
+		return nil
+	}
+	for tenant, config := range settings.Tenants {
+		if config.Store == nil && !config.bearerOnly() && !tenantScoped(shared) {
+			return fmt.Errorf("TNPPT - Tenants - %s: You need to set its Store, TNPPT.Store is not a TenantScopedStore", tenant)
+		}
+	}
+	if settings.Default != nil && !settings.Default.bearerOnly() {
+		store := settings.Default.Store
+		if store == nil {
+			store = shared
+		}
+		if !tenantScoped(store) {
+			return errors.New("TNPPT - Tenants - Default: You need to set a TenantScopedStore, the unlisted tenants share it")
+		}
+	}
+	return nil
+}
+
+func tenantScoped(store CredentialStore) bool {
+	if store == nil {
+		return true
+	}
+	_, scoped := store.(TenantScopedStore)
+	return scoped
+}
+
+// bearerOnly reports whether the tenant only accepts bearer tokens, never
+// looked up in a Store.
+func (config TenantConfig) bearerOnly() bool {
+	for _, scheme := range config.Schemes {
+		if credentialsKind(scheme) != "bearer" {
+			return false
+		}
+	}
+	return len(config.Schemes) > 0
+}
+
+func (config TenantConfig) validate() error {
+	for _, scheme := range config.Schemes {
+		if _, known := schemeAuthenticators[scheme]; !known {
+			return fmt.Errorf("unknown scheme %q", scheme)
+		}
+	}
+	if config.RateLimit.RequestsPerSecond < 0 || config.RateLimit.Burst < 0 {
+		return errors.New("negative rate limit")
+	}
+	return nil
+}
+
+// resolve returns the tenant of request, and its configuration when known.
+func (settings *TenantSettings) resolve(request *http.Request) (string, *TenantConfig, *rateLimiter) {
+	var tenant string
+	switch settings.Source {
+	case TenantFromHeader:
+		tenant = request.Header.Get(settings.Header)
+	case TenantFromSubdomain:
+		host := request.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		tenant = strings.TrimSuffix(strings.ToLower(host), "."+settings.Domain)
+		if tenant == strings.ToLower(host) {
+			tenant = ""
+		}
+	case TenantFromPath:
+		segments := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+		if settings.PathSegment < len(segments) {
+			tenant = segments[settings.PathSegment]
+		}
+	}
+	if !tenantIdentifierRegex.MatchString(tenant) {
+		return "", nil, nil
+	}
+	if config, listed := settings.Tenants[tenant]; listed {
+		return tenant, &config, settings.limiters[tenant]
+	}
+	if settings.Default != nil {
+		return tenant, settings.Default, settings.defaultLimiter
+	}
+	return "", nil, nil
+}
+
+// resolveTenant records the tenant of the request on tnppt and returns the
+// schemes it accepts among schemes.
+func (tnppt *TNPPT) resolveTenant(request *http.Request, header http.Header, schemes []string) ([]string, error) {
+	tnppt.tenant, tnppt.tenantConfig = "", nil
+	if !tnppt.Tenants.enabled() {
+		return schemes, nil
+	}
+	tenant, config, limiter := tnppt.Tenants.resolve(request)
+	if config == nil {
+		return nil, &AuthenticationError{StatusCode: http.StatusUnauthorized, Err: ErrUnknownTenant}
+	}
+	if wait := limiter.reserve(time.Now()); wait > 0 {
+		header.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return nil, &AuthenticationError{StatusCode: http.StatusTooManyRequests, Err: ErrTenantRateLimited}
+	}
+	tnppt.tenant, tnppt.tenantConfig = tenant, config
+	if len(config.Schemes) == 0 {
+		return schemes, nil
+	}
+	var allowed []string
+	for _, scheme := range schemes {
+		if containsString(config.Schemes, scheme) {
+			allowed = append(allowed, scheme)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, &AuthenticationError{StatusCode: http.StatusUnauthorized, Err: ErrSchemeNotAllowed}
+	}
+	return allowed, nil
+}
+
+// Tenant returns the tenant of the request being authenticated, for the
+// IsCredentialsValid functions.
+func (tnppt *TNPPT) Tenant() string {
+	return tnppt.tenant
+}
+
+// bindTenant sets the tenant on the principal. Bearer tokens are not looked
+// up in the tenant store, their tenant claim must match.
+func (tnppt *TNPPT) bindTenant() error {
+	if tnppt.tenant == "" {
+		return nil
+	}
+	if credentialsKind(tnppt.Principal.Scheme) == "bearer" && tnppt.Principal.Tenant != tnppt.tenant {
+		return ErrTenantMismatch
+	}
+	tnppt.Principal.Tenant = tnppt.tenant
+	return nil
+}
+
+// credentialStore is the Store of the tenant of the request, or TNPPT.Store.
+func (tnppt *TNPPT) credentialStore() CredentialStore {
+	if tnppt.tenantConfig != nil && tnppt.tenantConfig.Store != nil {
+		return tnppt.tenantConfig.Store
+	}
+	return tnppt.Store
+}
+
+// tenantStore is the Store of tenant, for the lookups outside of a request.
+func (tnppt *TNPPT) tenantStore(tenant string) CredentialStore {
+	if config, listed := tnppt.Tenants.Tenants[tenant]; listed && config.Store != nil {
+		return config.Store
+	}
+	if tenant != "" && tnppt.Tenants.Default != nil && tnppt.Tenants.Default.Store != nil {
+		return tnppt.Tenants.Default.Store
+	}
+	return tnppt.Store
+}
+
+func (tnppt *TNPPT) ttl() int64 {
+	if tnppt.tenantConfig != nil && tnppt.tenantConfig.TTL != 0 {
+		return tnppt.tenantConfig.TTL
+	}
+	return tnppt.Security.TTL
+}
+
+// hasTenantStores reports whether a tenant brings its own Store.
+func (settings *TenantSettings) hasTenantStores() bool {
+	if settings.Default != nil && settings.Default.Store != nil {
+		return true
+	}
+	for _, config := range settings.Tenants {
+		if config.Store != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant of the request given to the
+// CredentialStore, for the stores shared by several tenants.
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, found := ctx.Value(tenantContextKey{}).(string)
+	return tenant, found
+}
+
+// rateLimiter is a token bucket, a nil one lets everything through.
+type rateLimiter struct {
+	mu       sync.Mutex
+	limit    RateLimit
+	tokens   float64
+	lastFill time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.RequestsPerSecond == 0 {
+		return nil
+	}
+	if limit.Burst == 0 {
+		limit.Burst = int(math.Max(1, math.Ceil(limit.RequestsPerSecond)))
+	}
+	return &rateLimiter{limit: limit, tokens: float64(limit.Burst)}
+}
+
+// reserve takes a token, or returns how long to wait for the next one.
+func (limiter *rateLimiter) reserve(now time.Time) time.Duration {
+	if limiter == nil {
+		return 0
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if !limiter.lastFill.IsZero() {
+		elapsed := now.Sub(limiter.lastFill).Seconds()
+		limiter.tokens = math.Min(float64(limiter.limit.Burst), limiter.tokens+elapsed*limiter.limit.RequestsPerSecond)
+	}
+	limiter.lastFill = now
+	if limiter.tokens < 1 {
+		return time.Duration((1 - limiter.tokens) / limiter.limit.RequestsPerSecond * float64(time.Second))
+	}
+	limiter.tokens--
+	return 0
+}
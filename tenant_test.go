@@ -0,0 +1,287 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type tenantRecordingStore struct {
+	*MemoryStore
+	tenants []string
+}
+
+func (store *tenantRecordingStore) FindUserByLogin(ctx context.Context, login string) (UserInfo, error) {
+	tenant, _ := TenantFromContext(ctx)
+	store.tenants = append(store.tenants, tenant)
+	return store.MemoryStore.FindUserByLogin(ctx, login)
+}
+
+// tenantScopedStore keeps a MemoryStore per tenant.
+type tenantScopedStore map[string]*MemoryStore
+
+func (store tenantScopedStore) TenantScoped() {}
+
+func (store tenantScopedStore) tenantStore(ctx context.Context) (*MemoryStore, error) {
+	tenant, _ := TenantFromContext(ctx)
+	tenantStore, found := store[tenant]
+	if !found {
+		return nil, ErrCredentialsNotFound
+	}
+	return tenantStore, nil
+}
+
+func (store tenantScopedStore) FindUserByLogin(ctx context.Context, login string) (UserInfo, error) {
+	tenantStore, err := store.tenantStore(ctx)
+	if err != nil {
+		return UserInfo{}, err
+	}
+	return tenantStore.FindUserByLogin(ctx, login)
+}
+
+func (store tenantScopedStore) FindUserByAPIKey(ctx context.Context, apiKey string) (UserInfo, error) {
+	tenantStore, err := store.tenantStore(ctx)
+	if err != nil {
+		return UserInfo{}, err
+	}
+	return tenantStore.FindUserByAPIKey(ctx, apiKey)
+}
+
+func tenantHMACRequest(t *testing.T, tenant string, login string, password string, age time.Duration) *http.Request {
+	t.Helper()
+	timeSent := time.Now().Add(-age).UnixNano() / int64(time.Millisecond)
+	hash := sha256.Sum256([]byte(login + password + strconv.FormatInt(timeSent, 10)))
+	req, _ := http.NewRequest("POST", "/log", nil)
+	req.Header.Add("HMAC_HASH", fmt.Sprintf("%x", hash))
+	req.Header.Add("HMAC_LOGIN", login)
+	req.Header.Add("HMAC_TIME", strconv.FormatInt(timeSent, 10))
+	if tenant != "" {
+		req.Header.Set("X-Tenant-ID", tenant)
+	}
+	return req
+}
+
+func TestTNPPT_Tenants(t *testing.T) {
+	acmeStore := &tenantRecordingStore{MemoryStore: newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "steven", Password: "acme-pass"}}})}
+	globexStore := newTestMemoryStore(t, StoreRecords{
+		Users:   []UserRecord{{Login: "steven", Password: "globex-pass"}},
+		APIKeys: []APIKeyRecord{{Login: "collector", Key: "globex-key"}},
+	})
+	sharedStore := tenantScopedStore{
+		"small": newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "steven", Password: "shared-pass"}}}),
+		"plain": newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "steven", Password: "shared-pass"}}}),
+	}
+	auth, err := New(&TNPPT{
+		Store: sharedStore,
+		Tenants: TenantSettings{
+			Source: TenantFromHeader,
+			Tenants: map[string]TenantConfig{
+				"acme":   {Store: acmeStore, TTL: 60000},
+				"globex": {Store: globexStore, Schemes: []string{SchemeAPIKey}},
+				"small":  {RateLimit: RateLimit{RequestsPerSecond: 0.5, Burst: 1}},
+				"plain":  {},
+				"empty":  {},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/log", auth.ActivateAny(SchemeHMAC, SchemeAPIKey), func(c *gin.Context) {
+		c.String(200, principal(c).Tenant+":"+principal(c).Login)
+	})
+
+	apiKeyRequest := func(tenant string) *http.Request {
+		req, _ := http.NewRequest("POST", "/log", nil)
+		req.Header.Set("API_KEY", "globex-key")
+		req.Header.Set("X-Tenant-ID", tenant)
+		return req
+	}
+	tests := []struct {
+		name      string
+		req       *http.Request
+		wantCode  int
+		wantBody  string
+		wantError error
+	}{
+		{name: "acme", req: tenantHMACRequest(t, "acme", "steven", "acme-pass", 0), wantCode: 200, wantBody: "acme:steven"},
+		{name: "acme-tenant-ttl", req: tenantHMACRequest(t, "acme", "steven", "acme-pass", 5*time.Second), wantCode: 200, wantBody: "acme:steven"},
+		{name: "other-tenant-password", req: tenantHMACRequest(t, "acme", "steven", "globex-pass", 0), wantCode: 401, wantError: ErrFailedAuthenticationHMAC},
+		{name: "globex-scheme-not-allowed", req: tenantHMACRequest(t, "globex", "steven", "globex-pass", 0), wantCode: 401, wantError: ErrFailedPayload},
+		{name: "globex-api-key", req: apiKeyRequest("globex"), wantCode: 200, wantBody: "globex:collector"},
+		{name: "api-key-of-other-tenant", req: apiKeyRequest("acme"), wantCode: 401, wantError: ErrFailedAuthenticationAPIKEY},
+		{name: "shared-store", req: tenantHMACRequest(t, "small", "steven", "shared-pass", 0), wantCode: 200, wantBody: "small:steven"},
+		{name: "shared-store-of-other-tenant", req: tenantHMACRequest(t, "empty", "steven", "shared-pass", 0), wantCode: 401, wantError: ErrFailedAuthenticationHMAC},
+		{name: "tenant-rate-limit", req: tenantHMACRequest(t, "small", "steven", "shared-pass", 0), wantCode: 429, wantError: ErrTenantRateLimited},
+		{name: "default-ttl", req: tenantHMACRequest(t, "plain", "steven", "shared-pass", 5*time.Second), wantCode: 401, wantError: ErrFailedTTL},
+		{name: "unknown-tenant", req: tenantHMACRequest(t, "initech", "steven", "shared-pass", 0), wantCode: 401, wantError: ErrUnknownTenant},
+		{name: "no-tenant", req: tenantHMACRequest(t, "", "steven", "shared-pass", 0), wantCode: 401, wantError: ErrUnknownTenant},
+		{name: "invalid-tenant", req: tenantHMACRequest(t, "../acme", "steven", "acme-pass", 0), wantCode: 401, wantError: ErrUnknownTenant},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, tt.req)
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, w.Body.String())
+			} else {
+				assert.Contains(t, w.Body.String(), tt.wantError.Error())
+			}
+		})
+	}
+	assert.Equal(t, []string{"acme", "acme", "acme"}, acmeStore.tenants)
+
+	t.Run("scheme-not-allowed", func(t *testing.T) {
+		_, err := auth.Verifier(SchemeHMAC).Verify(tenantHMACRequest(t, "globex", "steven", "globex-pass", 0), http.Header{})
+		assert.True(t, errors.Is(err, ErrSchemeNotAllowed))
+	})
+	t.Run("rate-limit-retry-after", func(t *testing.T) {
+		header := http.Header{}
+		_, err := auth.Verifier(SchemeHMAC).Verify(tenantHMACRequest(t, "small", "steven", "shared-pass", 0), header)
+		var authenticationError *AuthenticationError
+		if assert.True(t, errors.As(err, &authenticationError)) {
+			assert.Equal(t, http.StatusTooManyRequests, authenticationError.StatusCode)
+		}
+		assert.Equal(t, "2", header.Get("Retry-After"))
+	})
+}
+
+func TestTNPPT_TenantTokens(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "steven", Password: "pass", Roles: []string{"viewer"}}}})
+	auth, err := New(&TNPPT{
+		Tokens: TokenSettings{SigningKey: JWTKey{ID: "session", Algorithm: JWTAlgHS256, Key: []byte("session-secret")}},
+		Tenants: TenantSettings{
+			Source:  TenantFromHeader,
+			Default: &TenantConfig{Store: tenantScopedStore{"acme": store}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := tokenMockHandler(t, auth)
+
+	req := hmacLoginRequest(t, auth, "/token", "steven", "pass")
+	req.Header.Set("X-Tenant-ID", "acme")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if !assert.Equal(t, 200, w.Code) {
+		return
+	}
+	response := TokenResponse{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	user, err := auth.Tokens.verify(response.AccessToken, tokenUseAccess, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", user.Tenant)
+
+	for _, tt := range []struct {
+		tenant   string
+		wantCode int
+	}{{tenant: "acme", wantCode: 200}, {tenant: "globex", wantCode: 401}} {
+		req, _ := http.NewRequest("GET", "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+response.AccessToken)
+		req.Header.Set("X-Tenant-ID", tt.tenant)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tt.wantCode, w.Code, tt.tenant)
+	}
+}
+
+func TestTenantSettings_Resolve(t *testing.T) {
+	tests := []struct {
+		name       string
+		settings   TenantSettings
+		host       string
+		path       string
+		wantTenant string
+	}{
+		{name: "subdomain", settings: TenantSettings{Source: TenantFromSubdomain, Domain: "example.com"}, host: "acme.example.com:8080", path: "/log", wantTenant: "acme"},
+		{name: "subdomain-case", settings: TenantSettings{Source: TenantFromSubdomain, Domain: ".Example.com"}, host: "ACME.example.com", path: "/log", wantTenant: "acme"},
+		{name: "subdomain-nested", settings: TenantSettings{Source: TenantFromSubdomain, Domain: "example.com"}, host: "a.acme.example.com", path: "/log"},
+		{name: "apex", settings: TenantSettings{Source: TenantFromSubdomain, Domain: "example.com"}, host: "example.com", path: "/log"},
+		{name: "other-domain", settings: TenantSettings{Source: TenantFromSubdomain, Domain: "example.com"}, host: "acme.evil.com", path: "/log"},
+		{name: "path", settings: TenantSettings{Source: TenantFromPath}, host: "example.com", path: "/acme/log", wantTenant: "acme"},
+		{name: "path-segment", settings: TenantSettings{Source: TenantFromPath, PathSegment: 1}, host: "example.com", path: "/tenants/acme/log", wantTenant: "acme"},
+		{name: "path-too-short", settings: TenantSettings{Source: TenantFromPath, PathSegment: 3}, host: "example.com", path: "/tenants/acme"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.settings.Default = &TenantConfig{}
+			assert.NoError(t, tt.settings.init())
+			req, _ := http.NewRequest("GET", tt.path, nil)
+			req.Host = tt.host
+			tenant, _, _ := tt.settings.resolve(req)
+			assert.Equal(t, tt.wantTenant, tenant)
+		})
+	}
+}
+
+func TestTenantSettings_Init(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings TenantSettings
+	}{
+		{name: "unknown-source", settings: TenantSettings{Source: "cookie"}},
+		{name: "no-domain", settings: TenantSettings{Source: TenantFromSubdomain}},
+		{name: "negative-segment", settings: TenantSettings{Source: TenantFromPath, PathSegment: -1}},
+		{name: "invalid-tenant", settings: TenantSettings{Source: TenantFromHeader, Tenants: map[string]TenantConfig{"a/b": {}}}},
+		{name: "unknown-scheme", settings: TenantSettings{Source: TenantFromHeader, Tenants: map[string]TenantConfig{"acme": {Schemes: []string{"kerberos"}}}}},
+		{name: "negative-rate", settings: TenantSettings{Source: TenantFromHeader, Default: &TenantConfig{RateLimit: RateLimit{RequestsPerSecond: -1}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Error(t, tt.settings.init())
+		})
+	}
+}
+
+func TestTNPPT_TenantStores(t *testing.T) {
+	memoryStore := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "steven", Password: "pass"}}})
+	tests := []struct {
+		name    string
+		tnppt   TNPPT
+		wantErr bool
+	}{
+		{name: "own-stores", tnppt: TNPPT{Store: memoryStore, Tenants: TenantSettings{Source: TenantFromHeader, Tenants: map[string]TenantConfig{"acme": {Store: memoryStore}}}}},
+		{name: "shared-store", tnppt: TNPPT{Store: memoryStore, Tenants: TenantSettings{Source: TenantFromHeader, Tenants: map[string]TenantConfig{"acme": {}}}}, wantErr: true},
+		{name: "shared-scoped-store", tnppt: TNPPT{Store: tenantScopedStore{}, Tenants: TenantSettings{Source: TenantFromHeader, Tenants: map[string]TenantConfig{"acme": {}}}}},
+		{name: "shared-store-bearer-only", tnppt: TNPPT{Store: memoryStore, JWT: JWTSettings{Keys: testJWTKeys(t)[:1]}, Tenants: TenantSettings{Source: TenantFromHeader, Tenants: map[string]TenantConfig{"acme": {Schemes: []string{SchemeJWT, SchemeToken}}}}}},
+		{name: "default-store", tnppt: TNPPT{Tenants: TenantSettings{Source: TenantFromHeader, Default: &TenantConfig{Store: memoryStore}}}, wantErr: true},
+		{name: "default-shared-store", tnppt: TNPPT{Store: memoryStore, Tenants: TenantSettings{Source: TenantFromHeader, Default: &TenantConfig{}}}, wantErr: true},
+		{name: "default-scoped-store", tnppt: TNPPT{Tenants: TenantSettings{Source: TenantFromHeader, Default: &TenantConfig{Store: tenantScopedStore{}}}}},
+		{name: "no-tenancy", tnppt: TNPPT{Store: memoryStore}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(&tt.tnppt)
+			assert.Equal(t, tt.wantErr, err != nil, err)
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(RateLimit{RequestsPerSecond: 2, Burst: 2})
+	assert.Equal(t, time.Duration(0), limiter.reserve(now))
+	assert.Equal(t, time.Duration(0), limiter.reserve(now))
+	assert.Equal(t, 500*time.Millisecond, limiter.reserve(now))
+	assert.Equal(t, time.Duration(0), limiter.reserve(now.Add(500*time.Millisecond)))
+	assert.Equal(t, time.Duration(0), limiter.reserve(now.Add(time.Hour)))
+	assert.Equal(t, time.Duration(0), limiter.reserve(now.Add(time.Hour)))
+	assert.NotEqual(t, time.Duration(0), limiter.reserve(now.Add(time.Hour)))
+
+	var disabled *rateLimiter = newRateLimiter(RateLimit{})
+	assert.Equal(t, time.Duration(0), disabled.reserve(now))
+}
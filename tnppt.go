@@ -11,6 +11,7 @@ import (
 
 	crunchyTools "github.com/StevenLeclerc/crunchy-tools"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
 type PayloadHMACFormat struct {
@@ -23,25 +24,77 @@ type PayloadAPIKeyFormat struct {
 	APIKey string `header:"API_KEY" binding:"required"`
 }
 
-type UserInfo struct {
-	ID       interface{}
+type PayloadBasicFormat struct {
 	Login    string
 	Password string
 }
 
+type UserInfo struct {
+	ID           interface{}
+	Login        string
+	Password     string
+	PasswordHash string
+	Scopes       []string
+	Roles        []string
+	Tenant       string
+	Anonymous    bool
+	StoreName    string
+	Scheme       string
+	Claims       map[string]interface{}
+}
+
 type Security struct {
 	TTL          int64
 	TimeReceived int64
 }
 
+// TNPPT is the configuration shared by the middlewares. Each request is
+// authenticated on a copy of it, whose requestState IsCredentialsValid reads
+// (the Payload* of the scheme) and completes (Principal).
 type TNPPT struct {
-	PayloadHMAC        PayloadHMACFormat
-	PayloadAPIKey      PayloadAPIKeyFormat
+	requestState
 	Security           Security
-	UserInfo           UserInfo
-	IsLoginValid       bool
-	Gin                *gin.Context
 	IsCredentialsValid func(tnppt *TNPPT) bool
+	Store              CredentialStore
+	JWT                JWTSettings
+	Tokens             TokenSettings
+	Passwords          PasswordPolicy
+	MTLS               MTLSSettings
+	Introspection      IntrospectionSettings
+	TOTP               TOTPSettings
+	Digest             DigestSettings
+	Challenges         ChallengeSettings
+	SCRAM              SCRAMSettings
+	RBAC               *RBAC
+	Auditor            Auditor
+	Tenants            TenantSettings
+	Lockout            LockoutSettings
+	Logger             LoggerSettings
+	Realm              string
+}
+
+// requestState is the state of the request being authenticated, it starts
+// empty on every per-request copy of the TNPPT.
+type requestState struct {
+	PayloadHMAC      PayloadHMACFormat
+	PayloadAPIKey    PayloadAPIKeyFormat
+	PayloadBasic     PayloadBasicFormat
+	PayloadMTLS      PayloadMTLSFormat
+	PayloadDigest    PayloadDigestFormat
+	PayloadChallenge PayloadChallengeFormat
+	PayloadSCRAM     PayloadSCRAMFormat
+	// Principal is the principal of the request, set by IsCredentialsValid.
+	// Handlers read it with UserInfoFromGin or UserInfoFromContext.
+	Principal    UserInfo
+	IsLoginValid bool
+	Gin          *gin.Context
+	Request      *http.Request
+	scheme       string
+	tenant       string
+	route        string
+	tenantConfig *TenantConfig
+	// header is the header of the response, for the Retry-After of a locked login
+	header http.Header
 }
 
 var (
@@ -59,67 +112,113 @@ func NewFake(tnppt *TNPPT) (*TNPPT, error) {
 	return tnppt.InitFake()
 }
 
+// ActivateHMACAuthFake lets every request go on as the principal of ID id, read
+// it with UserInfoFromGin.
 func (tnppt *TNPPT) ActivateHMACAuthFake(id interface{}) gin.HandlerFunc {
 	return func(ginEngine *gin.Context) {
-		tnppt.setTime()
-		tnppt.Gin = ginEngine.Copy()
-		tnppt.UserInfo.ID = id
-		tnppt.next()
+		setPrincipal(ginEngine, UserInfo{ID: id})
+		ginEngine.Next()
 	}
 }
 
 func (tnppt *TNPPT) ActivateHMACAuth() gin.HandlerFunc {
-	return func(ginEngine *gin.Context) {
-		tnppt.setTime()
-		tnppt.Gin = ginEngine.Copy()
-		if err := tnppt.checkHMACPayload(); err != nil {
-			message := errors.New(ErrFailedPayload.Error() + " - " + err.Error())
-			tnppt.sendError(ginEngine, http.StatusUnauthorized, message)
-			return
-		}
-		if !tnppt.IsCredentialsValid(tnppt) {
-			fmt.Println("user not found")
-			tnppt.sendError(ginEngine, http.StatusUnauthorized, ErrFailedAuthenticationHMAC)
-			return
-		}
-		if !tnppt.compareHash() {
-			fmt.Println("incorrect hash")
-			tnppt.sendError(ginEngine, http.StatusUnauthorized, ErrFailedAuthenticationHMAC)
-			return
-		}
-		if !tnppt.validateTTL() {
-			tnppt.sendError(ginEngine, http.StatusUnauthorized, ErrFailedTTL)
-			return
-		}
-		tnppt.next()
-	}
+	return tnppt.activate(SchemeHMAC)
 }
 
 func (tnppt *TNPPT) ActivateApiKeyAuth() gin.HandlerFunc {
-	return func(ginEngine *gin.Context) {
-		tnppt.setTime()
-		tnppt.Gin = ginEngine.Copy()
-		if err := tnppt.checkAPIKeyPayload(); err != nil {
-			message := errors.New(ErrFailedPayload.Error() + " - " + err.Error())
-			tnppt.sendError(ginEngine, http.StatusUnauthorized, message)
-			return
-		}
-		if !tnppt.IsCredentialsValid(tnppt) {
-			tnppt.sendError(ginEngine, http.StatusUnauthorized, ErrFailedAuthenticationAPIKEY)
-			return
-		}
-		tnppt.next()
+	return tnppt.activate(SchemeAPIKey)
+}
+
+// ActivateHMACAuthOptional authenticates the requests sending HMAC headers,
+// and lets the others go on with an anonymous principal (UserInfo.Anonymous).
+func (tnppt *TNPPT) ActivateHMACAuthOptional() gin.HandlerFunc {
+	return tnppt.Verifier(SchemeHMAC).Optional().handlerFunc()
+}
+
+// ActivateApiKeyAuthOptional is the optional ActivateApiKeyAuth, see ActivateHMACAuthOptional.
+func (tnppt *TNPPT) ActivateApiKeyAuthOptional() gin.HandlerFunc {
+	return tnppt.Verifier(SchemeAPIKey).Optional().handlerFunc()
+}
+
+func (tnppt *TNPPT) authenticateHMAC() error {
+	if err := tnppt.checkHMACPayload(); err != nil {
+		return errors.New(ErrFailedPayload.Error() + " - " + err.Error())
+	}
+	if err := tnppt.checkLoginLockout(); err != nil {
+		return err
+	}
+	if !tnppt.credentialsValid() {
+		tnppt.logDebug("hmac credentials rejected", "reason", "user not found")
+		return ErrFailedAuthenticationHMAC
 	}
+	if !tnppt.compareHash() {
+		tnppt.logDebug("hmac credentials rejected", "reason", "incorrect hash")
+		return ErrFailedAuthenticationHMAC
+	}
+	if !tnppt.validateTTL() {
+		return ErrFailedTTL
+	}
+	return nil
+}
+
+func (tnppt *TNPPT) authenticateAPIKey() error {
+	if err := tnppt.checkAPIKeyPayload(); err != nil {
+		return errors.New(ErrFailedPayload.Error() + " - " + err.Error())
+	}
+	if !tnppt.credentialsValid() {
+		return ErrFailedAuthenticationAPIKEY
+	}
+	return nil
 }
 
 func (tnppt *TNPPT) Init() (*TNPPT, error) {
 	tnppt.IsLoginValid = false
-	if tnppt.IsCredentialsValid == nil {
-		return nil, errors.New("TNPPT - You need to set the IsCredentialsValid function")
+	if tnppt.IsCredentialsValid == nil && (tnppt.Store != nil || tnppt.Tenants.hasTenantStores()) {
+		tnppt.IsCredentialsValid = storeCredentialsValid
+	}
+	if tnppt.IsCredentialsValid == nil && len(tnppt.JWT.Keys) == 0 && !tnppt.Tokens.enabled() && tnppt.Introspection.URL == "" {
+		return nil, errors.New("TNPPT - You need to set the IsCredentialsValid function, a Store, JWT Keys, a Tokens SigningKey or an Introspection URL")
 	}
+	for _, key := range tnppt.JWT.Keys {
+		if err := key.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := tnppt.Tokens.init(); err != nil {
+		return nil, err
+	}
+	if err := tnppt.MTLS.init(); err != nil {
+		return nil, err
+	}
+	if err := tnppt.Introspection.init(); err != nil {
+		return nil, err
+	}
+	if err := tnppt.Digest.init(); err != nil {
+		return nil, err
+	}
+	if err := tnppt.Challenges.init(); err != nil {
+		return nil, err
+	}
+	if err := tnppt.SCRAM.init(); err != nil {
+		return nil, err
+	}
+	if err := tnppt.Tenants.init(); err != nil {
+		return nil, err
+	}
+	if err := tnppt.Tenants.checkStores(tnppt.Store); err != nil {
+		return nil, err
+	}
+	if err := tnppt.Lockout.init(); err != nil {
+		return nil, err
+	}
+	tnppt.Logger.init()
 	if tnppt.Security.TTL == 0 {
 		tnppt.Security.TTL = 800
 	}
+	if tnppt.Realm == "" {
+		tnppt.Realm = "tnppt"
+	}
+	tnppt.Passwords = tnppt.Passwords.withDefaults()
 	return tnppt, nil
 }
 
@@ -129,28 +228,41 @@ func (tnppt *TNPPT) InitFake() (*TNPPT, error) {
 }
 
 func (tnppt *TNPPT) checkHMACPayload() error {
-	if tnppt.Gin.GetHeader("HMAC_LOGIN") != "" &&
-		tnppt.Gin.GetHeader("HMAC_HASH") != "" &&
-		tnppt.Gin.GetHeader("HMAC_TIME") != "" {
-		_, errTime := strconv.Atoi(tnppt.Gin.GetHeader("HMAC_TIME"))
+	if tnppt.Request.Header.Get("HMAC_LOGIN") != "" &&
+		tnppt.Request.Header.Get("HMAC_HASH") != "" &&
+		tnppt.Request.Header.Get("HMAC_TIME") != "" {
+		_, errTime := strconv.Atoi(tnppt.Request.Header.Get("HMAC_TIME"))
 		if errTime != nil {
 			return fmt.Errorf("[HMAC] Incorrect Payload")
 		}
-		errBind := crunchyTools.HasError(tnppt.Gin.BindHeader(&tnppt.PayloadHMAC), "TNPPT - INIT - Parsing Json", true)
+		errBind := crunchyTools.HasError(binding.Header.Bind(tnppt.Request, &tnppt.PayloadHMAC), "TNPPT - INIT - Parsing Json", true)
 		return errBind
 	}
 	return fmt.Errorf("[HMAC] No payload detected")
 }
 
 func (tnppt *TNPPT) checkAPIKeyPayload() error {
-	if tnppt.Gin.GetHeader("API_KEY") != "" {
-		errBind := crunchyTools.HasError(tnppt.Gin.BindHeader(&tnppt.PayloadAPIKey), "TNPPT - INIT - Parsing Json", true)
+	if tnppt.Request.Header.Get("API_KEY") != "" {
+		errBind := crunchyTools.HasError(binding.Header.Bind(tnppt.Request, &tnppt.PayloadAPIKey), "TNPPT - INIT - Parsing Json", true)
 		return errBind
 	}
 	return fmt.Errorf("[API-KEY] No payload detected")
 
 }
 
+// credentialsValid looks the credentials of the request up; a certificate
+// identity is only accepted by ActivateMTLSAuth, and by an API key issued to it.
+func (tnppt *TNPPT) credentialsValid() bool {
+	if tnppt.IsCredentialsValid == nil || !tnppt.IsCredentialsValid(tnppt) {
+		return false
+	}
+	if tnppt.scheme != SchemeMTLS && tnppt.scheme != SchemeAPIKey && isCertificateIdentity(tnppt.Principal.Login) {
+		tnppt.logDebug("credentials rejected", "reason", "certificate identity")
+		return false
+	}
+	return true
+}
+
 func (tnppt *TNPPT) LoginExists() {
 	tnppt.IsLoginValid = true
 }
@@ -159,7 +271,7 @@ func (tnppt *TNPPT) LoginDoestNotExists() {
 }
 
 func (tnppt *TNPPT) sendError(ginEngine *gin.Context, statusCode int, errorFetch error) {
-	//TODO LOG SERVER SIDE ERRORS WITHIN LOGGER
+	tnppt.logRejection(ginEngine.Request, statusCode, errorFetch)
 	_ = ginEngine.AbortWithError(statusCode, errorFetch)
 	ginEngine.JSON(statusCode, gin.H{
 		"code":    statusCode,
@@ -167,8 +279,52 @@ func (tnppt *TNPPT) sendError(ginEngine *gin.Context, statusCode int, errorFetch
 	})
 }
 
-func (tnppt *TNPPT) next() {
-	tnppt.Gin.Next()
+// activate is the gin middleware of a single scheme.
+func (tnppt *TNPPT) activate(scheme string) gin.HandlerFunc {
+	return tnppt.newVerifier("Activate", []string{scheme}, false).handlerFunc()
+}
+
+// startSchemes prepares the state of the schemes keeping one (keys, nonces,
+// sessions) the first time a route of caller uses them, the schemes left
+// unused cost nothing.
+func (tnppt *TNPPT) startSchemes(caller string, schemes ...string) {
+	for _, scheme := range schemes {
+		var err error
+		switch scheme {
+		case SchemeDigest:
+			err = tnppt.Digest.start()
+		case SchemeChallenge:
+			err = tnppt.Challenges.start()
+		case SchemeSCRAM:
+			err = tnppt.SCRAM.start()
+		}
+		if err != nil {
+			panic(fmt.Sprintf("TNPPT - %s - %v", caller, err))
+		}
+	}
+}
+
+// authenticated records scheme on the principal and adds its response headers.
+func (tnppt *TNPPT) authenticated(header http.Header, scheme string) {
+	tnppt.Principal.Scheme = scheme
+	if scheme == SchemeSCRAM {
+		header.Set("Authentication-Info", tnppt.scramAuthenticationInfo())
+	}
+}
+
+// challenge adds the WWW-Authenticate headers of the schemes having one,
+// errorFetch (nil when no credentials were sent) tunes them.
+func (tnppt *TNPPT) challenge(header http.Header, scheme string, errorFetch error) {
+	switch scheme {
+	case SchemeBasic:
+		header.Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", tnppt.Realm))
+	case SchemeDigest:
+		for _, challenge := range tnppt.digestChallenges(errors.Is(errorFetch, ErrDigestStaleNonce)) {
+			header.Add("WWW-Authenticate", challenge)
+		}
+	case SchemeSCRAM:
+		header.Add("WWW-Authenticate", tnppt.scramChallenge(errorFetch))
+	}
 }
 
 func (tnppt *TNPPT) GetTimeMilliseconds() int64 {
@@ -180,7 +336,7 @@ func (tnppt *TNPPT) setTime() {
 }
 
 func (tnppt *TNPPT) validateTTL() bool {
-	if tnppt.Security.TimeReceived-tnppt.PayloadHMAC.Time <= tnppt.Security.TTL {
+	if tnppt.Security.TimeReceived-tnppt.PayloadHMAC.Time <= tnppt.ttl() {
 		return true
 	}
 	return false
@@ -188,13 +344,16 @@ func (tnppt *TNPPT) validateTTL() bool {
 
 func (tnppt *TNPPT) createHash() string {
 	hasher := sha256.New()
-	hashPayload := tnppt.UserInfo.Login + tnppt.UserInfo.Password + strconv.FormatInt(tnppt.PayloadHMAC.Time, 10)
+	hashPayload := tnppt.Principal.Login + tnppt.Principal.Password + strconv.FormatInt(tnppt.PayloadHMAC.Time, 10)
 	hasher.Write([]byte(hashPayload))
 	hash := hasher.Sum(nil)
 	return fmt.Sprintf("%x", hash)
 }
 
 func (tnppt *TNPPT) compareHash() bool {
+	if tnppt.Principal.Password == "" {
+		return false
+	}
 	generatedHash := tnppt.createHash()
 	if isSame := strings.Compare(generatedHash, tnppt.PayloadHMAC.Hash); isSame == 0 {
 		return true
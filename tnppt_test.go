@@ -75,7 +75,7 @@ func TestTNPPT_createHash(t *testing.T) {
 						Login:    "steven",
 						Password: "pass",
 					}
-					tnppt.UserInfo = user
+					tnppt.Principal = user
 					return true
 				},
 			},
@@ -84,10 +84,12 @@ func TestTNPPT_createHash(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			tnppt, err := New(&TNPPT{
-				PayloadHMAC:        tt.fields.Payload,
-				UserInfo:           tt.fields.UserInfo,
-				IsLoginValid:       tt.fields.IsLoginValid,
-				Gin:                tt.fields.gin,
+				requestState: requestState{
+					PayloadHMAC:  tt.fields.Payload,
+					Principal:    tt.fields.UserInfo,
+					IsLoginValid: tt.fields.IsLoginValid,
+					Gin:          tt.fields.gin,
+				},
 				IsCredentialsValid: tt.fields.FetchUserInfos,
 			})
 			if err != nil {
@@ -128,7 +130,7 @@ func TestTNPPT_compareHash(t *testing.T) {
 						Login:    "steven",
 						Password: "pass",
 					}
-					tnppt.UserInfo = user
+					tnppt.Principal = user
 					return true
 				},
 			},
@@ -150,7 +152,7 @@ func TestTNPPT_compareHash(t *testing.T) {
 						Login:    "steven",
 						Password: "pass",
 					}
-					tnppt.UserInfo = user
+					tnppt.Principal = user
 					return true
 				},
 			},
@@ -160,10 +162,12 @@ func TestTNPPT_compareHash(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			tnppt, err := New(&TNPPT{
-				PayloadHMAC:        tt.fields.Payload,
-				UserInfo:           tt.fields.UserInfo,
-				IsLoginValid:       tt.fields.IsLoginValid,
-				Gin:                tt.fields.gin,
+				requestState: requestState{
+					PayloadHMAC:  tt.fields.Payload,
+					Principal:    tt.fields.UserInfo,
+					IsLoginValid: tt.fields.IsLoginValid,
+					Gin:          tt.fields.gin,
+				},
 				IsCredentialsValid: tt.fields.FetchUserInfos,
 			})
 			if err != nil {
@@ -186,10 +190,12 @@ func TestTNPPT_getTime(t *testing.T) {
 		FetchUserInfos func(tnppt *TNPPT) bool
 	}
 	tnppt, err := New(&TNPPT{
-		PayloadHMAC:  PayloadHMACFormat{},
-		UserInfo:     UserInfo{},
-		IsLoginValid: false,
-		Gin:          nil,
+		requestState: requestState{
+			PayloadHMAC:  PayloadHMACFormat{},
+			Principal:    UserInfo{},
+			IsLoginValid: false,
+			Gin:          nil,
+		},
 		IsCredentialsValid: func(tnppt *TNPPT) bool {
 			return true
 		},
@@ -237,7 +243,7 @@ func TestTNPPT_validateTTL(t *testing.T) {
 						Login:    "steven",
 						Password: "pass",
 					}
-					tnppt.UserInfo = user
+					tnppt.Principal = user
 					return true
 				},
 			},
@@ -263,7 +269,7 @@ func TestTNPPT_validateTTL(t *testing.T) {
 						Login:    "steven",
 						Password: "pass",
 					}
-					tnppt.UserInfo = user
+					tnppt.Principal = user
 					return true
 				},
 			},
@@ -273,11 +279,13 @@ func TestTNPPT_validateTTL(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			tnppt, err := New(&TNPPT{
-				PayloadHMAC:        tt.fields.Payload,
+				requestState: requestState{
+					PayloadHMAC:  tt.fields.Payload,
+					Principal:    tt.fields.UserInfo,
+					IsLoginValid: tt.fields.IsLoginValid,
+					Gin:          tt.fields.gin,
+				},
 				Security:           tt.fields.Security,
-				UserInfo:           tt.fields.UserInfo,
-				IsLoginValid:       tt.fields.IsLoginValid,
-				Gin:                tt.fields.gin,
 				IsCredentialsValid: tt.fields.FetchUserInfos,
 			})
 			if err != nil {
@@ -322,7 +330,7 @@ func TestTNPPT_HmacCompareProcess(t *testing.T) {
 						Login:    "steven",
 						Password: "pass",
 					}
-					tnppt.UserInfo = user
+					tnppt.Principal = user
 					return true
 				},
 			},
@@ -332,9 +340,11 @@ func TestTNPPT_HmacCompareProcess(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			tnppt, err := New(&TNPPT{
-				PayloadHMAC:        tt.fields.Payload,
+				requestState: requestState{
+					PayloadHMAC: tt.fields.Payload,
+					Principal:   tt.fields.UserInfo,
+				},
 				Security:           tt.fields.Security,
-				UserInfo:           tt.fields.UserInfo,
 				IsCredentialsValid: tt.fields.FetchUserInfos,
 			})
 			if err != nil {
@@ -343,7 +353,7 @@ func TestTNPPT_HmacCompareProcess(t *testing.T) {
 
 			timeNow := tnppt.GetTimeMilliseconds()
 			tnppt.IsCredentialsValid(tnppt)
-			hashPayload := tnppt.UserInfo.Login + tnppt.UserInfo.Password + strconv.FormatInt(timeNow, 10)
+			hashPayload := tnppt.Principal.Login + tnppt.Principal.Password + strconv.FormatInt(timeNow, 10)
 			hash := sha256.New()
 			hash.Write([]byte(hashPayload))
 			finalHash := fmt.Sprintf("%x", hash.Sum(nil))
@@ -352,7 +362,7 @@ func TestTNPPT_HmacCompareProcess(t *testing.T) {
 			w := httptest.NewRecorder()
 			req, _ := http.NewRequest("POST", "/login", nil)
 			req.Header.Add("HMAC_HASH", finalHash)
-			req.Header.Add("HMAC_LOGIN", tnppt.UserInfo.Login)
+			req.Header.Add("HMAC_LOGIN", tnppt.Principal.Login)
 			req.Header.Add("HMAC_TIME", strconv.FormatInt(timeNow, 10))
 
 			ginMock.ServeHTTP(w, req)
@@ -363,3 +373,32 @@ func TestTNPPT_HmacCompareProcess(t *testing.T) {
 	}
 	//auth :=
 }
+
+func TestTNPPT_StartSchemes(t *testing.T) {
+	started := func(auth *TNPPT) []bool {
+		return []bool{auth.Digest.nonces != nil, auth.Challenges.Store != nil, auth.SCRAM.sessions != nil}
+	}
+	tests := []struct {
+		name     string
+		activate func(auth *TNPPT)
+		want     []bool
+	}{
+		{name: "hmac", activate: func(auth *TNPPT) { auth.ActivateHMACAuth() }, want: []bool{false, false, false}},
+		{name: "digest", activate: func(auth *TNPPT) { auth.ActivateDigestAuth() }, want: []bool{true, false, false}},
+		{name: "challenge-handler", activate: func(auth *TNPPT) { auth.ChallengeHandler() }, want: []bool{false, true, false}},
+		{name: "any-scram", activate: func(auth *TNPPT) { auth.ActivateAny(SchemeBasic, SchemeSCRAM) }, want: []bool{false, false, true}},
+		{name: "verifier", activate: func(auth *TNPPT) { auth.Verifier(SchemeDigest, SchemeChallenge) }, want: []bool{true, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := New(&TNPPT{Store: newTestMemoryStore(t, StoreRecords{})})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, []bool{false, false, false}, started(auth))
+			assert.Empty(t, auth.SCRAM.Key)
+			tt.activate(auth)
+			assert.Equal(t, tt.want, started(auth))
+		})
+	}
+}
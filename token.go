@@ -0,0 +1,205 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SchemeToken = "token"
+
+	tokenUseAccess  = "access"
+	tokenUseRefresh = "refresh"
+)
+
+// TokenSettings configures the session tokens issued by IssueTokenHandler and
+// checked by ActivateTokenAuth. No refresh token is issued when RefreshTTL is 0,
+// otherwise they are tracked in RefreshStore, in memory by default.
+type TokenSettings struct {
+	SigningKey   JWTKey
+	Issuer       string
+	Audience     string
+	AccessTTL    time.Duration
+	RefreshTTL   time.Duration
+	RefreshStore RefreshTokenStore
+}
+
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+var ErrFailedAuthenticationToken = errors.New("incorrect Session Token")
+
+// IssueTokenHandler answers with a TokenResponse for the UserInfo set by the
+// previous handler, typically ActivateHMACAuth:
+//
+//	engine.POST("/token", auth.ActivateHMACAuth(), auth.IssueTokenHandler())
+func (tnppt *TNPPT) IssueTokenHandler() gin.HandlerFunc {
+	return func(ginEngine *gin.Context) {
+		user, found := UserInfoFromGin(ginEngine)
+		if !found || user.Login == "" {
+			tnppt.sendError(ginEngine, http.StatusUnauthorized, ErrAuthenticationRequired)
+			return
+		}
+		response, err := tnppt.Tokens.issue(ginEngine.Request.Context(), user, "", time.Now())
+		if err != nil {
+			tnppt.sendError(ginEngine, http.StatusInternalServerError, err)
+			return
+		}
+		ginEngine.JSON(http.StatusOK, response)
+	}
+}
+
+func (tnppt *TNPPT) ActivateTokenAuth() gin.HandlerFunc {
+	return tnppt.activate(SchemeToken)
+}
+
+func (tnppt *TNPPT) authenticateToken() error {
+	token, err := bearerToken(tnppt.Request.Header.Get("Authorization"))
+	if err != nil {
+		return errors.New(ErrFailedPayload.Error() + " - " + err.Error())
+	}
+	user, err := tnppt.Tokens.verify(token, tokenUseAccess, time.Unix(0, tnppt.Security.TimeReceived*int64(time.Millisecond)))
+	if err != nil {
+		return errors.New(ErrFailedAuthenticationToken.Error() + " - " + err.Error())
+	}
+	tnppt.Principal = user
+	return nil
+}
+
+func (settings *TokenSettings) init() error {
+	if settings.SigningKey.Algorithm == "" {
+		return nil
+	}
+	if err := settings.SigningKey.validate(); err != nil {
+		return err
+	}
+	if settings.Issuer == "" {
+		settings.Issuer = "tnppt"
+	}
+	if settings.AccessTTL == 0 {
+		settings.AccessTTL = 5 * time.Minute
+	}
+	if settings.RefreshTTL > 0 && settings.RefreshStore == nil {
+		settings.RefreshStore = NewMemoryRefreshTokenStore()
+	}
+	return nil
+}
+
+func (settings TokenSettings) enabled() bool {
+	return settings.SigningKey.Algorithm != ""
+}
+
+// issue starts a new refresh token family when familyID is empty.
+func (settings TokenSettings) issue(ctx context.Context, user UserInfo, familyID string, now time.Time) (TokenResponse, error) {
+	if !settings.enabled() {
+		return TokenResponse{}, errors.New("TNPPT - Tokens - You need to set the SigningKey")
+	}
+	if user.Login == "" {
+		return TokenResponse{}, errors.New("TNPPT - Tokens - No authenticated user to issue a token for")
+	}
+	accessToken, err := settings.sign(user, tokenUseAccess, settings.AccessTTL, now, nil)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	response := TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(settings.AccessTTL / time.Second),
+	}
+	if settings.RefreshTTL > 0 {
+		if response.RefreshToken, err = settings.issueRefreshToken(ctx, user, familyID, now); err != nil {
+			return TokenResponse{}, err
+		}
+	}
+	return response, nil
+}
+
+func (settings TokenSettings) sign(user UserInfo, use string, ttl time.Duration, now time.Time, extra map[string]interface{}) (string, error) {
+	tokenID, err := randomTokenID()
+	if err != nil {
+		return "", err
+	}
+	return settings.signWithID(tokenID, user, use, ttl, now, extra)
+}
+
+func (settings TokenSettings) signWithID(tokenID string, user UserInfo, use string, ttl time.Duration, now time.Time, extra map[string]interface{}) (string, error) {
+	claims := map[string]interface{}{
+		"iss":       settings.Issuer,
+		"sub":       user.Login,
+		"iat":       now.Unix(),
+		"exp":       now.Add(ttl).Unix(),
+		"jti":       tokenID,
+		"token_use": use,
+	}
+	if settings.Audience != "" {
+		claims["aud"] = settings.Audience
+	}
+	switch id := user.ID.(type) {
+	case string, int, int32, int64, uint, uint32, uint64, float64:
+		claims["uid"] = id
+	case fmt.Stringer:
+		claims["uid"] = id.String()
+	}
+	if len(user.Scopes) > 0 {
+		claims["scope"] = strings.Join(user.Scopes, " ")
+	}
+	if len(user.Roles) > 0 {
+		claims["roles"] = user.Roles
+	}
+	if user.Tenant != "" {
+		claims["tenant"] = user.Tenant
+	}
+	for name, value := range extra {
+		claims[name] = value
+	}
+	return SignJWT(claims, settings.SigningKey)
+}
+
+func (settings TokenSettings) verify(token string, use string, now time.Time) (UserInfo, error) {
+	user, _, err := settings.verifyClaims(token, use, now)
+	return user, err
+}
+
+func (settings TokenSettings) verifyClaims(token string, use string, now time.Time) (UserInfo, map[string]interface{}, error) {
+	if !settings.enabled() {
+		return UserInfo{}, nil, errors.New("[TOKEN] No signing key configured")
+	}
+	jwtSettings := JWTSettings{
+		Keys:     []JWTKey{settings.SigningKey},
+		Issuer:   settings.Issuer,
+		Audience: settings.Audience,
+	}
+	claims, err := jwtSettings.Verify(token, now)
+	if err != nil {
+		return UserInfo{}, nil, err
+	}
+	if claims["token_use"] != use {
+		return UserInfo{}, nil, fmt.Errorf("%w: not an %s token", ErrJWTClaims, use)
+	}
+	user := jwtSettings.userInfo(claims)
+	user.ID = nil
+	if id, exists := claims["uid"]; exists {
+		user.ID = id
+	}
+	return user, claims, nil
+}
+
+func randomTokenID() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
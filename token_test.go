@@ -0,0 +1,150 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func tokenMockHandler(t *testing.T, auth *TNPPT) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/token", auth.ActivateHMACAuth(), auth.IssueTokenHandler())
+	router.GET("/me", auth.ActivateTokenAuth(), func(c *gin.Context) {
+		c.String(200, principal(c).Login)
+	})
+	router.GET("/me/principal", auth.ActivateTokenAuth(), func(c *gin.Context) {
+		c.JSON(200, principal(c))
+	})
+	return router
+}
+
+// mePrincipal returns the principal authenticated by token.
+func mePrincipal(t *testing.T, router *gin.Engine, token string) UserInfo {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/me/principal", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+	var user UserInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func hmacLoginRequest(t *testing.T, auth *TNPPT, path string, login string, password string) *http.Request {
+	t.Helper()
+	timeNow := auth.GetTimeMilliseconds()
+	hash := sha256.Sum256([]byte(login + password + strconv.FormatInt(timeNow, 10)))
+	req, _ := http.NewRequest("POST", path, nil)
+	req.Header.Add("HMAC_HASH", fmt.Sprintf("%x", hash))
+	req.Header.Add("HMAC_LOGIN", login)
+	req.Header.Add("HMAC_TIME", strconv.FormatInt(timeNow, 10))
+	return req
+}
+
+func newTokenTestAuth(t *testing.T, refreshTTL time.Duration) *TNPPT {
+	t.Helper()
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{ID: "1", Login: "steven", Password: "pass", Scopes: []string{"logs:read"}, Roles: []string{"viewer"}}}})
+	auth, err := New(&TNPPT{
+		Store: store,
+		Tokens: TokenSettings{
+			SigningKey: JWTKey{ID: "session", Algorithm: JWTAlgHS256, Key: []byte("session-secret")},
+			RefreshTTL: refreshTTL,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+func TestTNPPT_IssueTokenHandler(t *testing.T) {
+	auth := newTokenTestAuth(t, time.Hour)
+	router := tokenMockHandler(t, auth)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, hmacLoginRequest(t, auth, "/token", "steven", "pass"))
+	assert.Equal(t, 200, w.Code)
+	var response TokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Bearer", response.TokenType)
+	assert.Equal(t, int64(300), response.ExpiresIn)
+	assert.NotEmpty(t, response.RefreshToken)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, hmacLoginRequest(t, auth, "/token", "steven", "wrong"))
+	assert.Equal(t, 401, w.Code)
+
+	router.POST("/unauthenticated-token", auth.IssueTokenHandler())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/unauthenticated-token", nil))
+	assert.Equal(t, 401, w.Code, "the principal of a previous request is not reused")
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{name: "access-token", token: response.AccessToken, want: 200},
+		{name: "refresh-token", token: response.RefreshToken, want: 401},
+		{name: "garbage", token: "garbage", want: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/me", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.want, w.Code)
+			if tt.want == 200 {
+				assert.Equal(t, "steven", w.Body.String())
+				user := mePrincipal(t, router, tt.token)
+				assert.Equal(t, "1", user.ID)
+				assert.Equal(t, []string{"logs:read"}, user.Scopes)
+				assert.Equal(t, []string{"viewer"}, user.Roles)
+				assert.Empty(t, user.Password)
+			}
+		})
+	}
+}
+
+func TestTokenSettings_Verify(t *testing.T) {
+	auth := newTokenTestAuth(t, 0)
+	now := time.Now()
+	response, err := auth.Tokens.issue(context.Background(), UserInfo{Login: "steven"}, "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, response.RefreshToken)
+
+	_, err = auth.Tokens.verify(response.AccessToken, tokenUseAccess, now.Add(6*time.Minute))
+	assert.True(t, errors.Is(err, ErrJWTExpired), err)
+
+	other := auth.Tokens
+	other.SigningKey.Key = []byte("other-secret")
+	_, err = other.verify(response.AccessToken, tokenUseAccess, now)
+	assert.True(t, errors.Is(err, ErrJWTSignature), err)
+
+	other = auth.Tokens
+	other.Issuer = "other-service"
+	_, err = other.verify(response.AccessToken, tokenUseAccess, now)
+	assert.True(t, errors.Is(err, ErrJWTClaims), err)
+
+	_, err = auth.Tokens.issue(context.Background(), UserInfo{}, "", now)
+	assert.Error(t, err)
+}
@@ -0,0 +1,310 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	TOTPSHA1   = "SHA1"
+	TOTPSHA256 = "SHA256"
+	TOTPSHA512 = "SHA512"
+)
+
+// TOTP is an RFC 6238 generator, Skew is the number of periods accepted
+// before and after the current one to absorb clock drift (1 by default, a
+// negative Skew only accepts the current period).
+type TOTP struct {
+	Secret    []byte
+	Algorithm string
+	Digits    int
+	Period    time.Duration
+	Skew      int
+}
+
+// TOTPStore holds the enrolled TOTP of every login of a tenant ("" without
+// tenancy) and the last time step accepted, so that a code can not be used twice.
+type TOTPStore interface {
+	// FindTOTP returns ErrCredentialsNotFound for a login without TOTP.
+	FindTOTP(ctx context.Context, tenant string, login string) (TOTP, error)
+	// MarkTOTPUsed returns ErrTOTPReplayed unless counter is after the last one accepted.
+	MarkTOTPUsed(ctx context.Context, tenant string, login string, counter int64) error
+}
+
+// TOTPSettings configures RequireTOTP, the code is read from the Header (TOTP_CODE by default).
+type TOTPSettings struct {
+	Store  TOTPStore
+	Header string
+}
+
+var (
+	ErrFailedAuthenticationTOTP = errors.New("incorrect TOTP Code")
+	ErrTOTPNotEnrolled          = errors.New("TOTP enrollment required")
+	ErrTOTPReplayed             = errors.New("TOTP code already used")
+)
+
+func NewTOTP(totp *TOTP) (*TOTP, error) {
+	return totp.Init()
+}
+
+// Init sets the defaults (SHA1, 6 digits, 30 seconds, skew of 1, the ones
+// authenticator apps expect) and generates a 160 bits Secret when empty.
+func (totp *TOTP) Init() (*TOTP, error) {
+	if totp.Algorithm == "" {
+		totp.Algorithm = TOTPSHA1
+	}
+	if totp.Digits == 0 {
+		totp.Digits = 6
+	}
+	if totp.Period == 0 {
+		totp.Period = 30 * time.Second
+	}
+	if totp.Skew == 0 {
+		totp.Skew = 1
+	}
+	if len(totp.Secret) == 0 {
+		totp.Secret = make([]byte, 20)
+		if _, err := rand.Read(totp.Secret); err != nil {
+			return nil, err
+		}
+	}
+	if err := totp.validate(); err != nil {
+		return nil, err
+	}
+	return totp, nil
+}
+
+// URI is the otpauth:// enrollment URI, usually shown as a QR code.
+func (totp TOTP) URI(issuer string, account string) string {
+	query := url.Values{}
+	query.Set("secret", base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(totp.Secret))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", totp.Algorithm)
+	query.Set("digits", strconv.Itoa(totp.Digits))
+	query.Set("period", strconv.FormatInt(int64(totp.Period/time.Second), 10))
+	return (&url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + issuer + ":" + account, RawQuery: query.Encode()}).String()
+}
+
+func (totp TOTP) Code(at time.Time) (string, error) {
+	if err := totp.validate(); err != nil {
+		return "", err
+	}
+	return totp.code(totp.counter(at)), nil
+}
+
+// Verify returns the time step matched by code, to be given to MarkTOTPUsed.
+func (totp TOTP) Verify(code string, at time.Time) (int64, bool) {
+	if totp.validate() != nil || len(code) != totp.Digits {
+		return 0, false
+	}
+	window := int64(totp.Skew)
+	if window < 0 {
+		window = 0
+	}
+	current := totp.counter(at)
+	matched, found := int64(0), false
+	for counter := current - window; counter <= current+window; counter++ {
+		if subtle.ConstantTimeCompare([]byte(totp.code(counter)), []byte(code)) == 1 && !found {
+			matched, found = counter, true
+		}
+	}
+	return matched, found
+}
+
+func (totp TOTP) counter(at time.Time) int64 {
+	return at.Unix() / int64(totp.Period/time.Second)
+}
+
+// code is the RFC 4226 HOTP value of counter.
+func (totp TOTP) code(counter int64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+	mac := hmac.New(totp.hash(), totp.Secret)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < totp.Digits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totp.Digits, value%modulo)
+}
+
+func (totp TOTP) hash() func() hash.Hash {
+	switch totp.Algorithm {
+	case TOTPSHA256:
+		return sha256.New
+	case TOTPSHA512:
+		return sha512.New
+	}
+	return sha1.New
+}
+
+func (totp TOTP) validate() error {
+	if totp.Algorithm != TOTPSHA1 && totp.Algorithm != TOTPSHA256 && totp.Algorithm != TOTPSHA512 {
+		return fmt.Errorf("TNPPT - TOTP - Unknown algorithm %q", totp.Algorithm)
+	}
+	if totp.Digits < 6 || totp.Digits > 8 {
+		return errors.New("TNPPT - TOTP - Digits must be between 6 and 8")
+	}
+	if totp.Period < time.Second {
+		return errors.New("TNPPT - TOTP - The Period must be at least a second")
+	}
+	if len(totp.Secret) < 16 {
+		return errors.New("TNPPT - TOTP - The Secret must be at least 128 bits")
+	}
+	return nil
+}
+
+// RequireTOTP checks the one-time code of the login authenticated by the
+// previous middleware:
+//
+//	engine.POST("/admin", auth.ActivateHMACAuth(), auth.RequireTOTP(), ...)
+//
+// With a Lockout LoginThreshold, the rejected codes of a login are counted
+// apart from its credentials, and lock its TOTP the same way.
+func (tnppt *TNPPT) RequireTOTP() gin.HandlerFunc {
+	if tnppt.TOTP.Store == nil {
+		panic("TNPPT - RequireTOTP - You need to set the TOTP Store")
+	}
+	header := tnppt.TOTP.Header
+	if header == "" {
+		header = "TOTP_CODE"
+	}
+	return func(ginEngine *gin.Context) {
+		user, found := UserInfoFromGin(ginEngine)
+		if !found || user.Login == "" {
+			tnppt.sendError(ginEngine, http.StatusUnauthorized, ErrFailedAuthenticationTOTP)
+			return
+		}
+		code := ginEngine.GetHeader(header)
+		if code == "" {
+			message := errors.New(ErrFailedPayload.Error() + " - [TOTP] No payload detected")
+			tnppt.sendError(ginEngine, http.StatusUnauthorized, message)
+			return
+		}
+		lockKey := ""
+		if tnppt.Lockout.LoginThreshold > 0 {
+			lockKey = lockoutTOTPKey(user.Tenant, user.Login)
+			if errLocked := tnppt.checkLocked(ginEngine.Request, ginEngine.Writer.Header(), lockKey); errLocked != nil {
+				tnppt.sendError(ginEngine, http.StatusTooManyRequests, errLocked)
+				return
+			}
+		}
+		ctx := ginEngine.Request.Context()
+		totp, errFind := tnppt.TOTP.Store.FindTOTP(ctx, user.Tenant, user.Login)
+		if errors.Is(errFind, ErrCredentialsNotFound) {
+			tnppt.sendError(ginEngine, http.StatusForbidden, ErrTOTPNotEnrolled)
+			return
+		}
+		if errFind != nil {
+			tnppt.logError(ginEngine.Request, "totp store lookup failed", errFind)
+			tnppt.sendError(ginEngine, http.StatusUnauthorized, ErrFailedAuthenticationTOTP)
+			return
+		}
+		now := time.Now()
+		counter, valid := totp.Verify(code, now)
+		if !valid {
+			tnppt.failTOTP(ginEngine.Request, lockKey, now)
+			tnppt.sendError(ginEngine, http.StatusUnauthorized, ErrFailedAuthenticationTOTP)
+			return
+		}
+		if errMark := tnppt.TOTP.Store.MarkTOTPUsed(ctx, user.Tenant, user.Login, counter); errMark != nil {
+			if errors.Is(errMark, ErrTOTPReplayed) {
+				tnppt.failTOTP(ginEngine.Request, lockKey, now)
+			} else {
+				tnppt.logError(ginEngine.Request, "totp store update failed", errMark)
+			}
+			tnppt.sendError(ginEngine, http.StatusUnauthorized, ErrFailedAuthenticationTOTP)
+			return
+		}
+		if lockKey != "" {
+			if errReset := tnppt.Lockout.Store.Reset(ctx, lockKey); errReset != nil {
+				tnppt.logError(ginEngine.Request, "lockout reset failed", errReset)
+			}
+		}
+		ginEngine.Next()
+	}
+}
+
+// failTOTP counts a rejected code on lockKey, when the lockout is enabled.
+func (tnppt *TNPPT) failTOTP(request *http.Request, lockKey string, now time.Time) {
+	if lockKey != "" {
+		tnppt.countFailure(request, lockKey, tnppt.Lockout.LoginThreshold, now)
+	}
+}
+
+type memoryTOTP struct {
+	totp        TOTP
+	lastCounter int64
+	used        bool
+}
+
+type memoryTOTPKey struct {
+	tenant string
+	login  string
+}
+
+// MemoryTOTPStore is a TOTPStore for a single instance.
+type MemoryTOTPStore struct {
+	mu    sync.Mutex
+	users map[memoryTOTPKey]*memoryTOTP
+}
+
+func NewMemoryTOTPStore() *MemoryTOTPStore {
+	return &MemoryTOTPStore{users: map[memoryTOTPKey]*memoryTOTP{}}
+}
+
+// Enroll replaces the TOTP of login in tenant ("" without tenancy).
+func (store *MemoryTOTPStore) Enroll(tenant string, login string, totp TOTP) error {
+	if err := totp.validate(); err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	totp.Secret = append([]byte(nil), totp.Secret...)
+	store.users[memoryTOTPKey{tenant, login}] = &memoryTOTP{totp: totp}
+	return nil
+}
+
+func (store *MemoryTOTPStore) FindTOTP(ctx context.Context, tenant string, login string) (TOTP, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	user, found := store.users[memoryTOTPKey{tenant, login}]
+	if !found {
+		return TOTP{}, ErrCredentialsNotFound
+	}
+	return user.totp, nil
+}
+
+func (store *MemoryTOTPStore) MarkTOTPUsed(ctx context.Context, tenant string, login string, counter int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	user, found := store.users[memoryTOTPKey{tenant, login}]
+	if !found {
+		return ErrCredentialsNotFound
+	}
+	if user.used && counter <= user.lastCounter {
+		return ErrTOTPReplayed
+	}
+	user.lastCounter, user.used = counter, true
+	return nil
+}
@@ -0,0 +1,241 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// RFC 6238 appendix B
+func TestTOTP_Code(t *testing.T) {
+	secrets := map[string][]byte{
+		TOTPSHA1:   []byte("12345678901234567890"),
+		TOTPSHA256: []byte("12345678901234567890123456789012"),
+		TOTPSHA512: []byte("1234567890123456789012345678901234567890123456789012345678901234"),
+	}
+	tests := []struct {
+		unix      int64
+		algorithm string
+		want      string
+	}{
+		{59, TOTPSHA1, "94287082"},
+		{59, TOTPSHA256, "46119246"},
+		{59, TOTPSHA512, "90693936"},
+		{1111111109, TOTPSHA1, "07081804"},
+		{1111111109, TOTPSHA256, "68084774"},
+		{1111111109, TOTPSHA512, "25091201"},
+		{1234567890, TOTPSHA1, "89005924"},
+		{1234567890, TOTPSHA256, "91819424"},
+		{1234567890, TOTPSHA512, "93441116"},
+		{20000000000, TOTPSHA1, "65353130"},
+		{20000000000, TOTPSHA256, "77737706"},
+		{20000000000, TOTPSHA512, "47863826"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm+"-"+tt.want, func(t *testing.T) {
+			totp, err := NewTOTP(&TOTP{Secret: secrets[tt.algorithm], Algorithm: tt.algorithm, Digits: 8})
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, err := totp.Code(time.Unix(tt.unix, 0))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, code)
+		})
+	}
+}
+
+func TestTOTP_Verify(t *testing.T) {
+	totp, err := NewTOTP(&TOTP{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, totp.Secret, 20)
+	now := time.Unix(1700000000, 0)
+	code, _ := totp.Code(now)
+	counter, valid := totp.Verify(code, now)
+	assert.True(t, valid)
+	assert.Equal(t, now.Unix()/30, counter)
+
+	previous, _ := totp.Code(now.Add(-30 * time.Second))
+	_, valid = totp.Verify(previous, now)
+	assert.True(t, valid, "drift of one period")
+	tooOld, _ := totp.Code(now.Add(-90 * time.Second))
+	_, valid = totp.Verify(tooOld, now)
+	assert.False(t, valid)
+	_, valid = totp.Verify(code[:5], now)
+	assert.False(t, valid)
+
+	strict := *totp
+	strict.Skew = -1
+	_, valid = strict.Verify(previous, now)
+	assert.False(t, valid)
+	_, valid = strict.Verify(code, now)
+	assert.True(t, valid)
+
+	_, err = NewTOTP(&TOTP{Secret: []byte("short")})
+	assert.Error(t, err)
+	_, err = NewTOTP(&TOTP{Algorithm: "MD5"})
+	assert.Error(t, err)
+	_, err = NewTOTP(&TOTP{Digits: 10})
+	assert.Error(t, err)
+}
+
+func TestTOTP_URI(t *testing.T) {
+	totp := TOTP{Secret: []byte("12345678901234567890"), Algorithm: TOTPSHA256, Digits: 8, Period: time.Minute}
+	uri, err := url.Parse(totp.URI("Log Platform", "steven@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/Log Platform:steven@example.com", uri.Path)
+	assert.Equal(t, url.Values{
+		"secret":    {"GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"},
+		"issuer":    {"Log Platform"},
+		"algorithm": {"SHA256"},
+		"digits":    {"8"},
+		"period":    {"60"},
+	}, uri.Query())
+}
+
+func TestMemoryTOTPStore_MarkTOTPUsed(t *testing.T) {
+	store := NewMemoryTOTPStore()
+	totp, _ := NewTOTP(&TOTP{})
+	assert.NoError(t, store.Enroll("", "steven", *totp))
+	assert.NoError(t, store.MarkTOTPUsed(context.Background(), "", "steven", 10))
+	assert.True(t, errors.Is(store.MarkTOTPUsed(context.Background(), "", "steven", 10), ErrTOTPReplayed))
+	assert.True(t, errors.Is(store.MarkTOTPUsed(context.Background(), "", "steven", 9), ErrTOTPReplayed))
+	assert.NoError(t, store.MarkTOTPUsed(context.Background(), "", "steven", 11))
+	assert.True(t, errors.Is(store.MarkTOTPUsed(context.Background(), "", "nobody", 1), ErrCredentialsNotFound))
+	assert.True(t, errors.Is(store.MarkTOTPUsed(context.Background(), "acme", "steven", 12), ErrCredentialsNotFound), "other tenant")
+}
+
+func TestTNPPT_RequireTOTP(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{
+		{Login: "admin", Password: "pass"},
+		{Login: "steven", Password: "pass"},
+	}})
+	totpStore := NewMemoryTOTPStore()
+	totp, _ := NewTOTP(&TOTP{})
+	assert.NoError(t, totpStore.Enroll("", "admin", *totp))
+	auth, err := New(&TNPPT{Store: store, TOTP: TOTPSettings{Store: totpStore}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/admin", auth.ActivateHMACAuth(), auth.RequireTOTP(), func(c *gin.Context) {
+		c.String(200, principal(c).Login)
+	})
+	router.POST("/unauthenticated", auth.RequireTOTP(), func(c *gin.Context) {})
+	send := func(login string, password string, code string) int {
+		req := hmacLoginRequest(t, auth, "/admin", login, password)
+		if code != "" {
+			req.Header.Set("TOTP_CODE", code)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	code, _ := totp.Code(time.Now())
+	wrongCode := "000000"
+	if code == wrongCode {
+		wrongCode = "111111"
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, send("admin", "pass", ""), "missing code")
+	assert.Equal(t, http.StatusUnauthorized, send("admin", "pass", wrongCode), "wrong code")
+	unauthenticated := httptest.NewRequest("POST", "/unauthenticated", nil)
+	unauthenticated.Header.Set("TOTP_CODE", code)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, unauthenticated)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "the login of a previous request is not reused")
+	assert.Equal(t, http.StatusUnauthorized, send("admin", "wrong", code), "wrong signature")
+	assert.Equal(t, http.StatusForbidden, send("steven", "pass", code), "not enrolled")
+	assert.Equal(t, http.StatusOK, send("admin", "pass", code))
+	assert.Equal(t, http.StatusUnauthorized, send("admin", "pass", code), "replayed code")
+
+	assert.Panics(t, func() { (&TNPPT{}).RequireTOTP() })
+}
+
+func TestTNPPT_RequireTOTPLockout(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "admin", Password: "pass"}}})
+	totpStore := NewMemoryTOTPStore()
+	totp, _ := NewTOTP(&TOTP{})
+	assert.NoError(t, totpStore.Enroll("", "admin", *totp))
+	auth, err := New(&TNPPT{
+		Store:   store,
+		TOTP:    TOTPSettings{Store: totpStore},
+		Lockout: LockoutSettings{LoginThreshold: 3, BaseDelay: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.POST("/admin", auth.ActivateHMACAuth(), auth.RequireTOTP(), func(c *gin.Context) {})
+	send := func(code string) int {
+		req := hmacLoginRequest(t, auth, "/admin", "admin", "pass")
+		req.Header.Set("TOTP_CODE", code)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	code, _ := totp.Code(time.Now())
+	wrongCode := "000000"
+	if code == wrongCode {
+		wrongCode = "111111"
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		assert.Equal(t, http.StatusUnauthorized, send(wrongCode), "the valid password does not reset the TOTP failures")
+	}
+	assert.Equal(t, http.StatusTooManyRequests, send(code), "locked even with the right code")
+	assert.NoError(t, auth.Unlock(context.Background(), "", "admin", ""))
+	assert.Equal(t, http.StatusOK, send(code))
+}
+
+func TestTNPPT_RequireTOTPTenants(t *testing.T) {
+	totpStore := NewMemoryTOTPStore()
+	totp, _ := NewTOTP(&TOTP{})
+	assert.NoError(t, totpStore.Enroll("acme", "admin", *totp))
+	auth, err := New(&TNPPT{
+		TOTP: TOTPSettings{Store: totpStore},
+		Tenants: TenantSettings{
+			Source: TenantFromHeader,
+			Tenants: map[string]TenantConfig{
+				"acme":   {Store: newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "admin", Password: "pass"}}})},
+				"globex": {Store: newTestMemoryStore(t, StoreRecords{Users: []UserRecord{{Login: "admin", Password: "pass"}}})},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.POST("/log", auth.ActivateHMACAuth(), auth.RequireTOTP(), func(c *gin.Context) {})
+	code, _ := totp.Code(time.Now())
+
+	tests := []struct {
+		tenant string
+		want   int
+	}{
+		{tenant: "globex", want: http.StatusForbidden},
+		{tenant: "acme", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tenant, func(t *testing.T) {
+			req := tenantHMACRequest(t, tt.tenant, "admin", "pass", 0)
+			req.Header.Set("TOTP_CODE", code)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.want, w.Code)
+		})
+	}
+}
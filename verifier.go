@@ -0,0 +1,248 @@
+package tnpptMiddleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Verifier authenticates a *http.Request with some schemes, whatever the
+// framework. The gin middlewares (ActivateHMACAuth, ActivateAny...) are built
+// on it, Middleware adapts it to net/http:
+//
+//	router.Handle("/log", auth.Verifier(tnpptMiddleware.SchemeHMAC).Middleware(logHandler))
+type Verifier struct {
+	tnppt    *TNPPT
+	schemes  []string
+	any      bool
+	optional bool
+}
+
+// AuthenticationError is the error of Verify, StatusCode is the one to answer.
+type AuthenticationError struct {
+	StatusCode int
+	Err        error
+}
+
+type userInfoContextKey struct{}
+
+func (err *AuthenticationError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *AuthenticationError) Unwrap() error {
+	return err.Err
+}
+
+// Verifier returns the Verifier of schemes, several schemes behave as ActivateAny.
+func (tnppt *TNPPT) Verifier(schemes ...string) *Verifier {
+	return tnppt.newVerifier("Verifier", schemes, len(schemes) > 1)
+}
+
+// Optional returns the Verifier that lets the requests without credentials go
+// on with an anonymous principal (UserInfo.Anonymous). Credentials sent are
+// still checked, invalid ones are rejected.
+func (verifier *Verifier) Optional() *Verifier {
+	optional := *verifier
+	optional.optional = true
+	return &optional
+}
+
+func (tnppt *TNPPT) newVerifier(caller string, schemes []string, any bool) *Verifier {
+	if len(schemes) == 0 {
+		panic(fmt.Sprintf("TNPPT - %s - You need to set at least one scheme", caller))
+	}
+	for _, scheme := range schemes {
+		if _, known := schemeAuthenticators[scheme]; !known {
+			panic(fmt.Sprintf("TNPPT - %s - Unknown scheme %q", caller, scheme))
+		}
+	}
+	tnppt.startSchemes(caller, schemes...)
+	return &Verifier{tnppt: tnppt, schemes: schemes, any: any}
+}
+
+// Verify authenticates request and returns the principal, on failure the error
+// is an *AuthenticationError. An Optional Verifier returns the anonymous
+// principal when no credentials are sent. The headers of the response (WWW-Authenticate,
+// Authentication-Info) are added to header.
+// Verify works on a copy of the TNPPT so that it can be called concurrently,
+// the TNPPT itself is left untouched.
+func (verifier *Verifier) Verify(request *http.Request, header http.Header) (UserInfo, error) {
+	return verifier.verifyCopy(request, header, nil, "")
+}
+
+// verifyCopy is Verify for the request of ginEngine (nil outside gin) on route.
+func (verifier *Verifier) verifyCopy(request *http.Request, header http.Header, ginEngine *gin.Context, route string) (UserInfo, error) {
+	tnppt := verifier.tnppt.requestCopy(ginEngine, route)
+	if verifier.anonymous(tnppt, request) {
+		return tnppt.Principal, nil
+	}
+	err := tnppt.verify(request, header, verifier.schemes, verifier.any)
+	if err != nil {
+		return UserInfo{}, err
+	}
+	return tnppt.Principal, nil
+}
+
+// requestCopy returns the copy of tnppt holding the state of one request,
+// IsCredentialsValid still finds the gin context in Gin.
+func (tnppt *TNPPT) requestCopy(ginEngine *gin.Context, route string) *TNPPT {
+	request := *tnppt
+	request.requestState = requestState{route: route}
+	if ginEngine != nil {
+		request.Gin = ginEngine.Copy()
+	}
+	return &request
+}
+
+// Middleware is the func(http.Handler) http.Handler adapter of the Verifier,
+// the principal is set in the request context (see UserInfoFromContext) and
+// failures are answered as the gin middlewares do.
+func (verifier *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		user, err := verifier.Verify(request, writer.Header())
+		if err != nil {
+			writeAuthenticationError(writer, asAuthenticationError(err))
+			return
+		}
+		next.ServeHTTP(writer, request.WithContext(ContextWithUserInfo(request.Context(), user)))
+	})
+}
+
+func ContextWithUserInfo(ctx context.Context, user UserInfo) context.Context {
+	return context.WithValue(ctx, userInfoContextKey{}, user)
+}
+
+// UserInfoFromContext returns the principal set by Verifier.Middleware, or by
+// the gin middlewares in the context of the request.
+func UserInfoFromContext(ctx context.Context) (UserInfo, bool) {
+	user, found := ctx.Value(userInfoContextKey{}).(UserInfo)
+	return user, found
+}
+
+const userInfoGinKey = "tnppt.Principal"
+
+// UserInfoFromGin returns the principal authenticated by the gin middlewares
+// for the request of ginEngine.
+func UserInfoFromGin(ginEngine *gin.Context) (UserInfo, bool) {
+	value, found := ginEngine.Get(userInfoGinKey)
+	user, isUserInfo := value.(UserInfo)
+	return user, found && isUserInfo
+}
+
+// setPrincipal records user as the principal of the request of ginEngine.
+func setPrincipal(ginEngine *gin.Context, user UserInfo) {
+	ginEngine.Set(userInfoGinKey, user)
+	ginEngine.Request = ginEngine.Request.WithContext(ContextWithUserInfo(ginEngine.Request.Context(), user))
+}
+
+// handlerFunc is the gin middleware of the Verifier, the principal is set on
+// the gin context (see UserInfoFromGin) and in the context of the request.
+func (verifier *Verifier) handlerFunc() gin.HandlerFunc {
+	return func(ginEngine *gin.Context) {
+		user, err := verifier.verifyCopy(ginEngine.Request, ginEngine.Writer.Header(), ginEngine, ginEngine.FullPath())
+		if err != nil {
+			verifier.tnppt.sendError(ginEngine, asAuthenticationError(err).StatusCode, err)
+			return
+		}
+		setPrincipal(ginEngine, user)
+		ginEngine.Next()
+	}
+}
+
+// anonymous reports whether an optional Verifier lets request go on without
+// principal, none of the credentials of its schemes being presented.
+func (verifier *Verifier) anonymous(tnppt *TNPPT, request *http.Request) bool {
+	if !verifier.optional {
+		return false
+	}
+	tnppt.Request = request
+	for _, scheme := range verifier.schemes {
+		if tnppt.presents(credentialsKind(scheme)) {
+			return false
+		}
+	}
+	tnppt.Principal = UserInfo{Anonymous: true}
+	return true
+}
+
+// verify authenticates request on the state of tnppt.
+func (tnppt *TNPPT) verify(request *http.Request, header http.Header, schemes []string, any bool) error {
+	start := time.Now()
+	err := tnppt.verifyRequest(request, header, schemes, any)
+	tnppt.logAuthentication(err, time.Since(start))
+	tnppt.auditAuthentication(err)
+	return err
+}
+
+func (tnppt *TNPPT) verifyRequest(request *http.Request, header http.Header, schemes []string, any bool) error {
+	tnppt.setTime()
+	tnppt.Request = request
+	tnppt.header = header
+	tnppt.scheme = ""
+	schemes, err := tnppt.resolveTenant(request, header, schemes)
+	if err != nil {
+		return err
+	}
+	if tnppt.tenant != "" {
+		tnppt.Request = request.WithContext(ContextWithTenant(request.Context(), tnppt.tenant))
+	}
+	if err := tnppt.checkClientLockout(header); err != nil {
+		return err
+	}
+	return tnppt.lockout(tnppt.authenticate(header, schemes, any))
+}
+
+// authenticate runs the authenticators of schemes on the request.
+func (tnppt *TNPPT) authenticate(header http.Header, schemes []string, any bool) error {
+	if any {
+		if err := tnppt.verifyAny(header, schemes); err != nil {
+			return err
+		}
+	} else {
+		tnppt.scheme = schemes[0]
+		if err := schemeAuthenticators[tnppt.scheme](tnppt); err != nil {
+			return tnppt.authenticationError(header, err)
+		}
+		tnppt.authenticated(header, tnppt.scheme)
+	}
+	if err := tnppt.bindTenant(); err != nil {
+		return tnppt.authenticationError(header, err)
+	}
+	return nil
+}
+
+// authenticationError adds the challenge of the current scheme to the 401,
+// an *AuthenticationError of the scheme keeps its status and goes without.
+func (tnppt *TNPPT) authenticationError(header http.Header, errorFetch error) *AuthenticationError {
+	var authenticationError *AuthenticationError
+	if errors.As(errorFetch, &authenticationError) {
+		return authenticationError
+	}
+	tnppt.challenge(header, tnppt.scheme, errorFetch)
+	return &AuthenticationError{StatusCode: http.StatusUnauthorized, Err: errorFetch}
+}
+
+// asAuthenticationError returns the *AuthenticationError wrapped in err, a
+// 401 for any other error.
+func asAuthenticationError(err error) *AuthenticationError {
+	var authenticationError *AuthenticationError
+	if errors.As(err, &authenticationError) {
+		return authenticationError
+	}
+	return &AuthenticationError{StatusCode: http.StatusUnauthorized, Err: err}
+}
+
+func writeAuthenticationError(writer http.ResponseWriter, err *AuthenticationError) {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(err.StatusCode)
+	_ = json.NewEncoder(writer).Encode(map[string]interface{}{
+		"code":    err.StatusCode,
+		"message": err.Error(),
+	})
+}
@@ -0,0 +1,214 @@
+package tnpptMiddleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// principal returns the principal the gin middlewares set for the request of c.
+func principal(c *gin.Context) UserInfo {
+	user, _ := UserInfoFromGin(c)
+	return user
+}
+
+func TestVerifier_Middleware(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{
+		Users:   []UserRecord{{Login: "steven", Password: "pass"}},
+		APIKeys: []APIKeyRecord{{Login: "partner", Key: "partner-key"}},
+	})
+	auth, err := New(&TNPPT{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		user, found := UserInfoFromContext(request.Context())
+		assert.True(t, found)
+		_, _ = fmt.Fprint(writer, user.Scheme+":"+user.Login)
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/login", auth.Verifier(SchemeHMAC).Middleware(handler))
+	mux.Handle("/any", auth.Verifier(SchemeAPIKey, SchemeHMAC, SchemeBasic).Middleware(handler))
+
+	apiKeyRequest := func(path string) *http.Request {
+		req, _ := http.NewRequest("POST", path, nil)
+		req.Header.Set("API_KEY", "partner-key")
+		return req
+	}
+	tests := []struct {
+		name      string
+		req       *http.Request
+		wantCode  int
+		wantBody  string
+		wantError error
+	}{
+		{name: "hmac", req: hmacLoginRequest(t, auth, "/login", "steven", "pass"), wantCode: 200, wantBody: "hmac:steven"},
+		{name: "hmac-wrong-password", req: hmacLoginRequest(t, auth, "/login", "steven", "wrong"), wantCode: 401, wantError: ErrFailedAuthenticationHMAC},
+		{name: "hmac-no-payload", req: apiKeyRequest("/login"), wantCode: 401, wantError: ErrFailedPayload},
+		{name: "any-api-key", req: apiKeyRequest("/any"), wantCode: 200, wantBody: "api_key:partner"},
+		{name: "any-conflict", req: func() *http.Request {
+			req := hmacLoginRequest(t, auth, "/any", "steven", "pass")
+			req.Header.Set("API_KEY", "partner-key")
+			return req
+		}(), wantCode: 400, wantError: ErrConflictingCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, tt.req)
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, w.Body.String())
+				return
+			}
+			var body struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, tt.wantCode, body.Code)
+			assert.Contains(t, body.Message, tt.wantError.Error())
+		})
+	}
+
+	t.Run("challenges", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/any", nil)
+		mux.ServeHTTP(w, req)
+		assert.Equal(t, 401, w.Code)
+		assert.Equal(t, `Basic realm="tnppt", charset="UTF-8"`, w.Header().Get("WWW-Authenticate"))
+	})
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	var users []UserRecord
+	for index := 0; index < 8; index++ {
+		users = append(users, UserRecord{Login: fmt.Sprintf("user-%d", index), Password: "pass"})
+	}
+	auth, err := New(&TNPPT{Store: newTestMemoryStore(t, StoreRecords{Users: users})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := auth.Verifier(SchemeHMAC)
+
+	var wg sync.WaitGroup
+	for _, user := range users {
+		wg.Add(1)
+		go func(login string) {
+			defer wg.Done()
+			for attempt := 0; attempt < 20; attempt++ {
+				principal, err := verifier.Verify(hmacLoginRequest(t, auth, "/login", login, "pass"), http.Header{})
+				assert.NoError(t, err)
+				assert.Equal(t, login, principal.Login)
+			}
+		}(user.Login)
+	}
+	wg.Wait()
+	assert.Equal(t, "", auth.Principal.Login)
+
+	_, err = verifier.Verify(hmacLoginRequest(t, auth, "/login", "user-0", "wrong"), http.Header{})
+	var authenticationError *AuthenticationError
+	if assert.True(t, errors.As(err, &authenticationError)) {
+		assert.Equal(t, http.StatusUnauthorized, authenticationError.StatusCode)
+		assert.True(t, errors.Is(err, ErrFailedAuthenticationHMAC))
+	}
+}
+
+func TestTNPPT_ActivateHMACAuthFake(t *testing.T) {
+	auth, err := NewFake(&TNPPT{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.GET("/log", auth.ActivateHMACAuthFake("5f8214530fd2dc23dbb05d17"), func(c *gin.Context) {
+		user, found := UserInfoFromGin(c)
+		c.String(200, fmt.Sprintf("%t:%v", found, user.ID))
+	})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/log", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "true:5f8214530fd2dc23dbb05d17", w.Body.String())
+}
+
+func TestTNPPT_VerifierConfiguration(t *testing.T) {
+	auth := &TNPPT{}
+	assert.Panics(t, func() { auth.Verifier() })
+	assert.Panics(t, func() { auth.Verifier("kerberos") })
+}
+
+func TestTNPPT_ActivateOptional(t *testing.T) {
+	store := newTestMemoryStore(t, StoreRecords{
+		Users:   []UserRecord{{Login: "steven", Password: "pass"}},
+		APIKeys: []APIKeyRecord{{Login: "partner", Key: "partner-key"}},
+	})
+	auth, err := New(&TNPPT{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	greet := func(c *gin.Context) {
+		if principal(c).Anonymous {
+			c.String(200, "hello stranger")
+			return
+		}
+		c.String(200, "hello "+principal(c).Login)
+	}
+	router.POST("/hmac", auth.ActivateHMACAuthOptional(), greet)
+	router.POST("/api-key", auth.ActivateApiKeyAuthOptional(), greet)
+
+	request := func(path string, headers map[string]string) *http.Request {
+		req, _ := http.NewRequest("POST", path, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return req
+	}
+	tests := []struct {
+		name     string
+		req      *http.Request
+		wantCode int
+		wantBody string
+	}{
+		{name: "hmac-signed", req: hmacLoginRequest(t, auth, "/hmac", "steven", "pass"), wantCode: 200, wantBody: "hello steven"},
+		{name: "hmac-anonymous", req: request("/hmac", nil), wantCode: 200, wantBody: "hello stranger"},
+		{name: "hmac-wrong-password", req: hmacLoginRequest(t, auth, "/hmac", "steven", "wrong"), wantCode: 401},
+		{name: "hmac-partial-headers", req: request("/hmac", map[string]string{"HMAC_LOGIN": "steven"}), wantCode: 401},
+		{name: "hmac-other-credentials", req: request("/hmac", map[string]string{"API_KEY": "partner-key"}), wantCode: 200, wantBody: "hello stranger"},
+		{name: "api-key-signed", req: request("/api-key", map[string]string{"API_KEY": "partner-key"}), wantCode: 200, wantBody: "hello partner"},
+		{name: "api-key-anonymous", req: request("/api-key", nil), wantCode: 200, wantBody: "hello stranger"},
+		{name: "api-key-wrong", req: request("/api-key", map[string]string{"API_KEY": "wrong"}), wantCode: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, tt.req)
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("verifier", func(t *testing.T) {
+		verifier := auth.Verifier(SchemeHMAC, SchemeAPIKey).Optional()
+		principal, err := verifier.Verify(request("/", nil), http.Header{})
+		assert.NoError(t, err)
+		assert.Equal(t, UserInfo{Anonymous: true}, principal)
+		principal, err = verifier.Verify(request("/", map[string]string{"API_KEY": "partner-key"}), http.Header{})
+		assert.NoError(t, err)
+		assert.Equal(t, "partner", principal.Login)
+		assert.False(t, principal.Anonymous)
+		_, err = verifier.Verify(request("/", map[string]string{"API_KEY": "wrong"}), http.Header{})
+		assert.True(t, errors.Is(err, ErrFailedAuthenticationAPIKEY))
+		_, err = auth.Verifier(SchemeHMAC).Verify(request("/", nil), http.Header{})
+		assert.Error(t, err)
+	})
+}